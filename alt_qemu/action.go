@@ -0,0 +1,72 @@
+package alt_qemu
+
+import "fmt"
+
+const (
+	// rebootActionReset resets the VM when the guest reboots, as qemu does
+	// by default
+	rebootActionReset = "reset"
+
+	// rebootActionShutdown exits qemu when the guest reboots, leaving the
+	// restart to the task's restart policy
+	rebootActionShutdown = "shutdown"
+)
+
+// rebootActionArgs returns the arguments making qemu handle guest reboots
+// according to action. Exiting on reboot uses -no-reboot rather than
+// -action reboot=shutdown, which older qemu releases lack.
+func rebootActionArgs(action string) ([]string, error) {
+	switch action {
+	case "", rebootActionReset:
+		return nil, nil
+	case rebootActionShutdown:
+		return []string{"-no-reboot"}, nil
+	default:
+		return nil, fmt.Errorf("unknown reboot_action %q, must be reset or shutdown", action)
+	}
+}
+
+// watchdogDeviceType is the emulated watchdog the guest arms to report it is
+// alive
+const watchdogDeviceType = "i6300esb"
+
+// watchdogActions are the actions qemu may take when the guest stops
+// petting its watchdog
+var watchdogActions = map[string]bool{
+	"reset":    true,
+	"poweroff": true,
+	"pause":    true,
+}
+
+// panicActions are the actions qemu may take when the guest reports a
+// kernel panic
+var panicActions = map[string]bool{
+	"pause":    true,
+	"shutdown": true,
+	"none":     true,
+}
+
+// watchdogArgs returns the arguments adding a watchdog device to the guest,
+// recovering a hung guest with action. No watchdog is added when action is
+// empty.
+func watchdogArgs(action string) ([]string, error) {
+	if action == "" {
+		return nil, nil
+	}
+	if !watchdogActions[action] {
+		return nil, fmt.Errorf("unknown watchdog action %q, must be reset, poweroff or pause", action)
+	}
+	return []string{"-device", watchdogDeviceType, "-watchdog-action", action}, nil
+}
+
+// panicActionArgs returns the arguments making qemu handle guest panics
+// with action, left to qemu when empty.
+func panicActionArgs(action string) ([]string, error) {
+	if action == "" {
+		return nil, nil
+	}
+	if !panicActions[action] {
+		return nil, fmt.Errorf("unknown panic_action %q, must be pause, shutdown or none", action)
+	}
+	return []string{"-action", "panic=" + action}, nil
+}
@@ -0,0 +1,80 @@
+package alt_qemu
+
+import (
+	"testing"
+
+	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskConfig_Actions(t *testing.T) {
+	var tc *TaskConfig
+	hclutils.NewConfigParser(taskConfigSpec).ParseHCL(t, `
+config {
+  image_path    = "linux.img"
+  reboot_action = "shutdown"
+  watchdog      = "reset"
+  panic_action  = "pause"
+}`, &tc)
+	require.Equal(t, rebootActionShutdown, tc.RebootAction)
+	require.Equal(t, "reset", tc.Watchdog)
+	require.Equal(t, "pause", tc.PanicAction)
+}
+
+func TestRebootActionArgs(t *testing.T) {
+	cases := []struct {
+		action string
+		args   []string
+		err    string
+	}{
+		{action: ""},
+		{action: "reset"},
+		{action: "shutdown", args: []string{"-no-reboot"}},
+		{action: "poweroff", err: `unknown reboot_action "poweroff"`},
+	}
+
+	for _, c := range cases {
+		t.Run(c.action, func(t *testing.T) {
+			args, err := rebootActionArgs(c.action)
+			if c.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.args, args)
+		})
+	}
+}
+
+func TestWatchdogArgs(t *testing.T) {
+	args, err := watchdogArgs("")
+	require.NoError(t, err)
+	require.Empty(t, args)
+
+	for _, action := range []string{"reset", "poweroff", "pause"} {
+		args, err := watchdogArgs(action)
+		require.NoError(t, err, action)
+		require.Equal(t, []string{"-device", watchdogDeviceType, "-watchdog-action", action}, args)
+	}
+
+	_, err = watchdogArgs("debug")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `unknown watchdog action "debug"`)
+}
+
+func TestPanicActionArgs(t *testing.T) {
+	args, err := panicActionArgs("")
+	require.NoError(t, err)
+	require.Empty(t, args)
+
+	for _, action := range []string{"pause", "shutdown", "none"} {
+		args, err := panicActionArgs(action)
+		require.NoError(t, err, action)
+		require.Equal(t, []string{"-action", "panic=" + action}, args)
+	}
+
+	_, err = panicActionArgs("reset")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `unknown panic_action "reset"`)
+}
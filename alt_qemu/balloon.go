@@ -0,0 +1,70 @@
+package alt_qemu
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// balloonExecCommand is the command name intercepted by ExecTask to
+	// resize the memory balloon, e.g.
+	// `nomad alloc exec <alloc> qemu-balloon 2048`
+	balloonExecCommand = "qemu-balloon"
+
+	// balloonDeviceType is the device letting the host reclaim guest memory
+	balloonDeviceType = "virtio-balloon"
+)
+
+// isBalloonCommand returns whether an exec command is a balloon command.
+func isBalloonCommand(cmd []string) bool {
+	return len(cmd) > 0 && cmd[0] == balloonExecCommand
+}
+
+// balloonTargetMb parses the arguments of a qemu-balloon command, returning
+// the requested guest memory in MB, which may not exceed memMb.
+func balloonTargetMb(args []string, memMb int64) (int64, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("usage: %s <memory MB>", balloonExecCommand)
+	}
+	target, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || target < minMemoryMb || target > memMb {
+		return 0, fmt.Errorf("balloon target must be between %d and %d MB", minMemoryMb, memMb)
+	}
+	return target, nil
+}
+
+// balloon runs a qemu-balloon command, setting the memory the guest is asked
+// to keep through the balloon device.
+func (h *taskHandle) balloon(ctx context.Context, args []string) (*drivers.ExecTaskResult, error) {
+	if !h.balloonEnabled {
+		return nil, fmt.Errorf("task %q has no balloon device, set enable_balloon", h.taskConfig.ID)
+	}
+	target, err := balloonTargetMb(args, h.memoryMb)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.monitorProtocol == monitorProtocolHMP {
+		cmd := fmt.Sprintf("balloon %d", target)
+		out, err := h.humanMonitorCommand(ctx, cmd)
+		if err == nil {
+			err = hmpError(cmd, out)
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else if _, err := h.monitorExecute(ctx, "balloon", map[string]interface{}{"value": target * 1024 * 1024}); err != nil {
+		return nil, err
+	}
+	h.stateLock.Lock()
+	h.balloonTarget = target * 1024 * 1024
+	h.stateLock.Unlock()
+
+	return &drivers.ExecTaskResult{
+		Stdout:     []byte(fmt.Sprintf("balloon target set to %d MB\n", target)),
+		ExitResult: &drivers.ExitResult{},
+	}, nil
+}
@@ -0,0 +1,66 @@
+package alt_qemu
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBalloonTargetMb(t *testing.T) {
+	cases := []struct {
+		name   string
+		args   []string
+		target int64
+		err    string
+	}{
+		{name: "valid", args: []string{"1024"}, target: 1024},
+		{name: "task memory", args: []string{"2048"}, target: 2048},
+		{name: "no target", args: nil, err: "usage: qemu-balloon <memory MB>"},
+		{name: "too many args", args: []string{"1024", "2048"}, err: "usage: qemu-balloon <memory MB>"},
+		{name: "not a number", args: []string{"1G"}, err: "balloon target must be between 128 and 2048 MB"},
+		{name: "too small", args: []string{"64"}, err: "balloon target must be between 128 and 2048 MB"},
+		{name: "above task memory", args: []string{"4096"}, err: "balloon target must be between 128 and 2048 MB"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			target, err := balloonTargetMb(c.args, 2048)
+			if c.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.target, target)
+		})
+	}
+}
+
+func TestTaskHandle_Balloon(t *testing.T) {
+	path, cmds := fakeQMPServer(t, func(cmd qmpCommand) string {
+		return `{"return": {}}`
+	})
+	h := &taskHandle{
+		taskConfig:     &drivers.TaskConfig{ID: "task-1"},
+		monitorPath:    path,
+		balloonEnabled: true,
+		memoryMb:       2048,
+	}
+
+	result, err := h.balloon(context.Background(), []string{"1024"})
+	require.NoError(t, err)
+	require.Equal(t, "balloon target set to 1024 MB\n", string(result.Stdout))
+	require.Equal(t, int64(1024*1024*1024), h.balloonTarget)
+
+	require.Equal(t, "qmp_capabilities", (<-cmds).Execute)
+	cmd := <-cmds
+	require.Equal(t, "balloon", cmd.Execute)
+	// QMP arguments are decoded as JSON numbers
+	require.Equal(t, float64(1024*1024*1024), cmd.Arguments["value"])
+
+	h.balloonEnabled = false
+	_, err = h.balloon(context.Background(), []string{"1024"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "set enable_balloon")
+}
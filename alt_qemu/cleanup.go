@@ -0,0 +1,43 @@
+package alt_qemu
+
+import (
+	"os"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// startCleanup undoes the setup of a task that fails to start. It records
+// the files created in the task directory, such as sockets, overlays and
+// seed ISOs, and the processes started for the task, so that no error path
+// of StartTask leaves them behind.
+type startCleanup struct {
+	logger hclog.Logger
+	paths  []string
+	funcs  []func()
+}
+
+// addPath registers a file to remove on failure. Files that were not
+// created by the time the cleanup runs are ignored.
+func (c *startCleanup) addPath(path string) {
+	if path != "" {
+		c.paths = append(c.paths, path)
+	}
+}
+
+// add registers f to run on failure, e.g. to stop a helper process.
+func (c *startCleanup) add(f func()) {
+	c.funcs = append(c.funcs, f)
+}
+
+// run stops the registered processes in the reverse order they were added
+// and then removes the registered files.
+func (c *startCleanup) run() {
+	for i := len(c.funcs) - 1; i >= 0; i-- {
+		c.funcs[i]()
+	}
+	for _, path := range c.paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			c.logger.Warn("failed to remove task file", "path", path, "error", err)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package alt_qemu
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartCleanup(t *testing.T) {
+	dir := t.TempDir()
+	seedPath := filepath.Join(dir, "seed.iso")
+	require.NoError(t, ioutil.WriteFile(seedPath, nil, 0644))
+
+	var stopped []string
+	c := &startCleanup{logger: hclog.NewNullLogger()}
+	c.addPath(seedPath)
+	c.addPath("")
+	// files that were never created are ignored
+	c.addPath(filepath.Join(dir, qemuMonitorSocketName))
+	c.add(func() { stopped = append(stopped, "swtpm") })
+	c.add(func() { stopped = append(stopped, "qemu") })
+	require.Len(t, c.paths, 2)
+
+	c.run()
+
+	// processes are stopped in the reverse order they were started
+	require.Equal(t, []string{"qemu", "swtpm"}, stopped)
+	_, err := os.Stat(seedPath)
+	require.True(t, os.IsNotExist(err))
+}
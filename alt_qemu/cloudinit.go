@@ -0,0 +1,90 @@
+package alt_qemu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+const (
+	// cloudInitSeedName is the name of the NoCloud seed ISO generated in the
+	// task directory
+	cloudInitSeedName = "cloud-init-seed.iso"
+
+	// driverCloudInitAttr reports whether a tool to build cloud-init seed
+	// images is available on the node
+	driverCloudInitAttr = "driver.qemu.cloud_init"
+)
+
+// isoTools are the binaries able to build a cloud-init seed image, in order of
+// preference. They share the same command line interface.
+var isoTools = []string{"genisoimage", "mkisofs"}
+
+// CloudInitConfig holds the NoCloud data passed to cloud-init in the guest
+type CloudInitConfig struct {
+	UserData string `codec:"user_data"`
+	MetaData string `codec:"meta_data"`
+}
+
+// IsSet returns whether any cloud-init data was configured.
+func (c *CloudInitConfig) IsSet() bool {
+	return c.UserData != "" || c.MetaData != ""
+}
+
+// isoTool returns the absolute path of the first available tool able to build
+// ISO images.
+func isoTool() (string, error) {
+	for _, tool := range isoTools {
+		if path, err := GetAbsolutePath(tool); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("none of %v found to build the cloud-init seed image", isoTools)
+}
+
+// buildCloudInitSeed writes the NoCloud user-data and meta-data of c into a
+// seed ISO in taskDir and returns its path. When no meta-data is given a
+// minimal one identifying the instance by instanceID is generated.
+func buildCloudInitSeed(taskDir, instanceID string, c *CloudInitConfig) (string, error) {
+	tool, err := isoTool()
+	if err != nil {
+		return "", err
+	}
+
+	dataDir, err := ioutil.TempDir(taskDir, "cloud-init")
+	if err != nil {
+		return "", fmt.Errorf("failed to create cloud-init data directory: %v", err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	metaData := c.MetaData
+	if metaData == "" {
+		metaData = fmt.Sprintf("instance-id: %s\n", instanceID)
+	}
+	files := map[string]string{
+		"user-data": c.UserData,
+		"meta-data": metaData,
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dataDir, name), []byte(data), 0600); err != nil {
+			return "", fmt.Errorf("failed to write cloud-init %s: %v", name, err)
+		}
+	}
+
+	// cloud-init identifies the seed by its "cidata" volume label
+	seedPath := filepath.Join(taskDir, cloudInitSeedName)
+	out, err := exec.Command(tool,
+		"-output", seedPath,
+		"-volid", "cidata",
+		"-joliet", "-rock",
+		filepath.Join(dataDir, "user-data"),
+		filepath.Join(dataDir, "meta-data"),
+	).CombinedOutput()
+	if err != nil {
+		os.Remove(seedPath)
+		return "", fmt.Errorf("failed to build cloud-init seed image: %v: %s", err, out)
+	}
+	return seedPath, nil
+}
@@ -0,0 +1,88 @@
+package alt_qemu
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeISOTool concatenates the files it is given into the -output file so
+// tests can inspect the seed contents.
+const fakeISOTool = `out=""
+files=""
+while [ $# -gt 0 ]; do
+  case "$1" in
+    -output) out="$2"; shift ;;
+    -volid) shift ;;
+    -*) ;;
+    *) files="$files $1" ;;
+  esac
+  shift
+done
+cat $files > "$out"`
+
+func TestTaskConfig_CloudInit(t *testing.T) {
+	config := `
+config {
+  image_path = "linux.img"
+  cloud_init {
+    user_data = "#cloud-config\n"
+  }
+}`
+
+	var tc *TaskConfig
+	hclutils.NewConfigParser(taskConfigSpec).ParseHCL(t, config, &tc)
+
+	require.Equal(t, CloudInitConfig{UserData: "#cloud-config\n"}, tc.CloudInit)
+	require.True(t, tc.CloudInit.IsSet())
+}
+
+func TestBuildCloudInitSeed(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake binaries are shell scripts")
+	}
+
+	binDir := t.TempDir()
+	writeFakeBinary(t, binDir, "genisoimage", fakeISOTool)
+	setPath(t, binDir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+
+	taskDir := t.TempDir()
+	seedPath, err := buildCloudInitSeed(taskDir, "alloc-1", &CloudInitConfig{UserData: "#cloud-config\n"})
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(taskDir, cloudInitSeedName), seedPath)
+
+	seed, err := ioutil.ReadFile(seedPath)
+	require.NoError(t, err)
+	require.Equal(t, "#cloud-config\ninstance-id: alloc-1\n", string(seed))
+
+	// the temporary data directory is removed
+	entries, err := ioutil.ReadDir(taskDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestBuildCloudInitSeed_Errors(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake binaries are shell scripts")
+	}
+
+	binDir := t.TempDir()
+	setPath(t, binDir)
+
+	_, err := buildCloudInitSeed(t.TempDir(), "alloc-1", &CloudInitConfig{UserData: "x"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "found to build the cloud-init seed image")
+
+	writeFakeBinary(t, binDir, "genisoimage", `echo "no space left" >&2; exit 1`)
+	taskDir := t.TempDir()
+	_, err = buildCloudInitSeed(taskDir, "alloc-1", &CloudInitConfig{UserData: "x"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no space left")
+	_, err = os.Stat(filepath.Join(taskDir, cloudInitSeedName))
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,541 @@
+package alt_qemu
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// qemuCommand is the qemu command line of a task along with what StartTask
+// must set up before launching it: the files and helper processes the
+// arguments refer to are not created while building it.
+type qemuCommand struct {
+	args  []string
+	vmID  string
+	memMb int64
+
+	// network is the driver network of the VM before it reports its own
+	// address
+	network   *drivers.DriverNetwork
+	snapshots bool
+
+	monitorPath string
+	agentPath   string
+	serialPaths []string
+
+	// imagePath is the resolved image_path disk
+	imagePath string
+
+	// firmware is the UEFI firmware with its resolved paths, whose vars
+	// template is copied into the task directory before qemu starts
+	firmware FirmwareConfig
+
+	// pidPath is the pidfile qemu writes its pid to, if any
+	pidPath string
+
+	// seedPath is the cloud-init seed ISO to build, if any
+	seedPath string
+
+	// vncPasswordPath is the file to write the VNC password to, if any
+	vncPasswordPath string
+
+	// netnsPath is the network namespace to set up the tap device of the
+	// cni network mode in, giving the CNI interface the guest's MAC
+	// address macAddress, if any
+	netnsPath  string
+	macAddress string
+
+	// overlayPath is the overlay to create on top of the image_path disk
+	// of format overlayBaseFormat, if any
+	overlayPath       string
+	overlayBaseFormat string
+	qemuImgPath       string
+
+	// tpmSocket is the control socket of the swtpm to start, if any
+	tpmSocket       string
+	virtiofsDaemons []virtiofsDaemon
+
+	// runAsUID and runAsGID own the files of the task qemu writes to once
+	// it has dropped its privileges to run_as_user
+	runAsUID int
+	runAsGID int
+}
+
+// buildQemuArgs validates the configuration tc of task cfg against the
+// plugin configuration and builds the qemu command line running it, along
+// with the driver network known before the VM starts. Nothing is created or
+// started: image formats are detected and host devices are checked, but the
+// overlay, seed ISO, firmware vars, cni tap device and helper daemons the
+// arguments refer to are left to the caller.
+func (d *AltQemuDriverPlugin) buildQemuArgs(cfg *drivers.TaskConfig, tc *TaskConfig) (*qemuCommand, error) {
+	taskDir := cfg.TaskDir().Dir
+	cmd := &qemuCommand{}
+
+	// get the image source
+	vmPath := tc.ImagePath
+	if vmPath == "" {
+		return nil, fmt.Errorf("image_path must be set")
+	}
+
+	cmd.vmID = tc.VmName
+	if cmd.vmID == "" {
+		cmd.vmID = unsafeNameCharsRegex.ReplaceAllString(filepath.Base(vmPath), "-")
+	} else if !safeNameRegex.MatchString(cmd.vmID) {
+		return nil, fmt.Errorf("invalid vm_name %q, must only contain letters, digits, '_', '.' and '-'", cmd.vmID)
+	}
+
+	if isImageURL(vmPath) {
+		return nil, fmt.Errorf("image_path %q must be downloaded before building the qemu command", vmPath)
+	}
+	vmPath, ok := resolveAllowedPath(d.config.ImagePaths, cfg.AllocDir, taskDir, vmPath)
+	if !ok {
+		return nil, fmt.Errorf("image_path is not in the allowed paths")
+	}
+	if err := checkImageReadable(vmPath); err != nil {
+		return nil, err
+	}
+	cmd.imagePath = vmPath
+
+	// parse configuration arugments
+	// create the base arguments
+	accelerator := "tcg"
+	if tc.Accelerator != "" {
+		accelerator = tc.Accelerator
+	} else if d.config.DefaultAccelerator != "" {
+		accelerator = d.config.DefaultAccelerator
+	}
+	if err := validateAccelerators(accelerator); err != nil {
+		return nil, err
+	}
+
+	cmd.memMb = d.taskMemoryMb(cfg)
+	if err := checkMemory(cmd.memMb, d.config.MaxMemoryMb, d.hostMemoryMb); err != nil {
+		return nil, err
+	}
+	mem := fmt.Sprintf("%dM", cmd.memMb)
+
+	if tc.RunAsUser != "" {
+		if runtime.GOOS == "windows" {
+			return nil, fmt.Errorf("run_as_user is unsupported on the Windows platform")
+		}
+		var err error
+		cmd.runAsUID, cmd.runAsGID, err = lookupRunAsUser(tc.RunAsUser)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cpuCount, err := d.vcpuCount(cfg)
+	if err != nil {
+		return nil, err
+	}
+	smp, err := smpArg(cpuCount, &tc.SMP)
+	if err != nil {
+		return nil, err
+	}
+
+	qemuSysPath := tc.QemuSystemBin
+	if qemuSysPath == "" {
+		qemuSysPath = d.qemuSystemBin()
+	}
+	absPath, err := GetAbsolutePath(qemuSysPath)
+	if err != nil {
+		return nil, err
+	}
+
+	machineType := tc.MachineType
+	if machineType == "" {
+		machineType = "pc"
+	}
+	if !safeNameRegex.MatchString(machineType) {
+		return nil, fmt.Errorf("invalid machine_type %q, must only contain letters, digits, '_', '.' and '-'", machineType)
+	}
+	if !isAllowedMachineType(d.config.AllowedMachineTypes, machineType) {
+		return nil, fmt.Errorf("machine_type %q is not in the allowed machine types", machineType)
+	}
+
+	machine, err := machineArg(machineType, accelerator, tc.MachineProperties)
+	if err != nil {
+		return nil, err
+	}
+
+	cpuType := tc.CpuType
+	if cpuType == "" {
+		cpuType = "host"
+	}
+	if !cpuTypeRegex.MatchString(cpuType) {
+		return nil, fmt.Errorf("invalid cpu_type %q", cpuType)
+	}
+
+	args := []string{
+		absPath,
+		"-machine", machine,
+		"-name", cmd.vmID,
+		"-m", mem,
+		"-cpu", cpuType,
+		"-smp", smp,
+	}
+
+	reboot, err := rebootActionArgs(tc.RebootAction)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, reboot...)
+
+	watchdog, err := watchdogArgs(tc.Watchdog)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, watchdog...)
+
+	panicAction, err := panicActionArgs(tc.PanicAction)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, panicAction...)
+
+	if tc.RTC.IsSet() {
+		rtc, err := rtcArg(&tc.RTC)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "-rtc", rtc)
+	}
+
+	var memArgs []string
+	if len(tc.NUMA) > 0 {
+		memArgs, err = numaArgs(tc.NUMA, cpuCount, cmd.memMb, tc.MemoryBackend, tc.HugepagesPath, hasVirtiofsShares(tc.Shares))
+	} else {
+		memArgs, err = memoryBackendArgs(tc.MemoryBackend, tc.HugepagesPath, cmd.memMb, hasVirtiofsShares(tc.Shares))
+	}
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, memArgs...)
+
+	netArgs, err := networkArgs(cfg, tc)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, netArgs...)
+	if tc.NetworkMode == "cni" {
+		cmd.netnsPath = cfg.NetworkIsolation.Path
+		cmd.macAddress = guestMacAddress(cfg, tc)
+	}
+
+	// consoles are reported through the driver network so users can find
+	// their ports
+	consolePorts := map[string]int{}
+	display, err := displayMode(tc)
+	if err != nil {
+		return nil, err
+	}
+	switch display {
+	case displayVNC:
+		displayArgs, passwordPath, err := vncArgs(taskDir, &tc.VNC)
+		if err != nil {
+			return nil, err
+		}
+		cmd.vncPasswordPath = passwordPath
+		args = append(args, displayArgs...)
+
+		consolePorts[vncPortLabel] = tc.VNC.Port()
+	case displaySpice:
+		displayArgs, err := spiceArgs(&tc.Spice)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, displayArgs...)
+
+		if tc.Spice.Port > 0 {
+			consolePorts[spicePortLabel] = tc.Spice.Port
+		}
+		if tc.Spice.TLSPort > 0 {
+			consolePorts[spiceTLSPortLabel] = tc.Spice.TLSPort
+		}
+	case displayNone:
+		args = append(args, "-display", "none")
+	default:
+		args = append(args, "-nographic")
+	}
+
+	// a migration target listens on its allocated port, reported alongside
+	// the consoles
+	if tc.Incoming != "" {
+		incoming, port, err := incomingArgs(cfg, tc.Incoming)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, incoming...)
+		consolePorts[tc.Incoming] = port
+	}
+	cmd.network = taskNetwork(cfg, tc, consolePorts)
+
+	// without serial, -nographic sends the first serial port to stdout
+	serial, serialPaths, err := serialArgs(taskDir, tc.Serial)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, serial...)
+	cmd.serialPaths = serialPaths
+
+	// the image_path disk is always attached first so it is used for booting
+	disks := []DiskConfig{{
+		Path:           vmPath,
+		Interface:      tc.BootDiskInterface,
+		disableLocking: tc.DisableImageLocking,
+	}}
+	for _, disk := range tc.Disks {
+		if disk.Path == "" {
+			return nil, fmt.Errorf("disk path must be set")
+		}
+		if disk.Format != "" && !diskFormats[disk.Format] {
+			return nil, fmt.Errorf("unsupported format %q for disk %q, must be one of raw, qcow2, vmdk, vdi, vhdx, vpc or qed", disk.Format, disk.Path)
+		}
+		if isDevicePath(d.config.AllowedDevicePaths, disk.Path) {
+			if err := checkBlockDevice(d.config.AllowedDevicePaths, disk.Path); err != nil {
+				return nil, err
+			}
+			disk.hostDevice = true
+		} else if path, ok := resolveAllowedPath(d.config.ImagePaths, cfg.AllocDir, taskDir, disk.Path); ok {
+			disk.Path = path
+		} else {
+			return nil, fmt.Errorf("disk path %q is not in the allowed paths", disk.Path)
+		}
+		disks = append(disks, disk)
+	}
+	cmd.qemuImgPath = tc.QemuImgBin
+	if cmd.qemuImgPath == "" {
+		cmd.qemuImgPath = d.qemuImgBin()
+	}
+	detectFormat := func(path string) (string, error) {
+		return d.imageFormats.Get(path, func(path string) (string, error) {
+			return qemuImgFormat(cmd.qemuImgPath, path)
+		})
+	}
+
+	// the VM writes to an overlay rather than to a shared base image
+	if tc.Overlay {
+		cmd.overlayBaseFormat, err = diskFormat(taskDir, disks[0], detectFormat)
+		if err != nil {
+			return nil, err
+		}
+		cmd.overlayPath = filepath.Join(taskDir, overlayImageName)
+		disks[0].Path = cmd.overlayPath
+		disks[0].Format = "qcow2"
+	}
+
+	blockArgs, err := diskArgs(taskDir, disks, detectFormat)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, blockArgs...)
+
+	cmd.snapshots, err = snapshotsSupported(taskDir, disks, detectFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	shares := make([]ShareConfig, len(tc.Shares))
+	for i, share := range tc.Shares {
+		path, ok := resolveAllowedPath(d.config.ImagePaths, cfg.AllocDir, taskDir, share.Path)
+		if !ok {
+			return nil, fmt.Errorf("share path %q is not in the allowed paths", share.Path)
+		}
+		share.Path = path
+		shares[i] = share
+	}
+	fsArgs, virtiofsDaemons, err := shareArgs(taskDir, shares)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, fsArgs...)
+	cmd.virtiofsDaemons = virtiofsDaemons
+
+	if tc.Cdrom != "" {
+		cdromAllowedPaths := append(append([]string{}, d.config.ImagePaths...), d.config.CdromPaths...)
+		cdrom, ok := resolveAllowedPath(cdromAllowedPaths, cfg.AllocDir, taskDir, tc.Cdrom)
+		if !ok {
+			return nil, fmt.Errorf("cdrom %q is not in the allowed paths", tc.Cdrom)
+		}
+		file, err := escapeOptionValue(cdrom)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cdrom: %v", err)
+		}
+		args = append(args, "-drive", fmt.Sprintf("file=%s,media=cdrom,readonly=on", file))
+	}
+
+	// the cloud-init seed is attached as a second CDROM
+	if tc.CloudInit.IsSet() {
+		cmd.seedPath = filepath.Join(taskDir, cloudInitSeedName)
+		file, err := escapeOptionValue(cmd.seedPath)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cloud-init seed path: %v", err)
+		}
+		args = append(args, "-drive", fmt.Sprintf("file=%s,media=cdrom,readonly=on", file))
+	}
+
+	// UEFI firmware is loaded from pflash instead of the default BIOS
+	if tc.Firmware.IsSet() {
+		cmd.firmware = tc.Firmware
+		for _, path := range []*string{&cmd.firmware.Code, &cmd.firmware.Vars} {
+			if *path == "" {
+				continue
+			}
+			resolved, ok := resolveAllowedPath(d.config.ImagePaths, cfg.AllocDir, taskDir, *path)
+			if !ok {
+				return nil, fmt.Errorf("firmware %q is not in the allowed paths", *path)
+			}
+			*path = resolved
+		}
+		firmware, err := firmwareArgs(taskDir, &cmd.firmware)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, firmware...)
+	}
+
+	kernelPath, initrdPath := tc.Kernel, tc.Initrd
+	for name, path := range map[string]*string{"kernel": &kernelPath, "initrd": &initrdPath} {
+		if *path == "" {
+			continue
+		}
+		resolved, ok := resolveAllowedPath(d.config.ImagePaths, cfg.AllocDir, taskDir, *path)
+		if !ok {
+			return nil, fmt.Errorf("%s %q is not in the allowed paths", name, *path)
+		}
+		*path = resolved
+	}
+	kernel, err := kernelArgs(kernelPath, initrdPath, tc.KernelAppend)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, kernel...)
+
+	boot, err := bootArg(&tc.Boot)
+	if err != nil {
+		return nil, err
+	}
+	if boot != "" {
+		args = append(args, "-boot", boot)
+	}
+
+	// the pidfile confirms the VM process when the task is recovered
+	if runtime.GOOS != "windows" {
+		cmd.pidPath = filepath.Join(taskDir, qemuPidFileName)
+		args = append(args, "-pidfile", cmd.pidPath)
+	}
+
+	// the monitor socket is used to manage the VM, e.g. to perform graceful
+	// shutdowns. Unix sockets are not available on Windows.
+	if runtime.GOOS != "windows" {
+		cmd.monitorPath, err = getMonitorPath(taskDir)
+		if err != nil {
+			return nil, err
+		}
+		monitor, err := monitorArgs(tc.MonitorProtocol, cmd.monitorPath)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, monitor...)
+	}
+
+	// the guest agent channel is used to run commands inside the guest
+	if tc.EnableGuestAgent || d.config.EnableGuestAgent {
+		if runtime.GOOS == "windows" {
+			return nil, fmt.Errorf("guest agent is unsupported on the Windows platform")
+		}
+		cmd.agentPath, err = socketPath(taskDir, qemuGuestAgentSocketName)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, guestAgentArgs(cmd.agentPath)...)
+	}
+
+	if tc.EnableBalloon {
+		args = append(args, "-device", balloonDeviceType)
+	}
+
+	if tc.EnableRNG {
+		rng, err := rngArgs(tc.RNGSource)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, rng...)
+	}
+
+	usb, err := usbArgs(d.config.AllowedUSBDevices, tc.USBPassthrough)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, usb...)
+
+	pci, err := pciArgs(d.config.AllowedPCIDevices, tc.PCIPassthrough)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, pci...)
+
+	gpuConfigs := make([]GPUConfig, len(tc.GPUPassthrough))
+	for i, gpu := range tc.GPUPassthrough {
+		if gpu.Romfile != "" {
+			path, ok := resolveAllowedPath(d.config.ImagePaths, cfg.AllocDir, taskDir, gpu.Romfile)
+			if !ok {
+				return nil, fmt.Errorf("romfile %q is not in the allowed paths", gpu.Romfile)
+			}
+			gpu.Romfile = path
+		}
+		gpuConfigs[i] = gpu
+	}
+	gpus, err := gpuArgs(d.config.AllowedPCIDevices, gpuConfigs)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, gpus...)
+
+	// the seccomp sandbox of qemu is only available on Linux
+	if runtime.GOOS == "linux" {
+		sandbox, err := sandboxArg(tc.Sandbox)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "-sandbox", sandbox)
+	} else if tc.Sandbox != "" {
+		return nil, fmt.Errorf("sandbox is unsupported on the %s platform", runtime.GOOS)
+	}
+
+	// qemu drops its privileges once it has opened its devices and sockets
+	if tc.RunAsUser != "" {
+		args = append(args, "-runas", tc.RunAsUser)
+	}
+
+	// the TPM is emulated by a swtpm daemon living alongside the VM
+	if tc.TPM.Enabled {
+		if runtime.GOOS == "windows" {
+			return nil, fmt.Errorf("tpm is unsupported on the Windows platform")
+		}
+		cmd.tpmSocket, err = socketPath(taskDir, tpmSocketName)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, tpmArgs(cmd.tpmSocket)...)
+	}
+
+	if !d.config.AllowExtraArgs && (len(tc.Args) > 0 || len(tc.ExtraArgs) > 0 || len(tc.ExtraDevices) > 0) {
+		return nil, fmt.Errorf("args, extra_args and extra_devices are disabled by the allow_extra_args plugin option")
+	}
+	extra, err := extraArgs(tc)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, extra...)
+
+	if len(tc.Args) > 0 {
+		args = append(args, tc.Args...)
+	}
+
+	cmd.args = args
+	return cmd, nil
+}
@@ -0,0 +1,489 @@
+package alt_qemu
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+// testBuildTask returns a task with a raw image_path disk in its task
+// directory, whose qemu binaries resolve without qemu being installed: qemu
+// is never run and formats are detected from the images' contents.
+func testBuildTask(t *testing.T) (*drivers.TaskConfig, *TaskConfig) {
+	cfg := &drivers.TaskConfig{
+		ID:       "task-1",
+		Name:     "vm",
+		AllocID:  "alloc-1",
+		AllocDir: t.TempDir(),
+		Resources: &drivers.Resources{
+			NomadResources: &structs.AllocatedTaskResources{
+				Cpu:    structs.AllocatedCpuResources{CpuShares: 1000},
+				Memory: structs.AllocatedMemoryResources{MemoryMB: 512},
+			},
+		},
+	}
+	taskDir := cfg.TaskDir().Dir
+	require.NoError(t, os.MkdirAll(taskDir, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(taskDir, "linux.img"), make([]byte, 512), 0644))
+
+	return cfg, &TaskConfig{
+		ImagePath:     "linux.img",
+		QemuSystemBin: "sh",
+		QemuImgBin:    "missing-qemu-img",
+	}
+}
+
+func TestTaskConfig_DryRun(t *testing.T) {
+	var tc *TaskConfig
+	hclutils.NewConfigParser(taskConfigSpec).ParseHCL(t, `
+config {
+  image_path = "linux.img"
+  dry_run    = true
+}`, &tc)
+	require.True(t, tc.DryRun)
+}
+
+func TestBuildQemuArgs(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the monitor socket is unsupported on Windows")
+	}
+
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	cfg, tc := testBuildTask(t)
+	taskDir := cfg.TaskDir().Dir
+
+	cmd, err := d.buildQemuArgs(cfg, tc)
+	require.NoError(t, err)
+	require.Equal(t, "linux.img", cmd.vmID)
+	require.Equal(t, int64(512), cmd.memMb)
+	require.Equal(t, filepath.Join(taskDir, qemuMonitorSocketName), cmd.monitorPath)
+
+	qemuBin, err := GetAbsolutePath("sh")
+	require.NoError(t, err)
+	require.Equal(t, qemuBin, cmd.args[0])
+	require.Equal(t, []string{
+		"-machine", "type=pc,accel=tcg",
+		"-name", "linux.img",
+		"-m", "512M",
+		"-cpu", "host",
+	}, cmd.args[1:9])
+	require.Contains(t, cmd.args, "-nographic")
+	require.Contains(t, cmd.args, "unix:"+cmd.monitorPath+",server,nowait")
+	require.Equal(t, filepath.Join(taskDir, qemuPidFileName), cmd.pidPath)
+	require.Contains(t, strings.Join(cmd.args, " "), " -pidfile "+cmd.pidPath+" ")
+
+	// every option is followed by its value
+	for i, arg := range cmd.args {
+		if arg == "-device" || arg == "-drive" {
+			require.True(t, i+1 < len(cmd.args) && cmd.args[i+1] != "", "%s at %d has no value", arg, i)
+		}
+	}
+}
+
+func TestBuildQemuArgs_NoSideEffects(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the monitor socket is unsupported on Windows")
+	}
+
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	cfg, tc := testBuildTask(t)
+	taskDir := cfg.TaskDir().Dir
+	require.NoError(t, ioutil.WriteFile(filepath.Join(taskDir, "OVMF_CODE.fd"), nil, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(taskDir, "OVMF_VARS.fd"), nil, 0644))
+
+	tc.Overlay = true
+	tc.CloudInit = CloudInitConfig{UserData: "#cloud-config\n"}
+	tc.Firmware = FirmwareConfig{Code: "OVMF_CODE.fd", Vars: "OVMF_VARS.fd"}
+	tc.VNC = VNCConfig{Enabled: true, Password: "secret"}
+
+	cmd, err := d.buildQemuArgs(cfg, tc)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(taskDir, overlayImageName), cmd.overlayPath)
+	require.Equal(t, "raw", cmd.overlayBaseFormat)
+	require.Equal(t, filepath.Join(taskDir, cloudInitSeedName), cmd.seedPath)
+	require.Equal(t, filepath.Join(taskDir, vncPasswordFileName), cmd.vncPasswordPath)
+
+	// the files the arguments refer to are left to StartTask
+	for _, path := range []string{cmd.overlayPath, cmd.seedPath, cmd.vncPasswordPath, filepath.Join(taskDir, firmwareVarsName)} {
+		_, err := os.Stat(path)
+		require.True(t, os.IsNotExist(err), path)
+	}
+}
+
+func TestBuildQemuArgs_Errors(t *testing.T) {
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+
+	cases := []struct {
+		name   string
+		modify func(tc *TaskConfig)
+		err    string
+	}{
+		{
+			name:   "no image",
+			modify: func(tc *TaskConfig) { tc.ImagePath = "" },
+			err:    "image_path must be set",
+		},
+		{
+			name:   "missing image",
+			modify: func(tc *TaskConfig) { tc.ImagePath = "missing.img" },
+			err:    "does not exist",
+		},
+		{
+			name:   "image outside the allowed paths",
+			modify: func(tc *TaskConfig) { tc.ImagePath = "/etc/passwd" },
+			err:    "image_path is not in the allowed paths",
+		},
+		{
+			name:   "not downloaded",
+			modify: func(tc *TaskConfig) { tc.ImagePath = "https://example.com/linux.img" },
+			err:    "must be downloaded before building the qemu command",
+		},
+		{
+			name:   "invalid vm_name",
+			modify: func(tc *TaskConfig) { tc.VmName = "vm,debug-threads=on" },
+			err:    "invalid vm_name",
+		},
+		{
+			name:   "invalid cpu_type",
+			modify: func(tc *TaskConfig) { tc.CpuType = "host,-vmx" },
+			err:    "invalid cpu_type",
+		},
+		{
+			name: "vnc and spice",
+			modify: func(tc *TaskConfig) {
+				tc.VNC.Enabled = true
+				tc.Spice.Enabled = true
+			},
+			err: "vnc and spice are mutually exclusive",
+		},
+		{
+			name:   "disk outside the allowed paths",
+			modify: func(tc *TaskConfig) { tc.Disks = []DiskConfig{{Path: "/etc/shadow"}} },
+			err:    `disk path "/etc/shadow" is not in the allowed paths`,
+		},
+		{
+			name:   "unsupported disk format",
+			modify: func(tc *TaskConfig) { tc.Disks = []DiskConfig{{Path: "linux.img", Format: "luks"}} },
+			err:    `unsupported format "luks" for disk "linux.img"`,
+		},
+		{
+			name: "disk format with options",
+			modify: func(tc *TaskConfig) {
+				tc.Disks = []DiskConfig{{Path: "linux.img", Format: "qcow2,file.driver=host_device"}}
+			},
+			err: `unsupported format "qcow2,file.driver=host_device"`,
+		},
+		{
+			name:   "disk format with a value",
+			modify: func(tc *TaskConfig) { tc.Disks = []DiskConfig{{Path: "linux.img", Format: "backing.driver=raw"}} },
+			err:    `unsupported format "backing.driver=raw"`,
+		},
+		{
+			name:   "cdrom outside the allowed paths",
+			modify: func(tc *TaskConfig) { tc.Cdrom = "/etc/shadow" },
+			err:    `cdrom "/etc/shadow" is not in the allowed paths`,
+		},
+		{
+			name:   "kernel outside the allowed paths",
+			modify: func(tc *TaskConfig) { tc.Kernel = "../../../vmlinuz" },
+			err:    `kernel "../../../vmlinuz" is not in the allowed paths`,
+		},
+		{
+			name:   "firmware outside the allowed paths",
+			modify: func(tc *TaskConfig) { tc.Firmware = FirmwareConfig{Code: "/usr/share/OVMF/OVMF_CODE.fd"} },
+			err:    `firmware "/usr/share/OVMF/OVMF_CODE.fd" is not in the allowed paths`,
+		},
+		{
+			name:   "share outside the allowed paths",
+			modify: func(tc *TaskConfig) { tc.Shares = []ShareConfig{{Path: "/etc", MountTag: "etc"}} },
+			err:    `share path "/etc" is not in the allowed paths`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg, tc := testBuildTask(t)
+			c.modify(tc)
+			_, err := d.buildQemuArgs(cfg, tc)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), c.err)
+		})
+	}
+}
+
+func TestBuildQemuArgs_ResolvedPaths(t *testing.T) {
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	cfg, tc := testBuildTask(t)
+	taskDir, err := filepath.EvalSymlinks(cfg.TaskDir().Dir)
+	require.NoError(t, err)
+	for _, name := range []string{"data.img", "boot.iso", "vmlinuz", "OVMF_CODE.fd", "OVMF_VARS.fd"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(taskDir, name), make([]byte, 512), 0644))
+	}
+	require.NoError(t, os.Mkdir(filepath.Join(taskDir, "shared"), 0755))
+	// links are followed once, and qemu is given their target
+	require.NoError(t, os.Symlink("data.img", filepath.Join(taskDir, "data-link.img")))
+
+	tc.Disks = []DiskConfig{{Path: "data-link.img", Format: "raw"}}
+	tc.Cdrom = "boot.iso"
+	tc.Kernel = "vmlinuz"
+	tc.Shares = []ShareConfig{{Path: "shared", MountTag: "shared"}}
+	tc.Firmware = FirmwareConfig{Code: "OVMF_CODE.fd", Vars: "OVMF_VARS.fd"}
+
+	cmd, err := d.buildQemuArgs(cfg, tc)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(taskDir, "linux.img"), cmd.imagePath)
+	require.Equal(t, FirmwareConfig{
+		Code: filepath.Join(taskDir, "OVMF_CODE.fd"),
+		Vars: filepath.Join(taskDir, "OVMF_VARS.fd"),
+	}, cmd.firmware)
+
+	args := strings.Join(cmd.args, " ")
+	for _, arg := range []string{
+		"file.filename=" + filepath.Join(taskDir, "linux.img") + ",",
+		"file.filename=" + filepath.Join(taskDir, "data.img") + ",",
+		"file=" + filepath.Join(taskDir, "boot.iso") + ",media=cdrom",
+		"-kernel " + filepath.Join(taskDir, "vmlinuz"),
+		"path=" + filepath.Join(taskDir, "shared") + ",",
+		"file=" + filepath.Join(taskDir, "OVMF_CODE.fd"),
+	} {
+		require.Contains(t, args, arg)
+	}
+
+	// the task configuration is left untouched
+	require.Equal(t, "linux.img", tc.ImagePath)
+	require.Equal(t, "data-link.img", tc.Disks[0].Path)
+	require.Equal(t, "shared", tc.Shares[0].Path)
+}
+
+func TestBuildQemuArgs_CdromEscaping(t *testing.T) {
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	cfg, tc := testBuildTask(t)
+	taskDir, err := filepath.EvalSymlinks(cfg.TaskDir().Dir)
+	require.NoError(t, err)
+	tc.Cdrom = "boot.iso,readonly=off"
+
+	cmd, err := d.buildQemuArgs(cfg, tc)
+	require.NoError(t, err)
+	require.Contains(t, cmd.args, "file="+filepath.Join(taskDir, "boot.iso,,readonly=off")+",media=cdrom,readonly=on")
+
+	tc.Cdrom = "boot\n.iso"
+	_, err = d.buildQemuArgs(cfg, tc)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid cdrom")
+}
+
+func TestBuildQemuArgs_SeedEscaping(t *testing.T) {
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	cfg, tc := testBuildTask(t)
+	cfg.AllocDir = filepath.Join(t.TempDir(), "a,b")
+	taskDir := cfg.TaskDir().Dir
+	require.NoError(t, os.MkdirAll(taskDir, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(taskDir, "linux.img"), make([]byte, 512), 0644))
+	tc.CloudInit = CloudInitConfig{UserData: "#cloud-config\n"}
+
+	// a comma in the task directory does not add options to the drive
+	cmd, err := d.buildQemuArgs(cfg, tc)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(taskDir, cloudInitSeedName), cmd.seedPath)
+	seed := strings.Replace(cmd.seedPath, ",", ",,", -1)
+	require.Contains(t, cmd.args, "file="+seed+",media=cdrom,readonly=on")
+}
+
+func TestBuildQemuArgs_Sandbox(t *testing.T) {
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	cfg, tc := testBuildTask(t)
+
+	cmd, err := d.buildQemuArgs(cfg, tc)
+	require.NoError(t, err)
+	tc.Sandbox = "on,spawn=deny"
+	sandboxCmd, err := d.buildQemuArgs(cfg, tc)
+
+	if runtime.GOOS != "linux" {
+		require.NotContains(t, cmd.args, "-sandbox")
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "sandbox is unsupported on the "+runtime.GOOS+" platform")
+		return
+	}
+	require.Contains(t, strings.Join(cmd.args, " "), " -sandbox on")
+	require.NoError(t, err)
+	require.Contains(t, strings.Join(sandboxCmd.args, " "), " -sandbox on,spawn=deny")
+}
+
+func TestStartTask_FailureRemovesFirmwareVars(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("tpm is unsupported on Windows")
+	}
+
+	// swtpm cannot be found, failing the start after the vars were copied
+	sh, err := GetAbsolutePath("sh")
+	require.NoError(t, err)
+	binDir := t.TempDir()
+	require.NoError(t, os.Symlink(sh, filepath.Join(binDir, "sh")))
+	setPath(t, binDir)
+
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	cfg, tc := testBuildTask(t)
+	taskDir := cfg.TaskDir().Dir
+	require.NoError(t, ioutil.WriteFile(filepath.Join(taskDir, "OVMF_CODE.fd"), nil, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(taskDir, "OVMF_VARS.fd"), nil, 0644))
+	tc.Firmware = FirmwareConfig{Code: "OVMF_CODE.fd", Vars: "OVMF_VARS.fd"}
+	tc.TPM.Enabled = true
+	require.NoError(t, cfg.EncodeConcreteDriverConfig(tc))
+
+	_, _, err = d.StartTask(cfg)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "tpm requires swtpm")
+
+	_, err = os.Stat(filepath.Join(taskDir, firmwareVarsName))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestStartTask_DryRun(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the monitor socket is unsupported on Windows")
+	}
+
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	cfg, tc := testBuildTask(t)
+	tc.DryRun = true
+	require.NoError(t, cfg.EncodeConcreteDriverConfig(tc))
+
+	_, _, err := d.StartTask(cfg)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "dry_run is set, qemu would have been started with: ")
+	require.Contains(t, err.Error(), "-machine type=pc,accel=tcg -name linux.img -m 512M")
+
+	_, ok := d.tasks.Get(cfg.ID)
+	require.False(t, ok)
+}
+
+func TestStartTask_DryRunCNI(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the monitor socket is unsupported on Windows")
+	}
+
+	// the tap device is not set up for a dry run
+	dir := t.TempDir()
+	logPath := fakeNsenter(t, dir)
+	setPath(t, dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	cfg, tc := testBuildTask(t)
+	cfg.NetworkIsolation = &drivers.NetworkIsolationSpec{Path: "/var/run/netns/alloc"}
+	tc.NetworkMode = "cni"
+	tc.DryRun = true
+	require.NoError(t, cfg.EncodeConcreteDriverConfig(tc))
+
+	_, _, err := d.StartTask(cfg)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "-netdev tap,id=nd0,ifname=tap0,script=no,downscript=no")
+	require.Contains(t, err.Error(), "mac="+cniMacAddress(cfg))
+
+	_, err = os.Stat(logPath)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestBuildQemuArgs_Network(t *testing.T) {
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	cfg, tc := testBuildTask(t)
+
+	cmd, err := d.buildQemuArgs(cfg, tc)
+	require.NoError(t, err)
+	require.Nil(t, cmd.network)
+
+	// consoles are reported before the VM starts
+	tc.VNC = VNCConfig{Enabled: true, Display: 1}
+	cmd, err = d.buildQemuArgs(cfg, tc)
+	require.NoError(t, err)
+	require.Equal(t, &drivers.DriverNetwork{
+		PortMap: map[string]int{vncPortLabel: tc.VNC.Port()},
+	}, cmd.network)
+}
+
+func TestBuildQemuArgs_ExtraArgs(t *testing.T) {
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	cfg, tc := testBuildTask(t)
+	tc.ExtraDevices = []string{"usb-tablet"}
+	tc.ExtraArgs = []string{"-no-hpet"}
+	tc.Args = []string{"-snapshot"}
+
+	cmd, err := d.buildQemuArgs(cfg, tc)
+	require.NoError(t, err)
+	// extra arguments follow the generated ones, before args
+	require.Equal(t, []string{"-device", "usb-tablet", "-no-hpet", "-snapshot"}, cmd.args[len(cmd.args)-4:])
+}
+
+func TestBuildQemuArgs_ExtraArgsDisabled(t *testing.T) {
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	d.config.AllowExtraArgs = false
+
+	cfg, tc := testBuildTask(t)
+	_, err := d.buildQemuArgs(cfg, tc)
+	require.NoError(t, err)
+
+	for name, modify := range map[string]func(tc *TaskConfig){
+		"args":          func(tc *TaskConfig) { tc.Args = []string{"-snapshot"} },
+		"extra_args":    func(tc *TaskConfig) { tc.ExtraArgs = []string{"-no-hpet"} },
+		"extra_devices": func(tc *TaskConfig) { tc.ExtraDevices = []string{"usb-tablet"} },
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg, tc := testBuildTask(t)
+			modify(tc)
+			_, err := d.buildQemuArgs(cfg, tc)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), "disabled by the allow_extra_args plugin option")
+		})
+	}
+}
+
+func TestBuildQemuArgs_DisplayNone(t *testing.T) {
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	cfg, tc := testBuildTask(t)
+	tc.Display = displayNone
+
+	cmd, err := d.buildQemuArgs(cfg, tc)
+	require.NoError(t, err)
+	require.Contains(t, strings.Join(cmd.args, " "), " -display none ")
+	require.NotContains(t, cmd.args, "-nographic")
+}
+
+func TestBuildQemuArgs_Incoming(t *testing.T) {
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	cfg, tc := testBuildTask(t)
+	cfg.Resources.NomadResources.Networks = []*structs.NetworkResource{{
+		IP:           "192.168.0.10",
+		DynamicPorts: []structs.Port{{Label: "migration", Value: 24444}},
+	}}
+	tc.Incoming = "migration"
+
+	cmd, err := d.buildQemuArgs(cfg, tc)
+	require.NoError(t, err)
+	require.Contains(t, strings.Join(cmd.args, " "), " -S -incoming tcp:192.168.0.10:24444 ")
+	// the migration port is reported like the consoles
+	require.Equal(t, 24444, cmd.network.PortMap["migration"])
+}
+
+func TestStartTask_IncomingBootTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("boot_timeout is unsupported on Windows")
+	}
+
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	cfg, tc := testBuildTask(t)
+	tc.Incoming = "migration"
+	tc.BootTimeout = "30s"
+	require.NoError(t, cfg.EncodeConcreteDriverConfig(tc))
+
+	_, _, err := d.StartTask(cfg)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "boot_timeout cannot be used with incoming")
+}
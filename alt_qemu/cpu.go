@@ -0,0 +1,192 @@
+package alt_qemu
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// defaultCPUSharesPerVCPU is the number of CPU shares backing each vCPU
+	// unless cpu_shares_per_vcpu is set
+	defaultCPUSharesPerVCPU = 1000
+
+	// minCPUShares and maxCPUShares bound the CPU shares a task may request
+	minCPUShares = 100
+	maxCPUShares = 1024000
+
+	// maxCPUs bounds the CPU indexes of a cpuset, the most CPUs the Linux
+	// kernel supports, so a range cannot expand to an unbounded list
+	maxCPUs = 8192
+)
+
+// SMPConfig describes the topology of the VM's vCPUs
+type SMPConfig struct {
+	Sockets int `codec:"sockets"`
+	Cores   int `codec:"cores"`
+	Threads int `codec:"threads"`
+}
+
+// IsSet returns whether any part of the topology was configured.
+func (c *SMPConfig) IsSet() bool {
+	return c.Sockets != 0 || c.Cores != 0 || c.Threads != 0
+}
+
+// smpArg returns the -smp argument for count vCPUs laid out according to
+// topology. Unset parts of the topology default to 1 and the topology must
+// account for exactly count vCPUs.
+func smpArg(count int, topology *SMPConfig) (string, error) {
+	if !topology.IsSet() {
+		return strconv.Itoa(count), nil
+	}
+
+	sockets, cores, threads := topology.Sockets, topology.Cores, topology.Threads
+	for name, v := range map[string]*int{"sockets": &sockets, "cores": &cores, "threads": &threads} {
+		if *v < 0 {
+			return "", fmt.Errorf("smp %s must not be negative", name)
+		}
+		if *v == 0 {
+			*v = 1
+		}
+	}
+
+	if total := sockets * cores * threads; total != count {
+		return "", fmt.Errorf("smp topology of %d sockets, %d cores and %d threads is %d vCPUs, but %d vCPUs are allocated",
+			sockets, cores, threads, total, count)
+	}
+	return fmt.Sprintf("%d,sockets=%d,cores=%d,threads=%d", count, sockets, cores, threads), nil
+}
+
+// vcpuCount returns the number of vCPUs given to the VM of the task, one for
+// every cpu_shares_per_vcpu shares allocated to it, rounded down, and at
+// least one. The count is clamped to the number of host CPUs and, when the
+// task is confined to a cpuset, to the number of CPUs in that set.
+func (d *AltQemuDriverPlugin) vcpuCount(cfg *drivers.TaskConfig) (int, error) {
+	cpu := cfg.Resources.NomadResources.Cpu.CpuShares
+	if cpu < minCPUShares || cpu > maxCPUShares {
+		return 0, fmt.Errorf("cpu share assignment out of bounds")
+	}
+
+	sharesPerVCPU := d.config.CPUSharesPerVCPU
+	if sharesPerVCPU <= 0 {
+		sharesPerVCPU = defaultCPUSharesPerVCPU
+	}
+	count := int(cpu / sharesPerVCPU)
+	if count < 1 {
+		count = 1
+	}
+
+	if hostCPUs := runtime.NumCPU(); count > hostCPUs {
+		d.logger.Debug("clamping vCPU count to host CPUs", "requested", count, "host_cpus", hostCPUs)
+		count = hostCPUs
+	}
+
+	if lr := cfg.Resources.LinuxResources; lr != nil && lr.CpusetCPUs != "" {
+		cpus, err := parseCpuset(lr.CpusetCPUs)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse task cpuset: %v", err)
+		}
+		if len(cpus) > 0 && count > len(cpus) {
+			d.logger.Debug("clamping vCPU count to task cpuset", "requested", count, "cpuset", lr.CpusetCPUs)
+			count = len(cpus)
+		}
+	}
+
+	return count, nil
+}
+
+// parseCpuset parses a cpuset list such as "0-3,6" into the CPU indexes it
+// contains, in order. Indexes must be below maxCPUs.
+func parseCpuset(cpuset string) ([]int, error) {
+	ranges, err := parseCpusetRanges(cpuset)
+	if err != nil {
+		return nil, err
+	}
+	return expandCpuRanges(ranges), nil
+}
+
+// cpuRange is an inclusive range of CPU indexes of a cpuset list.
+type cpuRange struct {
+	first, last int
+}
+
+// parseCpusetRanges parses a cpuset list into its ranges without expanding
+// them, so callers can bound the ranges further before expanding them with
+// expandCpuRanges. Indexes must be below maxCPUs.
+func parseCpusetRanges(cpuset string) ([]cpuRange, error) {
+	var ranges []cpuRange
+
+	for _, part := range strings.Split(cpuset, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			return nil, fmt.Errorf("invalid cpuset %q: empty element", cpuset)
+		}
+
+		bounds := strings.SplitN(part, "-", 2)
+		start, err := strconv.Atoi(bounds[0])
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid cpuset %q: bad cpu %q", cpuset, bounds[0])
+		}
+		end := start
+		if len(bounds) == 2 {
+			end, err = strconv.Atoi(bounds[1])
+			if err != nil || end < start {
+				return nil, fmt.Errorf("invalid cpuset %q: bad range %q", cpuset, part)
+			}
+		}
+		if end >= maxCPUs {
+			return nil, fmt.Errorf("invalid cpuset %q: cpu %d exceeds the maximum of %d CPUs", cpuset, end, maxCPUs)
+		}
+		ranges = append(ranges, cpuRange{first: start, last: end})
+	}
+
+	return ranges, nil
+}
+
+// expandCpuRanges returns the CPU indexes of ranges, in order and without
+// duplicates.
+func expandCpuRanges(ranges []cpuRange) []int {
+	var cpus []int
+	seen := map[int]bool{}
+
+	for _, r := range ranges {
+		for c := r.first; c <= r.last; c++ {
+			if !seen[c] {
+				seen[c] = true
+				cpus = append(cpus, c)
+			}
+		}
+	}
+
+	return cpus
+}
+
+// checkCpuset returns an error unless cpuset is a valid cpuset list whose CPUs
+// all exist on the host.
+func checkCpuset(cpuset string) error {
+	cpus, err := parseCpuset(cpuset)
+	if err != nil {
+		return err
+	}
+	hostCPUs := runtime.NumCPU()
+	for _, c := range cpus {
+		if c >= hostCPUs {
+			return fmt.Errorf("cpuset %q contains cpu %d, but the host only has %d CPUs", cpuset, c, hostCPUs)
+		}
+	}
+	return nil
+}
+
+// pinCPUs restricts every thread of the process pid to the CPUs in cpuset.
+// Threads qemu starts later, such as vCPU threads, inherit the affinity.
+func pinCPUs(pid int, cpuset string) error {
+	out, err := exec.Command("taskset", "--all-tasks", "--cpu-list", "--pid", cpuset, strconv.Itoa(pid)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to pin qemu to cpuset %q: %v: %s", cpuset, err, out)
+	}
+	return nil
+}
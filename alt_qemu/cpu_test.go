@@ -0,0 +1,204 @@
+package alt_qemu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+// testTaskConfigWithCPU returns a task config allocated the given CPU shares
+// and confined to cpuset when it is set.
+func testTaskConfigWithCPU(shares int64, cpuset string) *drivers.TaskConfig {
+	return &drivers.TaskConfig{
+		ID: "task-1",
+		Resources: &drivers.Resources{
+			NomadResources: &structs.AllocatedTaskResources{
+				Cpu: structs.AllocatedCpuResources{CpuShares: shares},
+			},
+			LinuxResources: &drivers.LinuxResources{CpusetCPUs: cpuset},
+		},
+	}
+}
+
+func TestVcpuCount(t *testing.T) {
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+
+	twoVCPUs := 2
+	if runtime.NumCPU() < twoVCPUs {
+		twoVCPUs = runtime.NumCPU()
+	}
+
+	cases := []struct {
+		name   string
+		shares int64
+		cpuset string
+		count  int
+		err    bool
+	}{
+		{name: "below one vcpu", shares: 500, count: 1},
+		{name: "one vcpu", shares: 1000, count: 1},
+		{name: "two vcpus", shares: 2500, count: twoVCPUs},
+		{name: "clamped to host", shares: maxCPUShares, count: runtime.NumCPU()},
+		{name: "clamped to cpuset", shares: maxCPUShares, cpuset: "0", count: 1},
+		{name: "too few shares", shares: 99, err: true},
+		{name: "too many shares", shares: maxCPUShares + 1, err: true},
+		{name: "invalid cpuset", shares: 1000, cpuset: "a-b", err: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			count, err := d.vcpuCount(testTaskConfigWithCPU(c.shares, c.cpuset))
+			if c.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.count, count)
+		})
+	}
+}
+
+func TestVcpuCount_SharesPerVCPU(t *testing.T) {
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	d.config.CPUSharesPerVCPU = 500
+
+	expected := 3
+	if runtime.NumCPU() < expected {
+		expected = runtime.NumCPU()
+	}
+	// the count is rounded down
+	count, err := d.vcpuCount(testTaskConfigWithCPU(1700, ""))
+	require.NoError(t, err)
+	require.Equal(t, expected, count)
+
+	d.config.CPUSharesPerVCPU = 4000
+	count, err = d.vcpuCount(testTaskConfigWithCPU(3000, ""))
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+}
+
+func TestParseCpuset(t *testing.T) {
+	cases := []struct {
+		cpuset string
+		cpus   []int
+		err    string
+	}{
+		{cpuset: "0", cpus: []int{0}},
+		{cpuset: "0-3,6", cpus: []int{0, 1, 2, 3, 6}},
+		{cpuset: "4, 2-3, 3", cpus: []int{4, 2, 3}},
+		{cpuset: "", err: "empty element"},
+		{cpuset: "0,,1", err: "empty element"},
+		{cpuset: "-1", err: "bad cpu"},
+		{cpuset: "x", err: "bad cpu"},
+		{cpuset: "3-1", err: "bad range"},
+		{cpuset: "1-x", err: "bad range"},
+		{cpuset: "8191", cpus: []int{8191}},
+		{cpuset: "8192", err: "cpu 8192 exceeds the maximum of 8192 CPUs"},
+		{cpuset: "0-2147483647", err: "exceeds the maximum"},
+		{cpuset: "0-99999999999999999999", err: "bad range"},
+	}
+	for _, c := range cases {
+		t.Run(c.cpuset, func(t *testing.T) {
+			cpus, err := parseCpuset(c.cpuset)
+			if c.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.cpus, cpus)
+		})
+	}
+}
+
+func TestParseCpusetRanges(t *testing.T) {
+	ranges, err := parseCpusetRanges("6,0-3,2")
+	require.NoError(t, err)
+	require.Equal(t, []cpuRange{{6, 6}, {0, 3}, {2, 2}}, ranges)
+	require.Equal(t, []int{6, 0, 1, 2, 3}, expandCpuRanges(ranges))
+}
+
+func TestTaskConfig_SMP(t *testing.T) {
+	config := `
+config {
+  image_path = "linux.img"
+  smp {
+    sockets = 2
+    cores = 2
+  }
+}`
+
+	var tc *TaskConfig
+	hclutils.NewConfigParser(taskConfigSpec).ParseHCL(t, config, &tc)
+
+	require.Equal(t, SMPConfig{Sockets: 2, Cores: 2}, tc.SMP)
+}
+
+func TestSmpArg(t *testing.T) {
+	cases := []struct {
+		name     string
+		count    int
+		topology SMPConfig
+		arg      string
+		err      string
+	}{
+		{name: "no topology", count: 4, arg: "4"},
+		{name: "full topology", count: 8, topology: SMPConfig{Sockets: 2, Cores: 2, Threads: 2}, arg: "8,sockets=2,cores=2,threads=2"},
+		{name: "unset parts default to one", count: 4, topology: SMPConfig{Cores: 4}, arg: "4,sockets=1,cores=4,threads=1"},
+		{name: "mismatched count", count: 4, topology: SMPConfig{Sockets: 2, Cores: 4}, err: "is 8 vCPUs, but 4 vCPUs are allocated"},
+		{name: "negative", count: 1, topology: SMPConfig{Threads: -1}, err: "smp threads must not be negative"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			arg, err := smpArg(c.count, &c.topology)
+			if c.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.arg, arg)
+		})
+	}
+}
+
+func TestCheckCpuset(t *testing.T) {
+	require.NoError(t, checkCpuset("0"))
+
+	hostCPUs := runtime.NumCPU()
+	err := checkCpuset(fmt.Sprintf("0,%d", hostCPUs))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), fmt.Sprintf("contains cpu %d, but the host only has %d CPUs", hostCPUs, hostCPUs))
+
+	err = checkCpuset("1-0")
+	require.Error(t, err)
+}
+
+func TestPinCPUs(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake binaries are shell scripts")
+	}
+
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "taskset.log")
+	writeFakeBinary(t, dir, "taskset", `echo "$@" > `+logPath+`
+[ "$4" = "0-1" ] || { echo "invalid cpu list" >&2; exit 1; }`)
+	setPath(t, dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	require.NoError(t, pinCPUs(1234, "0-1"))
+	data, err := ioutil.ReadFile(logPath)
+	require.NoError(t, err)
+	require.Equal(t, "--all-tasks --cpu-list --pid 0-1 1234\n", string(data))
+
+	err = pinCPUs(1234, "7")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid cpu list")
+}
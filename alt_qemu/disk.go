@@ -0,0 +1,511 @@
+package alt_qemu
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	// bootBlockDevName is the block node name of the disk built from
+	// image_path
+	bootBlockDevName = "bootbd"
+
+	// defaultQemuImgBin is the qemu-img binary used when none is configured
+	defaultQemuImgBin = "qemu-img"
+
+	// defaultQemuSystemBin is the qemu system emulator used when none is
+	// configured
+	defaultQemuSystemBin = "qemu-system-x86_64"
+
+	// scsiControllerID is the id of the virtio-scsi controller added when
+	// any disk uses the scsi interface
+	scsiControllerID = "scsi0"
+
+	// sataControllerID is the id of the AHCI controller added when any disk
+	// uses the sata interface
+	sataControllerID = "ahci0"
+
+	// driverIOUringAttr reports whether the kernel supports io_uring, as
+	// used by disks with aio set to io_uring
+	driverIOUringAttr = "driver.qemu.io_uring"
+)
+
+// DiskConfig describes a disk attached to the VM in addition to the boot
+// disk given by image_path.
+type DiskConfig struct {
+	Path      string `codec:"path"`
+	Format    string `codec:"format"`
+	Interface string `codec:"interface"` // one of virtio-blk, ide, sata or scsi
+	ReadOnly  bool   `codec:"readonly"`
+
+	// ShareRW allows other VMs to open the image at the same time, e.g. for
+	// clustered filesystems, by disabling image locking
+	ShareRW bool `codec:"share_rw"`
+
+	Cache string `codec:"cache"` // one of none, writeback, writethrough or directsync
+	AIO   string `codec:"aio"`   // one of threads, native or io_uring
+
+	// IO limits of the disk in operations and bytes per second, in total or
+	// for reads and writes
+	IOPS      int64 `codec:"iops"`
+	IOPSRead  int64 `codec:"iops_rd"`
+	IOPSWrite int64 `codec:"iops_wr"`
+	BPS       int64 `codec:"bps"`
+	BPSRead   int64 `codec:"bps_rd"`
+	BPSWrite  int64 `codec:"bps_wr"`
+
+	// disableLocking turns off image locking without sharing the device,
+	// as set for the boot disk by disable_image_locking
+	disableLocking bool
+
+	// hostDevice is set for disks backed by a host block device rather
+	// than an image file
+	hostDevice bool
+}
+
+// diskDeviceTypes maps the supported disk interfaces to the qemu device
+// exposing a block node to the guest.
+var diskDeviceTypes = map[string]string{
+	"virtio-blk": "virtio-blk",
+	"ide":        "ide-hd",
+	"sata":       "ide-hd",
+	"scsi":       "scsi-hd",
+}
+
+// diskFormats are the image formats a disk configuration may set, which
+// qemu opens through the block driver of the same name.
+var diskFormats = map[string]bool{
+	"raw":   true,
+	"qcow2": true,
+	"vmdk":  true,
+	"vdi":   true,
+	"vhdx":  true,
+	"vpc":   true,
+	"qed":   true,
+}
+
+// diskCacheModes maps the supported disk cache modes to whether they bypass
+// the host page cache and whether they expose a volatile write cache to the
+// guest.
+var diskCacheModes = map[string]struct{ direct, writeCache bool }{
+	"none":         {direct: true, writeCache: true},
+	"writeback":    {direct: false, writeCache: true},
+	"writethrough": {direct: false, writeCache: false},
+	"directsync":   {direct: true, writeCache: false},
+}
+
+// diskCacheOptions returns the -blockdev and -device properties implementing
+// the cache and aio modes of disk, which are left to qemu when unset.
+func diskCacheOptions(disk DiskConfig) (string, string, error) {
+	var blockdev, device string
+	direct := false
+	if disk.Cache != "" {
+		mode, ok := diskCacheModes[disk.Cache]
+		if !ok {
+			return "", "", fmt.Errorf("unsupported cache %q for disk %q, must be none, writeback, writethrough or directsync", disk.Cache, disk.Path)
+		}
+		direct = mode.direct
+		blockdev += fmt.Sprintf(",cache.direct=%s,cache.no-flush=off", onOff(mode.direct))
+		device += ",write-cache=" + onOff(mode.writeCache)
+	}
+
+	switch disk.AIO {
+	case "", "threads":
+	case "native":
+		if !direct {
+			return "", "", fmt.Errorf("aio native for disk %q requires cache none or directsync", disk.Path)
+		}
+	case "io_uring":
+		if !ioUringAvailable() {
+			return "", "", fmt.Errorf("aio io_uring for disk %q is not supported by the host kernel", disk.Path)
+		}
+	default:
+		return "", "", fmt.Errorf("unsupported aio %q for disk %q, must be threads, native or io_uring", disk.AIO, disk.Path)
+	}
+	if disk.AIO != "" {
+		blockdev += ",file.aio=" + disk.AIO
+	}
+	return blockdev, device, nil
+}
+
+// throttleLimits returns the throttle-group properties limiting the IO of
+// disk, or an empty string when it is not throttled.
+func throttleLimits(disk DiskConfig) (string, error) {
+	limits := []struct {
+		option, property string
+		value            int64
+	}{
+		{"iops", "iops-total", disk.IOPS},
+		{"iops_rd", "iops-read", disk.IOPSRead},
+		{"iops_wr", "iops-write", disk.IOPSWrite},
+		{"bps", "bps-total", disk.BPS},
+		{"bps_rd", "bps-read", disk.BPSRead},
+		{"bps_wr", "bps-write", disk.BPSWrite},
+	}
+
+	var props []string
+	for _, l := range limits {
+		if l.value < 0 {
+			return "", fmt.Errorf("%s of disk %q must not be negative", l.option, disk.Path)
+		}
+		if l.value > 0 {
+			props = append(props, fmt.Sprintf("limits.%s=%d", l.property, l.value))
+		}
+	}
+	if disk.IOPS > 0 && (disk.IOPSRead > 0 || disk.IOPSWrite > 0) {
+		return "", fmt.Errorf("iops of disk %q cannot be combined with iops_rd or iops_wr", disk.Path)
+	}
+	if disk.BPS > 0 && (disk.BPSRead > 0 || disk.BPSWrite > 0) {
+		return "", fmt.Errorf("bps of disk %q cannot be combined with bps_rd or bps_wr", disk.Path)
+	}
+	return strings.Join(props, ","), nil
+}
+
+// onOff returns the qemu representation of a boolean property.
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+// isDevicePath returns whether the disk path refers to a host device, either
+// because it is located under /dev or inside one of allowedDevicePaths.
+func isDevicePath(allowedDevicePaths []string, path string) bool {
+	if isSubpath("/dev", filepath.Clean(path)) {
+		return true
+	}
+	return isAllowedDevicePath(allowedDevicePaths, path)
+}
+
+// isAllowedDevicePath returns whether path is one of allowedDevicePaths or is
+// located inside one of them. Paths are compared without resolving symlinks
+// as device nodes are commonly reached through links such as /dev/vg/lv.
+func isAllowedDevicePath(allowedDevicePaths []string, path string) bool {
+	path = filepath.Clean(path)
+	for _, ap := range allowedDevicePaths {
+		if isSubpath(filepath.Clean(ap), path) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkBlockDevice returns an error unless path is an allowed host block
+// device.
+func checkBlockDevice(allowedDevicePaths []string, path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("device path %q must be absolute", path)
+	}
+	if !isAllowedDevicePath(allowedDevicePaths, path) {
+		return fmt.Errorf("device path %q is not in the allowed device paths", path)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat device %q: %v", path, err)
+	}
+	if fi.Mode()&os.ModeDevice == 0 || fi.Mode()&os.ModeCharDevice != 0 {
+		return fmt.Errorf("device path %q is not a block device", path)
+	}
+	return nil
+}
+
+// resolveTaskPath resolves a path relative to the task directory, which is
+// the working directory of the qemu process.
+func resolveTaskPath(taskDir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(taskDir, path)
+}
+
+// escapeOptionValue escapes value for use inside a qemu option string, where
+// commas separate properties and are doubled to be taken literally. Values
+// holding control characters cannot be passed to qemu safely and are
+// rejected.
+func escapeOptionValue(value string) (string, error) {
+	for _, r := range value {
+		if unicode.IsControl(r) {
+			return "", fmt.Errorf("%q contains control characters", value)
+		}
+	}
+	return strings.Replace(value, ",", ",,", -1), nil
+}
+
+// imageFormatCache caches the detected formats of images. Entries are keyed by
+// image path and are invalidated when the image's size or modification time
+// change.
+type imageFormatCache struct {
+	lock    sync.Mutex
+	formats map[string]cachedImageFormat
+}
+
+type cachedImageFormat struct {
+	size    int64
+	modTime time.Time
+	format  string
+}
+
+func newImageFormatCache() *imageFormatCache {
+	return &imageFormatCache{formats: map[string]cachedImageFormat{}}
+}
+
+// Get returns the format of the image at path, running detect on a cache
+// miss.
+func (c *imageFormatCache) Get(path string, detect func(string) (string, error)) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat image %q: %v", path, err)
+	}
+
+	c.lock.Lock()
+	cached, ok := c.formats[path]
+	c.lock.Unlock()
+	if ok && cached.size == fi.Size() && cached.modTime.Equal(fi.ModTime()) {
+		return cached.format, nil
+	}
+
+	format, err := detect(path)
+	if err != nil {
+		return "", err
+	}
+
+	c.lock.Lock()
+	c.formats[path] = cachedImageFormat{size: fi.Size(), modTime: fi.ModTime(), format: format}
+	c.lock.Unlock()
+	return format, nil
+}
+
+// qemuImgInfo is the subset of the `qemu-img info --output=json` output used
+// by the driver
+type qemuImgInfo struct {
+	Format string `json:"format"`
+}
+
+// qemuImgFormat returns the format of the image at path as reported by the
+// qemu-img binary at qemuImgPath. When qemu-img is not available the format
+// is detected from the image header instead.
+func qemuImgFormat(qemuImgPath, path string) (string, error) {
+	bin, err := GetAbsolutePath(qemuImgPath)
+	if err != nil {
+		return detectImageFormat(path)
+	}
+
+	// -U allows inspecting images locked by a running VM
+	out, err := exec.Command(bin, "info", "-U", "--output=json", path).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect image %q with qemu-img: %v", path, err)
+	}
+
+	var info qemuImgInfo
+	if err := json.Unmarshal(out, &info); err != nil {
+		return "", fmt.Errorf("failed to parse qemu-img info for image %q: %v", path, err)
+	}
+	if info.Format == "" {
+		return "", fmt.Errorf("qemu-img did not report a format for image %q", path)
+	}
+	return info.Format, nil
+}
+
+// diskFormat returns the image format of disk, detecting it when the disk
+// configuration does not set one. Host devices default to raw.
+func diskFormat(taskDir string, disk DiskConfig, detectFormat func(string) (string, error)) (string, error) {
+	switch {
+	case disk.Format != "":
+		return disk.Format, nil
+	case disk.hostDevice:
+		return "raw", nil
+	default:
+		return detectFormat(resolveTaskPath(taskDir, disk.Path))
+	}
+}
+
+// diskArgs returns the -blockdev and -device arguments attaching the given
+// disks to the VM, in order. Disks without a format have it determined by
+// detectFormat and disks without an interface default to virtio-blk. Images
+// are locked against concurrent use by other VMs unless the disk is shared.
+// Throttled disks are attached through a throttle filter node of their own
+// throttle group. The first disk is named after bootBlockDevName.
+func diskArgs(taskDir string, disks []DiskConfig, detectFormat func(string) (string, error)) ([]string, error) {
+	var args []string
+	var scsiController bool
+	var sataPorts int
+
+	for i, disk := range disks {
+		nodeName := bootBlockDevName
+		if i > 0 {
+			nodeName = fmt.Sprintf("disk%d", i)
+		}
+
+		iface := disk.Interface
+		if iface == "" {
+			iface = "virtio-blk"
+		}
+		deviceType, ok := diskDeviceTypes[iface]
+		if !ok {
+			return nil, fmt.Errorf("unsupported interface %q for disk %q", iface, disk.Path)
+		}
+
+		fileDriver := "file"
+		if disk.hostDevice {
+			fileDriver = "host_device"
+		}
+
+		format, err := diskFormat(taskDir, disk, detectFormat)
+		if err != nil {
+			return nil, err
+		}
+
+		locking := "on"
+		if disk.ShareRW || disk.disableLocking {
+			locking = "off"
+		}
+		limits, err := throttleLimits(disk)
+		if err != nil {
+			return nil, err
+		}
+		// the device is attached to the throttle filter node of throttled
+		// disks, which takes over the name of the disk node
+		imageNode := nodeName
+		if limits != "" {
+			imageNode = nodeName + "-base"
+		}
+
+		filename, err := escapeOptionValue(disk.Path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid disk path: %v", err)
+		}
+		blockdev := fmt.Sprintf("node-name=%s,driver=%s,file.filename=%s,file.locking=%s,file.driver=%s", imageNode, format, filename, locking, fileDriver)
+		if disk.ReadOnly {
+			blockdev += ",read-only=on"
+		}
+		cacheBlockdev, cacheDevice, err := diskCacheOptions(disk)
+		if err != nil {
+			return nil, err
+		}
+		blockdev += cacheBlockdev
+
+		if limits != "" {
+			group := "throttle-" + nodeName
+			args = append(args,
+				"-object", fmt.Sprintf("throttle-group,id=%s,%s", group, limits),
+				"-blockdev", blockdev,
+			)
+			blockdev = fmt.Sprintf("driver=throttle,node-name=%s,throttle-group=%s,file=%s", nodeName, group, imageNode)
+			if disk.ReadOnly {
+				blockdev += ",read-only=on"
+			}
+		}
+
+		device := fmt.Sprintf("%s,drive=%s%s", deviceType, nodeName, cacheDevice)
+		if disk.ShareRW {
+			device += ",share-rw=on"
+		}
+		if iface == "scsi" {
+			if !scsiController {
+				args = append(args, "-device", fmt.Sprintf("virtio-scsi-pci,id=%s", scsiControllerID))
+				scsiController = true
+			}
+			device += fmt.Sprintf(",bus=%s.0", scsiControllerID)
+		}
+		if iface == "sata" {
+			if sataPorts == 0 {
+				args = append(args, "-device", fmt.Sprintf("ahci,id=%s", sataControllerID))
+			}
+			device += fmt.Sprintf(",bus=%s.%d", sataControllerID, sataPorts)
+			sataPorts++
+		}
+
+		args = append(args, "-blockdev", blockdev, "-device", device)
+	}
+
+	return args, nil
+}
+
+// bootOrderRegex matches a boot order made of the qemu boot device letters:
+// a and b for floppies, c for the first hard disk, d for the first CDROM and
+// n through p for network adapters
+var bootOrderRegex = regexp.MustCompile(`^[abcdnop]+$`)
+
+// BootConfig configures the VM firmware boot process
+type BootConfig struct {
+	Order      string `codec:"order"` // boot device letters, e.g. "cd"
+	Menu       bool   `codec:"menu"`
+	SplashTime int    `codec:"splash_time"` // milliseconds the boot menu is shown
+}
+
+// bootArg returns the -boot argument for c, or an empty string when nothing is
+// configured.
+func bootArg(c *BootConfig) (string, error) {
+	var opts []string
+	if c.Order != "" {
+		if !bootOrderRegex.MatchString(c.Order) {
+			return "", fmt.Errorf("invalid boot order %q, must only contain the device letters a, b, c, d, n, o and p", c.Order)
+		}
+		opts = append(opts, "order="+c.Order)
+	}
+	if c.Menu {
+		opts = append(opts, "menu=on")
+	}
+	if c.SplashTime < 0 {
+		return "", fmt.Errorf("boot splash_time must not be negative")
+	} else if c.SplashTime > 0 {
+		opts = append(opts, fmt.Sprintf("splash-time=%d", c.SplashTime))
+	}
+	return strings.Join(opts, ","), nil
+}
+
+// kernelArgs returns the arguments booting kernel directly, without a
+// bootloader, with the optional initrd and kernel command line cmdline.
+func kernelArgs(kernel, initrd, cmdline string) ([]string, error) {
+	if kernel == "" {
+		if initrd != "" || cmdline != "" {
+			return nil, fmt.Errorf("initrd and kernel_append require kernel to be set")
+		}
+		return nil, nil
+	}
+
+	args := []string{"-kernel", kernel}
+	if initrd != "" {
+		args = append(args, "-initrd", initrd)
+	}
+	if cmdline != "" {
+		args = append(args, "-append", cmdline)
+	}
+	return args, nil
+}
+
+// overlayImageName is the name of the copy-on-write overlay created in the
+// task directory when overlay is set
+const overlayImageName = "overlay.qcow2"
+
+// createOverlay creates a qcow2 overlay in taskDir backed by the image at
+// base of format baseFormat, so the VM's writes do not modify the base
+// image, and returns its path. An overlay left by a previous run of the task
+// is replaced.
+func createOverlay(qemuImgPath, taskDir, base, baseFormat string) (string, error) {
+	base, err := filepath.Abs(resolveTaskPath(taskDir, base))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve image %q: %v", base, err)
+	}
+
+	overlayPath := filepath.Join(taskDir, overlayImageName)
+	if err := os.Remove(overlayPath); err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to remove previous overlay: %v", err)
+	}
+	out, err := exec.Command(qemuImgPath, "create", "-f", "qcow2", "-F", baseFormat, "-b", base, overlayPath).CombinedOutput()
+	if err != nil {
+		os.Remove(overlayPath)
+		return "", fmt.Errorf("failed to create overlay of %q: %v: %s", base, err, out)
+	}
+	return overlayPath, nil
+}
@@ -0,0 +1,578 @@
+package alt_qemu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskConfig_Disks(t *testing.T) {
+	config := `
+config {
+  image_path = "linux.img"
+  disk {
+    path = "data.qcow2"
+    format = "qcow2"
+    interface = "scsi"
+    readonly = true
+  }
+  disk {
+    path = "scratch.img"
+    share_rw = true
+    cache = "none"
+    aio = "native"
+    iops_rd = 500
+    bps = 10485760
+  }
+}`
+
+	var tc *TaskConfig
+	hclutils.NewConfigParser(taskConfigSpec).ParseHCL(t, config, &tc)
+
+	require.Equal(t, []DiskConfig{
+		{Path: "data.qcow2", Format: "qcow2", Interface: "scsi", ReadOnly: true},
+		{Path: "scratch.img", ShareRW: true, Cache: "none", AIO: "native", IOPSRead: 500, BPS: 10485760},
+	}, tc.Disks)
+}
+
+func TestDiskArgs(t *testing.T) {
+	taskDir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(taskDir, "linux.img"), []byte("raw image"), 0644))
+
+	args, err := diskArgs(taskDir, []DiskConfig{
+		{Path: "linux.img"},
+		{Path: "/data/extra.qcow2", Format: "qcow2", Interface: "ide"},
+		{Path: "/data/shared.img", Format: "raw", Interface: "scsi", ReadOnly: true},
+	}, detectImageFormat)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"-blockdev", "node-name=bootbd,driver=raw,file.filename=linux.img,file.locking=on,file.driver=file",
+		"-device", "virtio-blk,drive=bootbd",
+		"-blockdev", "node-name=disk1,driver=qcow2,file.filename=/data/extra.qcow2,file.locking=on,file.driver=file",
+		"-device", "ide-hd,drive=disk1",
+		"-device", "virtio-scsi-pci,id=scsi0",
+		"-blockdev", "node-name=disk2,driver=raw,file.filename=/data/shared.img,file.locking=on,file.driver=file,read-only=on",
+		"-device", "scsi-hd,drive=disk2,bus=scsi0.0",
+	}, args)
+}
+
+func TestDiskArgs_ShareRW(t *testing.T) {
+	args, err := diskArgs(t.TempDir(), []DiskConfig{
+		{Path: "/data/cluster.img", Format: "raw", ShareRW: true},
+	}, detectImageFormat)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"-blockdev", "node-name=bootbd,driver=raw,file.filename=/data/cluster.img,file.locking=off,file.driver=file",
+		"-device", "virtio-blk,drive=bootbd,share-rw=on",
+	}, args)
+}
+
+func TestDiskArgs_Cache(t *testing.T) {
+	args, err := diskArgs(t.TempDir(), []DiskConfig{
+		{Path: "/data/linux.img", Format: "raw", Cache: "none", AIO: "native"},
+		{Path: "/data/logs.img", Format: "raw", Cache: "writethrough", AIO: "threads"},
+	}, detectImageFormat)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"-blockdev", "node-name=bootbd,driver=raw,file.filename=/data/linux.img,file.locking=on,file.driver=file,cache.direct=on,cache.no-flush=off,file.aio=native",
+		"-device", "virtio-blk,drive=bootbd,write-cache=on",
+		"-blockdev", "node-name=disk1,driver=raw,file.filename=/data/logs.img,file.locking=on,file.driver=file,cache.direct=off,cache.no-flush=off,file.aio=threads",
+		"-device", "virtio-blk,drive=disk1,write-cache=off",
+	}, args)
+}
+
+func TestDiskCacheOptions(t *testing.T) {
+	cases := []struct {
+		name     string
+		disk     DiskConfig
+		blockdev string
+		device   string
+		err      string
+	}{
+		{
+			name: "unset",
+		},
+		{
+			name:     "writeback",
+			disk:     DiskConfig{Cache: "writeback"},
+			blockdev: ",cache.direct=off,cache.no-flush=off",
+			device:   ",write-cache=on",
+		},
+		{
+			name:     "directsync",
+			disk:     DiskConfig{Cache: "directsync", AIO: "native"},
+			blockdev: ",cache.direct=on,cache.no-flush=off,file.aio=native",
+			device:   ",write-cache=off",
+		},
+		{
+			name: "unknown cache",
+			disk: DiskConfig{Path: "data.img", Cache: "unsafe"},
+			err:  `unsupported cache "unsafe" for disk "data.img"`,
+		},
+		{
+			name: "native without direct",
+			disk: DiskConfig{Path: "data.img", AIO: "native"},
+			err:  `aio native for disk "data.img" requires cache none or directsync`,
+		},
+		{
+			name: "unknown aio",
+			disk: DiskConfig{Path: "data.img", AIO: "posix"},
+			err:  `unsupported aio "posix" for disk "data.img"`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			blockdev, device, err := diskCacheOptions(c.disk)
+			if c.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.blockdev, blockdev)
+			require.Equal(t, c.device, device)
+		})
+	}
+}
+
+func TestDiskCacheOptions_IOUring(t *testing.T) {
+	blockdev, _, err := diskCacheOptions(DiskConfig{Path: "data.img", AIO: "io_uring"})
+	if !ioUringAvailable() {
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "is not supported by the host kernel")
+		return
+	}
+	require.NoError(t, err)
+	require.Equal(t, ",file.aio=io_uring", blockdev)
+}
+
+func TestDiskArgs_Throttle(t *testing.T) {
+	args, err := diskArgs(t.TempDir(), []DiskConfig{
+		{Path: "/data/linux.img", Format: "raw"},
+		{Path: "/data/data.img", Format: "raw", ReadOnly: true, IOPS: 1000, BPSWrite: 1048576},
+	}, detectImageFormat)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"-blockdev", "node-name=bootbd,driver=raw,file.filename=/data/linux.img,file.locking=on,file.driver=file",
+		"-device", "virtio-blk,drive=bootbd",
+		"-object", "throttle-group,id=throttle-disk1,limits.iops-total=1000,limits.bps-write=1048576",
+		"-blockdev", "node-name=disk1-base,driver=raw,file.filename=/data/data.img,file.locking=on,file.driver=file,read-only=on",
+		"-blockdev", "driver=throttle,node-name=disk1,throttle-group=throttle-disk1,file=disk1-base,read-only=on",
+		"-device", "virtio-blk,drive=disk1",
+	}, args)
+}
+
+func TestThrottleLimits(t *testing.T) {
+	cases := []struct {
+		name   string
+		disk   DiskConfig
+		limits string
+		err    string
+	}{
+		{
+			name: "unthrottled",
+		},
+		{
+			name:   "all read and write limits",
+			disk:   DiskConfig{IOPSRead: 100, IOPSWrite: 50, BPSRead: 4096, BPSWrite: 2048},
+			limits: "limits.iops-read=100,limits.iops-write=50,limits.bps-read=4096,limits.bps-write=2048",
+		},
+		{
+			name: "negative",
+			disk: DiskConfig{Path: "data.img", BPSRead: -1},
+			err:  `bps_rd of disk "data.img" must not be negative`,
+		},
+		{
+			name: "iops with iops_wr",
+			disk: DiskConfig{Path: "data.img", IOPS: 100, IOPSWrite: 50},
+			err:  `iops of disk "data.img" cannot be combined with iops_rd or iops_wr`,
+		},
+		{
+			name: "bps with bps_rd",
+			disk: DiskConfig{Path: "data.img", BPS: 4096, BPSRead: 2048},
+			err:  `bps of disk "data.img" cannot be combined with bps_rd or bps_wr`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			limits, err := throttleLimits(c.disk)
+			if c.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.limits, limits)
+		})
+	}
+}
+
+func TestEscapeOptionValue(t *testing.T) {
+	for value, expected := range map[string]string{
+		"/data/linux.img":          "/data/linux.img",
+		"/data/a,b.img":            "/data/a,,b.img",
+		"/data/x,file.locking=off": "/data/x,,file.locking=off",
+	} {
+		escaped, err := escapeOptionValue(value)
+		require.NoError(t, err, value)
+		require.Equal(t, expected, escaped, value)
+	}
+
+	for _, value := range []string{"/data/a\nb.img", "/data/\x00.img", "/data/\x7f.img"} {
+		_, err := escapeOptionValue(value)
+		require.Error(t, err, value)
+		require.Contains(t, err.Error(), "contains control characters")
+	}
+}
+
+func TestDiskArgs_Escaping(t *testing.T) {
+	args, err := diskArgs(t.TempDir(), []DiskConfig{
+		{Path: "/data/vm,file.locking=off.img", Format: "raw"},
+	}, detectImageFormat)
+	require.NoError(t, err)
+	// a comma in the path cannot add properties to the block node
+	require.Equal(t, "node-name=bootbd,driver=raw,file.filename=/data/vm,,file.locking=off.img,file.locking=on,file.driver=file", args[1])
+
+	_, err = diskArgs(t.TempDir(), []DiskConfig{
+		{Path: "/data/vm\n.img", Format: "raw"},
+	}, detectImageFormat)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid disk path")
+}
+
+func TestDiskArgs_DisableLocking(t *testing.T) {
+	config := `
+config {
+  image_path = "linux.img"
+  disable_image_locking = true
+}`
+
+	var tc *TaskConfig
+	hclutils.NewConfigParser(taskConfigSpec).ParseHCL(t, config, &tc)
+	require.True(t, tc.DisableImageLocking)
+
+	args, err := diskArgs(t.TempDir(), []DiskConfig{
+		{Path: "/data/linux.img", Format: "raw", disableLocking: tc.DisableImageLocking},
+	}, detectImageFormat)
+	require.NoError(t, err)
+	// unlike share_rw the device is not shared with other VMs
+	require.Equal(t, []string{
+		"-blockdev", "node-name=bootbd,driver=raw,file.filename=/data/linux.img,file.locking=off,file.driver=file",
+		"-device", "virtio-blk,drive=bootbd",
+	}, args)
+}
+
+func TestDiskArgs_Sata(t *testing.T) {
+	config := `
+config {
+  image_path = "windows.img"
+  boot_disk_interface = "sata"
+}`
+
+	var tc *TaskConfig
+	hclutils.NewConfigParser(taskConfigSpec).ParseHCL(t, config, &tc)
+	require.Equal(t, "sata", tc.BootDiskInterface)
+
+	args, err := diskArgs(t.TempDir(), []DiskConfig{
+		{Path: "/data/windows.img", Format: "qcow2", Interface: tc.BootDiskInterface},
+		{Path: "/data/data.img", Format: "raw", Interface: "sata"},
+	}, detectImageFormat)
+	require.NoError(t, err)
+	// a single AHCI controller is shared by the sata disks, one port each
+	require.Equal(t, []string{
+		"-device", "ahci,id=ahci0",
+		"-blockdev", "node-name=bootbd,driver=qcow2,file.filename=/data/windows.img,file.locking=on,file.driver=file",
+		"-device", "ide-hd,drive=bootbd,bus=ahci0.0",
+		"-blockdev", "node-name=disk1,driver=raw,file.filename=/data/data.img,file.locking=on,file.driver=file",
+		"-device", "ide-hd,drive=disk1,bus=ahci0.1",
+	}, args)
+}
+
+func TestDiskArgs_Errors(t *testing.T) {
+	taskDir := t.TempDir()
+
+	cases := []struct {
+		name string
+		disk DiskConfig
+		err  string
+	}{
+		{
+			name: "unsupported interface",
+			disk: DiskConfig{Path: "disk.img", Format: "raw", Interface: "floppy"},
+			err:  `unsupported interface "floppy"`,
+		},
+		{
+			name: "missing image",
+			disk: DiskConfig{Path: "missing.img"},
+			err:  "missing.img",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := diskArgs(taskDir, []DiskConfig{c.disk}, detectImageFormat)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), c.err)
+		})
+	}
+}
+
+func TestImageFormatCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "linux.img")
+	require.NoError(t, ioutil.WriteFile(path, []byte("image"), 0644))
+
+	calls := 0
+	detect := func(string) (string, error) {
+		calls++
+		return "raw", nil
+	}
+
+	cache := newImageFormatCache()
+	for i := 0; i < 2; i++ {
+		format, err := cache.Get(path, detect)
+		require.NoError(t, err)
+		require.Equal(t, "raw", format)
+	}
+	require.Equal(t, 1, calls)
+
+	// a modified image is detected again
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(path, later, later))
+	_, err := cache.Get(path, detect)
+	require.NoError(t, err)
+	require.Equal(t, 2, calls)
+
+	_, err = cache.Get(filepath.Join(t.TempDir(), "missing.img"), detect)
+	require.Error(t, err)
+}
+
+func TestQemuImgFormat(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake binaries are shell scripts")
+	}
+
+	dir := t.TempDir()
+	image := filepath.Join(dir, "linux.img")
+	require.NoError(t, ioutil.WriteFile(image, []byte("QFI\xfb"), 0644))
+
+	writeFakeBinary(t, dir, "qemu-img", `echo '{"format": "qcow2", "virtual-size": 1024}'`)
+	format, err := qemuImgFormat(filepath.Join(dir, "qemu-img"), image)
+	require.NoError(t, err)
+	require.Equal(t, "qcow2", format)
+
+	writeFakeBinary(t, dir, "qemu-img-broken", `exit 1`)
+	_, err = qemuImgFormat(filepath.Join(dir, "qemu-img-broken"), image)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to inspect image")
+
+	// without qemu-img the image header is inspected
+	format, err = qemuImgFormat(filepath.Join(dir, "missing-qemu-img"), image)
+	require.NoError(t, err)
+	require.Equal(t, "qcow2", format)
+}
+
+func TestIsDevicePath(t *testing.T) {
+	allowed := []string{"/srv/devices", "/var/lib/vm.raw"}
+
+	require.True(t, isDevicePath(allowed, "/dev/sdb"))
+	require.True(t, isDevicePath(allowed, "/dev/vg0/lv0"))
+	require.True(t, isDevicePath(allowed, "/srv/devices/disk0"))
+	require.True(t, isDevicePath(allowed, "/var/lib/vm.raw"))
+	require.False(t, isDevicePath(allowed, "/devices/sdb"))
+	require.False(t, isDevicePath(allowed, "/srv/devices/../images/disk.img"))
+	require.False(t, isDevicePath(allowed, "disk.img"))
+}
+
+func TestCheckBlockDevice(t *testing.T) {
+	cases := []struct {
+		name    string
+		allowed []string
+		path    string
+		err     string
+	}{
+		{name: "relative", allowed: []string{"/dev"}, path: "dev/sdb", err: "must be absolute"},
+		{name: "not allowed", allowed: []string{"/dev/sdc"}, path: "/dev/sdb", err: "not in the allowed device paths"},
+		{name: "missing", allowed: []string{"/dev"}, path: "/dev/alt-qemu-missing", err: "failed to stat device"},
+		{name: "character device", allowed: []string{"/dev"}, path: "/dev/null", err: "is not a block device"},
+		{name: "regular file", allowed: []string{"/"}, path: os.Args[0], err: "is not a block device"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := checkBlockDevice(c.allowed, c.path)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), c.err)
+		})
+	}
+}
+
+func TestDiskArgs_HostDevice(t *testing.T) {
+	args, err := diskArgs(t.TempDir(), []DiskConfig{
+		{Path: "/dev/sdb", hostDevice: true},
+	}, func(string) (string, error) {
+		return "", fmt.Errorf("host devices are not probed")
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"-blockdev", "node-name=bootbd,driver=raw,file.filename=/dev/sdb,file.locking=on,file.driver=host_device",
+		"-device", "virtio-blk,drive=bootbd",
+	}, args)
+}
+
+func TestTaskConfig_Boot(t *testing.T) {
+	config := `
+config {
+  image_path = "linux.img"
+  boot {
+    order = "dc"
+    menu = true
+    splash_time = 3000
+  }
+}`
+
+	var tc *TaskConfig
+	hclutils.NewConfigParser(taskConfigSpec).ParseHCL(t, config, &tc)
+
+	require.Equal(t, BootConfig{Order: "dc", Menu: true, SplashTime: 3000}, tc.Boot)
+}
+
+func TestBootArg(t *testing.T) {
+	cases := []struct {
+		name   string
+		config BootConfig
+		arg    string
+		err    string
+	}{
+		{name: "unset", config: BootConfig{}, arg: ""},
+		{name: "order", config: BootConfig{Order: "cdn"}, arg: "order=cdn"},
+		{name: "all", config: BootConfig{Order: "d", Menu: true, SplashTime: 500}, arg: "order=d,menu=on,splash-time=500"},
+		{name: "invalid order", config: BootConfig{Order: "c,once=d"}, err: `invalid boot order "c,once=d"`},
+		{name: "negative splash time", config: BootConfig{SplashTime: -1}, err: "must not be negative"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			arg, err := bootArg(&c.config)
+			if c.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.arg, arg)
+		})
+	}
+}
+
+func TestTaskConfig_Kernel(t *testing.T) {
+	config := `
+config {
+  image_path    = "rootfs.img"
+  kernel        = "local/vmlinuz"
+  initrd        = "local/initrd.img"
+  kernel_append = "console=ttyS0 root=/dev/vda"
+}`
+
+	var tc *TaskConfig
+	hclutils.NewConfigParser(taskConfigSpec).ParseHCL(t, config, &tc)
+
+	require.Equal(t, "local/vmlinuz", tc.Kernel)
+	require.Equal(t, "local/initrd.img", tc.Initrd)
+	require.Equal(t, "console=ttyS0 root=/dev/vda", tc.KernelAppend)
+}
+
+func TestKernelArgs(t *testing.T) {
+	cases := []struct {
+		name    string
+		kernel  string
+		initrd  string
+		cmdline string
+		args    []string
+		err     string
+	}{
+		{name: "no kernel"},
+		{
+			name:   "kernel",
+			kernel: "/alloc/vmlinuz",
+			args:   []string{"-kernel", "/alloc/vmlinuz"},
+		},
+		{
+			name:    "kernel with initrd and cmdline",
+			kernel:  "/alloc/vmlinuz",
+			initrd:  "/alloc/initrd.img",
+			cmdline: "console=ttyS0 root=/dev/vda",
+			args:    []string{"-kernel", "/alloc/vmlinuz", "-initrd", "/alloc/initrd.img", "-append", "console=ttyS0 root=/dev/vda"},
+		},
+		{name: "initrd without kernel", initrd: "/alloc/initrd.img", err: "initrd and kernel_append require kernel to be set"},
+		{name: "cmdline without kernel", cmdline: "console=ttyS0", err: "initrd and kernel_append require kernel to be set"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			args, err := kernelArgs(c.kernel, c.initrd, c.cmdline)
+			if c.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.args, args)
+		})
+	}
+}
+
+func TestCreateOverlay(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake binaries are shell scripts")
+	}
+
+	// the fake qemu-img records its arguments and creates the overlay,
+	// which is its last argument
+	binDir, taskDir := t.TempDir(), t.TempDir()
+	logPath := filepath.Join(binDir, "args.log")
+	writeFakeBinary(t, binDir, "qemu-img", `echo "$@" > `+logPath+`
+for last; do :; done
+echo overlay > "$last"`)
+	qemuImg := filepath.Join(binDir, "qemu-img")
+
+	// a previous overlay is replaced
+	overlayPath := filepath.Join(taskDir, overlayImageName)
+	require.NoError(t, ioutil.WriteFile(overlayPath, []byte("stale"), 0644))
+
+	path, err := createOverlay(qemuImg, taskDir, "local/base.img", "raw")
+	require.NoError(t, err)
+	require.Equal(t, overlayPath, path)
+
+	data, err := ioutil.ReadFile(logPath)
+	require.NoError(t, err)
+	base := filepath.Join(taskDir, "local/base.img")
+	require.Equal(t, "create -f qcow2 -F raw -b "+base+" "+overlayPath+"\n", string(data))
+	data, err = ioutil.ReadFile(overlayPath)
+	require.NoError(t, err)
+	require.Equal(t, "overlay\n", string(data))
+}
+
+func TestCreateOverlay_Error(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake binaries are shell scripts")
+	}
+
+	binDir, taskDir := t.TempDir(), t.TempDir()
+	writeFakeBinary(t, binDir, "qemu-img", `for last; do :; done
+touch "$last"
+echo "Could not open backing file" >&2
+exit 1`)
+
+	_, err := createOverlay(filepath.Join(binDir, "qemu-img"), taskDir, "/images/base.img", "qcow2")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Could not open backing file")
+
+	// a partially created overlay is removed
+	_, err = os.Stat(filepath.Join(taskDir, overlayImageName))
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,194 @@
+package alt_qemu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	// vncBasePort is the TCP port of VNC display 0
+	vncBasePort = 5900
+
+	// vncPasswordFileName is the file in the task directory holding the VNC
+	// password, so it is not visible in the qemu command line
+	vncPasswordFileName = "vnc-password"
+
+	// vncPortLabel is the port label the VNC console is reported under in
+	// the driver network
+	vncPortLabel = "vnc"
+
+	// spicePortLabel and spiceTLSPortLabel are the port labels the SPICE
+	// console is reported under in the driver network
+	spicePortLabel    = "spice"
+	spiceTLSPortLabel = "spice_tls"
+)
+
+const (
+	// displayNone gives the VM no display, leaving serial ports unconnected
+	// unless serial says otherwise
+	displayNone = "none"
+
+	// displayNographic gives the VM no display and multiplexes the first
+	// serial port and the monitor on stdio
+	displayNographic = "nographic"
+
+	// displayVNC and displaySpice expose the VM's display on a console
+	displayVNC   = "vnc"
+	displaySpice = "spice"
+)
+
+// displayMode returns the display of the VM of tc. Without a display option
+// it is the enabled console, or nographic when there is none.
+func displayMode(tc *TaskConfig) (string, error) {
+	if tc.VNC.Enabled && tc.Spice.Enabled {
+		return "", fmt.Errorf("vnc and spice are mutually exclusive")
+	}
+
+	switch tc.Display {
+	case "":
+		switch {
+		case tc.VNC.Enabled:
+			return displayVNC, nil
+		case tc.Spice.Enabled:
+			return displaySpice, nil
+		}
+		return displayNographic, nil
+	case displayNone, displayNographic:
+		if tc.VNC.Enabled || tc.Spice.Enabled {
+			return "", fmt.Errorf("display %s conflicts with the enabled vnc or spice console", tc.Display)
+		}
+		return tc.Display, nil
+	case displayVNC:
+		if tc.Spice.Enabled {
+			return "", fmt.Errorf("display vnc conflicts with the enabled spice console")
+		}
+		return displayVNC, nil
+	case displaySpice:
+		if tc.VNC.Enabled {
+			return "", fmt.Errorf("display spice conflicts with the enabled vnc console")
+		}
+		return displaySpice, nil
+	default:
+		return "", fmt.Errorf("unknown display %q, must be none, nographic, vnc or spice", tc.Display)
+	}
+}
+
+// VNCConfig configures a VNC console for the VM
+type VNCConfig struct {
+	Enabled  bool   `codec:"enabled"`
+	Host     string `codec:"host"`    // address to listen on, defaults to 127.0.0.1
+	Display  int    `codec:"display"` // display number, the console listens on 5900 + display
+	Password string `codec:"password"`
+}
+
+// Port returns the TCP port the VNC console listens on.
+func (c *VNCConfig) Port() int {
+	return vncBasePort + c.Display
+}
+
+// ListenHost returns the address the VNC console listens on.
+func (c *VNCConfig) ListenHost() string {
+	if c.Host == "" {
+		return "127.0.0.1"
+	}
+	return c.Host
+}
+
+// Address returns the host:port address of the VNC console.
+func (c *VNCConfig) Address() string {
+	return net.JoinHostPort(c.ListenHost(), strconv.Itoa(c.Port()))
+}
+
+// vncArgs returns the arguments enabling the VNC console described by c. When
+// a password is set qemu reads it through a secret object from a file in
+// taskDir, whose path is returned along with the arguments; the file is left
+// to writeVNCPassword.
+func vncArgs(taskDir string, c *VNCConfig) ([]string, string, error) {
+	if c.Display < 0 || c.Port() > 65535 {
+		return nil, "", fmt.Errorf("vnc display %d out of range", c.Display)
+	}
+
+	host := c.ListenHost()
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, "", fmt.Errorf("invalid vnc host %q", host)
+	}
+	if ip.To4() == nil {
+		host = "[" + host + "]"
+	}
+
+	vnc := fmt.Sprintf("%s:%d", host, c.Display)
+	var args []string
+	var passwordPath string
+	if c.Password != "" {
+		passwordPath = filepath.Join(taskDir, vncPasswordFileName)
+		args = append(args, "-object", fmt.Sprintf("secret,id=vncsecret0,file=%s", passwordPath))
+		vnc += ",password-secret=vncsecret0"
+	}
+
+	return append(args, "-vnc", vnc), passwordPath, nil
+}
+
+// writeVNCPassword writes the VNC password to the file at path, readable by
+// its owner only.
+func writeVNCPassword(path, password string) error {
+	if err := ioutil.WriteFile(path, []byte(password), 0600); err != nil {
+		return fmt.Errorf("failed to write vnc password file: %v", err)
+	}
+	return nil
+}
+
+// SpiceConfig configures a SPICE console for the VM
+type SpiceConfig struct {
+	Enabled          bool   `codec:"enabled"`
+	Addr             string `codec:"addr"` // address to listen on, defaults to 127.0.0.1
+	Port             int    `codec:"port"`
+	TLSPort          int    `codec:"tls_port"`
+	DisableTicketing bool   `codec:"disable_ticketing"`
+}
+
+// ListenAddr returns the address the SPICE console listens on.
+func (c *SpiceConfig) ListenAddr() string {
+	if c.Addr == "" {
+		return "127.0.0.1"
+	}
+	return c.Addr
+}
+
+// spiceArgs returns the arguments enabling the SPICE console described by c,
+// along with the virtio-serial channel used by the SPICE guest agent.
+func spiceArgs(c *SpiceConfig) ([]string, error) {
+	if c.Port <= 0 && c.TLSPort <= 0 {
+		return nil, fmt.Errorf("spice requires port or tls_port to be set")
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		return nil, fmt.Errorf("spice port %d out of range", c.Port)
+	}
+	if c.TLSPort < 0 || c.TLSPort > 65535 {
+		return nil, fmt.Errorf("spice tls_port %d out of range", c.TLSPort)
+	}
+	if net.ParseIP(c.ListenAddr()) == nil {
+		return nil, fmt.Errorf("invalid spice addr %q", c.ListenAddr())
+	}
+
+	spice := fmt.Sprintf("addr=%s", c.ListenAddr())
+	if c.Port > 0 {
+		spice += fmt.Sprintf(",port=%d", c.Port)
+	}
+	if c.TLSPort > 0 {
+		spice += fmt.Sprintf(",tls-port=%d", c.TLSPort)
+	}
+	if c.DisableTicketing {
+		spice += ",disable-ticketing=on"
+	}
+
+	return []string{
+		"-spice", spice,
+		"-device", "virtio-serial",
+		"-chardev", "spicevmc,id=vdagent0,name=vdagent",
+		"-device", "virtserialport,chardev=vdagent0,name=com.redhat.spice.0",
+	}, nil
+}
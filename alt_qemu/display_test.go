@@ -0,0 +1,223 @@
+package alt_qemu
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskConfig_VNC(t *testing.T) {
+	config := `
+config {
+  image_path = "linux.img"
+  vnc {
+    enabled = true
+    host = "0.0.0.0"
+    display = 2
+  }
+}`
+
+	var tc *TaskConfig
+	hclutils.NewConfigParser(taskConfigSpec).ParseHCL(t, config, &tc)
+
+	require.Equal(t, VNCConfig{Enabled: true, Host: "0.0.0.0", Display: 2}, tc.VNC)
+	require.Equal(t, 5902, tc.VNC.Port())
+	require.Equal(t, "0.0.0.0:5902", tc.VNC.Address())
+}
+
+func TestVncArgs(t *testing.T) {
+	cases := []struct {
+		name   string
+		config VNCConfig
+		args   []string
+		err    string
+	}{
+		{
+			name:   "defaults",
+			config: VNCConfig{Enabled: true},
+			args:   []string{"-vnc", "127.0.0.1:0"},
+		},
+		{
+			name:   "ipv6 host",
+			config: VNCConfig{Enabled: true, Host: "::1", Display: 3},
+			args:   []string{"-vnc", "[::1]:3"},
+		},
+		{
+			name:   "negative display",
+			config: VNCConfig{Enabled: true, Display: -1},
+			err:    "out of range",
+		},
+		{
+			name:   "display beyond port range",
+			config: VNCConfig{Enabled: true, Display: 65535},
+			err:    "out of range",
+		},
+		{
+			name:   "invalid host",
+			config: VNCConfig{Enabled: true, Host: "localhost"},
+			err:    `invalid vnc host "localhost"`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			args, passwordPath, err := vncArgs(t.TempDir(), &c.config)
+			if c.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.args, args)
+			require.Empty(t, passwordPath)
+		})
+	}
+}
+
+func TestVncArgs_Password(t *testing.T) {
+	taskDir := t.TempDir()
+	args, passwordPath, err := vncArgs(taskDir, &VNCConfig{Enabled: true, Password: "secret"})
+	require.NoError(t, err)
+
+	require.Equal(t, filepath.Join(taskDir, vncPasswordFileName), passwordPath)
+	require.Equal(t, []string{
+		"-object", "secret,id=vncsecret0,file=" + passwordPath,
+		"-vnc", "127.0.0.1:0,password-secret=vncsecret0",
+	}, args)
+
+	// the password is only written when the task starts
+	_, err = os.Stat(passwordPath)
+	require.True(t, os.IsNotExist(err))
+
+	require.NoError(t, writeVNCPassword(passwordPath, "secret"))
+	info, err := os.Stat(passwordPath)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	password, err := ioutil.ReadFile(passwordPath)
+	require.NoError(t, err)
+	require.Equal(t, "secret", string(password))
+}
+
+func TestSpiceArgs(t *testing.T) {
+	agentArgs := []string{
+		"-device", "virtio-serial",
+		"-chardev", "spicevmc,id=vdagent0,name=vdagent",
+		"-device", "virtserialport,chardev=vdagent0,name=com.redhat.spice.0",
+	}
+
+	cases := []struct {
+		name   string
+		config SpiceConfig
+		spice  string
+		err    string
+	}{
+		{
+			name:   "port",
+			config: SpiceConfig{Enabled: true, Port: 5930},
+			spice:  "addr=127.0.0.1,port=5930",
+		},
+		{
+			name:   "tls port without ticketing",
+			config: SpiceConfig{Enabled: true, Addr: "0.0.0.0", TLSPort: 5931, DisableTicketing: true},
+			spice:  "addr=0.0.0.0,tls-port=5931,disable-ticketing=on",
+		},
+		{
+			name:   "both ports",
+			config: SpiceConfig{Enabled: true, Port: 5930, TLSPort: 5931},
+			spice:  "addr=127.0.0.1,port=5930,tls-port=5931",
+		},
+		{
+			name:   "no port",
+			config: SpiceConfig{Enabled: true},
+			err:    "requires port or tls_port",
+		},
+		{
+			name:   "port out of range",
+			config: SpiceConfig{Enabled: true, Port: 70000},
+			err:    "spice port 70000 out of range",
+		},
+		{
+			name:   "tls port out of range",
+			config: SpiceConfig{Enabled: true, Port: 5930, TLSPort: -1},
+			err:    "spice tls_port -1 out of range",
+		},
+		{
+			name:   "invalid addr",
+			config: SpiceConfig{Enabled: true, Addr: "example.com", Port: 5930},
+			err:    `invalid spice addr "example.com"`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			args, err := spiceArgs(&c.config)
+			if c.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, append([]string{"-spice", c.spice}, agentArgs...), args)
+		})
+	}
+}
+
+func TestDisplayMode(t *testing.T) {
+	vnc := VNCConfig{Enabled: true, Display: 1}
+	spice := SpiceConfig{Enabled: true, Port: 5930}
+
+	cases := []struct {
+		name    string
+		tc      TaskConfig
+		display string
+		err     string
+	}{
+		{name: "default", display: displayNographic},
+		{name: "vnc enabled", tc: TaskConfig{VNC: vnc}, display: displayVNC},
+		{name: "spice enabled", tc: TaskConfig{Spice: spice}, display: displaySpice},
+		{name: "none", tc: TaskConfig{Display: "none"}, display: displayNone},
+		{name: "nographic", tc: TaskConfig{Display: "nographic"}, display: displayNographic},
+		{name: "vnc", tc: TaskConfig{Display: "vnc", VNC: vnc}, display: displayVNC},
+		{name: "spice", tc: TaskConfig{Display: "spice", Spice: spice}, display: displaySpice},
+		{
+			name: "vnc and spice enabled",
+			tc:   TaskConfig{VNC: vnc, Spice: spice},
+			err:  "vnc and spice are mutually exclusive",
+		},
+		{
+			name: "none with a console",
+			tc:   TaskConfig{Display: "none", VNC: vnc},
+			err:  "display none conflicts with the enabled vnc or spice console",
+		},
+		{
+			name: "vnc with spice",
+			tc:   TaskConfig{Display: "vnc", Spice: spice},
+			err:  "display vnc conflicts with the enabled spice console",
+		},
+		{
+			name: "spice with vnc",
+			tc:   TaskConfig{Display: "spice", VNC: vnc},
+			err:  "display spice conflicts with the enabled vnc console",
+		},
+		{
+			name: "unknown",
+			tc:   TaskConfig{Display: "sdl"},
+			err:  `unknown display "sdl"`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			display, err := displayMode(&c.tc)
+			if c.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.display, display)
+		})
+	}
+}
@@ -1,21 +1,24 @@
 package alt_qemu
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"github.com/hashicorp/nomad/client/taskenv"
 	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
-	"text/template"
 
 	"github.com/hashicorp/consul-template/signals"
 	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-plugin"
 	"github.com/hashicorp/nomad/drivers/shared/eventer"
 	"github.com/hashicorp/nomad/drivers/shared/executor"
 	"github.com/hashicorp/nomad/plugins/base"
@@ -44,13 +47,35 @@ const (
 	// used by the plugin
 	taskHandleVersion = 1
 
-	qemuGracefulShutdownMsg = "system_powerdown\n"
-	qemuMonitorSocketName = "qemu-monitor.sock"
+	qemuGracefulShutdownMsg     = "system_powerdown\n"
+	qemuMonitorSocketName       = "qemu-monitor.sock"
 	qemuLegacyMaxMonitorPathLen = 108
 
+	// reattachAttempts is the number of times RecoverTask tries to reattach
+	// to the executor of a task whose VM is still running, waiting
+	// reattachBackoff before the second attempt and doubling it after each
+	// failed attempt
+	reattachAttempts = 5
+	reattachBackoff  = 250 * time.Millisecond
+
+	// defaultExecutorLogLevel is the log level of the executors when the
+	// plugin config sets none
+	defaultExecutorLogLevel = "info"
+
 	// The key populated in Node Attributes to indicate presence of the Qemu driver
 	driverAttr        = "driver.qemu"
 	driverVersionAttr = "driver.qemu.version"
+
+	// driverVersionFullAttr reports the qemu version along with its build
+	// suffix, e.g. "8.2.0 (Debian 1:8.2.0+dfsg-1)"
+	driverVersionFullAttr = "driver.qemu.version.full"
+
+	// driverKVMAttr reports whether the KVM device is usable by the plugin
+	driverKVMAttr = "driver.qemu.kvm"
+
+	// driverAcceleratorsAttr holds the comma separated list of accelerators
+	// usable on the node
+	driverAcceleratorsAttr = "driver.qemu.accelerators"
 )
 
 var (
@@ -80,7 +105,26 @@ var (
 		//       shell = "fish"
 		//     }
 		//   }
-		"image_paths": hclspec.NewAttr("image_paths", "list(string)", false),
+		"image_paths":           hclspec.NewAttr("image_paths", "list(string)", false),
+		"cdrom_paths":           hclspec.NewAttr("cdrom_paths", "list(string)", false),
+		"allowed_device_paths":  hclspec.NewAttr("allowed_device_paths", "list(string)", false),
+		"allowed_usb_devices":   hclspec.NewAttr("allowed_usb_devices", "list(string)", false),
+		"allowed_pci_devices":   hclspec.NewAttr("allowed_pci_devices", "list(string)", false),
+		"default_accelerator":   hclspec.NewAttr("default_accelerator", "string", false),
+		"allowed_machine_types": hclspec.NewAttr("allowed_machine_types", "list(string)", false),
+		"default_memory_mb":     hclspec.NewAttr("default_memory_mb", "number", false),
+		"max_memory_mb":         hclspec.NewAttr("max_memory_mb", "number", false),
+		"qemu_system_bin":       hclspec.NewAttr("qemu_system_bin", "string", false),
+		"qemu_img_bin":          hclspec.NewAttr("qemu_img_bin", "string", false),
+		"health_probe":          hclspec.NewAttr("health_probe", "bool", false),
+		"allow_image_download":  hclspec.NewAttr("allow_image_download", "bool", false),
+		"executor_log_level":    hclspec.NewAttr("executor_log_level", "string", false),
+		"cpu_shares_per_vcpu":   hclspec.NewAttr("cpu_shares_per_vcpu", "number", false),
+		"enable_guest_agent":    hclspec.NewAttr("enable_guest_agent", "bool", false),
+		"allow_extra_args": hclspec.NewDefault(
+			hclspec.NewAttr("allow_extra_args", "bool", false),
+			hclspec.NewLiteral("true"),
+		),
 		// TODO: what other elements are needed at the agent config level?
 	})
 
@@ -107,15 +151,127 @@ var (
 		//       }
 		//     }
 		//   }
-		"image_path":        hclspec.NewAttr("image_path", "string", true),
-		"accelerator":       hclspec.NewAttr("accelerator", "string", false),
-		"graceful_shutdown": hclspec.NewAttr("graceful_shutdown", "bool", false),
-		"args":              hclspec.NewAttr("args", "list(string)", false),
-		"port_map":          hclspec.NewAttr("port_map", "list(map(number))", false),
-		"qemu_system_bin":   hclspec.NewAttr("qemu_system_bin", "string", false),
-		"qemu_img_bin":      hclspec.NewAttr("qemu_img_bin", "string", false),
-		"vm_name": hclspec.NewAttr("vm_name", "string", false),
-		"machine_type": hclspec.NewAttr("machine_type", "string", false),
+		"image_path":            hclspec.NewAttr("image_path", "string", true),
+		"image_checksum":        hclspec.NewAttr("image_checksum", "string", false),
+		"overlay":               hclspec.NewAttr("overlay", "bool", false),
+		"kernel":                hclspec.NewAttr("kernel", "string", false),
+		"initrd":                hclspec.NewAttr("initrd", "string", false),
+		"kernel_append":         hclspec.NewAttr("kernel_append", "string", false),
+		"disable_image_locking": hclspec.NewAttr("disable_image_locking", "bool", false),
+		"boot_disk_interface":   hclspec.NewAttr("boot_disk_interface", "string", false),
+		"accelerator":           hclspec.NewAttr("accelerator", "string", false),
+		"graceful_shutdown":     hclspec.NewAttr("graceful_shutdown", "bool", false),
+		"reboot_action":         hclspec.NewAttr("reboot_action", "string", false),
+		"watchdog":              hclspec.NewAttr("watchdog", "string", false),
+		"panic_action":          hclspec.NewAttr("panic_action", "string", false),
+		"monitor_protocol":      hclspec.NewAttr("monitor_protocol", "string", false),
+		"boot_timeout":          hclspec.NewAttr("boot_timeout", "string", false),
+		"dry_run":               hclspec.NewAttr("dry_run", "bool", false),
+		"incoming":              hclspec.NewAttr("incoming", "string", false),
+		"args":                  hclspec.NewAttr("args", "list(string)", false),
+		"extra_devices":         hclspec.NewAttr("extra_devices", "list(string)", false),
+		"extra_args":            hclspec.NewAttr("extra_args", "list(string)", false),
+		"port_map":              hclspec.NewAttr("port_map", "list(map(number))", false),
+		"port_protocols":        hclspec.NewAttr("port_protocols", "list(map(string))", false),
+		"qemu_system_bin":       hclspec.NewAttr("qemu_system_bin", "string", false),
+		"qemu_img_bin":          hclspec.NewAttr("qemu_img_bin", "string", false),
+		"vm_name":               hclspec.NewAttr("vm_name", "string", false),
+		"machine_type":          hclspec.NewAttr("machine_type", "string", false),
+		"machine_properties":    hclspec.NewAttr("machine_properties", "list(map(string))", false),
+		"cpu_type":              hclspec.NewAttr("cpu_type", "string", false),
+		"memory_backend":        hclspec.NewAttr("memory_backend", "string", false),
+		"hugepages_path":        hclspec.NewAttr("hugepages_path", "string", false),
+		"smp": hclspec.NewBlock("smp", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"sockets": hclspec.NewAttr("sockets", "number", false),
+			"cores":   hclspec.NewAttr("cores", "number", false),
+			"threads": hclspec.NewAttr("threads", "number", false),
+		})),
+		"numa": hclspec.NewBlockList("numa", hclspec.NewObject(map[string]*hclspec.Spec{
+			"cpus":      hclspec.NewAttr("cpus", "string", true),
+			"memory_mb": hclspec.NewAttr("memory_mb", "number", true),
+		})),
+		"cdrom":  hclspec.NewAttr("cdrom", "string", false),
+		"serial": hclspec.NewAttr("serial", "list(string)", false),
+		"boot": hclspec.NewBlock("boot", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"order":       hclspec.NewAttr("order", "string", false),
+			"menu":        hclspec.NewAttr("menu", "bool", false),
+			"splash_time": hclspec.NewAttr("splash_time", "number", false),
+		})),
+		"cloud_init": hclspec.NewBlock("cloud_init", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"user_data": hclspec.NewAttr("user_data", "string", false),
+			"meta_data": hclspec.NewAttr("meta_data", "string", false),
+		})),
+		"rtc": hclspec.NewBlock("rtc", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"base":  hclspec.NewAttr("base", "string", false),
+			"clock": hclspec.NewAttr("clock", "string", false),
+		})),
+		"tpm": hclspec.NewBlock("tpm", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"enabled": hclspec.NewAttr("enabled", "bool", false),
+		})),
+		"firmware": hclspec.NewBlock("firmware", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"code": hclspec.NewAttr("code", "string", true),
+			"vars": hclspec.NewAttr("vars", "string", false),
+		})),
+		"network_mode":       hclspec.NewAttr("network_mode", "string", false),
+		"bridge_name":        hclspec.NewAttr("bridge_name", "string", false),
+		"hostfwd_family":     hclspec.NewAttr("hostfwd_family", "string", false),
+		"mac_address":        hclspec.NewAttr("mac_address", "string", false),
+		"enable_guest_agent": hclspec.NewAttr("enable_guest_agent", "bool", false),
+		"enable_balloon":     hclspec.NewAttr("enable_balloon", "bool", false),
+		"enable_rng":         hclspec.NewAttr("enable_rng", "bool", false),
+		"rng_source":         hclspec.NewAttr("rng_source", "string", false),
+		"process_priority":   hclspec.NewAttr("process_priority", "number", false),
+		"cpuset":             hclspec.NewAttr("cpuset", "string", false),
+		"run_as_user":        hclspec.NewAttr("run_as_user", "string", false),
+		"sandbox":            hclspec.NewAttr("sandbox", "string", false),
+		"display":            hclspec.NewAttr("display", "string", false),
+		"vnc": hclspec.NewBlock("vnc", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"enabled":  hclspec.NewAttr("enabled", "bool", false),
+			"host":     hclspec.NewAttr("host", "string", false),
+			"display":  hclspec.NewAttr("display", "number", false),
+			"password": hclspec.NewAttr("password", "string", false),
+		})),
+		"spice": hclspec.NewBlock("spice", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"enabled":           hclspec.NewAttr("enabled", "bool", false),
+			"addr":              hclspec.NewAttr("addr", "string", false),
+			"port":              hclspec.NewAttr("port", "number", false),
+			"tls_port":          hclspec.NewAttr("tls_port", "number", false),
+			"disable_ticketing": hclspec.NewAttr("disable_ticketing", "bool", false),
+		})),
+		"disk": hclspec.NewBlockList("disk", hclspec.NewObject(map[string]*hclspec.Spec{
+			"path":      hclspec.NewAttr("path", "string", true),
+			"format":    hclspec.NewAttr("format", "string", false),
+			"interface": hclspec.NewAttr("interface", "string", false),
+			"readonly":  hclspec.NewAttr("readonly", "bool", false),
+			"share_rw":  hclspec.NewAttr("share_rw", "bool", false),
+			"cache":     hclspec.NewAttr("cache", "string", false),
+			"aio":       hclspec.NewAttr("aio", "string", false),
+			"iops":      hclspec.NewAttr("iops", "number", false),
+			"iops_rd":   hclspec.NewAttr("iops_rd", "number", false),
+			"iops_wr":   hclspec.NewAttr("iops_wr", "number", false),
+			"bps":       hclspec.NewAttr("bps", "number", false),
+			"bps_rd":    hclspec.NewAttr("bps_rd", "number", false),
+			"bps_wr":    hclspec.NewAttr("bps_wr", "number", false),
+		})),
+		"share": hclspec.NewBlockList("share", hclspec.NewObject(map[string]*hclspec.Spec{
+			"path":      hclspec.NewAttr("path", "string", true),
+			"mount_tag": hclspec.NewAttr("mount_tag", "string", true),
+			"readonly":  hclspec.NewAttr("readonly", "bool", false),
+			"driver":    hclspec.NewAttr("driver", "string", false),
+		})),
+		"pci_passthrough": hclspec.NewAttr("pci_passthrough", "list(string)", false),
+		"gpu_passthrough": hclspec.NewBlockList("gpu_passthrough", hclspec.NewObject(map[string]*hclspec.Spec{
+			"address":       hclspec.NewAttr("address", "string", true),
+			"audio_address": hclspec.NewAttr("audio_address", "string", false),
+			"romfile":       hclspec.NewAttr("romfile", "string", false),
+			"vga":           hclspec.NewAttr("vga", "bool", false),
+		})),
+		"usb_passthrough": hclspec.NewBlockList("usb_passthrough", hclspec.NewObject(map[string]*hclspec.Spec{
+			"vendor_id":  hclspec.NewAttr("vendor_id", "string", false),
+			"product_id": hclspec.NewAttr("product_id", "string", false),
+			"hostbus":    hclspec.NewAttr("hostbus", "number", false),
+			"hostaddr":   hclspec.NewAttr("hostaddr", "number", false),
+		})),
 	})
 
 	// capabilities indicates what optional features this driver supports
@@ -126,14 +282,63 @@ var (
 		// The plugin's capabilities signal Nomad which extra functionalities
 		// are supported. For a list of available options check the docs page:
 		// https://godoc.org/github.com/hashicorp/nomad/plugins/drivers#Capabilities
-		SendSignals:         false,
-		Exec:                false,
-		FSIsolation:         drivers.FSIsolationImage,
-		NetIsolationModes:   nil,
+		SendSignals: true,
+		// Exec is set by Capabilities when every VM has a guest agent
+		// channel, enabled by the plugin's enable_guest_agent
+		Exec:        false,
+		FSIsolation: drivers.FSIsolationImage,
+		// qemu runs without network isolation of its own and joins the
+		// allocation's network namespace when Nomad manages group networking
+		NetIsolationModes: []drivers.NetIsolationMode{
+			drivers.NetIsolationModeNone,
+			drivers.NetIsolationModeGroup,
+		},
+		// Nomad creates the network namespace, the driver only attaches
+		// the VM to it
 		MustInitiateNetwork: false,
 	}
 
-	versionRegex = regexp.MustCompile(`version (\d[\.\d+]+)`)
+	// signalMonitorCommands maps the signals sent to a task to the monitor
+	// command run in their place. SIGTERM powers the guest down and SIGHUP
+	// resets it. SIGSTOP and SIGTSTP pause the VM, freeing its CPUs while
+	// keeping its state, until SIGCONT resumes it.
+	signalMonitorCommands = map[string]string{
+		"SIGTERM": "system_powerdown",
+		"SIGHUP":  "system_reset",
+		"SIGSTOP": "stop",
+		"SIGTSTP": "stop",
+		"SIGCONT": "cont",
+	}
+
+	// kvmDevicePath is the device node used by qemu for KVM acceleration
+	kvmDevicePath = "/dev/kvm"
+
+	// knownAccelerators are the accelerators qemu may be asked to use
+	knownAccelerators = map[string]bool{
+		"kvm":  true,
+		"tcg":  true,
+		"hvf":  true,
+		"whpx": true,
+		"xen":  true,
+		"hax":  true,
+		"nvmm": true,
+	}
+
+	// versionRegex matches the version banner of qemu binaries, such as
+	// "QEMU emulator version 8.2.0 (Debian 1:8.2.0+dfsg-1)" or
+	// "qemu-img version 2.11.1(Debian 1:2.11+dfsg-1ubuntu7.41)", capturing
+	// the version number and the optional build suffix
+	versionRegex = regexp.MustCompile(`(?i)version\s+(\d+(?:\.\d+)*)[ \t]*(\([^)\n]*\))?`)
+
+	// cpuTypeRegex matches the qemu CPU model names accepted for cpu_type,
+	// e.g. "host", "qemu64" or "Skylake-Server-v4"
+	cpuTypeRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+	// safeNameRegex matches values that can be embedded in qemu options
+	// without being able to inject further options, e.g. vm_name and
+	// machine_type. unsafeNameCharsRegex matches the characters it rejects.
+	safeNameRegex        = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+	unsafeNameCharsRegex = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
 )
 
 // Config contains configuration information for the plugin
@@ -144,6 +349,66 @@ type Config struct {
 	// configSpec variable above. It's used to convert the HCL configuration
 	// passed by the Nomad agent into Go contructs.
 	ImagePaths []string `codec:"image_paths"`
+
+	// CdromPaths are additional directories ISO images may be attached from
+	CdromPaths []string `codec:"cdrom_paths"`
+
+	// AllowedDevicePaths are the host block devices, or directories of
+	// them, that may be passed through to VMs as disks
+	AllowedDevicePaths []string `codec:"allowed_device_paths"`
+
+	// AllowedUSBDevices are the host USB devices, as "vendor:product" hex
+	// ids, that may be passed through to VMs
+	AllowedUSBDevices []string `codec:"allowed_usb_devices"`
+
+	// AllowedPCIDevices are the addresses of the host PCI devices, bound to
+	// vfio-pci, that may be passed through to VMs
+	AllowedPCIDevices []string `codec:"allowed_pci_devices"`
+
+	// DefaultAccelerator is the accelerator chain used by tasks that do
+	// not set one, instead of tcg
+	DefaultAccelerator string `codec:"default_accelerator"`
+
+	// AllowedMachineTypes restricts the machine_type tasks may use. An
+	// empty list allows all machine types.
+	AllowedMachineTypes []string `codec:"allowed_machine_types"`
+
+	// DefaultMemoryMb is the memory of VMs whose task does not set any
+	DefaultMemoryMb int64 `codec:"default_memory_mb"`
+
+	// MaxMemoryMb is the most memory a VM may be assigned, when set
+	MaxMemoryMb int64 `codec:"max_memory_mb"`
+
+	// QemuSystemBin and QemuImgBin are the qemu binaries fingerprinted and
+	// used by tasks that do not set their own
+	QemuSystemBin string `codec:"qemu_system_bin"`
+	QemuImgBin    string `codec:"qemu_img_bin"`
+
+	// HealthProbe makes fingerprinting launch qemu to check it can run VMs
+	// rather than only checking its version
+	HealthProbe bool `codec:"health_probe"`
+
+	// AllowImageDownload lets tasks set image_path to an http or https URL
+	// the image is downloaded from
+	AllowImageDownload bool `codec:"allow_image_download"`
+
+	// ExecutorLogLevel is the log level of the executors running qemu,
+	// defaulting to info
+	ExecutorLogLevel string `codec:"executor_log_level"`
+
+	// CPUSharesPerVCPU is the number of CPU shares backing each vCPU of a
+	// VM, 1000 by default. The vCPU count is rounded down, at least one and
+	// clamped to the host CPUs and the task cpuset.
+	CPUSharesPerVCPU int64 `codec:"cpu_shares_per_vcpu"`
+
+	// EnableGuestAgent attaches the guest agent channel to every VM, as if
+	// its task set enable_guest_agent, and advertises the exec capability
+	// running commands inside the guest
+	EnableGuestAgent bool `codec:"enable_guest_agent"`
+
+	// AllowExtraArgs lets tasks pass arguments to qemu verbatim with args,
+	// extra_args and extra_devices. It is enabled unless set to false.
+	AllowExtraArgs bool `codec:"allow_extra_args"`
 }
 
 // TaskConfig contains configuration information for a task that runs with
@@ -154,15 +419,65 @@ type TaskConfig struct {
 	// This struct is the decoded version of the schema defined in the
 	// taskConfigSpec variable above. It's used to convert the string
 	// configuration for the task into Go contructs.
-	ImagePath        string             `codec:"image_path"`
-	Accelerator      string             `codec:"accelerator"`
-	Args             []string           `codec:"args"`     // extra arguments to qemu executable
-	PortMap          hclutils.MapStrInt `codec:"port_map"` // A map of host port and the port name defined in the image manifest file
-	GracefulShutdown bool               `codec:"graceful_shutdown"`
-	QemuSystemBin    string             `codec:"qemu_system_bin"`
-	QemuImgBin       string             `codec:"qemu_img_bin"`
-	VmName string `codec:"vm_name"`
-	MachineType string `codec:"machine_type"`
+	ImagePath           string             `codec:"image_path"`
+	ImageChecksum       string             `codec:"image_checksum"`        // e.g. "sha256:<hex digest>", verified before boot
+	Overlay             bool               `codec:"overlay"`               // boot from a copy-on-write overlay, leaving image_path unmodified
+	DisableImageLocking bool               `codec:"disable_image_locking"` // allow other VMs to open the image_path disk
+	BootDiskInterface   string             `codec:"boot_disk_interface"`   // interface of the image_path disk, defaults to virtio-blk
+	Accelerator         string             `codec:"accelerator"`
+	Args                []string           `codec:"args"`           // extra arguments to qemu executable
+	ExtraDevices        []string           `codec:"extra_devices"`  // -device values for devices the driver does not model
+	ExtraArgs           []string           `codec:"extra_args"`     // arguments appended after the generated ones
+	PortMap             hclutils.MapStrInt `codec:"port_map"`       // A map of host port and the port name defined in the image manifest file
+	PortProtocols       hclutils.MapStrStr `codec:"port_protocols"` // tcp, udp or both by port_map label, defaults to tcp
+	GracefulShutdown    bool               `codec:"graceful_shutdown"`
+	RebootAction        string             `codec:"reboot_action"`    // reset or shutdown, defaults to reset
+	Watchdog            string             `codec:"watchdog"`         // action taken when the guest watchdog expires: reset, poweroff or pause
+	PanicAction         string             `codec:"panic_action"`     // action taken when the guest panics: pause, shutdown or none
+	MonitorProtocol     string             `codec:"monitor_protocol"` // qmp or hmp, defaults to qmp
+	BootTimeout         string             `codec:"boot_timeout"`     // time the VM has to reach the running state, e.g. "30s"
+	DryRun              bool               `codec:"dry_run"`          // fail the task with the qemu command line instead of starting it
+	Incoming            string             `codec:"incoming"`         // port label a migrated VM is received on
+	QemuSystemBin       string             `codec:"qemu_system_bin"`
+	QemuImgBin          string             `codec:"qemu_img_bin"`
+	VmName              string             `codec:"vm_name"`
+	MachineType         string             `codec:"machine_type"`
+	MachineProperties   hclutils.MapStrStr `codec:"machine_properties"` // extra -machine properties such as kernel_irqchip
+	RTC                 RTCConfig          `codec:"rtc"`
+	CpuType             string             `codec:"cpu_type"`
+	SMP                 SMPConfig          `codec:"smp"`
+	NUMA                []NUMANodeConfig   `codec:"numa"`
+	MemoryBackend       string             `codec:"memory_backend"` // "file" backs guest memory with hugepages
+	HugepagesPath       string             `codec:"hugepages_path"`
+	Disks               []DiskConfig       `codec:"disk"`
+	Shares              []ShareConfig      `codec:"share"` // host directories shared with the guest
+	USBPassthrough      []USBConfig        `codec:"usb_passthrough"`
+	PCIPassthrough      []string           `codec:"pci_passthrough"` // addresses of host PCI devices, e.g. "0000:65:00.0"
+	GPUPassthrough      []GPUConfig        `codec:"gpu_passthrough"`
+	Cdrom               string             `codec:"cdrom"`  // ISO image attached as a read-only CDROM
+	Serial              []string           `codec:"serial"` // guest serial ports: stdio, file:<path>, socket or none
+	Boot                BootConfig         `codec:"boot"`
+	Kernel              string             `codec:"kernel"` // kernel booted directly, bypassing the bootloader
+	Initrd              string             `codec:"initrd"`
+	KernelAppend        string             `codec:"kernel_append"` // kernel command line
+	CloudInit           CloudInitConfig    `codec:"cloud_init"`
+	Firmware            FirmwareConfig     `codec:"firmware"`
+	TPM                 TPMConfig          `codec:"tpm"`
+	NetworkMode         string             `codec:"network_mode"`   // one of user, bridge, tap, cni or none
+	BridgeName          string             `codec:"bridge_name"`    // host bridge used by the bridge network mode
+	HostfwdFamily       string             `codec:"hostfwd_family"` // ipv4, ipv6 or dual, defaults to the family of the allocated address
+	MacAddress          string             `codec:"mac_address"`
+	EnableGuestAgent    bool               `codec:"enable_guest_agent"`
+	EnableBalloon       bool               `codec:"enable_balloon"`
+	EnableRNG           bool               `codec:"enable_rng"`
+	RNGSource           string             `codec:"rng_source"`       // host entropy source, defaults to /dev/urandom
+	ProcessPriority     int                `codec:"process_priority"` // nice value of the qemu process
+	Cpuset              string             `codec:"cpuset"`           // host CPUs the qemu process is pinned to, e.g. "0-3,6"
+	RunAsUser           string             `codec:"run_as_user"`      // host user qemu drops its privileges to after setup
+	Sandbox             string             `codec:"sandbox"`          // seccomp sandbox spec, defaults to "on"
+	Display             string             `codec:"display"`          // none, nographic, vnc or spice, defaults to the enabled console or nographic
+	VNC                 VNCConfig          `codec:"vnc"`
+	Spice               SpiceConfig        `codec:"spice"`
 }
 
 // TaskState is the runtime state which is encoded in the handle returned to
@@ -170,10 +485,23 @@ type TaskConfig struct {
 // This information is needed to rebuild the task state and handler during
 // recovery.
 type TaskState struct {
-	ReattachConfig *pstructs.ReattachConfig
-	TaskConfig     *drivers.TaskConfig
-	StartedAt      time.Time
-	Pid int
+	ReattachConfig  *pstructs.ReattachConfig
+	TaskConfig      *drivers.TaskConfig
+	StartedAt       time.Time
+	Pid             int
+	PidPath         string
+	MonitorPath     string
+	AgentPath       string
+	SeedPath        string
+	TPMPidPath      string
+	VirtiofsdPids   []int
+	OverlayPath     string
+	VarsPath        string
+	VNCPasswordPath string
+	NetnsPath       string
+	SerialPaths     []string
+	OOMKillCount    int64
+	Snapshots       bool
 
 	// TODO: add any extra important values that must be persisted in order
 	// to restore a task.
@@ -201,6 +529,13 @@ type AltQemuDriverPlugin struct {
 	// tasks is the in memory datastore mapping taskIDs to driver handles
 	tasks *taskStore
 
+	// hostMemoryMb is the memory of the host, read when the plugin is
+	// configured
+	hostMemoryMb int64
+
+	// imageFormats caches the formats detected for disk images
+	imageFormats *imageFormatCache
+
 	// ctx is the context for the driver. It is passed to other subsystems to
 	// coordinate shutdown
 	ctx context.Context
@@ -220,8 +555,9 @@ func NewAltQemuDriver(logger hclog.Logger) drivers.DriverPlugin {
 
 	return &AltQemuDriverPlugin{
 		eventer:        eventer.NewEventer(ctx, logger),
-		config:         &Config{},
+		config:         &Config{ExecutorLogLevel: defaultExecutorLogLevel, AllowExtraArgs: true},
 		tasks:          newTaskStore(),
+		imageFormats:   newImageFormatCache(),
 		ctx:            ctx,
 		signalShutdown: cancel,
 		logger:         logger,
@@ -240,13 +576,34 @@ func (d *AltQemuDriverPlugin) ConfigSchema() (*hclspec.Spec, error) {
 
 // SetConfig is called by the client to pass the configuration for the plugin.
 func (d *AltQemuDriverPlugin) SetConfig(cfg *base.Config) error {
-	var config Config
+	config := Config{AllowExtraArgs: true}
 	if len(cfg.PluginConfig) != 0 {
 		if err := base.MsgPackDecode(cfg.PluginConfig, &config); err != nil {
 			return err
 		}
 	}
 
+	if config.MaxMemoryMb > 0 && config.DefaultMemoryMb > config.MaxMemoryMb {
+		return fmt.Errorf("default_memory_mb %d exceeds max_memory_mb %d", config.DefaultMemoryMb, config.MaxMemoryMb)
+	}
+	if config.CPUSharesPerVCPU < 0 {
+		return fmt.Errorf("cpu_shares_per_vcpu must not be negative")
+	}
+	if config.ExecutorLogLevel == "" {
+		config.ExecutorLogLevel = defaultExecutorLogLevel
+	}
+	if hclog.LevelFromString(config.ExecutorLogLevel) == hclog.NoLevel {
+		return fmt.Errorf("invalid executor_log_level %q, must be one of trace, debug, info, warn or error", config.ExecutorLogLevel)
+	}
+	if config.DefaultAccelerator != "" {
+		if err := validateAccelerators(config.DefaultAccelerator); err != nil {
+			return fmt.Errorf("invalid default_accelerator: %v", err)
+		}
+	}
+	if config.EnableGuestAgent && runtime.GOOS == "windows" {
+		return fmt.Errorf("enable_guest_agent is unsupported on the Windows platform")
+	}
+
 	// Save the configuration to the plugin
 	d.config = &config
 
@@ -258,6 +615,9 @@ func (d *AltQemuDriverPlugin) SetConfig(cfg *base.Config) error {
 	// value in d.config.
 	//
 
+	// the host memory bounds the memory assigned to VMs
+	d.hostMemoryMb = hostMemoryMb()
+
 	// Save the Nomad agent configuration
 	if cfg.AgentConfig != nil {
 		d.nomadConfig = cfg.AgentConfig.Driver
@@ -278,7 +638,9 @@ func (d *AltQemuDriverPlugin) TaskConfigSchema() (*hclspec.Spec, error) {
 
 // Capabilities returns the features supported by the driver.
 func (d *AltQemuDriverPlugin) Capabilities() (*drivers.Capabilities, error) {
-	return capabilities, nil
+	caps := *capabilities
+	caps.Exec = d.config.EnableGuestAgent
+	return &caps, nil
 }
 
 // Fingerprint returns a channel that will be used to send health information
@@ -334,11 +696,11 @@ func (d *AltQemuDriverPlugin) buildFingerprint() *drivers.Fingerprint {
 	//
 	// In the example below we check if the shell specified by the user exists
 	// in the node.
-	bin := "qemu-system-x86_64"
+	bin := d.qemuSystemBin()
 	if runtime.GOOS == "windows" {
 		// On windows, the "qemu-system-x86_64" command does not respond to the
 		// version flag.
-		bin = "qemu-img"
+		bin = d.qemuImgBin()
 	}
 	outBytes, err := exec.Command(bin, "--version").Output()
 	if err != nil {
@@ -350,18 +712,105 @@ func (d *AltQemuDriverPlugin) buildFingerprint() *drivers.Fingerprint {
 	}
 	out := strings.TrimSpace(string(outBytes))
 
-	matches := versionRegex.FindStringSubmatch(out)
-	if len(matches) != 2 {
+	currentQemuVersion, fullQemuVersion, ok := parseQemuVersion(out)
+	if !ok {
 		fingerprint.Health = drivers.HealthStateUndetected
 		fingerprint.HealthDescription = fmt.Sprintf("Failed to parse qemu version from %v", out)
 		return fingerprint
 	}
-	currentQemuVersion := matches[1]
 	fingerprint.Attributes[driverAttr] = pstructs.NewBoolAttribute(true)
 	fingerprint.Attributes[driverVersionAttr] = pstructs.NewStringAttribute(currentQemuVersion)
+	fingerprint.Attributes[driverVersionFullAttr] = pstructs.NewStringAttribute(fullQemuVersion)
+	fingerprint.Attributes[driverKVMAttr] = pstructs.NewBoolAttribute(kvmAvailable(kvmDevicePath))
+	fingerprint.Attributes[driverAcceleratorsAttr] = pstructs.NewStringAttribute(strings.Join(availableAccelerators(), ","))
+	for _, arch := range qemuSystemArchs() {
+		fingerprint.Attributes[driverArchAttrPrefix+arch] = pstructs.NewBoolAttribute(true)
+	}
+
+	// qemu-img is optional, without it image formats are detected from the
+	// image headers
+	if imgPath, imgVersion, err := qemuImgVersion(d.qemuImgBin()); err != nil {
+		d.logger.Debug("qemu-img not available", "error", err)
+		fingerprint.Attributes[driverImgAttr] = pstructs.NewBoolAttribute(false)
+	} else {
+		fingerprint.Attributes[driverImgAttr] = pstructs.NewBoolAttribute(true)
+		fingerprint.Attributes[driverImgVersionAttr] = pstructs.NewStringAttribute(imgVersion)
+		fingerprint.Attributes[driverImgPathAttr] = pstructs.NewStringAttribute(imgPath)
+	}
+
+	_, err = isoTool()
+	fingerprint.Attributes[driverCloudInitAttr] = pstructs.NewBoolAttribute(err == nil)
+	_, err = GetAbsolutePath(swtpmBin)
+	fingerprint.Attributes[driverSwtpmAttr] = pstructs.NewBoolAttribute(err == nil)
+	_, err = virtiofsd()
+	fingerprint.Attributes[driverVirtiofsdAttr] = pstructs.NewBoolAttribute(err == nil)
+	fingerprint.Attributes[driverIOUringAttr] = pstructs.NewBoolAttribute(ioUringAvailable())
+
+	// a qemu reporting its version may still be unable to launch VMs, e.g.
+	// without its accelerator modules
+	if d.config.HealthProbe && runtime.GOOS != "windows" {
+		accel := d.config.DefaultAccelerator
+		if accel == "" {
+			accel = availableAccelerators()[0]
+		}
+		if err := probeQemu(bin, accel); err != nil {
+			fingerprint.Health = drivers.HealthStateUnhealthy
+			fingerprint.HealthDescription = fmt.Sprintf("qemu failed to launch with accelerator %q: %v", accel, err)
+		}
+	}
 	return fingerprint
 }
 
+// qemuSystemBin returns the qemu system emulator binary configured for the
+// plugin, or the x86_64 emulator found in PATH.
+func (d *AltQemuDriverPlugin) qemuSystemBin() string {
+	if d.config.QemuSystemBin != "" {
+		return d.config.QemuSystemBin
+	}
+	return defaultQemuSystemBin
+}
+
+// qemuImgBin returns the qemu-img binary configured for the plugin, or the
+// one found in PATH.
+func (d *AltQemuDriverPlugin) qemuImgBin() string {
+	if d.config.QemuImgBin != "" {
+		return d.config.QemuImgBin
+	}
+	return defaultQemuImgBin
+}
+
+// kvmAvailable returns whether the KVM device at path exists and can be opened
+// for reading and writing by the plugin.
+func kvmAvailable(path string) bool {
+	if runtime.GOOS != "linux" {
+		return false
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// availableAccelerators returns the qemu accelerators usable on this node. The
+// tcg software emulator is always available.
+func availableAccelerators() []string {
+	var accels []string
+	switch runtime.GOOS {
+	case "linux":
+		if kvmAvailable(kvmDevicePath) {
+			accels = append(accels, "kvm")
+		}
+	case "darwin":
+		accels = append(accels, "hvf")
+	case "windows":
+		accels = append(accels, "whpx")
+	}
+	return append(accels, "tcg")
+}
+
 // GetAbsolutePath returns the absolute path of the passed binary by resolving
 // it in the path and following symlinks.
 func GetAbsolutePath(bin string) (string, error) {
@@ -373,6 +822,97 @@ func GetAbsolutePath(bin string) (string, error) {
 	return filepath.EvalSymlinks(lp)
 }
 
+// imageMagics maps the magic bytes found at the start of an image file to the
+// qemu block driver able to read it. Images matching none of these are raw.
+var imageMagics = []struct {
+	magic  []byte
+	format string
+}{
+	{[]byte("QFI\xfb"), "qcow2"},
+	{[]byte("KDMV"), "vmdk"},
+	{[]byte("vhdxfile"), "vhdx"},
+	{[]byte("conectix"), "vpc"},
+	{[]byte("<<< Oracle VM VirtualBox Disk Image >>>"), "vdi"},
+}
+
+// checkImageReadable returns a descriptive error when the image at path does
+// not exist, is not a regular file or cannot be read by the plugin.
+func checkImageReadable(path string) error {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("image_path %q does not exist", path)
+	} else if err != nil {
+		return fmt.Errorf("failed to stat image_path %q: %v", path, err)
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("image_path %q is a directory", path)
+	}
+
+	f, err := os.Open(path)
+	if os.IsPermission(err) {
+		return fmt.Errorf("image_path %q is not readable: permission denied", path)
+	} else if err != nil {
+		return fmt.Errorf("failed to open image_path %q: %v", path, err)
+	}
+	return f.Close()
+}
+
+// detectImageFormat returns the qemu block driver name for the image at path
+// by inspecting the image header.
+func detectImageFormat(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open image %q: %v", path, err)
+	}
+	defer f.Close()
+
+	header := make([]byte, 64)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", fmt.Errorf("failed to read image %q: %v", path, err)
+	}
+	header = header[:n]
+
+	for _, m := range imageMagics {
+		if bytes.HasPrefix(header, m.magic) {
+			return m.format, nil
+		}
+	}
+	return "raw", nil
+}
+
+// isAcceleratorAvailable returns whether accel is one of the accelerators
+// usable on this node.
+func isAcceleratorAvailable(accel string) bool {
+	for _, a := range availableAccelerators() {
+		if a == accel {
+			return true
+		}
+	}
+	return false
+}
+
+// validateAccelerators validates an accelerator preference list such as
+// "kvm:tcg", which qemu tries in order. Every accelerator must be known and
+// the last one, which qemu falls back to, must be available on this node.
+func validateAccelerators(chain string) error {
+	accels := strings.Split(chain, ":")
+	for _, accel := range accels {
+		if !knownAccelerators[accel] {
+			return fmt.Errorf("unknown accelerator %q in %q", accel, chain)
+		}
+	}
+
+	last := accels[len(accels)-1]
+	if !isAcceleratorAvailable(last) {
+		if len(accels) == 1 {
+			return fmt.Errorf("accelerator %q not available on this node", last)
+		}
+		return fmt.Errorf("fallback accelerator %q of %q not available on this node", last, chain)
+	}
+	return nil
+}
+
 // StartTask returns a task handle and a driver network if necessary.
 func (d *AltQemuDriverPlugin) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHandle, *drivers.DriverNetwork, error) {
 	if _, ok := d.tasks.Get(cfg.ID); ok {
@@ -392,159 +932,282 @@ func (d *AltQemuDriverPlugin) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskH
 	handle := drivers.NewTaskHandle(taskHandleVersion)
 	handle.Config = cfg
 
-	// get the image source
-	vmPath := driverConfig.ImagePath
-	if vmPath == "" {
+	// anything set up for the VM is torn down again if it fails to start
+	cleanup := &startCleanup{logger: d.logger}
+	started := false
+	defer func() {
+		if !started {
+			cleanup.run()
+		}
+	}()
+
+	if driverConfig.ImagePath == "" {
 		return nil, nil, fmt.Errorf("image_path must be set")
 	}
 
-	vmID := driverConfig.VmName
-	if vmID == "" {
-		vmID = filepath.Base(vmPath)
+	var bootTimeout time.Duration
+	if driverConfig.BootTimeout != "" {
+		var err error
+		bootTimeout, err = time.ParseDuration(driverConfig.BootTimeout)
+		if err != nil || bootTimeout <= 0 {
+			return nil, nil, fmt.Errorf("invalid boot_timeout %q", driverConfig.BootTimeout)
+		}
+		if runtime.GOOS == "windows" {
+			return nil, nil, fmt.Errorf("boot_timeout is unsupported on the Windows platform")
+		}
+		if driverConfig.Incoming != "" {
+			return nil, nil, fmt.Errorf("boot_timeout cannot be used with incoming, the VM stays paused once migrated")
+		}
+	}
+
+	if err := checkProcessPriority(driverConfig.ProcessPriority); err != nil {
+		return nil, nil, err
+	}
+	if driverConfig.Cpuset != "" {
+		if runtime.GOOS != "linux" {
+			return nil, nil, fmt.Errorf("cpuset is only supported on Linux")
+		}
+		if err := checkCpuset(driverConfig.Cpuset); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// remote images are downloaded into the task directory, verifying
+	// their checksum as part of the download
+	checksumVerified := false
+	if isImageURL(driverConfig.ImagePath) {
+		if !d.config.AllowImageDownload {
+			return nil, nil, fmt.Errorf("image_path %q is a URL but allow_image_download is not enabled", driverConfig.ImagePath)
+		}
+		if driverConfig.VmName == "" {
+			driverConfig.VmName = unsafeNameCharsRegex.ReplaceAllString(filepath.Base(driverConfig.ImagePath), "-")
+		}
+		d.logger.Debug("downloading image", "url", driverConfig.ImagePath)
+		localPath, err := downloadImage(d.ctx, cfg.TaskDir().Dir, driverConfig.ImagePath, driverConfig.ImageChecksum)
+		if err != nil {
+			return nil, nil, err
+		}
+		cleanup.addPath(localPath)
+		driverConfig.ImagePath = localPath
+		checksumVerified = true
 	}
 
-	if !isAllowedImagePath(d.config.ImagePaths, cfg.AllocDir, vmPath) {
-		return nil, nil, fmt.Errorf("image_path is not in the allowed paths")
+	cmd, err := d.buildQemuArgs(cfg, &driverConfig)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// parse configuration arugments
-	// create the base arguments
-	accelerator := "tcg"
-	if driverConfig.Accelerator != "" {
-		accelerator = driverConfig.Accelerator
+	if driverConfig.DryRun {
+		d.emitEvent(cfg, "QEMU VM not started by dry run", map[string]string{"command": strings.Join(cmd.args, " ")})
+		return nil, nil, fmt.Errorf("dry_run is set, qemu would have been started with: %s", strings.Join(cmd.args, " "))
 	}
 
-	memMb := cfg.Resources.NomadResources.Memory.MemoryMB
-	if memMb < 128 || memMb > 4000000 {
-		return nil, nil, fmt.Errorf("qemu memory assignment out of bounds")
-	}
-	mem := fmt.Sprintf("%dM", memMb)
-
-	// TODO: this checks for a cpu share out of reasonable bounds. determine the minimum share amount and maximum
-	// possible share amount. Divide the number of shares by 1000 to determine the number of vCPUs to allocate
-	cpuCount := 0
-	cpu := cfg.Resources.NomadResources.Cpu.CpuShares
-	if cpu < 100 || cpu > 1024000 {
-		return nil, nil, fmt.Errorf("cpu share assignment out of bounds")
-	} else if cpu < 1000 {
-		cpuCount = 1
-	} else {
-		cpuCount = int(cpu / 1000)
+	if driverConfig.ImageChecksum != "" && !checksumVerified {
+		if err := verifyChecksum(cmd.imagePath, driverConfig.ImageChecksum); err != nil {
+			return nil, nil, err
+		}
 	}
-	cpuCountStr := fmt.Sprintf("%d", cpuCount)
 
-	qemuSysPath := driverConfig.QemuSystemBin
-	if qemuSysPath == "" {
-		qemuSysPath = "qemu-system-x86_64"
+	// a pidfile left by a previous run of the task must not be mistaken for
+	// the one of the new VM
+	if cmd.pidPath != "" {
+		if err := os.Remove(cmd.pidPath); err != nil && !os.IsNotExist(err) {
+			return nil, nil, fmt.Errorf("failed to remove previous pidfile: %v", err)
+		}
+	}
+
+	// sockets and the pidfile are created by qemu and its helpers
+	for _, path := range append([]string{cmd.monitorPath, cmd.agentPath, cmd.pidPath}, cmd.serialPaths...) {
+		cleanup.addPath(path)
+	}
+	for _, daemon := range cmd.virtiofsDaemons {
+		cleanup.addPath(daemon.socket)
 	}
-	absPath, err := GetAbsolutePath(qemuSysPath)
+
+	if cmd.overlayPath != "" {
+		if _, err := createOverlay(cmd.qemuImgPath, cfg.TaskDir().Dir, cmd.imagePath, cmd.overlayBaseFormat); err != nil {
+			return nil, nil, err
+		}
+		cleanup.addPath(cmd.overlayPath)
+	}
+
+	if cmd.seedPath != "" {
+		if _, err := buildCloudInitSeed(cfg.TaskDir().Dir, cfg.AllocID, &driverConfig.CloudInit); err != nil {
+			return nil, nil, err
+		}
+		cleanup.addPath(cmd.seedPath)
+	}
+
+	if cmd.vncPasswordPath != "" {
+		if err := writeVNCPassword(cmd.vncPasswordPath, driverConfig.VNC.Password); err != nil {
+			return nil, nil, err
+		}
+		cleanup.addPath(cmd.vncPasswordPath)
+	}
+
+	varsPath, err := copyFirmwareVars(cfg.TaskDir().Dir, &cmd.firmware)
 	if err != nil {
 		return nil, nil, err
 	}
+	cleanup.addPath(varsPath)
 
-	machineType := driverConfig.MachineType
-	if machineType == "" {
-		machineType = "pc"
+	// the tap device lives in the allocation's network namespace rather
+	// than the task directory, so it is only set up once the task is valid
+	if cmd.netnsPath != "" {
+		if err := setupNamespaceTap(cmd.netnsPath, cmd.macAddress); err != nil {
+			return nil, nil, fmt.Errorf("failed to set up the tap device: %v", err)
+		}
+		cleanup.add(func() {
+			if err := teardownNamespaceTap(cmd.netnsPath); err != nil {
+				d.logger.Warn("failed to remove the tap device", "netns", cmd.netnsPath, "error", err)
+			}
+		})
 	}
 
-	cpuType := driverConfig.CpuType
-	if cpuType == "" {
-		cpuType = "host"
+	// qemu writes to its files after dropping its privileges
+	if driverConfig.RunAsUser != "" {
+		if err := chownTaskFiles(cmd.runAsUID, cmd.runAsGID, varsPath, cmd.seedPath); err != nil {
+			return nil, nil, err
+		}
 	}
 
-	// TODO: netdev type
-	netdevType := "bridge"
-	netdevID := "nd0"
-	bootBlockDevName := "bootbd"
-	bootBlockDevDriver := "qcow2"
-	bootBlockDevFileDriver := "file"
-	bootDeviceType := "virtio-blk"
-
-	// TODO: options other than nographic?
-	// TODO: blockdev paths, including disk format
-	// TODO: vnc vs spice
-	// TODO: support multiple block devs
-	// TODO: support CDROM/DVD drive
-	// TODO:
+	// the swtpm and virtiofsd daemons are started last so that they are not
+	// left running by a failed validation, and must be listening before
+	// qemu starts
+	var tpmPidPath string
+	if cmd.tpmSocket != "" {
+		var tpmSocket string
+		tpmSocket, tpmPidPath, err = startSwtpm(cfg.TaskDir().Dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		cleanup.add(func() { d.stopSwtpm(tpmPidPath) })
+		cleanup.addPath(tpmSocket)
+	}
 
-	args := []string {
-		absPath,
-		"-machine", fmt.Sprintf("type=%s,accel=%s", machineType, accelerator),
-		"-name", vmID,
-		"-m", mem,
-		"-cpu", cpuType,
-		"-smp", cpuCountStr,
-		"-nographic",
-		"-blockdev", fmt.Sprintf("node-name=%s,driver=#%s,file.filename=%s,file.locking=off,file.driver=%s", bootBlockDevName, bootBlockDevDriver, vmPath, bootBlockDevFileDriver),
-		"-device", fmt.Sprintf("%s,drive=%s", bootDeviceType, bootBlockDevName),
-		"-netdev", fmt.Sprintf("%s,id=%s", netdevType, netdevID),
-		"-device", fmt.Sprintf(""),
+	virtiofsdPids, err := startVirtiofsd(cmd.virtiofsDaemons)
+	if err != nil {
+		return nil, nil, err
 	}
+	cleanup.add(func() { stopVirtiofsd(virtiofsdPids) })
+
+	d.logger.Debug("starting qemu VM command", "args", strings.Join(cmd.args, " "))
+
+	d.emitEvent(cfg, "Starting QEMU VM", map[string]string{"vm_id": cmd.vmID})
 
-	// TODO: implement driver specific mechanism to start the task.
-	//
-	// Once the task is started you will need to store any relevant runtime
-	// information in a taskHandle and TaskState. The taskHandle will be
-	// stored in-memory in the plugin and will be used to interact with the
-	// task.
-	//
-	// The TaskState will be returned to the Nomad client inside a
-	// drivers.TaskHandle instance. This TaskHandle will be sent back to plugin
-	// if the task ever needs to be recovered, so the TaskState should contain
-	// enough information to handle that.
-	//
-	// In the example below we use an executor to fork a process to run our
-	// greeter. The executor is then stored in the handle so we can access it
-	// later and the the plugin.Client is used to generate a reattach
-	// configuration that can be used to recover communication with the task.
 	executorConfig := &executor.ExecutorConfig{
 		LogFile:  filepath.Join(cfg.TaskDir().Dir, "executor.out"),
-		LogLevel: "debug",
+		LogLevel: d.config.ExecutorLogLevel,
 	}
 
 	exec, pluginClient, err := executor.CreateExecutor(d.logger, d.nomadConfig, executorConfig)
 	if err != nil {
+		d.emitEvent(cfg, "Failed to start QEMU VM", map[string]string{"error": err.Error()})
 		return nil, nil, fmt.Errorf("failed to create executor: %v", err)
 	}
+	cleanup.add(pluginClient.Kill)
 
-	echoCmd := fmt.Sprintf(`echo "%s"`, driverConfig.Greeting)
-	execCmd := &executor.ExecCommand{
-		Cmd:        d.config.Shell,
-		Args:       []string{"-c", echoCmd},
-		StdoutPath: cfg.StdoutPath,
-		StderrPath: cfg.StderrPath,
-	}
-
+	execCmd := qemuExecCommand(cfg, cmd.args)
+	oomKillCount := hostOOMKillCount()
 	ps, err := exec.Launch(execCmd)
 	if err != nil {
-		pluginClient.Kill()
+		d.emitEvent(cfg, "Failed to start QEMU VM", map[string]string{"error": err.Error()})
 		return nil, nil, fmt.Errorf("failed to launch command with executor: %v", err)
 	}
+	cleanup.add(func() { exec.Shutdown("SIGKILL", 0) })
+
+	pid := ps.Pid
+	if cmd.pidPath != "" {
+		if filePid, err := waitPidFile(cmd.pidPath, ps.Pid, pidFileTimeout); err != nil {
+			d.logger.Warn("failed to read qemu pidfile, using the executor pid", "vm_id", cmd.vmID, "error", err)
+		} else {
+			pid = filePid
+		}
+	}
+	d.logger.Debug("started qemu VM", "vm_id", cmd.vmID, "pid", pid)
+
+	if err := d.tuneProcess(pid, &driverConfig); err != nil {
+		d.emitEvent(cfg, "Failed to start QEMU VM", map[string]string{"error": err.Error()})
+		return nil, nil, err
+	}
+
+	// fail the start of VMs that exit right away, e.g. because of a bad
+	// image, rather than reporting them as running
+	if bootTimeout > 0 {
+		if err := d.waitBootReady(exec, driverConfig.MonitorProtocol, cmd.monitorPath, bootTimeout); err != nil {
+			d.emitEvent(cfg, "Failed to start QEMU VM", map[string]string{"error": err.Error()})
+			return nil, nil, err
+		}
+		d.logger.Debug("qemu VM is running", "vm_id", cmd.vmID, "pid", pid)
+	}
+
+	driverNetwork := cmd.network
+	if guestAddressWanted(&driverConfig, cmd.agentPath) {
+		ctx, cancel, exited := d.watchExit(exec)
+		if guest := d.guestNetwork(ctx, cfg, &driverConfig, cmd.agentPath, exited); guest != nil {
+			driverNetwork = guest
+		}
+		cancel()
+	}
 
 	h := &taskHandle{
-		exec:         exec,
-		pid:          ps.Pid,
-		pluginClient: pluginClient,
-		taskConfig:   cfg,
-		procState:    drivers.TaskStateRunning,
-		startedAt:    time.Now().Round(time.Millisecond),
-		logger:       d.logger,
+		exec:             exec,
+		pid:              pid,
+		pidPath:          cmd.pidPath,
+		monitorPath:      cmd.monitorPath,
+		monitorProtocol:  driverConfig.MonitorProtocol,
+		agentPath:        cmd.agentPath,
+		seedPath:         cmd.seedPath,
+		tpmPidPath:       tpmPidPath,
+		virtiofsdPids:    virtiofsdPids,
+		overlayPath:      cmd.overlayPath,
+		varsPath:         varsPath,
+		vncPasswordPath:  cmd.vncPasswordPath,
+		netnsPath:        cmd.netnsPath,
+		serialPaths:      cmd.serialPaths,
+		attributes:       taskAttributes(cfg, &driverConfig, cmd.monitorPath, cmd.serialPaths),
+		gracefulShutdown: driverConfig.GracefulShutdown,
+		snapshots:        cmd.snapshots,
+		balloonEnabled:   driverConfig.EnableBalloon,
+		balloonTarget:    cmd.memMb * 1024 * 1024,
+		paused:           driverConfig.Incoming != "",
+		memoryMb:         cmd.memMb,
+		oomKillCount:     oomKillCount,
+		pluginClient:     pluginClient,
+		taskConfig:       cfg,
+		procState:        drivers.TaskStateRunning,
+		startedAt:        time.Now().Round(time.Millisecond),
+		logger:           d.logger,
 	}
 
 	driverState := TaskState{
-		ReattachConfig: structs.ReattachConfigFromGoPlugin(pluginClient.ReattachConfig()),
-		Pid:            ps.Pid,
-		TaskConfig:     cfg,
-		StartedAt:      h.startedAt,
+		ReattachConfig:  pstructs.ReattachConfigFromGoPlugin(pluginClient.ReattachConfig()),
+		Pid:             pid,
+		PidPath:         cmd.pidPath,
+		TaskConfig:      cfg,
+		StartedAt:       h.startedAt,
+		MonitorPath:     cmd.monitorPath,
+		AgentPath:       cmd.agentPath,
+		SeedPath:        cmd.seedPath,
+		TPMPidPath:      tpmPidPath,
+		VirtiofsdPids:   virtiofsdPids,
+		OverlayPath:     cmd.overlayPath,
+		VarsPath:        varsPath,
+		VNCPasswordPath: cmd.vncPasswordPath,
+		NetnsPath:       cmd.netnsPath,
+		SerialPaths:     cmd.serialPaths,
+		OOMKillCount:    oomKillCount,
+		Snapshots:       cmd.snapshots,
 	}
 
 	if err := handle.SetDriverState(&driverState); err != nil {
 		return nil, nil, fmt.Errorf("failed to set driver state: %v", err)
 	}
 
+	started = true
 	d.tasks.Set(cfg.ID, h)
 	go h.run()
-	return handle, nil, nil
+	return handle, driverNetwork, nil
 }
 
 // RecoverTask recreates the in-memory state of a task from a TaskHandle.
@@ -557,7 +1220,7 @@ func (d *AltQemuDriverPlugin) RecoverTask(handle *drivers.TaskHandle) error {
 		d.logger.Trace("nothing to recover; task already exists",
 			"task_id", handle.Config.ID,
 			"task_name", handle.Config.Name,
-			)
+		)
 		return nil
 	}
 
@@ -568,11 +1231,21 @@ func (d *AltQemuDriverPlugin) RecoverTask(handle *drivers.TaskHandle) error {
 		return fmt.Errorf(msg)
 	}
 
+	// the raw driver config does not survive the encoding of the driver
+	// state, so it is decoded from the task config of the handle
 	var driverConfig TaskConfig
-	if err := taskState.TaskConfig.DecodeDriverConfig(&driverConfig); err != nil {
-		msg := fmt.Sprintf("faield to decode driver config: #{err}")
+	if err := handle.Config.DecodeDriverConfig(&driverConfig); err != nil {
+		msg := fmt.Sprintf("failed to decode driver config: %v", err)
 		d.logger.Error(msg, "error", err, "task_id", handle.Config.ID)
-		return fmt.Errorf("failed to decode driver config: %v", err)
+		return fmt.Errorf(msg)
+	}
+
+	// after a host reboot the VM is gone and its pid may have been reused by
+	// an unrelated process, so there is nothing to reattach to. Recent qemu
+	// releases also remove their pidfile when they exit.
+	if !d.confirmQemuProcess(&taskState) {
+		d.recoverExitedTask(&taskState)
+		return nil
 	}
 
 	// TODO: implement driver specific logic to recover a task.
@@ -584,26 +1257,49 @@ func (d *AltQemuDriverPlugin) RecoverTask(handle *drivers.TaskHandle) error {
 	// that was created when the task first started.
 	plugRC, err := pstructs.ReattachConfigToGoPlugin(taskState.ReattachConfig)
 	if err != nil {
-		msg := fmt.Sprintf("failed to build ReattachConfig from taskConfig state: #{err}")
+		msg := fmt.Sprintf("failed to build ReattachConfig from taskConfig state: %v", err)
 		d.logger.Error(msg, "error", err, "task_id", handle.Config.ID)
 		return fmt.Errorf(msg)
 	}
 
-	execImpl, pluginClient, err := executor.ReattachToExecutor(plugRC, d.logger.With("task_name", handle.Config.Name, "alloc_id", handle.Config.AllocID))
+	execImpl, pluginClient, err := d.reattachExecutor(plugRC, taskState.Pid, handle.Config)
 	if err != nil {
 		d.logger.Error("failed to reattach to executor", "error", err, "task_id", handle.Config.ID)
-		return fmt.Errorf("failed to reattach to executor: #{err}")
+		if !processExists(taskState.Pid) {
+			d.recoverExitedTask(&taskState)
+			return nil
+		}
+		return fmt.Errorf("failed to reattach to executor: %v", err)
 	}
 
 	h := &taskHandle{
-		exec:         execImpl,
-		pid:          taskState.Pid,
-		pluginClient: pluginClient,
-		taskConfig:   taskState.TaskConfig,
-		procState:    drivers.TaskStateRunning,
-		startedAt:    taskState.StartedAt,
-		exitResult:   &drivers.ExitResult{},
-		logger: d.logger,
+		exec:             execImpl,
+		pid:              taskState.Pid,
+		pidPath:          taskState.PidPath,
+		monitorPath:      taskState.MonitorPath,
+		monitorProtocol:  driverConfig.MonitorProtocol,
+		agentPath:        taskState.AgentPath,
+		seedPath:         taskState.SeedPath,
+		tpmPidPath:       taskState.TPMPidPath,
+		virtiofsdPids:    taskState.VirtiofsdPids,
+		overlayPath:      taskState.OverlayPath,
+		varsPath:         taskState.VarsPath,
+		vncPasswordPath:  taskState.VNCPasswordPath,
+		netnsPath:        taskState.NetnsPath,
+		serialPaths:      taskState.SerialPaths,
+		attributes:       taskAttributes(taskState.TaskConfig, &driverConfig, taskState.MonitorPath, taskState.SerialPaths),
+		gracefulShutdown: driverConfig.GracefulShutdown,
+		snapshots:        taskState.Snapshots,
+		balloonEnabled:   driverConfig.EnableBalloon,
+		balloonTarget:    d.taskMemoryMb(taskState.TaskConfig) * 1024 * 1024,
+		memoryMb:         d.taskMemoryMb(taskState.TaskConfig),
+		oomKillCount:     taskState.OOMKillCount,
+		pluginClient:     pluginClient,
+		taskConfig:       taskState.TaskConfig,
+		procState:        drivers.TaskStateRunning,
+		startedAt:        taskState.StartedAt,
+		exitResult:       &drivers.ExitResult{},
+		logger:           d.logger,
 	}
 
 	d.tasks.Set(taskState.TaskConfig.ID, h)
@@ -612,27 +1308,135 @@ func (d *AltQemuDriverPlugin) RecoverTask(handle *drivers.TaskHandle) error {
 	return nil
 }
 
-func isAllowedImagePath(allowedPaths []string, allocDir, imagePath string) bool {
-	if !filepath.IsAbs(imagePath) {
-		imagePath = filepath.Join(allocDir, imagePath)
+// recoverExitedTask registers the task of taskState, whose qemu process is no
+// longer running, as exited so that it is reported as such rather than as a
+// running task without a VM. The files left in the task directory are
+// removed. Helper processes are not signalled as their recorded pids may
+// have been reused; they exit on their own once qemu is gone.
+func (d *AltQemuDriverPlugin) recoverExitedTask(taskState *TaskState) {
+	cfg := taskState.TaskConfig
+	d.logger.Warn("qemu process of recovered task is no longer running", "task_id", cfg.ID, "pid", taskState.Pid)
+
+	h := &taskHandle{
+		pid:             taskState.Pid,
+		pidPath:         taskState.PidPath,
+		monitorPath:     taskState.MonitorPath,
+		agentPath:       taskState.AgentPath,
+		seedPath:        taskState.SeedPath,
+		overlayPath:     taskState.OverlayPath,
+		varsPath:        taskState.VarsPath,
+		vncPasswordPath: taskState.VNCPasswordPath,
+		netnsPath:       taskState.NetnsPath,
+		serialPaths:     taskState.SerialPaths,
+		taskConfig:      cfg,
+		procState:       drivers.TaskStateExited,
+		startedAt:       taskState.StartedAt,
+		completedAt:     time.Now().Round(time.Millisecond),
+		exitResult: &drivers.ExitResult{
+			Err: fmt.Errorf("qemu process %d is no longer running", taskState.Pid),
+		},
+		logger: d.logger,
+	}
+	h.cleanup()
+
+	d.tasks.Set(cfg.ID, h)
+	d.emitEvent(cfg, "VM was no longer running when the task was recovered", nil)
+}
+
+// confirmQemuProcess returns whether the qemu process of taskState is still
+// running. Tasks started with a pidfile must still have it, holding the same
+// pid.
+func (d *AltQemuDriverPlugin) confirmQemuProcess(taskState *TaskState) bool {
+	if taskState.PidPath != "" {
+		pid, err := readPidFile(taskState.PidPath)
+		if err != nil {
+			d.logger.Debug("failed to read qemu pidfile", "task_id", taskState.TaskConfig.ID, "error", err)
+			return false
+		}
+		if pid != taskState.Pid {
+			d.logger.Debug("qemu pidfile does not match the task pid", "task_id", taskState.TaskConfig.ID, "pid", taskState.Pid, "pidfile_pid", pid)
+			return false
+		}
 	}
+	return isQemuProcess(taskState.Pid)
+}
+
+// reattachExecutor reattaches to the executor described by rc, retrying with
+// a backoff as its socket may not be reachable yet right after the plugin
+// restarted. Retries stop early once the qemu process pid has exited as
+// there is nothing left to reattach to.
+func (d *AltQemuDriverPlugin) reattachExecutor(rc *plugin.ReattachConfig, pid int, cfg *drivers.TaskConfig) (executor.Executor, *plugin.Client, error) {
+	logger := d.logger.With("task_name", cfg.Name, "alloc_id", cfg.AllocID)
+	backoff := reattachBackoff
+
+	for attempt := 1; ; attempt++ {
+		execImpl, pluginClient, err := executor.ReattachToExecutor(rc, logger)
+		if err == nil {
+			return execImpl, pluginClient, nil
+		}
+		if attempt == reattachAttempts || !processExists(pid) {
+			return nil, nil, err
+		}
 
-	isParent := func(parent, path string) bool {
-		rel, err := filepath.Rel(parent, path)
-		return err == nill && !strings.HasPrefix(rel, "..")
+		d.logger.Debug("failed to reattach to executor, retrying", "error", err, "task_id", cfg.ID, "attempt", attempt, "backoff", backoff)
+		select {
+		case <-d.ctx.Done():
+			return nil, nil, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
 	}
+}
 
-	if isParent(allocDir, imagePath) {
-		return true
+// resolveAllowedPath resolves path against the task directory, the working
+// directory of qemu, and follows its symlinks where they exist. The resolved
+// path is returned if it is located inside the alloc directory or inside one
+// of allowedPaths; it is the path to give to qemu, so a link swapped after
+// the check cannot be used to escape the allowed directories.
+func resolveAllowedPath(allowedPaths []string, allocDir, taskDir, path string) (string, bool) {
+	path = resolvePath(resolveTaskPath(taskDir, path))
+
+	if isSubpath(resolvePath(allocDir), path) {
+		return path, true
 	}
 
 	for _, ap := range allowedPaths {
-		if isParent(ap, imagePath) {
-			return true
+		if isSubpath(resolvePath(ap), path) {
+			return path, true
 		}
 	}
 
-	return false
+	return "", false
+}
+
+// isSubpath returns whether path is parent or is located inside it. Both
+// paths are compared lexically.
+func isSubpath(parent, path string) bool {
+	rel, err := filepath.Rel(parent, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolvePath returns the cleaned form of path with any symlinks evaluated.
+// Paths that do not exist yet are only cleaned.
+func resolvePath(path string) string {
+	path = filepath.Clean(path)
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	return path
+}
+
+// resolveNewPath returns the cleaned form of path with any symlinks
+// evaluated, including those of its directory when path does not exist yet.
+func resolveNewPath(path string) string {
+	path = filepath.Clean(path)
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	return filepath.Join(resolvePath(filepath.Dir(path)), filepath.Base(path))
 }
 
 // WaitTask returns a channel used to notify Nomad when a task exits.
@@ -661,16 +1465,53 @@ func (d *AltQemuDriverPlugin) handleWait(ctx context.Context, handle *taskHandle
 	// In the example below we block and wait until the executor finishes
 	// running, at which point we send the exit code and signal in the result
 	// channel.
+	// a task recovered after its VM exited has no executor to wait on
+	if handle.exec == nil {
+		handle.stateLock.RLock()
+		result = handle.exitResult.Copy()
+		handle.stateLock.RUnlock()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-d.ctx.Done():
+				return
+			case ch <- result:
+			}
+		}
+	}
+
 	ps, err := handle.exec.Wait(ctx)
 	if err != nil {
 		result = &drivers.ExitResult{
 			Err: fmt.Errorf("executor: error waiting on process: %v", err),
 		}
+		d.emitEvent(handle.taskConfig, "Failed waiting on QEMU VM", map[string]string{"error": err.Error()})
+	} else if handle.isPoweringDown() {
+		// the guest powered off as requested by StopTask, whatever qemu
+		// exited with this is a clean stop
+		result = &drivers.ExitResult{}
+		d.emitEvent(handle.taskConfig, "VM powered down gracefully", map[string]string{
+			"qemu_exit_code": strconv.Itoa(ps.ExitCode),
+		})
 	} else {
 		result = &drivers.ExitResult{
-			ExitCode: ps.ExitCode,
-			Signal:   ps.Signal,
+			ExitCode:  ps.ExitCode,
+			Signal:    ps.Signal,
+			OOMKilled: probablyOOMKilled(ps.Signal, handle.isStopRequested(), handle.oomKillCount),
 		}
+		if result.OOMKilled {
+			d.logger.Warn("qemu was probably killed by the OOM killer", "pid", handle.pid)
+			d.emitEvent(handle.taskConfig, "VM was killed by SIGKILL while the host was out of memory, probably by the OOM killer", nil)
+		} else {
+			d.emitEvent(handle.taskConfig, "VM powered down", map[string]string{
+				"exit_code": strconv.Itoa(ps.ExitCode),
+				"signal":    strconv.Itoa(ps.Signal),
+			})
+		}
+	}
+	if err == nil {
+		handle.markExited(result, ps.Time)
 	}
 
 	for {
@@ -684,6 +1525,98 @@ func (d *AltQemuDriverPlugin) handleWait(ctx context.Context, handle *taskHandle
 	}
 }
 
+// qemuExecCommand returns the command the executor runs for the qemu
+// command line args of task cfg. qemu's stdout and stderr, which carry its
+// diagnostics and, with -nographic, the guest's serial console, are written
+// to the task's log files so they show up in `nomad alloc logs`.
+func qemuExecCommand(cfg *drivers.TaskConfig, args []string) *executor.ExecCommand {
+	return &executor.ExecCommand{
+		Cmd:        args[0],
+		Args:       args[1:],
+		Env:        cfg.EnvList(),
+		User:       cfg.User,
+		TaskDir:    cfg.TaskDir().Dir,
+		StdoutPath: cfg.StdoutPath,
+		StderrPath: cfg.StderrPath,
+
+		NetworkIsolation: cfg.NetworkIsolation,
+	}
+}
+
+// waitBootReady waits up to timeout for the VM launched by exec to be running,
+// as reported by its monitor speaking protocol at monitorPath, returning an
+// error if qemu exits first.
+func (d *AltQemuDriverPlugin) waitBootReady(exec executor.Executor, protocol, monitorPath string, timeout time.Duration) error {
+	ctx, cancel, exited := d.watchExit(exec)
+	defer cancel()
+	return waitRunning(ctx, protocol, monitorPath, timeout, exited)
+}
+
+// watchExit returns a context derived from the driver's, along with the
+// channel receiving the exit code of the process launched by exec if it exits
+// before the context is cancelled.
+func (d *AltQemuDriverPlugin) watchExit(exec executor.Executor) (context.Context, context.CancelFunc, <-chan int) {
+	ctx, cancel := context.WithCancel(d.ctx)
+	exited := make(chan int, 1)
+	go func() {
+		if ps, err := exec.Wait(ctx); err == nil {
+			exited <- ps.ExitCode
+		}
+	}()
+	return ctx, cancel, exited
+}
+
+// taskMemoryMb returns the memory of the VM of task cfg in MB, which is the
+// memory allocated to the task or the configured default_memory_mb when the
+// task has none.
+func (d *AltQemuDriverPlugin) taskMemoryMb(cfg *drivers.TaskConfig) int64 {
+	memMb := cfg.Resources.NomadResources.Memory.MemoryMB
+	if memMb == 0 {
+		memMb = d.config.DefaultMemoryMb
+	}
+	return memMb
+}
+
+// tuneProcess applies the scheduling options of the task to the launched qemu
+// process pid.
+func (d *AltQemuDriverPlugin) tuneProcess(pid int, tc *TaskConfig) error {
+	if tc.ProcessPriority != 0 {
+		if err := setProcessPriority(pid, tc.ProcessPriority); err != nil {
+			return err
+		}
+	}
+	if tc.Cpuset != "" {
+		if err := pinCPUs(pid, tc.Cpuset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stopSwtpm stops the swtpm of a task that failed to start, logging any
+// error.
+func (d *AltQemuDriverPlugin) stopSwtpm(pidPath string) {
+	if pidPath == "" {
+		return
+	}
+	if err := stopSwtpm(pidPath); err != nil {
+		d.logger.Warn("failed to stop swtpm", "pid_file", pidPath, "error", err)
+	}
+}
+
+// emitEvent sends a task event for the task described by cfg, giving
+// operators a timeline of the VM lifecycle in the allocation status.
+func (d *AltQemuDriverPlugin) emitEvent(cfg *drivers.TaskConfig, msg string, annotations map[string]string) {
+	d.eventer.EmitEvent(&drivers.TaskEvent{
+		TaskID:      cfg.ID,
+		AllocID:     cfg.AllocID,
+		TaskName:    cfg.Name,
+		Timestamp:   time.Now(),
+		Message:     msg,
+		Annotations: annotations,
+	})
+}
+
 // StopTask stops a running task with the given signal and within the timeout window.
 func (d *AltQemuDriverPlugin) StopTask(taskID string, timeout time.Duration, signal string) error {
 	handle, ok := d.tasks.Get(taskID)
@@ -691,15 +1624,28 @@ func (d *AltQemuDriverPlugin) StopTask(taskID string, timeout time.Duration, sig
 		return drivers.ErrTaskNotFound
 	}
 
-	// TODO: implement driver specific logic to stop a task.
-	//
-	// The StopTask function is expected to stop a running task by sending the
-	// given signal to it. If the task does not stop during the given timeout,
-	// the driver must forcefully kill the task.
-	//
-	// In the example below we let the executor handle the task shutdown
-	// process for us, but you might need to customize this for your own
-	// implementation.
+	if handle.exec == nil {
+		return nil
+	}
+
+	handle.setStopRequested()
+
+	// attempt a graceful shutdown only if it was configured in the job,
+	// falling back to killing qemu if the guest does not power off in time
+	if handle.gracefulShutdown && handle.monitorPath != "" {
+		handle.setPoweringDown(true)
+		if err := handle.monitorCommand(d.ctx, "system_powerdown"); err != nil {
+			handle.setPoweringDown(false)
+			d.logger.Debug("error sending graceful shutdown", "pid", handle.pid, "error", err)
+		} else if handle.waitExited(timeout) {
+			return nil
+		} else {
+			handle.setPoweringDown(false)
+			d.logger.Debug("VM did not power off within timeout, killing it", "pid", handle.pid, "timeout", timeout)
+			timeout = 0
+		}
+	}
+
 	if err := handle.exec.Shutdown(signal, timeout); err != nil {
 		if handle.pluginClient.Exited() {
 			return nil
@@ -729,7 +1675,7 @@ func (d *AltQemuDriverPlugin) DestroyTask(taskID string, force bool) error {
 	//
 	// In the example below we use the executor to force shutdown the task
 	// (timeout equals 0).
-	if !handle.pluginClient.Exited() {
+	if handle.pluginClient != nil && !handle.pluginClient.Exited() {
 		if err := handle.exec.Shutdown("", 0); err != nil {
 			handle.logger.Error("destroying executor failed", "err", err)
 		}
@@ -737,6 +1683,7 @@ func (d *AltQemuDriverPlugin) DestroyTask(taskID string, force bool) error {
 		handle.pluginClient.Kill()
 	}
 
+	handle.cleanup()
 	d.tasks.Delete(taskID)
 	return nil
 }
@@ -758,15 +1705,23 @@ func (d *AltQemuDriverPlugin) TaskStats(ctx context.Context, taskID string, inte
 		return nil, drivers.ErrTaskNotFound
 	}
 
-	// TODO: implement driver specific logic to send task stats.
-	//
-	// This function returns a channel that Nomad will use to listen for task
-	// stats (e.g., CPU and memory usage) in a given interval. It should send
-	// stats until the context is canceled or the task stops running.
-	//
-	// In the example below we use the Stats function provided by the executor,
-	// but you can build a set of functions similar to the fingerprint process.
-	return handle.exec.Stats(ctx, interval)
+	if handle.exec == nil {
+		return nil, fmt.Errorf("task %q is not running", taskID)
+	}
+
+	execCh, err := handle.exec.Stats(ctx, interval)
+	if err != nil {
+		return nil, err
+	}
+
+	// without a monitor only the qemu process stats are available
+	if handle.monitorPath == "" {
+		return execCh, nil
+	}
+
+	ch := make(chan *drivers.TaskResourceUsage)
+	go d.handleStats(ctx, handle, execCh, ch)
+	return ch, nil
 }
 
 // TaskEvents returns a channel that the plugin can use to emit task related events.
@@ -781,12 +1736,26 @@ func (d *AltQemuDriverPlugin) SignalTask(taskID string, signal string) error {
 	if !ok {
 		return drivers.ErrTaskNotFound
 	}
+	if handle.exec == nil {
+		return fmt.Errorf("task %q is not running", taskID)
+	}
+
+	// signals with a meaning for the guest are translated into monitor
+	// commands, anything else is delivered to the qemu process
+	if cmd, ok := signalMonitorCommands[signal]; ok {
+		d.logger.Debug("translating signal to monitor command", "signal", signal, "command", cmd, "task_id", taskID)
+		if err := handle.monitorCommand(d.ctx, cmd); err != nil {
+			return fmt.Errorf("failed to send %s for signal %s: %v", cmd, signal, err)
+		}
+		switch cmd {
+		case "stop":
+			handle.setPaused(true)
+		case "cont":
+			handle.setPaused(false)
+		}
+		return nil
+	}
 
-	// TODO: implement driver specific signal handling logic.
-	//
-	// The given signal must be forwarded to the target taskID. If this plugin
-	// doesn't support receiving signals (capability SendSignals is set to
-	// false) you can just return nil.
 	sig := os.Interrupt
 	if s, ok := signals.SignalLookup[signal]; ok {
 		sig = s
@@ -794,12 +1763,40 @@ func (d *AltQemuDriverPlugin) SignalTask(taskID string, signal string) error {
 		d.logger.Warn("unknown signal to send to task, using SIGINT instead", "signal", signal, "task_id", handle.taskConfig.ID)
 
 	}
+	d.logger.Debug("forwarding signal to qemu process", "signal", signal, "task_id", taskID)
 	return handle.exec.Signal(sig)
 }
 
 // ExecTask returns the result of executing the given command inside a task.
-// This is an optional capability.
+// This is an optional capability, advertised when the plugin enables the
+// guest agent of every VM. Commands other than the monitor commands are run
+// by the qemu guest agent and fail with a clear error for tasks without a
+// guest agent channel, e.g. those started before it was enabled.
 func (d *AltQemuDriverPlugin) ExecTask(taskID string, cmd []string, timeout time.Duration) (*drivers.ExecTaskResult, error) {
-	// TODO: implement driver specific logic to execute commands in a task.
-	return nil, fmt.Errorf("This driver does not support exec")
+	handle, ok := d.tasks.Get(taskID)
+	if !ok {
+		return nil, drivers.ErrTaskNotFound
+	}
+
+	// snapshot, balloon and migrate commands are handled by the monitor,
+	// all other commands are run inside the guest by the qemu guest agent
+	if isSnapshotCommand(cmd) || isBalloonCommand(cmd) || isMigrateCommand(cmd) {
+		ctx := d.ctx
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		switch {
+		case isSnapshotCommand(cmd):
+			return handle.snapshot(ctx, cmd[1:])
+		case isMigrateCommand(cmd):
+			return d.migrate(ctx, handle, cmd[1:])
+		}
+		return handle.balloon(ctx, cmd[1:])
+	}
+	if handle.agentPath == "" {
+		return nil, fmt.Errorf("task %q has no guest agent channel to execute commands, set enable_guest_agent and run qemu-guest-agent in the guest", taskID)
+	}
+	return guestExec(handle.agentPath, cmd, timeout)
 }
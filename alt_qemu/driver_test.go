@@ -0,0 +1,627 @@
+package alt_qemu
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/drivers/shared/executor"
+	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+	"github.com/hashicorp/nomad/plugins/base"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskConfig_ParseHCL(t *testing.T) {
+	config := `
+config {
+  image_path = "linux.img"
+  accelerator = "kvm"
+  args = ["-nodefaults", "-snapshot"]
+  graceful_shutdown = true
+}`
+
+	var tc TaskConfig
+	hclutils.NewConfigParser(taskConfigSpec).ParseHCL(t, config, &tc)
+
+	require.Equal(t, "linux.img", tc.ImagePath)
+	require.Equal(t, "kvm", tc.Accelerator)
+	require.Equal(t, []string{"-nodefaults", "-snapshot"}, tc.Args)
+	require.True(t, tc.GracefulShutdown)
+}
+
+func TestTaskConfig_CpuType(t *testing.T) {
+	var tc TaskConfig
+	hclutils.NewConfigParser(taskConfigSpec).ParseHCL(t, `
+config {
+  image_path = "linux.img"
+  cpu_type = "qemu64"
+}`, &tc)
+	require.Equal(t, "qemu64", tc.CpuType)
+
+	cases := map[string]bool{
+		"host":              true,
+		"qemu64":            true,
+		"Skylake-Server-v4": true,
+		"max,+vmx":          false,
+		"host -snapshot":    false,
+		"-host":             false,
+		"":                  false,
+	}
+	for cpuType, valid := range cases {
+		require.Equal(t, valid, cpuTypeRegex.MatchString(cpuType), "cpu_type %q", cpuType)
+	}
+}
+
+func TestDetectImageFormat(t *testing.T) {
+	dir := t.TempDir()
+	cases := []struct {
+		name   string
+		header []byte
+		format string
+	}{
+		{"qcow2", []byte("QFI\xfb\x00\x00\x00\x03"), "qcow2"},
+		{"vmdk", []byte("KDMV\x01\x00\x00\x00"), "vmdk"},
+		{"vhdx", []byte("vhdxfile"), "vhdx"},
+		{"vpc", []byte("conectix\x00\x00"), "vpc"},
+		{"vdi", []byte("<<< Oracle VM VirtualBox Disk Image >>>\n"), "vdi"},
+		{"raw", []byte("\xeb\x63\x90\x10\x8e\xd0\xbc\x00"), "raw"},
+		{"empty", nil, "raw"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(dir, c.name)
+			require.NoError(t, ioutil.WriteFile(path, c.header, 0644))
+
+			format, err := detectImageFormat(path)
+			require.NoError(t, err)
+			require.Equal(t, c.format, format)
+		})
+	}
+
+	_, err := detectImageFormat(filepath.Join(dir, "missing"))
+	require.Error(t, err)
+}
+
+func TestResolveAllowedPath(t *testing.T) {
+	root := t.TempDir()
+	allocDir := filepath.Join(root, "alloc")
+	taskDir := filepath.Join(allocDir, "task")
+	allowedDir := filepath.Join(root, "images")
+	outsideDir := filepath.Join(root, "outside")
+	for _, dir := range []string{taskDir, allowedDir, outsideDir} {
+		require.NoError(t, os.MkdirAll(dir, 0755))
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(outsideDir, "disk.img"), nil, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(allowedDir, "disk.img"), nil, 0644))
+	require.NoError(t, os.Symlink(outsideDir, filepath.Join(taskDir, "escape")))
+	require.NoError(t, os.Symlink(filepath.Join(outsideDir, "disk.img"), filepath.Join(allowedDir, "link.img")))
+	require.NoError(t, os.Symlink(filepath.Join(allowedDir, "disk.img"), filepath.Join(taskDir, "images.img")))
+
+	// symlinks of the temporary directory itself are resolved too
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	require.NoError(t, err)
+
+	cases := []struct {
+		name     string
+		path     string
+		resolved string
+	}{
+		{"relative to the task dir", "local/disk.img", filepath.Join(resolvedRoot, "alloc", "task", "local", "disk.img")},
+		{"relative in alloc dir", "../alloc/disk.img", filepath.Join(resolvedRoot, "alloc", "alloc", "disk.img")},
+		{"absolute in alloc dir", filepath.Join(allocDir, "disk.img"), filepath.Join(resolvedRoot, "alloc", "disk.img")},
+		{"nested in allowed path", filepath.Join(allowedDir, "linux", "disk.img"), filepath.Join(resolvedRoot, "images", "linux", "disk.img")},
+		{"symlink into allowed path", "images.img", filepath.Join(resolvedRoot, "images", "disk.img")},
+		{"outside", filepath.Join(outsideDir, "disk.img"), ""},
+		{"relative traversal", "../../outside/disk.img", ""},
+		{"absolute traversal", filepath.Join(allowedDir, "..", "outside", "disk.img"), ""},
+		{"symlinked dir escape", "escape/disk.img", ""},
+		{"symlinked file escape", filepath.Join(allowedDir, "link.img"), ""},
+		{"sibling with common prefix", filepath.Join(root, "images2", "disk.img"), ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resolved, ok := resolveAllowedPath([]string{allowedDir}, allocDir, taskDir, c.path)
+			require.Equal(t, c.resolved != "", ok)
+			require.Equal(t, c.resolved, resolved)
+		})
+	}
+}
+
+func TestResolveNewPath(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "real"), 0755))
+	require.NoError(t, os.Symlink(filepath.Join(dir, "real"), filepath.Join(dir, "link")))
+
+	require.Equal(t, filepath.Join(dir, "real", "new.log"), resolveNewPath(filepath.Join(dir, "link", "new.log")))
+	require.Equal(t, filepath.Join(dir, "real"), resolveNewPath(filepath.Join(dir, "link")))
+	require.Equal(t, "/missing/dir/new.log", resolveNewPath("/missing/dir/../dir/new.log"))
+}
+
+func TestKvmAvailable(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("KVM is only detected on linux")
+	}
+
+	dir := t.TempDir()
+	dev := filepath.Join(dir, "kvm")
+	require.NoError(t, ioutil.WriteFile(dev, nil, 0600))
+
+	require.True(t, kvmAvailable(dev))
+	require.False(t, kvmAvailable(filepath.Join(dir, "missing")))
+}
+
+func TestAvailableAccelerators(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("KVM is only detected on linux")
+	}
+
+	orig := kvmDevicePath
+	defer func() { kvmDevicePath = orig }()
+
+	dir := t.TempDir()
+	kvmDevicePath = filepath.Join(dir, "missing")
+	require.Equal(t, []string{"tcg"}, availableAccelerators())
+
+	kvmDevicePath = filepath.Join(dir, "kvm")
+	require.NoError(t, ioutil.WriteFile(kvmDevicePath, nil, 0600))
+	require.Equal(t, []string{"kvm", "tcg"}, availableAccelerators())
+}
+
+func TestIsAcceleratorAvailable(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("KVM is only detected on linux")
+	}
+
+	orig := kvmDevicePath
+	defer func() { kvmDevicePath = orig }()
+	kvmDevicePath = filepath.Join(t.TempDir(), "missing")
+
+	require.True(t, isAcceleratorAvailable("tcg"))
+	require.False(t, isAcceleratorAvailable("kvm"))
+	require.False(t, isAcceleratorAvailable("hvf"))
+	require.False(t, isAcceleratorAvailable(""))
+}
+
+func TestConfig_CdromPaths(t *testing.T) {
+	config := `
+config {
+  image_paths = ["/var/lib/images"]
+  cdrom_paths = ["/var/lib/isos"]
+}`
+
+	var c *Config
+	hclutils.NewConfigParser(configSpec).ParseHCL(t, config, &c)
+
+	require.Equal(t, []string{"/var/lib/images"}, c.ImagePaths)
+	require.Equal(t, []string{"/var/lib/isos"}, c.CdromPaths)
+}
+
+func TestTaskConfig_Cdrom(t *testing.T) {
+	config := `
+config {
+  image_path = "linux.img"
+  cdrom = "install.iso"
+}`
+
+	var tc *TaskConfig
+	hclutils.NewConfigParser(taskConfigSpec).ParseHCL(t, config, &tc)
+
+	require.Equal(t, "install.iso", tc.Cdrom)
+}
+
+// fakeExecutor stands in for the executor of tasks whose VM is only driven
+// through its monitor in tests. Calling any of its methods panics.
+type fakeExecutor struct {
+	executor.Executor
+}
+
+func TestSignalTask_MonitorCommands(t *testing.T) {
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	require.Equal(t, drivers.ErrTaskNotFound, d.SignalTask("missing", "SIGTERM"))
+
+	path, cmds := fakeQMPServer(t, func(qmpCommand) string { return `{"return": {}}` })
+	d.tasks.Set("task-1", &taskHandle{
+		exec:        &fakeExecutor{},
+		taskConfig:  &drivers.TaskConfig{ID: "task-1"},
+		monitorPath: path,
+	})
+
+	for signal, cmd := range signalMonitorCommands {
+		require.NoError(t, d.SignalTask("task-1", signal))
+		require.Equal(t, "qmp_capabilities", (<-cmds).Execute)
+		require.Equal(t, cmd, (<-cmds).Execute)
+	}
+
+	d.tasks.Set("task-2", &taskHandle{exec: &fakeExecutor{}, taskConfig: &drivers.TaskConfig{ID: "task-2"}})
+	err := d.SignalTask("task-2", "SIGHUP")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to send system_reset for signal SIGHUP")
+}
+
+func TestSignalTask_PauseResume(t *testing.T) {
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	path, cmds := fakeQMPServer(t, func(qmpCommand) string { return `{"return": {}}` })
+	h := &taskHandle{
+		exec:        &fakeExecutor{},
+		taskConfig:  &drivers.TaskConfig{ID: "task-1"},
+		monitorPath: path,
+		procState:   drivers.TaskStateRunning,
+	}
+	d.tasks.Set("task-1", h)
+
+	for _, c := range []struct {
+		signal string
+		cmd    string
+		status string
+	}{
+		{"SIGTSTP", "stop", "paused"},
+		{"SIGCONT", "cont", "running"},
+		{"SIGSTOP", "stop", "paused"},
+		{"SIGCONT", "cont", "running"},
+	} {
+		require.NoError(t, d.SignalTask("task-1", c.signal))
+		require.Equal(t, "qmp_capabilities", (<-cmds).Execute)
+		require.Equal(t, c.cmd, (<-cmds).Execute)
+		require.Equal(t, c.status, h.TaskStatus().DriverAttributes["vm_status"], c.signal)
+	}
+}
+
+func TestCheckImageReadable(t *testing.T) {
+	dir := t.TempDir()
+	readable := filepath.Join(dir, "linux.img")
+	require.NoError(t, ioutil.WriteFile(readable, []byte("image"), 0644))
+	unreadable := filepath.Join(dir, "secret.img")
+	require.NoError(t, ioutil.WriteFile(unreadable, []byte("image"), 0000))
+
+	require.NoError(t, checkImageReadable(readable))
+
+	err := checkImageReadable(filepath.Join(dir, "missing.img"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "does not exist")
+
+	err = checkImageReadable(dir)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is a directory")
+
+	// root can read files regardless of their mode
+	if os.Geteuid() != 0 {
+		err = checkImageReadable(unreadable)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "permission denied")
+	}
+}
+
+func TestIsSubpath(t *testing.T) {
+	cases := []struct {
+		parent, path string
+		sub          bool
+	}{
+		{"/a", "/a", true},
+		{"/a", "/a/b/c", true},
+		{"/a", "/a/../a/b", true},
+		{"/a", "/b", false},
+		{"/a", "/ab", false},
+		{"/a/b", "/a", false},
+		{"/a", "a/b", false},
+	}
+	for _, c := range cases {
+		require.Equal(t, c.sub, isSubpath(c.parent, c.path), "isSubpath(%q, %q)", c.parent, c.path)
+	}
+}
+
+func TestValidateAccelerators(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("KVM is only detected on linux")
+	}
+
+	orig := kvmDevicePath
+	defer func() { kvmDevicePath = orig }()
+	kvmDevicePath = filepath.Join(t.TempDir(), "missing")
+
+	cases := []struct {
+		chain string
+		err   string
+	}{
+		{chain: "tcg"},
+		{chain: "kvm:tcg"},
+		{chain: "hvf:kvm:tcg"},
+		{chain: "kvm", err: `accelerator "kvm" not available`},
+		{chain: "tcg:kvm", err: `fallback accelerator "kvm" of "tcg:kvm" not available`},
+		{chain: "kvm:foo", err: `unknown accelerator "foo"`},
+		{chain: "kvm:", err: `unknown accelerator ""`},
+	}
+	for _, c := range cases {
+		t.Run(c.chain, func(t *testing.T) {
+			err := validateAccelerators(c.chain)
+			if c.err == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Contains(t, err.Error(), c.err)
+		})
+	}
+}
+
+func TestSafeNameRegex(t *testing.T) {
+	for _, name := range []string{"pc", "pc-q35-4.2", "virt", "my_vm.1"} {
+		require.True(t, safeNameRegex.MatchString(name), name)
+	}
+	for _, name := range []string{"", "-pc", "q35,kernel_irqchip=off", "vm name", "vm\nname"} {
+		require.False(t, safeNameRegex.MatchString(name), name)
+	}
+
+	require.Equal(t, "my-image.qcow2", unsafeNameCharsRegex.ReplaceAllString("my image.qcow2", "-"))
+	require.Equal(t, "a-b-c", unsafeNameCharsRegex.ReplaceAllString("a,b=c", "-"))
+}
+
+func TestStopTask_GracefulShutdown(t *testing.T) {
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+
+	path, cmds := fakeQMPServer(t, func(qmpCommand) string { return `{"return": {}}` })
+	h := &taskHandle{
+		exec:             &fakeExecutor{},
+		taskConfig:       &drivers.TaskConfig{ID: "task-1"},
+		monitorPath:      path,
+		gracefulShutdown: true,
+		// the guest has already powered off when the monitor is checked
+		procState: drivers.TaskStateExited,
+		logger:    hclog.NewNullLogger(),
+	}
+	d.tasks.Set("task-1", h)
+
+	require.NoError(t, d.StopTask("task-1", time.Second, "SIGINT"))
+	require.Equal(t, "qmp_capabilities", (<-cmds).Execute)
+	require.Equal(t, "system_powerdown", (<-cmds).Execute)
+	require.True(t, h.isPoweringDown())
+}
+
+func TestEmitEvent(t *testing.T) {
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := d.TaskEvents(ctx)
+	require.NoError(t, err)
+
+	cfg := &drivers.TaskConfig{ID: "task-1", AllocID: "alloc-1", Name: "vm"}
+	d.emitEvent(cfg, "Starting QEMU VM", map[string]string{"vm_id": "linux"})
+
+	select {
+	case event := <-events:
+		require.Equal(t, "task-1", event.TaskID)
+		require.Equal(t, "alloc-1", event.AllocID)
+		require.Equal(t, "vm", event.TaskName)
+		require.Equal(t, "Starting QEMU VM", event.Message)
+		require.Equal(t, map[string]string{"vm_id": "linux"}, event.Annotations)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the task event")
+	}
+}
+
+func TestCapabilities_NetIsolation(t *testing.T) {
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	caps, err := d.Capabilities()
+	require.NoError(t, err)
+	require.Equal(t, []drivers.NetIsolationMode{
+		drivers.NetIsolationModeNone,
+		drivers.NetIsolationModeGroup,
+	}, caps.NetIsolationModes)
+	require.False(t, caps.MustInitiateNetwork)
+}
+
+func TestCapabilities_Exec(t *testing.T) {
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	caps, err := d.Capabilities()
+	require.NoError(t, err)
+	require.False(t, caps.Exec)
+
+	if runtime.GOOS == "windows" {
+		t.Skip("the guest agent is unsupported on Windows")
+	}
+
+	// exec is advertised once every VM has a guest agent channel
+	var c *Config
+	hclutils.NewConfigParser(configSpec).ParseHCL(t, `
+config {
+  enable_guest_agent = true
+}`, &c)
+	require.True(t, c.EnableGuestAgent)
+	var data []byte
+	require.NoError(t, base.MsgPackEncode(&data, c))
+	require.NoError(t, d.SetConfig(&base.Config{PluginConfig: data}))
+
+	caps, err = d.Capabilities()
+	require.NoError(t, err)
+	require.True(t, caps.Exec)
+	require.False(t, capabilities.Exec)
+
+	cfg, tc := testBuildTask(t)
+	cmd, err := d.buildQemuArgs(cfg, tc)
+	require.NoError(t, err)
+	require.NotEmpty(t, cmd.agentPath)
+	require.Contains(t, cmd.args, "virtserialport,chardev=qga0,name=org.qemu.guest_agent.0")
+}
+
+func TestSetConfig_DefaultAccelerator(t *testing.T) {
+	config := `
+config {
+  default_accelerator = "tcg"
+}`
+
+	var c *Config
+	hclutils.NewConfigParser(configSpec).ParseHCL(t, config, &c)
+	require.Equal(t, "tcg", c.DefaultAccelerator)
+
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	var data []byte
+	require.NoError(t, base.MsgPackEncode(&data, c))
+	require.NoError(t, d.SetConfig(&base.Config{PluginConfig: data}))
+	require.Equal(t, "tcg", d.config.DefaultAccelerator)
+
+	c.DefaultAccelerator = "kvm:foo"
+	require.NoError(t, base.MsgPackEncode(&data, c))
+	err := d.SetConfig(&base.Config{PluginConfig: data})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `invalid default_accelerator: unknown accelerator "foo"`)
+}
+
+func TestSetConfig_ExecutorLogLevel(t *testing.T) {
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	require.Equal(t, "info", d.config.ExecutorLogLevel)
+
+	require.NoError(t, d.SetConfig(&base.Config{}))
+	require.Equal(t, "info", d.config.ExecutorLogLevel)
+
+	var data []byte
+	require.NoError(t, base.MsgPackEncode(&data, &Config{ExecutorLogLevel: "trace"}))
+	require.NoError(t, d.SetConfig(&base.Config{PluginConfig: data}))
+	require.Equal(t, "trace", d.config.ExecutorLogLevel)
+
+	require.NoError(t, base.MsgPackEncode(&data, &Config{ExecutorLogLevel: "verbose"}))
+	err := d.SetConfig(&base.Config{PluginConfig: data})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `invalid executor_log_level "verbose"`)
+}
+
+func TestSetConfig_AllowExtraArgs(t *testing.T) {
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	require.True(t, d.config.AllowExtraArgs)
+
+	// passthrough stays allowed without plugin configuration
+	require.NoError(t, d.SetConfig(&base.Config{}))
+	require.True(t, d.config.AllowExtraArgs)
+
+	var data []byte
+	require.NoError(t, base.MsgPackEncode(&data, &Config{AllowExtraArgs: false}))
+	require.NoError(t, d.SetConfig(&base.Config{PluginConfig: data}))
+	require.False(t, d.config.AllowExtraArgs)
+}
+
+func TestSetConfig_CPUSharesPerVCPU(t *testing.T) {
+	var c *Config
+	hclutils.NewConfigParser(configSpec).ParseHCL(t, `
+config {
+  cpu_shares_per_vcpu = 2000
+}`, &c)
+	require.Equal(t, int64(2000), c.CPUSharesPerVCPU)
+
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	var data []byte
+	require.NoError(t, base.MsgPackEncode(&data, c))
+	require.NoError(t, d.SetConfig(&base.Config{PluginConfig: data}))
+	require.Equal(t, int64(2000), d.config.CPUSharesPerVCPU)
+
+	c.CPUSharesPerVCPU = -1
+	require.NoError(t, base.MsgPackEncode(&data, c))
+	err := d.SetConfig(&base.Config{PluginConfig: data})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cpu_shares_per_vcpu must not be negative")
+}
+
+func TestConfig_AllowExtraArgsDefault(t *testing.T) {
+	var c *Config
+	hclutils.NewConfigParser(configSpec).ParseHCL(t, `
+config {
+  image_paths = ["/var/lib/images"]
+}`, &c)
+	require.True(t, c.AllowExtraArgs)
+
+	hclutils.NewConfigParser(configSpec).ParseHCL(t, `
+config {
+  allow_extra_args = false
+}`, &c)
+	require.False(t, c.AllowExtraArgs)
+}
+
+func TestRecoverExitedTask(t *testing.T) {
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	dir := t.TempDir()
+	monitorPath := filepath.Join(dir, qemuMonitorSocketName)
+	require.NoError(t, ioutil.WriteFile(monitorPath, nil, 0600))
+
+	// the task is registered as exited and its files are removed
+	d.recoverExitedTask(&TaskState{
+		TaskConfig:  &drivers.TaskConfig{ID: "task-1", Name: "vm"},
+		Pid:         123456,
+		MonitorPath: monitorPath,
+		StartedAt:   time.Now(),
+	})
+	status, err := d.InspectTask("task-1")
+	require.NoError(t, err)
+	require.Equal(t, drivers.TaskStateExited, status.State)
+	require.Contains(t, status.ExitResult.Err.Error(), "qemu process 123456 is no longer running")
+	_, err = os.Stat(monitorPath)
+	require.True(t, os.IsNotExist(err))
+
+	ch, err := d.WaitTask(context.Background(), "task-1")
+	require.NoError(t, err)
+	select {
+	case result := <-ch:
+		require.Error(t, result.Err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the exit result")
+	}
+
+	// there is no executor left to stop or signal
+	require.NoError(t, d.StopTask("task-1", time.Second, "SIGINT"))
+	err = d.SignalTask("task-1", "SIGHUP")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is not running")
+	require.NoError(t, d.DestroyTask("task-1", false))
+}
+
+func TestRecoverTask_ProcessGone(t *testing.T) {
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	require.Error(t, d.RecoverTask(nil))
+
+	cfg := &drivers.TaskConfig{ID: "task-1", Name: "vm", AllocDir: t.TempDir()}
+	require.NoError(t, cfg.EncodeConcreteDriverConfig(&TaskConfig{ImagePath: "linux.img"}))
+
+	handle := drivers.NewTaskHandle(taskHandleVersion)
+	handle.Config = cfg
+	require.NoError(t, handle.SetDriverState(&TaskState{
+		TaskConfig: cfg,
+		Pid:        123456,
+		StartedAt:  time.Now(),
+	}))
+
+	// the driver config is decoded from the handle and the task whose
+	// process is gone is recovered as exited
+	require.NoError(t, d.RecoverTask(handle))
+	status, err := d.InspectTask("task-1")
+	require.NoError(t, err)
+	require.Equal(t, drivers.TaskStateExited, status.State)
+
+	// recovering a known task is a no-op
+	require.NoError(t, d.RecoverTask(handle))
+}
+
+func TestQemuExecCommand(t *testing.T) {
+	cfg := &drivers.TaskConfig{
+		ID:         "task-1",
+		Name:       "vm",
+		AllocDir:   "/var/nomad/alloc/alloc-1",
+		User:       "nobody",
+		Env:        map[string]string{"FOO": "bar"},
+		StdoutPath: "/var/nomad/alloc/alloc-1/alloc/logs/.vm.stdout.fifo",
+		StderrPath: "/var/nomad/alloc/alloc-1/alloc/logs/.vm.stderr.fifo",
+	}
+
+	cmd := qemuExecCommand(cfg, []string{"qemu-system-x86_64", "-machine", "type=pc,accel=tcg", "-nographic"})
+	require.Equal(t, "qemu-system-x86_64", cmd.Cmd)
+	require.Equal(t, []string{"-machine", "type=pc,accel=tcg", "-nographic"}, cmd.Args)
+	require.Equal(t, []string{"FOO=bar"}, cmd.Env)
+	require.Equal(t, "nobody", cmd.User)
+	require.Equal(t, filepath.Join(cfg.AllocDir, "vm"), cmd.TaskDir)
+	// qemu's output goes to the task's logs
+	require.Equal(t, cfg.StdoutPath, cmd.StdoutPath)
+	require.Equal(t, cfg.StderrPath, cmd.StderrPath)
+}
@@ -0,0 +1,41 @@
+package alt_qemu
+
+import (
+	"fmt"
+	"strings"
+)
+
+// checkExtraArgs returns an error if any of args, given by the task option
+// named option, could smuggle more than a single argument to qemu.
+func checkExtraArgs(option string, args []string) error {
+	for _, arg := range args {
+		if arg == "" {
+			return fmt.Errorf("%s must not contain empty entries", option)
+		}
+		if strings.ContainsAny(arg, "\x00\r\n") {
+			return fmt.Errorf("%s entry %q must not contain NUL bytes or line breaks", option, arg)
+		}
+	}
+	return nil
+}
+
+// extraArgs returns the arguments adding the extra_devices and extra_args of
+// tc, in order, for devices and options the driver does not model. The
+// verbatim args of tc are validated alongside them.
+func extraArgs(tc *TaskConfig) ([]string, error) {
+	if err := checkExtraArgs("args", tc.Args); err != nil {
+		return nil, err
+	}
+	if err := checkExtraArgs("extra_devices", tc.ExtraDevices); err != nil {
+		return nil, err
+	}
+	if err := checkExtraArgs("extra_args", tc.ExtraArgs); err != nil {
+		return nil, err
+	}
+
+	var args []string
+	for _, device := range tc.ExtraDevices {
+		args = append(args, "-device", device)
+	}
+	return append(args, tc.ExtraArgs...), nil
+}
@@ -0,0 +1,84 @@
+package alt_qemu
+
+import (
+	"testing"
+
+	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskConfig_Extra(t *testing.T) {
+	var tc *TaskConfig
+	hclutils.NewConfigParser(taskConfigSpec).ParseHCL(t, `
+config {
+  image_path    = "linux.img"
+  extra_devices = ["virtio-keyboard-pci", "usb-tablet"]
+  extra_args    = ["-no-hpet"]
+}`, &tc)
+	require.Equal(t, []string{"virtio-keyboard-pci", "usb-tablet"}, tc.ExtraDevices)
+	require.Equal(t, []string{"-no-hpet"}, tc.ExtraArgs)
+}
+
+func TestExtraArgs(t *testing.T) {
+	args, err := extraArgs(&TaskConfig{})
+	require.NoError(t, err)
+	require.Empty(t, args)
+
+	args, err = extraArgs(&TaskConfig{
+		ExtraDevices: []string{"virtio-keyboard-pci", "usb-tablet"},
+		ExtraArgs:    []string{"-global", "kvm-pit.lost_tick_policy=discard"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"-device", "virtio-keyboard-pci",
+		"-device", "usb-tablet",
+		"-global", "kvm-pit.lost_tick_policy=discard",
+	}, args)
+}
+
+func TestExtraArgs_Errors(t *testing.T) {
+	cases := []struct {
+		name string
+		tc   TaskConfig
+		err  string
+	}{
+		{
+			name: "empty verbatim arg",
+			tc:   TaskConfig{Args: []string{""}},
+			err:  "args must not contain empty entries",
+		},
+		{
+			name: "verbatim arg with line break",
+			tc:   TaskConfig{Args: []string{"-S\n-no-shutdown"}},
+			err:  "must not contain NUL bytes or line breaks",
+		},
+		{
+			name: "empty device",
+			tc:   TaskConfig{ExtraDevices: []string{""}},
+			err:  "extra_devices must not contain empty entries",
+		},
+		{
+			name: "empty arg",
+			tc:   TaskConfig{ExtraArgs: []string{"-no-hpet", ""}},
+			err:  "extra_args must not contain empty entries",
+		},
+		{
+			name: "line break",
+			tc:   TaskConfig{ExtraArgs: []string{"-no-hpet\n-S"}},
+			err:  "must not contain NUL bytes or line breaks",
+		},
+		{
+			name: "nul byte",
+			tc:   TaskConfig{ExtraDevices: []string{"usb-tablet\x00"}},
+			err:  "must not contain NUL bytes or line breaks",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := extraArgs(&c.tc)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), c.err)
+		})
+	}
+}
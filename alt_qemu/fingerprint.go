@@ -0,0 +1,125 @@
+package alt_qemu
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// qemuSystemBinPrefix is the prefix of the qemu system emulator binaries,
+	// which are suffixed by the guest architecture they emulate
+	qemuSystemBinPrefix = "qemu-system-"
+
+	// driverArchAttrPrefix prefixes the node attributes reporting the guest
+	// architectures qemu can emulate on the node
+	driverArchAttrPrefix = "driver.qemu.arch."
+
+	// driverImgAttr, driverImgVersionAttr and driverImgPathAttr report the
+	// presence, version and resolved path of the qemu-img binary
+	driverImgAttr        = "driver.qemu.img"
+	driverImgVersionAttr = "driver.qemu.img.version"
+	driverImgPathAttr    = "driver.qemu.img.path"
+
+	// probeTimeout bounds the run of the qemu launch probe
+	probeTimeout = 10 * time.Second
+)
+
+// qemuImgVersion resolves the qemu-img binary bin and returns its absolute
+// path and reported version.
+func qemuImgVersion(bin string) (string, string, error) {
+	path, err := GetAbsolutePath(bin)
+	if err != nil {
+		return "", "", err
+	}
+
+	out, err := exec.Command(path, "--version").Output()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to run %q: %v", path, err)
+	}
+
+	version, _, ok := parseQemuVersion(string(out))
+	if !ok {
+		return "", "", fmt.Errorf("failed to parse qemu-img version from %q", strings.TrimSpace(string(out)))
+	}
+	return path, version, nil
+}
+
+// parseQemuVersion parses the --version output of a qemu binary, returning
+// the version number and the full version including the build suffix, if
+// any.
+func parseQemuVersion(out string) (string, string, bool) {
+	matches := versionRegex.FindStringSubmatch(out)
+	if len(matches) != 3 {
+		return "", "", false
+	}
+	version := matches[1]
+	full := version
+	if matches[2] != "" {
+		full += " " + matches[2]
+	}
+	return version, full, true
+}
+
+// qemuSystemArchs scans the directories of PATH for qemu system emulator
+// binaries and returns the guest architectures whose binary reports a
+// version.
+func qemuSystemArchs() []string {
+	seen := map[string]bool{}
+	var archs []string
+
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		matches, err := filepath.Glob(filepath.Join(dir, qemuSystemBinPrefix+"*"))
+		if err != nil {
+			continue
+		}
+
+		for _, bin := range matches {
+			arch := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(bin), qemuSystemBinPrefix), ".exe")
+			if arch == "" || seen[arch] {
+				continue
+			}
+
+			out, err := exec.Command(bin, "--version").Output()
+			if err != nil {
+				continue
+			}
+			if !versionRegex.Match(out) {
+				continue
+			}
+
+			seen[arch] = true
+			archs = append(archs, arch)
+		}
+	}
+
+	return archs
+}
+
+// probeQemu launches the qemu system emulator bin with no machine using the
+// accelerator chain accel and quits it right away, returning an error if qemu
+// cannot run, e.g. because the accelerator modules are missing.
+func probeQemu(bin, accel string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, bin,
+		"-machine", "none,accel="+accel,
+		"-display", "none",
+		"-nodefaults",
+		"-monitor", "stdio",
+	)
+	cmd.Stdin = strings.NewReader("quit\n")
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("qemu did not quit within %v", probeTimeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package alt_qemu
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+// writeFakeBinary writes an executable shell script named name to dir.
+func writeFakeBinary(t *testing.T, dir, name, script string) {
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script+"\n"), 0755))
+}
+
+// setPath sets the PATH environment variable for the duration of the test.
+func setPath(t *testing.T, path string) {
+	old := os.Getenv("PATH")
+	require.NoError(t, os.Setenv("PATH", path))
+	t.Cleanup(func() { os.Setenv("PATH", old) })
+}
+
+func TestQemuSystemArchs(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake binaries are shell scripts")
+	}
+
+	dir1, dir2 := t.TempDir(), t.TempDir()
+	writeFakeBinary(t, dir1, "qemu-system-x86_64", `echo "QEMU emulator version 4.2.0"`)
+	writeFakeBinary(t, dir1, "qemu-system-broken", `exit 1`)
+	writeFakeBinary(t, dir1, "qemu-system-noversion", `echo "not qemu"`)
+	writeFakeBinary(t, dir2, "qemu-system-aarch64", `echo "QEMU emulator version 5.0.0"`)
+	// shadowed by the binary found earlier in PATH
+	writeFakeBinary(t, dir2, "qemu-system-x86_64", `exit 1`)
+	setPath(t, dir1+string(filepath.ListSeparator)+dir2)
+
+	require.ElementsMatch(t, []string{"x86_64", "aarch64"}, qemuSystemArchs())
+}
+
+func TestQemuImgVersion(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake binaries are shell scripts")
+	}
+
+	dir := t.TempDir()
+	writeFakeBinary(t, dir, "qemu-img", `echo "qemu-img version 4.2.1 (Debian 1:4.2-3ubuntu6)"`)
+	writeFakeBinary(t, dir, "qemu-img-garbled", `echo "qemu-img"`)
+	setPath(t, dir)
+
+	path, version, err := qemuImgVersion("qemu-img")
+	require.NoError(t, err)
+	expected, err := filepath.EvalSymlinks(filepath.Join(dir, "qemu-img"))
+	require.NoError(t, err)
+	require.Equal(t, expected, path)
+	require.Equal(t, "4.2.1", version)
+
+	_, _, err = qemuImgVersion("qemu-img-garbled")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to parse qemu-img version")
+
+	_, _, err = qemuImgVersion("qemu-img-missing")
+	require.Error(t, err)
+}
+
+func TestParseQemuVersion(t *testing.T) {
+	cases := []struct {
+		out     string
+		version string
+		full    string
+		ok      bool
+	}{
+		{
+			out:     "QEMU emulator version 8.2.0 (Debian 1:8.2.0+dfsg-1)\nCopyright (c) 2003-2023 Fabrice Bellard and the QEMU Project developers",
+			version: "8.2.0",
+			full:    "8.2.0 (Debian 1:8.2.0+dfsg-1)",
+			ok:      true,
+		},
+		{
+			out:     "qemu-img version 2.11.1(Debian 1:2.11+dfsg-1ubuntu7.41)",
+			version: "2.11.1",
+			full:    "2.11.1 (Debian 1:2.11+dfsg-1ubuntu7.41)",
+			ok:      true,
+		},
+		{
+			out:     "QEMU emulator version 4.2.0",
+			version: "4.2.0",
+			full:    "4.2.0",
+			ok:      true,
+		},
+		{out: "not qemu"},
+	}
+	for _, c := range cases {
+		t.Run(c.out, func(t *testing.T) {
+			version, full, ok := parseQemuVersion(c.out)
+			require.Equal(t, c.ok, ok)
+			require.Equal(t, c.version, version)
+			require.Equal(t, c.full, full)
+		})
+	}
+}
+
+func TestQemuBins(t *testing.T) {
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	require.Equal(t, defaultQemuSystemBin, d.qemuSystemBin())
+	require.Equal(t, defaultQemuImgBin, d.qemuImgBin())
+
+	d.config.QemuSystemBin = "/opt/qemu/bin/qemu-system-aarch64"
+	d.config.QemuImgBin = "/opt/qemu/bin/qemu-img"
+	require.Equal(t, "/opt/qemu/bin/qemu-system-aarch64", d.qemuSystemBin())
+	require.Equal(t, "/opt/qemu/bin/qemu-img", d.qemuImgBin())
+}
+
+func TestBuildFingerprint_ConfiguredBin(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("fake binaries are shell scripts")
+	}
+
+	dir := t.TempDir()
+	writeFakeBinary(t, dir, "qemu-custom", `echo "QEMU emulator version 8.2.0 (Debian 1:8.2.0+dfsg-1)"`)
+
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	d.config.QemuSystemBin = filepath.Join(dir, "qemu-custom")
+
+	fp := d.buildFingerprint()
+	require.Equal(t, drivers.HealthStateHealthy, fp.Health)
+	version, ok := fp.Attributes[driverVersionAttr].GetString()
+	require.True(t, ok)
+	require.Equal(t, "8.2.0", version)
+	full, ok := fp.Attributes[driverVersionFullAttr].GetString()
+	require.True(t, ok)
+	require.Equal(t, "8.2.0 (Debian 1:8.2.0+dfsg-1)", full)
+}
+
+func TestProbeQemu(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake binaries are shell scripts")
+	}
+
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "args.log")
+	writeFakeBinary(t, dir, "qemu-ok", `echo "$@" > `+logPath)
+	writeFakeBinary(t, dir, "qemu-broken", `echo "failed to initialize kvm: No such file or directory" >&2; exit 1`)
+
+	require.NoError(t, probeQemu(filepath.Join(dir, "qemu-ok"), "kvm:tcg"))
+	data, err := ioutil.ReadFile(logPath)
+	require.NoError(t, err)
+	require.Equal(t, "-machine none,accel=kvm:tcg -display none -nodefaults -monitor stdio\n", string(data))
+
+	err = probeQemu(filepath.Join(dir, "qemu-broken"), "kvm")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to initialize kvm")
+}
+
+func TestBuildFingerprint_HealthProbe(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("fake binaries are shell scripts")
+	}
+
+	// the fake qemu reports its version but fails to launch VMs
+	dir := t.TempDir()
+	writeFakeBinary(t, dir, "qemu-custom", `[ "$1" = "--version" ] && { echo "QEMU emulator version 8.2.0"; exit 0; }
+echo "no accelerator found" >&2
+exit 1`)
+
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	d.config.QemuSystemBin = filepath.Join(dir, "qemu-custom")
+	d.config.DefaultAccelerator = "tcg"
+	require.Equal(t, drivers.HealthStateHealthy, d.buildFingerprint().Health)
+
+	d.config.HealthProbe = true
+	fp := d.buildFingerprint()
+	require.Equal(t, drivers.HealthStateUnhealthy, fp.Health)
+	require.Contains(t, fp.HealthDescription, `qemu failed to launch with accelerator "tcg"`)
+	require.Contains(t, fp.HealthDescription, "no accelerator found")
+}
@@ -0,0 +1,89 @@
+package alt_qemu
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// firmwareVarsName is the name of the per-VM copy of the UEFI variable store
+// in the task directory
+const firmwareVarsName = "efivars.fd"
+
+// FirmwareConfig selects the UEFI firmware booting the VM, e.g. OVMF
+type FirmwareConfig struct {
+	Code string `codec:"code"` // read-only firmware code, e.g. OVMF_CODE.fd
+	Vars string `codec:"vars"` // variable store template, e.g. OVMF_VARS.fd
+}
+
+// IsSet returns whether a firmware was configured.
+func (c *FirmwareConfig) IsSet() bool {
+	return c.Code != "" || c.Vars != ""
+}
+
+// firmwareArgs returns the pflash drives loading the firmware of c. The vars
+// are loaded from the copy in taskDir made by copyFirmwareVars.
+func firmwareArgs(taskDir string, c *FirmwareConfig) ([]string, error) {
+	if c.Code == "" {
+		return nil, fmt.Errorf("firmware code must be set")
+	}
+	code, err := escapeOptionValue(c.Code)
+	if err != nil {
+		return nil, fmt.Errorf("invalid firmware code: %v", err)
+	}
+	args := []string{
+		"-drive", fmt.Sprintf("if=pflash,format=raw,readonly=on,file=%s", code),
+	}
+	if c.Vars == "" {
+		return args, nil
+	}
+
+	varsPath, err := escapeOptionValue(filepath.Join(taskDir, firmwareVarsName))
+	if err != nil {
+		return nil, fmt.Errorf("invalid firmware vars: %v", err)
+	}
+	return append(args, "-drive", fmt.Sprintf("if=pflash,format=raw,readonly=off,file=%s", varsPath)), nil
+}
+
+// copyFirmwareVars copies the vars template of c into taskDir so every VM has
+// its own NVRAM, returning the path of the copy. The copy is removed with the
+// other files of the task; an existing copy is kept.
+func copyFirmwareVars(taskDir string, c *FirmwareConfig) (string, error) {
+	if c.Vars == "" {
+		return "", nil
+	}
+	varsPath := filepath.Join(taskDir, firmwareVarsName)
+	if _, err := os.Stat(varsPath); os.IsNotExist(err) {
+		if err := copyFile(resolveTaskPath(taskDir, c.Vars), varsPath); err != nil {
+			return "", fmt.Errorf("failed to copy firmware vars %q: %v", c.Vars, err)
+		}
+	} else if err != nil {
+		return "", fmt.Errorf("failed to stat firmware vars: %v", err)
+	}
+	return varsPath, nil
+}
+
+// copyFile copies the contents of src to a new file dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return nil
+}
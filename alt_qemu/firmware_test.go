@@ -0,0 +1,98 @@
+package alt_qemu
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskConfig_Firmware(t *testing.T) {
+	config := `
+config {
+  image_path = "linux.img"
+  firmware {
+    code = "/usr/share/OVMF/OVMF_CODE.fd"
+    vars = "/usr/share/OVMF/OVMF_VARS.fd"
+  }
+}`
+
+	var tc *TaskConfig
+	hclutils.NewConfigParser(taskConfigSpec).ParseHCL(t, config, &tc)
+
+	require.Equal(t, FirmwareConfig{
+		Code: "/usr/share/OVMF/OVMF_CODE.fd",
+		Vars: "/usr/share/OVMF/OVMF_VARS.fd",
+	}, tc.Firmware)
+	require.True(t, tc.Firmware.IsSet())
+}
+
+func TestFirmwareArgs(t *testing.T) {
+	taskDir := t.TempDir()
+	varsPath := filepath.Join(taskDir, firmwareVarsName)
+
+	args, err := firmwareArgs(taskDir, &FirmwareConfig{Code: "/usr/share/OVMF/OVMF_CODE.fd"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"-drive", "if=pflash,format=raw,readonly=on,file=/usr/share/OVMF/OVMF_CODE.fd"}, args)
+
+	// the vars are loaded from the task's copy, which is not made here
+	args, err = firmwareArgs(taskDir, &FirmwareConfig{Code: "/usr/share/OVMF/OVMF_CODE.fd", Vars: "OVMF_VARS.fd"})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"-drive", "if=pflash,format=raw,readonly=on,file=/usr/share/OVMF/OVMF_CODE.fd",
+		"-drive", "if=pflash,format=raw,readonly=off,file=" + varsPath,
+	}, args)
+	_, err = os.Stat(varsPath)
+	require.True(t, os.IsNotExist(err))
+
+	_, err = firmwareArgs(taskDir, &FirmwareConfig{Vars: "OVMF_VARS.fd"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "firmware code must be set")
+}
+
+func TestFirmwareArgs_Escaping(t *testing.T) {
+	// a comma in a path does not add options to the drive
+	taskDir := filepath.Join(t.TempDir(), "a,b")
+	args, err := firmwareArgs(taskDir, &FirmwareConfig{Code: "/srv/OVMF_CODE.fd,readonly=off", Vars: "OVMF_VARS.fd"})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"-drive", "if=pflash,format=raw,readonly=on,file=/srv/OVMF_CODE.fd,,readonly=off",
+		"-drive", "if=pflash,format=raw,readonly=off,file=" + strings.Replace(filepath.Join(taskDir, firmwareVarsName), ",", ",,", -1),
+	}, args)
+
+	_, err = firmwareArgs(taskDir, &FirmwareConfig{Code: "/srv/OVMF_CODE.fd\n"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid firmware code")
+}
+
+func TestCopyFirmwareVars(t *testing.T) {
+	taskDir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(taskDir, "OVMF_VARS.fd"), []byte("template"), 0644))
+
+	path, err := copyFirmwareVars(taskDir, &FirmwareConfig{Code: "/usr/share/OVMF/OVMF_CODE.fd"})
+	require.NoError(t, err)
+	require.Empty(t, path)
+
+	path, err = copyFirmwareVars(taskDir, &FirmwareConfig{Code: "/usr/share/OVMF/OVMF_CODE.fd", Vars: "OVMF_VARS.fd"})
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(taskDir, firmwareVarsName), path)
+	vars, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "template", string(vars))
+
+	// an existing copy keeps the variables written by the guest
+	require.NoError(t, ioutil.WriteFile(path, []byte("modified"), 0600))
+	_, err = copyFirmwareVars(taskDir, &FirmwareConfig{Code: "/usr/share/OVMF/OVMF_CODE.fd", Vars: "OVMF_VARS.fd"})
+	require.NoError(t, err)
+	vars, err = ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "modified", string(vars))
+
+	_, err = copyFirmwareVars(t.TempDir(), &FirmwareConfig{Code: "OVMF_CODE.fd", Vars: "missing.fd"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `failed to copy firmware vars "missing.fd"`)
+}
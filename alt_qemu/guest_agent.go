@@ -0,0 +1,215 @@
+package alt_qemu
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// qemuGuestAgentSocketName is the name of the guest agent socket created
+	// in the task directory
+	qemuGuestAgentSocketName = "qga.sock"
+
+	// guestExecPollInterval is the interval at which the status of a command
+	// run through the guest agent is polled
+	guestExecPollInterval = 100 * time.Millisecond
+
+	// guestAddressTimeout bounds how long StartTask waits for a bridged
+	// guest to report its address through the guest agent
+	guestAddressTimeout = 60 * time.Second
+)
+
+// guestExecStatus is the result of the guest-exec-status guest agent command
+type guestExecStatus struct {
+	Exited   bool   `json:"exited"`
+	ExitCode int    `json:"exitcode"`
+	Signal   int    `json:"signal"`
+	OutData  string `json:"out-data"`
+	ErrData  string `json:"err-data"`
+}
+
+// guestAgentArgs returns the arguments exposing the guest agent channel of
+// the VM on the socket at agentPath.
+func guestAgentArgs(agentPath string) []string {
+	return []string{
+		"-chardev", fmt.Sprintf("socket,path=%s,server=on,wait=off,id=qga0", agentPath),
+		"-device", "virtio-serial",
+		"-device", "virtserialport,chardev=qga0,name=org.qemu.guest_agent.0",
+	}
+}
+
+// guestAgentExecute connects to the qemu guest agent socket at agentPath,
+// synchronizes with the agent and executes cmd, returning the command's
+// result. The connection is bounded by timeout, if positive.
+func guestAgentExecute(agentPath string, timeout time.Duration, cmd string, args map[string]interface{}) (json.RawMessage, error) {
+	// net.DialTimeout fails right away with a negative timeout
+	if timeout < 0 {
+		timeout = 0
+	}
+	conn, err := net.DialTimeout("unix", agentPath, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to guest agent %q: %v", agentPath, err)
+	}
+	defer conn.Close()
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+
+	// the agent has no greeting; guest-sync flushes any stale response left
+	// by a previous client and echoes our id back once in sync
+	id := rand.Int63()
+	for {
+		ret, err := qmpExchange(dec, enc, qmpCommand{Execute: "guest-sync", Arguments: map[string]interface{}{"id": id}})
+		if err != nil {
+			return nil, fmt.Errorf("failed to sync with guest agent: %v", err)
+		}
+		var synced int64
+		if json.Unmarshal(ret, &synced) == nil && synced == id {
+			break
+		}
+	}
+
+	return qmpExchange(dec, enc, qmpCommand{Execute: cmd, Arguments: args})
+}
+
+// guestExec runs cmd inside the guest through the guest agent at agentPath and
+// waits up to timeout for it to exit, returning its output and exit code.
+// It waits without a deadline when timeout is not positive, like the monitor
+// commands.
+func guestExec(agentPath string, cmd []string, timeout time.Duration) (*drivers.ExecTaskResult, error) {
+	if len(cmd) == 0 {
+		return nil, fmt.Errorf("command must be set")
+	}
+	deadline := time.Now().Add(timeout)
+
+	ret, err := guestAgentExecute(agentPath, timeout, "guest-exec", map[string]interface{}{
+		"path":           cmd[0],
+		"arg":            cmd[1:],
+		"capture-output": true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var started struct {
+		Pid int `json:"pid"`
+	}
+	if err := json.Unmarshal(ret, &started); err != nil {
+		return nil, fmt.Errorf("failed to decode guest-exec response: %v", err)
+	}
+
+	for {
+		// a zero remaining time leaves the connection without a deadline
+		var remaining time.Duration
+		if timeout > 0 {
+			remaining = time.Until(deadline)
+			if remaining <= 0 {
+				return nil, fmt.Errorf("timed out waiting for guest command %q to exit", cmd[0])
+			}
+		}
+
+		ret, err := guestAgentExecute(agentPath, remaining, "guest-exec-status", map[string]interface{}{"pid": started.Pid})
+		if err != nil {
+			return nil, err
+		}
+		var status guestExecStatus
+		if err := json.Unmarshal(ret, &status); err != nil {
+			return nil, fmt.Errorf("failed to decode guest-exec-status response: %v", err)
+		}
+
+		if status.Exited {
+			stdout, err := base64.StdEncoding.DecodeString(status.OutData)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode guest command stdout: %v", err)
+			}
+			stderr, err := base64.StdEncoding.DecodeString(status.ErrData)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode guest command stderr: %v", err)
+			}
+			return &drivers.ExecTaskResult{
+				Stdout: stdout,
+				Stderr: stderr,
+				ExitResult: &drivers.ExitResult{
+					ExitCode: status.ExitCode,
+					Signal:   status.Signal,
+				},
+			}, nil
+		}
+
+		time.Sleep(guestExecPollInterval)
+	}
+}
+
+// guestInterface is an entry of the guest-network-get-interfaces guest agent
+// command result
+type guestInterface struct {
+	Name            string `json:"name"`
+	HardwareAddress string `json:"hardware-address"`
+	IPAddresses     []struct {
+		Type    string `json:"ip-address-type"`
+		Address string `json:"ip-address"`
+	} `json:"ip-addresses"`
+}
+
+// guestAddress waits up to timeout for the guest to report an IPv4 address
+// through the guest agent at agentPath and returns it. When macAddress is set
+// only the interface with that hardware address is considered, otherwise the
+// first non-loopback interface with an address is used. It gives up early
+// when ctx is done or when qemu exits, as reported on exited.
+func guestAddress(ctx context.Context, agentPath, macAddress string, timeout time.Duration, exited <-chan int) (string, error) {
+	deadline := time.After(timeout)
+	var lastErr error
+	for {
+		raw, err := guestAgentExecute(agentPath, monitorTimeout, "guest-network-get-interfaces", nil)
+		if err != nil {
+			// the agent is not reachable until the guest has booted
+			lastErr = err
+		} else {
+			var ifaces []guestInterface
+			if err := json.Unmarshal(raw, &ifaces); err != nil {
+				return "", fmt.Errorf("failed to decode guest interfaces: %v", err)
+			}
+			if ip := guestIPv4(ifaces, macAddress); ip != "" {
+				return ip, nil
+			}
+			lastErr = fmt.Errorf("guest has no IPv4 address yet")
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case code := <-exited:
+			return "", fmt.Errorf("qemu exited with code %d before the guest reported its address", code)
+		case <-deadline:
+			return "", fmt.Errorf("failed to get the guest address within %v: %v", timeout, lastErr)
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// guestIPv4 returns the first non-loopback IPv4 address of ifaces, only
+// considering the interface with macAddress when it is set.
+func guestIPv4(ifaces []guestInterface, macAddress string) string {
+	for _, iface := range ifaces {
+		if macAddress != "" && !strings.EqualFold(iface.HardwareAddress, macAddress) {
+			continue
+		}
+		for _, addr := range iface.IPAddresses {
+			ip := net.ParseIP(addr.Address)
+			if addr.Type == "ipv4" && ip != nil && !ip.IsLoopback() && !ip.IsLinkLocalUnicast() {
+				return addr.Address
+			}
+		}
+	}
+	return ""
+}
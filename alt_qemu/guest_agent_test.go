@@ -0,0 +1,212 @@
+package alt_qemu
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeGuestAgent listens on a unix socket in a temporary directory and acts
+// as a qemu guest agent, answering guest-sync itself and every other command
+// through handle. It returns the socket path.
+func fakeGuestAgent(t *testing.T, handle func(cmd qmpCommand) string) string {
+	path := filepath.Join(t.TempDir(), "qemu-ga.sock")
+	l, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				dec := json.NewDecoder(conn)
+				dec.UseNumber()
+				for {
+					var cmd qmpCommand
+					if err := dec.Decode(&cmd); err != nil {
+						return
+					}
+					resp := ""
+					if cmd.Execute == "guest-sync" {
+						resp = fmt.Sprintf(`{"return": %s}`, cmd.Arguments["id"])
+					} else {
+						resp = handle(cmd)
+					}
+					conn.Write([]byte(resp + "\n"))
+				}
+			}()
+		}
+	}()
+	return path
+}
+
+func TestGuestExec(t *testing.T) {
+	polls := 0
+	path := fakeGuestAgent(t, func(cmd qmpCommand) string {
+		switch cmd.Execute {
+		case "guest-exec":
+			if cmd.Arguments["path"] != "/bin/echo" {
+				return `{"error": {"class": "GenericError", "desc": "unexpected path"}}`
+			}
+			return `{"return": {"pid": 7}}`
+		case "guest-exec-status":
+			polls++
+			if polls == 1 {
+				return `{"return": {"exited": false}}`
+			}
+			return fmt.Sprintf(`{"return": {"exited": true, "exitcode": 3, "out-data": %q, "err-data": %q}}`,
+				base64.StdEncoding.EncodeToString([]byte("hello\n")),
+				base64.StdEncoding.EncodeToString([]byte("oops\n")))
+		}
+		return `{"error": {"class": "CommandNotFound", "desc": "unknown command"}}`
+	})
+
+	result, err := guestExec(path, []string{"/bin/echo", "hello"}, 5*time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "hello\n", string(result.Stdout))
+	require.Equal(t, "oops\n", string(result.Stderr))
+	require.Equal(t, 3, result.ExitResult.ExitCode)
+	require.Equal(t, 2, polls)
+}
+
+func TestGuestExec_NoTimeout(t *testing.T) {
+	polls := 0
+	path := fakeGuestAgent(t, func(cmd qmpCommand) string {
+		if cmd.Execute == "guest-exec" {
+			return `{"return": {"pid": 7}}`
+		}
+		polls++
+		return fmt.Sprintf(`{"return": {"exited": %t, "exitcode": 0}}`, polls%3 == 0)
+	})
+
+	// a timeout that is not positive waits without a deadline
+	for _, timeout := range []time.Duration{0, -time.Second} {
+		result, err := guestExec(path, []string{"true"}, timeout)
+		require.NoError(t, err, timeout)
+		require.Equal(t, 0, result.ExitResult.ExitCode)
+	}
+	require.Equal(t, 6, polls)
+}
+
+func TestGuestExec_Errors(t *testing.T) {
+	_, err := guestExec("unused", nil, time.Second)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "command must be set")
+
+	_, err = guestExec(filepath.Join(t.TempDir(), "missing.sock"), []string{"true"}, time.Second)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to connect to guest agent")
+
+	path := fakeGuestAgent(t, func(cmd qmpCommand) string {
+		if cmd.Execute == "guest-exec" {
+			return `{"return": {"pid": 7}}`
+		}
+		return `{"return": {"exited": false}}`
+	})
+	_, err = guestExec(path, []string{"sleep", "60"}, 300*time.Millisecond)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "timed out")
+}
+
+func TestExecTask_NoGuestAgent(t *testing.T) {
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+
+	_, err := d.ExecTask("missing", []string{"true"}, time.Second)
+	require.Equal(t, drivers.ErrTaskNotFound, err)
+
+	d.tasks.Set("task-1", &taskHandle{taskConfig: &drivers.TaskConfig{ID: "task-1"}})
+	_, err = d.ExecTask("task-1", []string{"true"}, time.Second)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "has no guest agent channel")
+	require.Contains(t, err.Error(), "set enable_guest_agent")
+
+	// monitor commands do not need the guest agent
+	_, err = d.ExecTask("task-1", []string{"qemu-balloon"}, time.Second)
+	require.Error(t, err)
+	require.NotContains(t, err.Error(), "guest agent")
+}
+
+func TestGuestAgentArgs(t *testing.T) {
+	require.Equal(t, []string{
+		"-chardev", "socket,path=/alloc/task/qga.sock,server=on,wait=off,id=qga0",
+		"-device", "virtio-serial",
+		"-device", "virtserialport,chardev=qga0,name=org.qemu.guest_agent.0",
+	}, guestAgentArgs("/alloc/task/qga.sock"))
+}
+
+func TestTaskState_AgentPathRoundTrip(t *testing.T) {
+	handle := drivers.NewTaskHandle(taskHandleVersion)
+	state := TaskState{
+		TaskConfig: &drivers.TaskConfig{ID: "task-1"},
+		AgentPath:  "/alloc/task/qga.sock",
+	}
+	require.NoError(t, handle.SetDriverState(&state))
+
+	var recovered TaskState
+	require.NoError(t, handle.GetDriverState(&recovered))
+	require.Equal(t, state.AgentPath, recovered.AgentPath)
+}
+
+func TestGuestAddress(t *testing.T) {
+	path := fakeGuestAgent(t, func(cmd qmpCommand) string {
+		return `{"return": [
+  {"name": "lo", "hardware-address": "00:00:00:00:00:00", "ip-addresses": [
+    {"ip-address-type": "ipv4", "ip-address": "127.0.0.1"}]},
+  {"name": "eth0", "hardware-address": "52:54:00:12:34:56", "ip-addresses": [
+    {"ip-address-type": "ipv6", "ip-address": "fe80::5054:ff:fe12:3456"},
+    {"ip-address-type": "ipv4", "ip-address": "10.0.0.5"}]},
+  {"name": "eth1", "hardware-address": "52:54:00:ab:cd:ef", "ip-addresses": [
+    {"ip-address-type": "ipv4", "ip-address": "192.168.1.20"}]}
+]}`
+	})
+
+	addr, err := guestAddress(context.Background(), path, "", time.Second, nil)
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.5", addr)
+
+	addr, err = guestAddress(context.Background(), path, "52:54:00:AB:CD:EF", time.Second, nil)
+	require.NoError(t, err)
+	require.Equal(t, "192.168.1.20", addr)
+}
+
+func TestGuestAddress_Timeout(t *testing.T) {
+	path := fakeGuestAgent(t, func(cmd qmpCommand) string {
+		return `{"return": [{"name": "lo", "hardware-address": "00:00:00:00:00:00", "ip-addresses": [
+  {"ip-address-type": "ipv4", "ip-address": "127.0.0.1"}]}]}`
+	})
+
+	_, err := guestAddress(context.Background(), path, "", 500*time.Millisecond, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "guest has no IPv4 address yet")
+}
+
+func TestGuestAddress_Cancelled(t *testing.T) {
+	// the guest agent is not reachable while the guest boots
+	path := filepath.Join(t.TempDir(), qemuGuestAgentSocketName)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	_, err := guestAddress(ctx, path, "", time.Minute, nil)
+	require.Equal(t, context.Canceled, err)
+	require.True(t, time.Since(start) < 5*time.Second)
+
+	exited := make(chan int, 1)
+	exited <- 1
+	_, err = guestAddress(context.Background(), path, "", time.Minute, exited)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "qemu exited with code 1 before the guest reported its address")
+}
@@ -2,6 +2,10 @@ package alt_qemu
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
 	"strconv"
 	"sync"
 	"time"
@@ -29,7 +33,51 @@ type taskHandle struct {
 	exitResult   *drivers.ExitResult
 
 	// TODO: add any extra relevant information about the task.
-	pid int
+	pid             int
+	pidPath         string
+	monitorPath     string
+	monitorProtocol string
+	agentPath       string
+	seedPath        string
+	tpmPidPath      string
+	virtiofsdPids   []int
+	overlayPath     string
+	varsPath        string
+	vncPasswordPath string
+	serialPaths     []string
+
+	// netnsPath is the network namespace holding the tap device of the
+	// cni network mode, if any
+	netnsPath string
+
+	// attributes are the driver attributes reported in the task status,
+	// such as the consoles' addresses
+	attributes       map[string]string
+	gracefulShutdown bool
+	snapshots        bool
+
+	// balloonTarget is the guest memory in bytes last requested through the
+	// balloon device. It is reset to the task memory on recovery.
+	balloonEnabled bool
+	balloonTarget  int64
+
+	// memoryMb is the memory the VM was started with
+	memoryMb int64
+
+	// poweringDown is set while a graceful shutdown initiated by StopTask is
+	// in progress, so the VM exiting is reported as a clean stop
+	poweringDown bool
+
+	// stopRequested is set once StopTask has been called, so a SIGKILL sent
+	// by the executor is not mistaken for the OOM killer
+	stopRequested bool
+
+	// oomKillCount is the host OOM kill count when the task started
+	oomKillCount int64
+
+	// paused is set while the VM is paused, either because it awaits an
+	// incoming migration or through SIGSTOP, until SIGCONT resumes it
+	paused bool
 }
 
 func (h *taskHandle) TaskStatus() *drivers.TaskStatus {
@@ -37,16 +85,73 @@ func (h *taskHandle) TaskStatus() *drivers.TaskStatus {
 	defer h.stateLock.RUnlock()
 
 	return &drivers.TaskStatus{
-		ID:          h.taskConfig.ID,
-		Name:        h.taskConfig.Name,
-		State:       h.procState,
-		StartedAt:   h.startedAt,
-		CompletedAt: h.completedAt,
-		ExitResult:  h.exitResult,
-		DriverAttributes: map[string]string{
-			"pid": strconv.Itoa(h.pid),
-		},
+		ID:               h.taskConfig.ID,
+		Name:             h.taskConfig.Name,
+		State:            h.procState,
+		StartedAt:        h.startedAt,
+		CompletedAt:      h.completedAt,
+		ExitResult:       h.exitResult,
+		DriverAttributes: h.driverAttributes(),
+	}
+}
+
+// driverAttributes returns the task's driver attributes along with its pid
+// and, while it runs, whether the VM is running or paused.
+func (h *taskHandle) driverAttributes() map[string]string {
+	attrs := map[string]string{
+		"pid": strconv.Itoa(h.pid),
+	}
+	if h.procState == drivers.TaskStateRunning {
+		attrs["vm_status"] = "running"
+		if h.paused {
+			attrs["vm_status"] = "paused"
+		}
+	}
+	for k, v := range h.attributes {
+		attrs[k] = v
+	}
+	return attrs
+}
+
+// taskAttributes returns the driver attributes describing how to reach the
+// VM of task cfg: its monitor socket, serial sockets, consoles and the host
+// ports forwarded to the guest by user-mode networking.
+func taskAttributes(cfg *drivers.TaskConfig, tc *TaskConfig, monitorPath string, serialPaths []string) map[string]string {
+	attrs := map[string]string{}
+	if monitorPath != "" {
+		attrs["monitor_path"] = monitorPath
+	}
+	for i, path := range serialPaths {
+		attrs[fmt.Sprintf("serial_path.%d", i)] = path
+	}
+	display, _ := displayMode(tc)
+	if display == displayVNC {
+		attrs["vnc_address"] = tc.VNC.Address()
 	}
+	if display == displaySpice {
+		if tc.Spice.Port > 0 {
+			attrs["spice_address"] = net.JoinHostPort(tc.Spice.ListenAddr(), strconv.Itoa(tc.Spice.Port))
+		}
+		if tc.Spice.TLSPort > 0 {
+			attrs["spice_tls_address"] = net.JoinHostPort(tc.Spice.ListenAddr(), strconv.Itoa(tc.Spice.TLSPort))
+		}
+	}
+	if tc.NetworkMode == "" || tc.NetworkMode == "user" {
+		taskPorts := taskPortLabels(cfg)
+		for label, guestPort := range tc.PortMap {
+			if hostPort, ok := taskPorts[label]; ok {
+				attrs["port_forward."+label] = fmt.Sprintf("%d:%d", hostPort, guestPort)
+			}
+		}
+	}
+	return attrs
+}
+
+// setPaused records whether the VM is paused.
+func (h *taskHandle) setPaused(paused bool) {
+	h.stateLock.Lock()
+	defer h.stateLock.Unlock()
+	h.paused = paused
 }
 
 func (h *taskHandle) IsRunning() bool {
@@ -55,6 +160,91 @@ func (h *taskHandle) IsRunning() bool {
 	return h.procState == drivers.TaskStateRunning
 }
 
+// monitorExecute runs cmd on the VM's QMP monitor. A new connection is made
+// for every command so the monitor remains reachable after the plugin has
+// restarted and recovered the task.
+func (h *taskHandle) monitorExecute(ctx context.Context, cmd string, args map[string]interface{}) (json.RawMessage, error) {
+	if h.monitorPath == "" {
+		return nil, fmt.Errorf("task %q has no monitor socket", h.taskConfig.ID)
+	}
+	return qmpExecute(ctx, h.monitorPath, cmd, args)
+}
+
+// monitorCommand runs cmd, which takes no arguments and has the same name in
+// both monitor protocols, such as system_powerdown, on the VM's monitor.
+func (h *taskHandle) monitorCommand(ctx context.Context, cmd string) error {
+	if h.monitorProtocol != monitorProtocolHMP {
+		_, err := h.monitorExecute(ctx, cmd, nil)
+		return err
+	}
+	_, err := h.humanMonitorCommand(ctx, cmd)
+	return err
+}
+
+// humanMonitorCommand runs the human monitor command line cmd on the VM's
+// monitor, through QMP unless the monitor speaks the human protocol, and
+// returns its output. Errors reported in the output are returned as is.
+func (h *taskHandle) humanMonitorCommand(ctx context.Context, cmd string) (string, error) {
+	if h.monitorPath == "" {
+		return "", fmt.Errorf("task %q has no monitor socket", h.taskConfig.ID)
+	}
+	if h.monitorProtocol == monitorProtocolHMP {
+		return hmpExecute(ctx, h.monitorPath, cmd)
+	}
+
+	raw, err := h.monitorExecute(ctx, "human-monitor-command", map[string]interface{}{
+		"command-line": cmd,
+	})
+	if err != nil {
+		return "", err
+	}
+	var output string
+	if err := json.Unmarshal(raw, &output); err != nil {
+		return "", fmt.Errorf("failed to decode monitor output: %v", err)
+	}
+	return output, nil
+}
+
+// cleanup stops the helper processes of the task and removes the files
+// created for it in the task directory, and its tap device. Files that no
+// longer exist are ignored.
+func (h *taskHandle) cleanup() {
+	if h.tpmPidPath != "" {
+		if err := stopSwtpm(h.tpmPidPath); err != nil {
+			h.logger.Warn("failed to stop swtpm", "pid_file", h.tpmPidPath, "error", err)
+		}
+	}
+	stopVirtiofsd(h.virtiofsdPids)
+	if h.netnsPath != "" {
+		if err := teardownNamespaceTap(h.netnsPath); err != nil {
+			h.logger.Warn("failed to remove the tap device", "netns", h.netnsPath, "error", err)
+		}
+	}
+
+	paths := append([]string{h.monitorPath, h.agentPath, h.pidPath, h.seedPath, h.overlayPath, h.varsPath, h.vncPasswordPath}, h.serialPaths...)
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			h.logger.Warn("failed to remove task file", "path", path, "error", err)
+		}
+	}
+}
+
+// waitExited blocks until the task is no longer running or timeout elapses,
+// returning whether the task exited.
+func (h *taskHandle) waitExited(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for h.IsRunning() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
 func (h *taskHandle) run() {
 	h.stateLock.Lock()
 	if h.exitResult == nil {
@@ -74,7 +264,57 @@ func (h *taskHandle) run() {
 		return
 	}
 	h.procState = drivers.TaskStateExited
-	h.exitResult.ExitCode = ps.ExitCode
-	h.exitResult.Signal = ps.Signal
+	h.exitResult.OOMKilled = probablyOOMKilled(ps.Signal, h.stopRequested, h.oomKillCount)
+	if h.poweringDown {
+		h.exitResult.ExitCode = 0
+		h.exitResult.Signal = 0
+	} else {
+		h.exitResult.ExitCode = ps.ExitCode
+		h.exitResult.Signal = ps.Signal
+	}
 	h.completedAt = ps.Time
 }
+
+// markExited records that the task exited with result at completedAt, unless
+// its exit was already recorded, so the task status reflects the VM exiting
+// as soon as it is noticed.
+func (h *taskHandle) markExited(result *drivers.ExitResult, completedAt time.Time) {
+	h.stateLock.Lock()
+	defer h.stateLock.Unlock()
+	if h.procState == drivers.TaskStateExited {
+		return
+	}
+	h.procState = drivers.TaskStateExited
+	h.exitResult = result.Copy()
+	h.completedAt = completedAt
+}
+
+// setPoweringDown records whether a graceful shutdown of the VM is in
+// progress.
+func (h *taskHandle) setPoweringDown(v bool) {
+	h.stateLock.Lock()
+	defer h.stateLock.Unlock()
+	h.poweringDown = v
+}
+
+// setStopRequested records that the task is being stopped by the driver.
+func (h *taskHandle) setStopRequested() {
+	h.stateLock.Lock()
+	defer h.stateLock.Unlock()
+	h.stopRequested = true
+}
+
+// isStopRequested returns whether the task is being stopped by the driver.
+func (h *taskHandle) isStopRequested() bool {
+	h.stateLock.RLock()
+	defer h.stateLock.RUnlock()
+	return h.stopRequested
+}
+
+// isPoweringDown returns whether a graceful shutdown of the VM is in
+// progress.
+func (h *taskHandle) isPoweringDown() bool {
+	h.stateLock.RLock()
+	defer h.stateLock.RUnlock()
+	return h.poweringDown
+}
@@ -0,0 +1,154 @@
+package alt_qemu
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskState_MonitorPathRoundTrip(t *testing.T) {
+	handle := drivers.NewTaskHandle(taskHandleVersion)
+	state := TaskState{
+		TaskConfig:  &drivers.TaskConfig{ID: "task-1"},
+		Pid:         42,
+		MonitorPath: "/alloc/task/qemu-monitor.sock",
+	}
+	require.NoError(t, handle.SetDriverState(&state))
+
+	var recovered TaskState
+	require.NoError(t, handle.GetDriverState(&recovered))
+	require.Equal(t, state.MonitorPath, recovered.MonitorPath)
+}
+
+func TestTaskHandle_MonitorExecute(t *testing.T) {
+	h := &taskHandle{taskConfig: &drivers.TaskConfig{ID: "task-1"}}
+	_, err := h.monitorExecute(context.Background(), "system_powerdown", nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "has no monitor socket")
+
+	path, cmds := fakeQMPServer(t, func(qmpCommand) string { return `{"return": {}}` })
+	h.monitorPath = path
+	_, err = h.monitorExecute(context.Background(), "system_powerdown", nil)
+	require.NoError(t, err)
+	<-cmds
+	require.Equal(t, "system_powerdown", (<-cmds).Execute)
+}
+
+func TestTaskHandle_Cleanup(t *testing.T) {
+	dir := t.TempDir()
+	monitorPath := filepath.Join(dir, qemuMonitorSocketName)
+	require.NoError(t, ioutil.WriteFile(monitorPath, nil, 0600))
+	overlayPath := filepath.Join(dir, overlayImageName)
+	require.NoError(t, ioutil.WriteFile(overlayPath, nil, 0600))
+	serialPath := filepath.Join(dir, "serial.sock")
+	require.NoError(t, ioutil.WriteFile(serialPath, nil, 0600))
+	pidPath := filepath.Join(dir, qemuPidFileName)
+	require.NoError(t, ioutil.WriteFile(pidPath, nil, 0600))
+	varsPath := filepath.Join(dir, firmwareVarsName)
+	require.NoError(t, ioutil.WriteFile(varsPath, nil, 0600))
+	vncPasswordPath := filepath.Join(dir, vncPasswordFileName)
+	require.NoError(t, ioutil.WriteFile(vncPasswordPath, nil, 0600))
+
+	h := &taskHandle{
+		monitorPath:     monitorPath,
+		overlayPath:     overlayPath,
+		pidPath:         pidPath,
+		varsPath:        varsPath,
+		vncPasswordPath: vncPasswordPath,
+		serialPaths:     []string{serialPath},
+		// already removed files are ignored
+		agentPath: filepath.Join(dir, qemuGuestAgentSocketName),
+		logger:    hclog.NewNullLogger(),
+	}
+	h.cleanup()
+
+	for _, path := range []string{monitorPath, overlayPath, pidPath, varsPath, vncPasswordPath, serialPath} {
+		_, err := os.Stat(path)
+		require.True(t, os.IsNotExist(err), path)
+	}
+}
+
+func TestTaskAttributes(t *testing.T) {
+	cfg := testTaskConfigWithPorts(map[string]int{"ssh": 22000, "http": 28080})
+
+	tc := &TaskConfig{
+		PortMap: map[string]int{"ssh": 22, "metrics": 9100},
+		VNC:     VNCConfig{Enabled: true, Display: 1},
+	}
+	require.Equal(t, map[string]string{
+		"monitor_path":     "/alloc/task/qemu-monitor.sock",
+		"vnc_address":      tc.VNC.Address(),
+		"port_forward.ssh": "22000:22",
+		"serial_path.0":    "/alloc/task/serial.sock",
+		"serial_path.1":    "/alloc/task/serial1.sock",
+	}, taskAttributes(cfg, tc, "/alloc/task/qemu-monitor.sock", []string{"/alloc/task/serial.sock", "/alloc/task/serial1.sock"}))
+
+	tc = &TaskConfig{
+		NetworkMode: "bridge",
+		Spice:       SpiceConfig{Enabled: true, Port: 5930, TLSPort: 5931},
+	}
+	require.Equal(t, map[string]string{
+		"spice_address":     "127.0.0.1:5930",
+		"spice_tls_address": "127.0.0.1:5931",
+	}, taskAttributes(cfg, tc, "", nil))
+
+	// ports are only forwarded by user-mode networking, and no console is
+	// reported for a display conflicting with it
+	tc = &TaskConfig{
+		NetworkMode: "bridge",
+		PortMap:     map[string]int{"ssh": 22},
+		Display:     displayNone,
+		VNC:         VNCConfig{Enabled: true, Display: 1},
+	}
+	require.Empty(t, taskAttributes(cfg, tc, "", nil))
+}
+
+func TestTaskHandle_TaskStatus(t *testing.T) {
+	h := &taskHandle{
+		taskConfig: &drivers.TaskConfig{ID: "task-1", Name: "vm"},
+		pid:        42,
+		attributes: map[string]string{"monitor_path": "/alloc/task/qemu-monitor.sock"},
+		procState:  drivers.TaskStateRunning,
+	}
+	status := h.TaskStatus()
+	require.Equal(t, "task-1", status.ID)
+	require.Equal(t, map[string]string{
+		"pid":          "42",
+		"monitor_path": "/alloc/task/qemu-monitor.sock",
+		"vm_status":    "running",
+	}, status.DriverAttributes)
+
+	h.setPaused(true)
+	require.Equal(t, "paused", h.TaskStatus().DriverAttributes["vm_status"])
+
+	// the VM status is only reported while the task runs
+	h.procState = drivers.TaskStateExited
+	require.NotContains(t, h.TaskStatus().DriverAttributes, "vm_status")
+}
+
+func TestTaskHandle_MarkExited(t *testing.T) {
+	h := &taskHandle{
+		taskConfig: &drivers.TaskConfig{ID: "task-1"},
+		procState:  drivers.TaskStateRunning,
+	}
+	first := time.Now()
+	h.markExited(&drivers.ExitResult{ExitCode: 1}, first)
+
+	status := h.TaskStatus()
+	require.Equal(t, drivers.TaskStateExited, status.State)
+	require.Equal(t, 1, status.ExitResult.ExitCode)
+	require.Equal(t, first, status.CompletedAt)
+
+	// the exit recorded first is kept
+	h.markExited(&drivers.ExitResult{ExitCode: 0}, first.Add(time.Second))
+	status = h.TaskStatus()
+	require.Equal(t, 1, status.ExitResult.ExitCode)
+	require.Equal(t, first, status.CompletedAt)
+}
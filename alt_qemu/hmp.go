@@ -0,0 +1,189 @@
+package alt_qemu
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// monitorProtocolQMP exposes the machine protocol monitor, used unless
+	// monitor_protocol is set
+	monitorProtocolQMP = "qmp"
+
+	// monitorProtocolHMP exposes the human monitor
+	monitorProtocolHMP = "hmp"
+
+	// hmpPrompt is printed by the human monitor when it awaits a command
+	hmpPrompt = "(qemu) "
+)
+
+var (
+	// ansiEscapeRegex matches the terminal escape sequences the human
+	// monitor's line editor mixes into its output
+	ansiEscapeRegex = regexp.MustCompile(`\x1b\[[0-9;]*[A-Za-z]`)
+
+	// hmpBalloonRegex matches the output of the "info balloon" command,
+	// e.g. "balloon: actual=1024"
+	hmpBalloonRegex = regexp.MustCompile(`actual=(\d+)`)
+
+	// hmpStatusRegex matches the output of the "info status" command, e.g.
+	// "VM status: running" or "VM status: paused (prelaunch)"
+	hmpStatusRegex = regexp.MustCompile(`VM status: (\w+)`)
+)
+
+// monitorArgs returns the arguments exposing the monitor speaking protocol on
+// the socket at monitorPath.
+func monitorArgs(protocol, monitorPath string) ([]string, error) {
+	chardev := fmt.Sprintf("unix:%s,server,nowait", monitorPath)
+	switch protocol {
+	case "", monitorProtocolQMP:
+		return []string{"-qmp", chardev}, nil
+	case monitorProtocolHMP:
+		return []string{"-monitor", chardev}, nil
+	default:
+		return nil, fmt.Errorf("unknown monitor_protocol %q, must be qmp or hmp", protocol)
+	}
+}
+
+// hmpExecute connects to the human monitor at monitorPath, runs the command
+// line cmd and returns its output. It gives up once ctx is done.
+func hmpExecute(ctx context.Context, monitorPath string, cmd string) (string, error) {
+	conn, err := dialMonitor(ctx, monitorPath, monitorTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(monitorTimeout))
+	defer watchContext(ctx, conn)()
+
+	r := bufio.NewReader(conn)
+	if _, err := hmpReadPrompt(r); err != nil {
+		return "", fmt.Errorf("failed to read monitor greeting: %v", contextError(ctx, err))
+	}
+	if _, err := conn.Write([]byte(cmd + "\n")); err != nil {
+		return "", fmt.Errorf("failed to send %q: %v", cmd, contextError(ctx, err))
+	}
+	out, err := hmpReadPrompt(r)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %q output: %v", cmd, contextError(ctx, err))
+	}
+	return hmpOutput(out), nil
+}
+
+// hmpReadPrompt reads from r up to the next monitor prompt, returning what
+// was read before it.
+func hmpReadPrompt(r *bufio.Reader) (string, error) {
+	var buf bytes.Buffer
+	for !bytes.HasSuffix(buf.Bytes(), []byte(hmpPrompt)) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		buf.WriteByte(b)
+	}
+	return strings.TrimSuffix(buf.String(), hmpPrompt), nil
+}
+
+// hmpOutput cleans up raw output of the human monitor: the echo of the
+// command on its first line, escape sequences and carriage returns are
+// dropped.
+func hmpOutput(raw string) string {
+	raw = strings.Replace(ansiEscapeRegex.ReplaceAllString(raw, ""), "\r", "", -1)
+	if i := strings.Index(raw, "\n"); i >= 0 {
+		raw = raw[i+1:]
+	}
+	return raw
+}
+
+// hmpError returns the error reported in the output of a human monitor
+// command, which unlike QMP has no separate error response.
+func hmpError(cmd, out string) error {
+	if strings.HasPrefix(out, "Error") || strings.HasPrefix(out, "unknown command") {
+		return fmt.Errorf("command %q failed: %s", cmd, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// parseHMPBalloon parses the output of the "info balloon" command into the
+// memory assigned to the guest in bytes.
+func parseHMPBalloon(out string) (int64, error) {
+	m := hmpBalloonRegex.FindStringSubmatch(out)
+	if m == nil {
+		return 0, fmt.Errorf("unexpected balloon info %q", strings.TrimSpace(out))
+	}
+	mb, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return mb * 1024 * 1024, nil
+}
+
+// parseHMPBlockStats parses the output of the "info blockstats" command, made
+// of a "name: key=value ..." line per block device.
+func parseHMPBlockStats(out string) []qmpBlockStats {
+	var stats []qmpBlockStats
+	for _, line := range strings.Split(out, "\n") {
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			continue
+		}
+		b := qmpBlockStats{Device: strings.TrimSpace(line[:i])}
+		for _, field := range strings.Fields(line[i+1:]) {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			v, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil {
+				continue
+			}
+			switch kv[0] {
+			case "rd_bytes":
+				b.Stats.RdBytes = v
+			case "wr_bytes":
+				b.Stats.WrBytes = v
+			case "rd_operations":
+				b.Stats.RdOperations = v
+			case "wr_operations":
+				b.Stats.WrOperations = v
+			}
+		}
+		stats = append(stats, b)
+	}
+	return stats
+}
+
+// monitorStatus queries the status of the VM on the monitor speaking
+// protocol at monitorPath.
+func monitorStatus(ctx context.Context, protocol, monitorPath string) (qmpStatus, error) {
+	var status qmpStatus
+	if protocol == monitorProtocolHMP {
+		out, err := hmpExecute(ctx, monitorPath, "info status")
+		if err != nil {
+			return status, err
+		}
+		m := hmpStatusRegex.FindStringSubmatch(out)
+		if m == nil {
+			return status, fmt.Errorf("unexpected status %q", strings.TrimSpace(out))
+		}
+		status.Status = m[1]
+		status.Running = m[1] == "running"
+		return status, nil
+	}
+
+	raw, err := qmpExecute(ctx, monitorPath, "query-status", nil)
+	if err != nil {
+		return status, err
+	}
+	if err := json.Unmarshal(raw, &status); err != nil {
+		return status, fmt.Errorf("failed to decode VM status: %v", err)
+	}
+	return status, nil
+}
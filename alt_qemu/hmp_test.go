@@ -0,0 +1,219 @@
+package alt_qemu
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeHMPServer listens on a unix socket in a temporary directory and answers
+// human monitor command lines through handle, echoing them back like the
+// monitor's line editor does. It returns the socket path and the channel the
+// command lines are sent on.
+func fakeHMPServer(t *testing.T, handle func(cmd string) string) (string, <-chan string) {
+	path := filepath.Join(t.TempDir(), qemuMonitorSocketName)
+	l, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	cmds := make(chan string, 16)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte("QEMU 4.2.0 monitor - type 'help' for more information\r\n" + hmpPrompt))
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					cmd := scanner.Text()
+					cmds <- cmd
+					conn.Write([]byte(cmd + "\r\n\x1b[K" + handle(cmd) + hmpPrompt))
+				}
+			}()
+		}
+	}()
+	return path, cmds
+}
+
+func TestTaskConfig_MonitorProtocol(t *testing.T) {
+	var tc *TaskConfig
+	hclutils.NewConfigParser(taskConfigSpec).ParseHCL(t, `
+config {
+  image_path       = "linux.img"
+  monitor_protocol = "hmp"
+}`, &tc)
+	require.Equal(t, monitorProtocolHMP, tc.MonitorProtocol)
+}
+
+func TestMonitorArgs(t *testing.T) {
+	cases := []struct {
+		name     string
+		protocol string
+		expected []string
+		err      string
+	}{
+		{
+			name:     "default",
+			expected: []string{"-qmp", "unix:/task/monitor.sock,server,nowait"},
+		},
+		{
+			name:     "qmp",
+			protocol: "qmp",
+			expected: []string{"-qmp", "unix:/task/monitor.sock,server,nowait"},
+		},
+		{
+			name:     "hmp",
+			protocol: "hmp",
+			expected: []string{"-monitor", "unix:/task/monitor.sock,server,nowait"},
+		},
+		{
+			name:     "unknown",
+			protocol: "telnet",
+			err:      `unknown monitor_protocol "telnet"`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			args, err := monitorArgs(c.protocol, "/task/monitor.sock")
+			if c.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.expected, args)
+		})
+	}
+}
+
+func TestHmpExecute(t *testing.T) {
+	path, cmds := fakeHMPServer(t, func(cmd string) string {
+		return "VM status: running\r\n"
+	})
+
+	out, err := hmpExecute(context.Background(), path, "info status")
+	require.NoError(t, err)
+	require.Equal(t, "VM status: running\n", out)
+	require.Equal(t, "info status", <-cmds)
+
+	_, err = hmpExecute(context.Background(), filepath.Join(t.TempDir(), "missing.sock"), "info status")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to connect to monitor")
+}
+
+func TestHmpError(t *testing.T) {
+	require.NoError(t, hmpError("balloon 512", ""))
+	require.NoError(t, hmpError("info status", "VM status: running\n"))
+
+	err := hmpError("balloon 512", "Error: No balloon device has been activated\n")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "No balloon device")
+
+	err = hmpError("frobnicate", "unknown command: 'frobnicate'\n")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unknown command")
+}
+
+func TestParseHMPBalloon(t *testing.T) {
+	actual, err := parseHMPBalloon("balloon: actual=1024\n")
+	require.NoError(t, err)
+	require.Equal(t, int64(1024*1024*1024), actual)
+
+	_, err = parseHMPBalloon("Error: No balloon device has been activated\n")
+	require.Error(t, err)
+}
+
+func TestParseHMPBlockStats(t *testing.T) {
+	out := "drive0: rd_bytes=512 wr_bytes=1024 rd_operations=2 wr_operations=4 flush_operations=0\n" +
+		"cd0: rd_bytes=2048 wr_bytes=0 rd_operations=1 wr_operations=0\n"
+
+	stats := parseHMPBlockStats(out)
+	require.Len(t, stats, 2)
+	require.Equal(t, "drive0", stats[0].Device)
+	require.Equal(t, int64(512), stats[0].Stats.RdBytes)
+	require.Equal(t, int64(1024), stats[0].Stats.WrBytes)
+	require.Equal(t, int64(2), stats[0].Stats.RdOperations)
+	require.Equal(t, int64(4), stats[0].Stats.WrOperations)
+	require.Equal(t, "cd0", stats[1].Device)
+	require.Equal(t, int64(2048), stats[1].Stats.RdBytes)
+}
+
+func TestMonitorStatus_HMP(t *testing.T) {
+	path, _ := fakeHMPServer(t, func(cmd string) string {
+		return "VM status: paused (prelaunch)\r\n"
+	})
+
+	status, err := monitorStatus(context.Background(), monitorProtocolHMP, path)
+	require.NoError(t, err)
+	require.Equal(t, "paused", status.Status)
+	require.False(t, status.Running)
+}
+
+func TestWaitRunning_HMP(t *testing.T) {
+	path, _ := fakeHMPServer(t, func(cmd string) string {
+		return "VM status: running\r\n"
+	})
+	require.NoError(t, waitRunning(context.Background(), monitorProtocolHMP, path, 5*time.Second, nil))
+}
+
+func TestTaskHandle_MonitorCommand_HMP(t *testing.T) {
+	path, cmds := fakeHMPServer(t, func(cmd string) string {
+		return ""
+	})
+	h := &taskHandle{
+		taskConfig:      &drivers.TaskConfig{ID: "task-1"},
+		monitorPath:     path,
+		monitorProtocol: monitorProtocolHMP,
+	}
+
+	require.NoError(t, h.monitorCommand(context.Background(), "system_powerdown"))
+	require.Equal(t, "system_powerdown", <-cmds)
+}
+
+func TestTaskHandle_Balloon_HMP(t *testing.T) {
+	path, cmds := fakeHMPServer(t, func(cmd string) string {
+		return ""
+	})
+	h := &taskHandle{
+		taskConfig:      &drivers.TaskConfig{ID: "task-1"},
+		monitorPath:     path,
+		monitorProtocol: monitorProtocolHMP,
+		balloonEnabled:  true,
+		memoryMb:        2048,
+	}
+
+	_, err := h.balloon(context.Background(), []string{"1024"})
+	require.NoError(t, err)
+	require.Equal(t, "balloon 1024", <-cmds)
+	require.Equal(t, int64(1024*1024*1024), h.balloonTarget)
+}
+
+func TestTaskHandle_HumanMonitorCommand_QMP(t *testing.T) {
+	path, cmds := fakeQMPServer(t, func(cmd qmpCommand) string {
+		return `{"return": "VM status: running\r\n"}`
+	})
+	h := &taskHandle{
+		taskConfig:  &drivers.TaskConfig{ID: "task-1"},
+		monitorPath: path,
+	}
+
+	out, err := h.humanMonitorCommand(context.Background(), "info status")
+	require.NoError(t, err)
+	require.Equal(t, "VM status: running\r\n", out)
+
+	require.Equal(t, "qmp_capabilities", (<-cmds).Execute)
+	cmd := <-cmds
+	require.Equal(t, "human-monitor-command", cmd.Execute)
+	require.Equal(t, "info status", cmd.Arguments["command-line"])
+}
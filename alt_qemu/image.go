@@ -0,0 +1,131 @@
+package alt_qemu
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// checksumHashes maps the algorithms accepted in image_checksum to their hash
+var checksumHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// parseChecksum splits a checksum of the form "<algorithm>:<hex digest>",
+// e.g. "sha256:9f86d0...", returning its hash and decoded digest.
+func parseChecksum(checksum string) (func() hash.Hash, []byte, error) {
+	parts := strings.SplitN(checksum, ":", 2)
+	if len(parts) != 2 {
+		return nil, nil, fmt.Errorf("invalid image_checksum %q, must be <algorithm>:<digest>", checksum)
+	}
+	newHash, ok := checksumHashes[parts[0]]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported image_checksum algorithm %q, must be one of md5, sha1, sha256 or sha512", parts[0])
+	}
+	digest, err := hex.DecodeString(parts[1])
+	if err != nil || len(digest) != newHash().Size() {
+		return nil, nil, fmt.Errorf("invalid %s digest %q", parts[0], parts[1])
+	}
+	return newHash, digest, nil
+}
+
+// verifyChecksum returns an error unless the file at path matches checksum.
+// The file is hashed as it is read, so large images are not loaded in memory.
+func verifyChecksum(path, checksum string) error {
+	newHash, want, err := parseChecksum(checksum)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open image %q: %v", path, err)
+	}
+	defer f.Close()
+
+	h := newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("failed to read image %q: %v", path, err)
+	}
+	if got := h.Sum(nil); !bytes.Equal(got, want) {
+		return fmt.Errorf("image %q checksum mismatch, expected %s but got %x", path, checksum, got)
+	}
+	return nil
+}
+
+// isImageURL returns whether image_path refers to a remote image to download.
+func isImageURL(imagePath string) bool {
+	return strings.HasPrefix(imagePath, "http://") || strings.HasPrefix(imagePath, "https://")
+}
+
+// downloadImage downloads the image at rawURL into taskDir and returns the
+// path of the local copy. The image is written to a temporary file which is
+// only renamed into place once complete and, when checksum is set, verified,
+// so a failed download leaves nothing behind.
+func downloadImage(ctx context.Context, taskDir, rawURL, checksum string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid image_path URL %q: %v", rawURL, err)
+	}
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		name = "image"
+	}
+	name = unsafeNameCharsRegex.ReplaceAllString(name, "-")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("invalid image_path URL %q: %v", rawURL, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to download image %q: %v", rawURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download image %q: %s", rawURL, resp.Status)
+	}
+
+	tmp, err := ioutil.TempFile(taskDir, name+".download")
+	if err != nil {
+		return "", fmt.Errorf("failed to create image file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, resp.Body); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("failed to download image %q: %v", rawURL, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("failed to write image file: %v", err)
+	}
+
+	if checksum != "" {
+		if err := verifyChecksum(tmp.Name(), checksum); err != nil {
+			return "", err
+		}
+	}
+
+	imagePath := filepath.Join(taskDir, name)
+	if err := os.Rename(tmp.Name(), imagePath); err != nil {
+		return "", fmt.Errorf("failed to move downloaded image: %v", err)
+	}
+	return imagePath, nil
+}
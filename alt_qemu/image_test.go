@@ -0,0 +1,110 @@
+package alt_qemu
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseChecksum(t *testing.T) {
+	cases := []struct {
+		checksum string
+		err      string
+	}{
+		{checksum: "md5:5d41402abc4b2a76b9719d911017c592"},
+		{checksum: "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"},
+		{checksum: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", err: "must be <algorithm>:<digest>"},
+		{checksum: "crc32:3610a686", err: `unsupported image_checksum algorithm "crc32"`},
+		{checksum: "sha256:not-hex", err: `invalid sha256 digest "not-hex"`},
+		{checksum: "sha256:5d41402abc4b2a76b9719d911017c592", err: "invalid sha256 digest"},
+	}
+	for _, c := range cases {
+		t.Run(c.checksum, func(t *testing.T) {
+			_, _, err := parseChecksum(c.checksum)
+			if c.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), c.err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "linux.img")
+	require.NoError(t, ioutil.WriteFile(path, []byte("hello"), 0644))
+
+	require.NoError(t, verifyChecksum(path, "md5:5d41402abc4b2a76b9719d911017c592"))
+	require.NoError(t, verifyChecksum(path, "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"))
+
+	err := verifyChecksum(path, "md5:00000000000000000000000000000000")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "checksum mismatch, expected md5:00000000000000000000000000000000 but got 5d41402abc4b2a76b9719d911017c592")
+
+	err = verifyChecksum(filepath.Join(dir, "missing.img"), "md5:5d41402abc4b2a76b9719d911017c592")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to open image")
+}
+
+func TestIsImageURL(t *testing.T) {
+	require.True(t, isImageURL("https://images.example.com/linux.img"))
+	require.True(t, isImageURL("http://images.example.com/linux.img"))
+	require.False(t, isImageURL("ftp://images.example.com/linux.img"))
+	require.False(t, isImageURL("local/linux.img"))
+}
+
+func TestDownloadImage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/images/linux 1.img" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	taskDir := t.TempDir()
+	path, err := downloadImage(context.Background(), taskDir, srv.URL+"/images/linux%201.img", "md5:5d41402abc4b2a76b9719d911017c592")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(taskDir, "linux-1.img"), path)
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+
+	// only the downloaded image is left in the task directory
+	files, err := ioutil.ReadDir(taskDir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+}
+
+func TestDownloadImage_Errors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/linux.img" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	taskDir := t.TempDir()
+	_, err := downloadImage(context.Background(), taskDir, srv.URL+"/missing.img", "")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "404 Not Found")
+
+	_, err = downloadImage(context.Background(), taskDir, srv.URL+"/linux.img", "md5:00000000000000000000000000000000")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "checksum mismatch")
+
+	// failed downloads leave nothing behind
+	files, err := ioutil.ReadDir(taskDir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
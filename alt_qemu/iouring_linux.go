@@ -0,0 +1,15 @@
+package alt_qemu
+
+import "syscall"
+
+// sysIOUringSetup is the number of the io_uring_setup system call, shared by
+// all architectures
+const sysIOUringSetup = 425
+
+// ioUringAvailable returns whether the kernel lets processes use io_uring.
+// The probe asks for a ring of no entries, which a supporting kernel rejects
+// as invalid rather than as unknown or forbidden.
+func ioUringAvailable() bool {
+	_, _, errno := syscall.Syscall(sysIOUringSetup, 0, 0, 0)
+	return errno == syscall.EINVAL
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package alt_qemu
+
+// ioUringAvailable returns whether the kernel lets processes use io_uring,
+// which only Linux provides.
+func ioUringAvailable() bool {
+	return false
+}
@@ -0,0 +1,96 @@
+package alt_qemu
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// knownMachineProperties lists the -machine properties that may be set with
+// machine_properties. The machine type and accelerator have their own task
+// options and are not accepted here.
+var knownMachineProperties = map[string]bool{
+	"kernel_irqchip":  true,
+	"hpet":            true,
+	"vmport":          true,
+	"smm":             true,
+	"pit":             true,
+	"sata":            true,
+	"usb":             true,
+	"graphics":        true,
+	"nvdimm":          true,
+	"i8042":           true,
+	"smbus":           true,
+	"dump-guest-core": true,
+	"mem-merge":       true,
+	"suppress-vmdesc": true,
+}
+
+// machineArg returns the value of the -machine argument for machineType,
+// using accelerator and the extra properties. Properties are emitted sorted
+// by name so the command line is stable.
+func machineArg(machineType, accelerator string, properties map[string]string) (string, error) {
+	names := make([]string, 0, len(properties))
+	for name, value := range properties {
+		if !knownMachineProperties[name] {
+			return "", fmt.Errorf("unknown machine property %q", name)
+		}
+		if !safeNameRegex.MatchString(value) {
+			return "", fmt.Errorf("invalid value %q for machine property %q", value, name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := []string{"type=" + machineType, "accel=" + accelerator}
+	for _, name := range names {
+		parts = append(parts, name+"="+properties[name])
+	}
+	return strings.Join(parts, ","), nil
+}
+
+// RTCConfig configures the real time clock presented to the guest
+type RTCConfig struct {
+	Base  string `codec:"base"`  // utc or localtime, Windows guests expect localtime
+	Clock string `codec:"clock"` // host or vm
+}
+
+// IsSet returns whether any RTC option was configured.
+func (c *RTCConfig) IsSet() bool {
+	return c.Base != "" || c.Clock != ""
+}
+
+// rtcArg returns the value of the -rtc argument for c. Unset options default
+// to a UTC clock following the host time.
+func rtcArg(c *RTCConfig) (string, error) {
+	base := c.Base
+	if base == "" {
+		base = "utc"
+	}
+	if base != "utc" && base != "localtime" {
+		return "", fmt.Errorf("invalid rtc base %q, must be utc or localtime", base)
+	}
+
+	clock := c.Clock
+	if clock == "" {
+		clock = "host"
+	}
+	if clock != "host" && clock != "vm" {
+		return "", fmt.Errorf("invalid rtc clock %q, must be host or vm", clock)
+	}
+	return fmt.Sprintf("base=%s,clock=%s", base, clock), nil
+}
+
+// isAllowedMachineType returns whether machineType is one of allowedTypes. An
+// empty allowedTypes allows every machine type.
+func isAllowedMachineType(allowedTypes []string, machineType string) bool {
+	if len(allowedTypes) == 0 {
+		return true
+	}
+	for _, t := range allowedTypes {
+		if t == machineType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+package alt_qemu
+
+import (
+	"testing"
+
+	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskConfig_MachineProperties(t *testing.T) {
+	config := `
+config {
+  image_path = "linux.img"
+  machine_properties {
+    kernel_irqchip = "split"
+    hpet = "off"
+  }
+}`
+
+	var tc *TaskConfig
+	hclutils.NewConfigParser(taskConfigSpec).ParseHCL(t, config, &tc)
+
+	require.Equal(t, hclutils.MapStrStr{"kernel_irqchip": "split", "hpet": "off"}, tc.MachineProperties)
+}
+
+func TestMachineArg(t *testing.T) {
+	cases := []struct {
+		name       string
+		properties map[string]string
+		arg        string
+		err        string
+	}{
+		{
+			name: "no properties",
+			arg:  "type=q35,accel=kvm:tcg",
+		},
+		{
+			name:       "sorted properties",
+			properties: map[string]string{"vmport": "off", "kernel_irqchip": "split", "hpet": "off"},
+			arg:        "type=q35,accel=kvm:tcg,hpet=off,kernel_irqchip=split,vmport=off",
+		},
+		{
+			name:       "accelerator is its own option",
+			properties: map[string]string{"accel": "tcg"},
+			err:        `unknown machine property "accel"`,
+		},
+		{
+			name:       "injected option",
+			properties: map[string]string{"hpet": "off,memory-backend=mem"},
+			err:        `invalid value "off,memory-backend=mem" for machine property "hpet"`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			arg, err := machineArg("q35", "kvm:tcg", c.properties)
+			if c.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.arg, arg)
+		})
+	}
+}
+
+func TestTaskConfig_RTC(t *testing.T) {
+	config := `
+config {
+  image_path = "windows.img"
+  rtc {
+    base = "localtime"
+  }
+}`
+
+	var tc *TaskConfig
+	hclutils.NewConfigParser(taskConfigSpec).ParseHCL(t, config, &tc)
+
+	require.Equal(t, RTCConfig{Base: "localtime"}, tc.RTC)
+	require.True(t, tc.RTC.IsSet())
+}
+
+func TestRtcArg(t *testing.T) {
+	cases := []struct {
+		name   string
+		config RTCConfig
+		arg    string
+		err    string
+	}{
+		{name: "defaults", config: RTCConfig{}, arg: "base=utc,clock=host"},
+		{name: "localtime", config: RTCConfig{Base: "localtime"}, arg: "base=localtime,clock=host"},
+		{name: "vm clock", config: RTCConfig{Clock: "vm"}, arg: "base=utc,clock=vm"},
+		{name: "invalid base", config: RTCConfig{Base: "2006-06-17T16:01:21"}, err: `invalid rtc base "2006-06-17T16:01:21"`},
+		{name: "invalid clock", config: RTCConfig{Clock: "rt"}, err: `invalid rtc clock "rt"`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			arg, err := rtcArg(&c.config)
+			if c.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.arg, arg)
+		})
+	}
+}
+
+func TestIsAllowedMachineType(t *testing.T) {
+	config := `
+config {
+  allowed_machine_types = ["pc", "q35"]
+}`
+
+	var c *Config
+	hclutils.NewConfigParser(configSpec).ParseHCL(t, config, &c)
+	require.Equal(t, []string{"pc", "q35"}, c.AllowedMachineTypes)
+
+	require.True(t, isAllowedMachineType(c.AllowedMachineTypes, "q35"))
+	require.False(t, isAllowedMachineType(c.AllowedMachineTypes, "microvm"))
+	require.False(t, isAllowedMachineType(c.AllowedMachineTypes, "pc-q35-4.2"))
+
+	// no allow list allows every machine type
+	require.True(t, isAllowedMachineType(nil, "microvm"))
+}
@@ -0,0 +1,159 @@
+package alt_qemu
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// memoryBackendID is the id of the object backing the guest memory
+	memoryBackendID = "mem"
+
+	// procMountsPath lists the filesystems mounted on the host
+	procMountsPath = "/proc/mounts"
+
+	// procMeminfoPath reports the memory of the host
+	procMeminfoPath = "/proc/meminfo"
+
+	// minMemoryMb is the least memory a VM may be assigned
+	minMemoryMb = 128
+
+	// maxMemoryMb is the most memory a VM may be assigned when the host
+	// memory is unknown
+	maxMemoryMb = 4000000
+)
+
+// memoryBackendArgs returns the arguments backing guest memory of size memMb
+// with the given memory_backend. An empty backend leaves the memory to qemu,
+// unless the memory must be shared with vhost-user daemons such as virtiofsd,
+// in which case it is backed by a memfd.
+func memoryBackendArgs(backend, hugepagesPath string, memMb int64, shared bool) ([]string, error) {
+	switch backend {
+	case "":
+		if !shared {
+			return nil, nil
+		}
+	case "file":
+		if err := checkHugepagesMount(hugepagesPath); err != nil {
+			return nil, err
+		}
+	}
+
+	object, err := memoryBackendObject(backend, hugepagesPath, memoryBackendID, memMb, shared)
+	if err != nil {
+		return nil, err
+	}
+	return []string{"-object", object, "-numa", fmt.Sprintf("node,memdev=%s", memoryBackendID)}, nil
+}
+
+// memoryBackendObject returns the -object value of the memory object id of
+// size memMb for the given memory_backend. Memory is allocated by qemu when
+// no backend is set, from a memfd if it must be shared.
+func memoryBackendObject(backend, hugepagesPath, id string, memMb int64, shared bool) (string, error) {
+	switch backend {
+	case "":
+		if shared {
+			return fmt.Sprintf("memory-backend-memfd,id=%s,size=%dM,share=on", id, memMb), nil
+		}
+		return fmt.Sprintf("memory-backend-ram,id=%s,size=%dM", id, memMb), nil
+	case "file":
+		memPath, err := escapeOptionValue(hugepagesPath)
+		if err != nil {
+			return "", fmt.Errorf("invalid hugepages_path: %v", err)
+		}
+		object := fmt.Sprintf("memory-backend-file,id=%s,size=%dM,mem-path=%s,prealloc=on", id, memMb, memPath)
+		if shared {
+			object += ",share=on"
+		}
+		return object, nil
+	default:
+		return "", fmt.Errorf("unknown memory_backend %q, must be file", backend)
+	}
+}
+
+// hostMemoryMb returns the total memory of the host in MB, or 0 if it cannot
+// be determined.
+func hostMemoryMb() int64 {
+	f, err := os.Open(procMeminfoPath)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// MemTotal:       16314732 kB
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[0] != "MemTotal:" || fields[2] != "kB" {
+			continue
+		}
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0
+		}
+		return kb / 1024
+	}
+	return 0
+}
+
+// checkMemory returns an error unless memMb is a valid amount of memory for a
+// VM on a host with hostMemMb of memory, within the configured maxMemMb. A
+// zero maxMemMb or hostMemMb means there is no such limit or that the host
+// memory is unknown.
+func checkMemory(memMb, maxMemMb, hostMemMb int64) error {
+	if memMb < minMemoryMb || memMb > maxMemoryMb {
+		return fmt.Errorf("qemu memory assignment out of bounds")
+	}
+	if maxMemMb > 0 && memMb > maxMemMb {
+		return fmt.Errorf("qemu memory assignment of %d MB exceeds max_memory_mb of %d MB", memMb, maxMemMb)
+	}
+	if hostMemMb > 0 && memMb > hostMemMb {
+		return fmt.Errorf("qemu memory assignment of %d MB exceeds the %d MB of memory of the host", memMb, hostMemMb)
+	}
+	return nil
+}
+
+// checkHugepagesMount returns an error unless path is the mountpoint of a
+// hugetlbfs filesystem.
+func checkHugepagesMount(path string) error {
+	if path == "" {
+		return fmt.Errorf("hugepages_path must be set for the file memory backend")
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("hugepages_path %q is not accessible: %v", path, err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("hugepages_path %q is not a directory", path)
+	}
+
+	f, err := os.Open(procMountsPath)
+	if err != nil {
+		return fmt.Errorf("failed to read mounts: %v", err)
+	}
+	defer f.Close()
+
+	path = filepath.Clean(path)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// device mountpoint fstype options dump pass
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || filepath.Clean(fields[1]) != path {
+			continue
+		}
+		if fields[2] != "hugetlbfs" {
+			return fmt.Errorf("hugepages_path %q is a %s mount, not hugetlbfs", path, fields[2])
+		}
+		return nil
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read mounts: %v", err)
+	}
+
+	return fmt.Errorf("hugepages_path %q is not a mountpoint", path)
+}
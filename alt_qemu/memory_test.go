@@ -0,0 +1,193 @@
+package alt_qemu
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/plugins/base"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskConfig_MemoryBackend(t *testing.T) {
+	config := `
+config {
+  image_path = "linux.img"
+  memory_backend = "file"
+  hugepages_path = "/dev/hugepages"
+}`
+
+	var tc *TaskConfig
+	hclutils.NewConfigParser(taskConfigSpec).ParseHCL(t, config, &tc)
+
+	require.Equal(t, "file", tc.MemoryBackend)
+	require.Equal(t, "/dev/hugepages", tc.HugepagesPath)
+}
+
+func TestMemoryBackendArgs(t *testing.T) {
+	args, err := memoryBackendArgs("", "", 1024, false)
+	require.NoError(t, err)
+	require.Empty(t, args)
+
+	// memory shared with virtiofsd is backed by a memfd
+	args, err = memoryBackendArgs("", "", 1024, true)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"-object", "memory-backend-memfd,id=mem,size=1024M,share=on",
+		"-numa", "node,memdev=mem",
+	}, args)
+
+	_, err = memoryBackendArgs("ram", "", 1024, false)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `unknown memory_backend "ram"`)
+
+	_, err = memoryBackendArgs("file", "", 1024, false)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "hugepages_path must be set")
+}
+
+func TestMemoryBackendObject(t *testing.T) {
+	object, err := memoryBackendObject("", "", "mem0", 512, false)
+	require.NoError(t, err)
+	require.Equal(t, "memory-backend-ram,id=mem0,size=512M", object)
+
+	object, err = memoryBackendObject("", "", "mem0", 512, true)
+	require.NoError(t, err)
+	require.Equal(t, "memory-backend-memfd,id=mem0,size=512M,share=on", object)
+
+	object, err = memoryBackendObject("file", "/dev/hugepages", "mem1", 512, false)
+	require.NoError(t, err)
+	require.Equal(t, "memory-backend-file,id=mem1,size=512M,mem-path=/dev/hugepages,prealloc=on", object)
+
+	object, err = memoryBackendObject("file", "/dev/hugepages", "mem1", 512, true)
+	require.NoError(t, err)
+	require.Equal(t, "memory-backend-file,id=mem1,size=512M,mem-path=/dev/hugepages,prealloc=on,share=on", object)
+
+	// a comma in the path cannot add properties to the object
+	object, err = memoryBackendObject("file", "/mnt/huge,share=on", "mem1", 512, false)
+	require.NoError(t, err)
+	require.Equal(t, "memory-backend-file,id=mem1,size=512M,mem-path=/mnt/huge,,share=on,prealloc=on", object)
+
+	_, err = memoryBackendObject("file", "/mnt/huge\n", "mem1", 512, false)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid hugepages_path")
+
+	_, err = memoryBackendObject("ram", "", "mem0", 512, false)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `unknown memory_backend "ram"`)
+}
+
+func TestCheckHugepagesMount(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	require.NoError(t, ioutil.WriteFile(file, nil, 0644))
+
+	cases := []struct {
+		name string
+		path string
+		err  string
+	}{
+		{name: "unset", path: "", err: "must be set"},
+		{name: "missing", path: filepath.Join(dir, "missing"), err: "is not accessible"},
+		{name: "file", path: file, err: "is not a directory"},
+		{name: "not a mountpoint", path: dir, err: "is not a mountpoint"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := checkHugepagesMount(c.path)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), c.err)
+		})
+	}
+
+	if runtime.GOOS == "linux" {
+		err := checkHugepagesMount("/")
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "not hugetlbfs")
+	}
+}
+
+func TestCheckMemory(t *testing.T) {
+	cases := []struct {
+		name   string
+		memMb  int64
+		maxMb  int64
+		hostMb int64
+		err    string
+	}{
+		{name: "within host memory", memMb: 2048, hostMb: 16384},
+		{name: "unknown host memory", memMb: 65536, hostMb: 0},
+		{name: "all host memory", memMb: 16384, hostMb: 16384},
+		{name: "within max memory", memMb: 4096, maxMb: 4096, hostMb: 16384},
+		{name: "too little", memMb: 64, hostMb: 16384, err: "out of bounds"},
+		{name: "too much", memMb: maxMemoryMb + 1, hostMb: 0, err: "out of bounds"},
+		{name: "exceeds max memory", memMb: 8192, maxMb: 4096, hostMb: 16384, err: "qemu memory assignment of 8192 MB exceeds max_memory_mb of 4096 MB"},
+		{name: "exceeds host memory", memMb: 32768, hostMb: 16384, err: "qemu memory assignment of 32768 MB exceeds the 16384 MB of memory of the host"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := checkMemory(c.memMb, c.maxMb, c.hostMb)
+			if c.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), c.err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestHostMemoryMb(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("host memory is read from /proc/meminfo")
+	}
+	require.True(t, hostMemoryMb() > 0)
+}
+
+func TestTaskMemoryMb(t *testing.T) {
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	d.config.DefaultMemoryMb = 1024
+
+	cfg := &drivers.TaskConfig{
+		ID: "task-1",
+		Resources: &drivers.Resources{
+			NomadResources: &structs.AllocatedTaskResources{
+				Memory: structs.AllocatedMemoryResources{MemoryMB: 2048},
+			},
+		},
+	}
+	require.Equal(t, int64(2048), d.taskMemoryMb(cfg))
+
+	// tasks without memory get the default
+	cfg.Resources.NomadResources.Memory.MemoryMB = 0
+	require.Equal(t, int64(1024), d.taskMemoryMb(cfg))
+}
+
+func TestSetConfig_MemoryLimits(t *testing.T) {
+	config := `
+config {
+  default_memory_mb = 8192
+  max_memory_mb     = 4096
+}`
+
+	var c *Config
+	hclutils.NewConfigParser(configSpec).ParseHCL(t, config, &c)
+	require.Equal(t, int64(8192), c.DefaultMemoryMb)
+	require.Equal(t, int64(4096), c.MaxMemoryMb)
+
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	var data []byte
+	require.NoError(t, base.MsgPackEncode(&data, c))
+	err := d.SetConfig(&base.Config{PluginConfig: data})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "default_memory_mb 8192 exceeds max_memory_mb 4096")
+
+	c.DefaultMemoryMb = 2048
+	require.NoError(t, base.MsgPackEncode(&data, c))
+	require.NoError(t, d.SetConfig(&base.Config{PluginConfig: data}))
+}
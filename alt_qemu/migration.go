@@ -0,0 +1,165 @@
+package alt_qemu
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// migrateExecCommand is the command name intercepted by ExecTask to
+	// migrate the VM to a target started with incoming, e.g.
+	// `nomad alloc exec <alloc> qemu-migrate 10.0.0.2:24000`
+	migrateExecCommand = "qemu-migrate"
+
+	// migrationPollInterval is how often the progress of an outgoing
+	// migration is queried
+	migrationPollInterval = time.Second
+
+	// migrationProgressStep is the progress, in percent, between the task
+	// events reporting an outgoing migration
+	migrationProgressStep = 10
+)
+
+// qmpMigrationInfo is the part of the query-migrate response the driver uses
+type qmpMigrationInfo struct {
+	Status    string `json:"status"`
+	ErrorDesc string `json:"error-desc"`
+	RAM       struct {
+		Transferred int64 `json:"transferred"`
+		Remaining   int64 `json:"remaining"`
+		Total       int64 `json:"total"`
+	} `json:"ram"`
+}
+
+// progress returns the share of the guest memory transferred, in percent.
+func (m *qmpMigrationInfo) progress() int {
+	if m.RAM.Total <= 0 {
+		return 0
+	}
+	return int((m.RAM.Total - m.RAM.Remaining) * 100 / m.RAM.Total)
+}
+
+// isMigrateCommand returns whether an exec command is a migrate command.
+func isMigrateCommand(cmd []string) bool {
+	return len(cmd) > 0 && cmd[0] == migrateExecCommand
+}
+
+// migrationURI parses the arguments of a qemu-migrate command into the URI
+// of the migration target.
+func migrationURI(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("usage: %s <host>:<port>", migrateExecCommand)
+	}
+	addr := strings.TrimPrefix(args[0], "tcp:")
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return "", fmt.Errorf("invalid migration target %q, must be <host>:<port>", args[0])
+	}
+	if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+		return "", fmt.Errorf("invalid migration target port %q", port)
+	}
+	return "tcp:" + addr, nil
+}
+
+// incomingArgs returns the arguments making qemu wait for the state of a VM
+// migrated to it on the host port allocated to the task under label, along
+// with that port. The VM is left paused once the migration completes, until
+// it is resumed.
+func incomingArgs(cfg *drivers.TaskConfig, label string) ([]string, int, error) {
+	port, ok := taskPortLabels(cfg)[label]
+	if !ok {
+		return nil, 0, fmt.Errorf("incoming refers to unknown port label %q, the task's network must reserve it", label)
+	}
+
+	host := "0.0.0.0"
+	if cfg.Resources != nil && cfg.Resources.NomadResources != nil && len(cfg.Resources.NomadResources.Networks) > 0 {
+		if ip := cfg.Resources.NomadResources.Networks[0].IP; ip != "" {
+			host = ip
+		}
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	return []string{"-S", "-incoming", "tcp:" + addr}, port, nil
+}
+
+// migrate runs a qemu-migrate command, sending the VM of handle to a target
+// started with incoming and waiting for the migration to complete. Progress
+// is reported through task events. If the migration fails or ctx is done
+// first, the migration is cancelled and the VM keeps running here.
+func (d *AltQemuDriverPlugin) migrate(ctx context.Context, handle *taskHandle, args []string) (*drivers.ExecTaskResult, error) {
+	if handle.monitorProtocol == monitorProtocolHMP {
+		return nil, fmt.Errorf("%s requires monitor_protocol qmp", migrateExecCommand)
+	}
+	uri, err := migrationURI(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := handle.monitorExecute(ctx, "migrate", map[string]interface{}{"uri": uri}); err != nil {
+		return nil, err
+	}
+	d.emitEvent(handle.taskConfig, "QEMU VM migration started", map[string]string{"target": uri})
+
+	ticker := time.NewTicker(migrationPollInterval)
+	defer ticker.Stop()
+	reported := 0
+	for {
+		select {
+		case <-ctx.Done():
+			d.cancelMigration(handle)
+			return nil, fmt.Errorf("migration to %s cancelled: %v", uri, ctx.Err())
+		case <-ticker.C:
+		}
+
+		raw, err := handle.monitorExecute(ctx, "query-migrate", nil)
+		if err != nil {
+			d.cancelMigration(handle)
+			return nil, fmt.Errorf("failed to query migration: %v", err)
+		}
+		var info qmpMigrationInfo
+		if err := json.Unmarshal(raw, &info); err != nil {
+			d.cancelMigration(handle)
+			return nil, fmt.Errorf("failed to decode migration status: %v", err)
+		}
+
+		switch info.Status {
+		case "completed":
+			d.emitEvent(handle.taskConfig, "QEMU VM migration completed", map[string]string{"target": uri})
+			return &drivers.ExecTaskResult{
+				Stdout:     []byte(fmt.Sprintf("migration to %s completed\n", uri)),
+				ExitResult: &drivers.ExitResult{},
+			}, nil
+		case "failed", "cancelled":
+			msg := fmt.Sprintf("migration to %s %s", uri, info.Status)
+			if info.ErrorDesc != "" {
+				msg += ": " + info.ErrorDesc
+			}
+			d.emitEvent(handle.taskConfig, "QEMU VM migration failed", map[string]string{"target": uri, "error": msg})
+			return &drivers.ExecTaskResult{
+				Stderr:     []byte(msg + "\n"),
+				ExitResult: &drivers.ExitResult{ExitCode: 1},
+			}, nil
+		}
+
+		if p := info.progress(); p >= reported+migrationProgressStep {
+			reported = p - p%migrationProgressStep
+			d.emitEvent(handle.taskConfig, fmt.Sprintf("QEMU VM migration %d%% done", reported), map[string]string{"target": uri})
+		}
+	}
+}
+
+// cancelMigration cancels the outgoing migration of the VM of handle, which
+// keeps running on this node.
+func (d *AltQemuDriverPlugin) cancelMigration(handle *taskHandle) {
+	ctx, cancel := context.WithTimeout(d.ctx, monitorTimeout)
+	defer cancel()
+	if _, err := handle.monitorExecute(ctx, "migrate_cancel", nil); err != nil {
+		d.logger.Warn("failed to cancel migration", "task_id", handle.taskConfig.ID, "error", err)
+	}
+}
@@ -0,0 +1,168 @@
+package alt_qemu
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskConfig_Incoming(t *testing.T) {
+	var tc *TaskConfig
+	hclutils.NewConfigParser(taskConfigSpec).ParseHCL(t, `
+config {
+  image_path = "linux.img"
+  incoming   = "migration"
+}`, &tc)
+	require.Equal(t, "migration", tc.Incoming)
+}
+
+func TestIncomingArgs(t *testing.T) {
+	cfg := testTaskConfigWithPorts(map[string]int{"migration": 24444})
+
+	args, port, err := incomingArgs(cfg, "migration")
+	require.NoError(t, err)
+	require.Equal(t, []string{"-S", "-incoming", "tcp:0.0.0.0:24444"}, args)
+	require.Equal(t, 24444, port)
+
+	// the VM is received on the allocated address
+	cfg.Resources.NomadResources.Networks[0].IP = "2001:db8::10"
+	args, _, err = incomingArgs(cfg, "migration")
+	require.NoError(t, err)
+	require.Equal(t, []string{"-S", "-incoming", "tcp:[2001:db8::10]:24444"}, args)
+
+	_, _, err = incomingArgs(cfg, "ssh")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `incoming refers to unknown port label "ssh"`)
+
+	_, _, err = incomingArgs(&drivers.TaskConfig{ID: "task-1"}, "migration")
+	require.Error(t, err)
+}
+
+func TestMigrationURI(t *testing.T) {
+	for arg, expected := range map[string]string{
+		"10.0.0.2:24000":      "tcp:10.0.0.2:24000",
+		"tcp:10.0.0.2:24000":  "tcp:10.0.0.2:24000",
+		"[2001:db8::2]:24000": "tcp:[2001:db8::2]:24000",
+		"node2.example:24000": "tcp:node2.example:24000",
+	} {
+		uri, err := migrationURI([]string{arg})
+		require.NoError(t, err, arg)
+		require.Equal(t, expected, uri, arg)
+	}
+
+	for _, args := range [][]string{
+		nil,
+		{"10.0.0.2:24000", "10.0.0.3:24000"},
+		{"10.0.0.2"},
+		{":24000"},
+		{"10.0.0.2:0"},
+		{"10.0.0.2:migration"},
+	} {
+		_, err := migrationURI(args)
+		require.Error(t, err, "%v", args)
+	}
+}
+
+func TestQmpMigrationInfo_Progress(t *testing.T) {
+	var info qmpMigrationInfo
+	require.Equal(t, 0, info.progress())
+
+	info.RAM.Total = 2048
+	info.RAM.Remaining = 512
+	require.Equal(t, 75, info.progress())
+}
+
+func TestMigrate(t *testing.T) {
+	cases := []struct {
+		name     string
+		status   string
+		exitCode int
+		output   string
+	}{
+		{
+			name:   "completed",
+			status: `{"status": "completed", "ram": {"total": 2048, "remaining": 0}}`,
+			output: "migration to tcp:10.0.0.2:24000 completed\n",
+		},
+		{
+			name:     "failed",
+			status:   `{"status": "failed", "error-desc": "Connection refused"}`,
+			exitCode: 1,
+			output:   "migration to tcp:10.0.0.2:24000 failed: Connection refused\n",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path, cmds := fakeQMPServer(t, func(cmd qmpCommand) string {
+				if cmd.Execute == "query-migrate" {
+					return `{"return": ` + c.status + `}`
+				}
+				return `{"return": {}}`
+			})
+			d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+			h := &taskHandle{
+				taskConfig:  &drivers.TaskConfig{ID: "task-1"},
+				monitorPath: path,
+			}
+
+			res, err := d.migrate(context.Background(), h, []string{"10.0.0.2:24000"})
+			require.NoError(t, err)
+			require.Equal(t, c.exitCode, res.ExitResult.ExitCode)
+			require.Equal(t, c.output, string(res.Stdout)+string(res.Stderr))
+
+			require.Equal(t, "qmp_capabilities", (<-cmds).Execute)
+			cmd := <-cmds
+			require.Equal(t, "migrate", cmd.Execute)
+			require.Equal(t, "tcp:10.0.0.2:24000", cmd.Arguments["uri"])
+		})
+	}
+}
+
+func TestMigrate_Errors(t *testing.T) {
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+
+	h := &taskHandle{
+		taskConfig:      &drivers.TaskConfig{ID: "task-1"},
+		monitorProtocol: monitorProtocolHMP,
+	}
+	_, err := d.migrate(context.Background(), h, []string{"10.0.0.2:24000"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "requires monitor_protocol qmp")
+
+	h.monitorProtocol = monitorProtocolQMP
+	_, err = d.migrate(context.Background(), h, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "usage: qemu-migrate <host>:<port>")
+}
+
+func TestMigrate_Cancelled(t *testing.T) {
+	path, cmds := fakeQMPServer(t, func(cmd qmpCommand) string {
+		if cmd.Execute == "query-migrate" {
+			return `{"return": {"status": "active", "ram": {"total": 2048, "remaining": 2048}}}`
+		}
+		return `{"return": {}}`
+	})
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	h := &taskHandle{
+		taskConfig:  &drivers.TaskConfig{ID: "task-1"},
+		monitorPath: path,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), migrationPollInterval/2)
+	defer cancel()
+	_, err := d.migrate(ctx, h, []string{"10.0.0.2:24000"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "migration to tcp:10.0.0.2:24000 cancelled")
+
+	// the VM keeps running here
+	var executed []string
+	for i := 0; i < 4; i++ {
+		executed = append(executed, (<-cmds).Execute)
+	}
+	require.Equal(t, []string{"qmp_capabilities", "migrate", "qmp_capabilities", "migrate_cancel"}, executed)
+}
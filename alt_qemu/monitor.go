@@ -0,0 +1,263 @@
+package alt_qemu
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// monitorTimeout bounds every exchange with the qemu monitor socket
+	monitorTimeout = 5 * time.Second
+)
+
+// watchContext interrupts any I/O on conn once ctx is done, so that a monitor
+// that stopped responding cannot block its caller past the context's
+// cancellation. The returned function stops watching ctx.
+func watchContext(ctx context.Context, conn net.Conn) func() {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// contextError returns the error of ctx if it is done, which explains why I/O
+// failed with err, or err otherwise.
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// dialMonitor connects to the unix socket at path within timeout, or until
+// ctx is done.
+func dialMonitor(ctx context.Context, path string, timeout time.Duration) (net.Conn, error) {
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to monitor %q: %v", path, contextError(ctx, err))
+	}
+	return conn, nil
+}
+
+// qmpCommand is a command sent to the QMP monitor
+type qmpCommand struct {
+	Execute   string                 `json:"execute"`
+	Arguments map[string]interface{} `json:"arguments,omitempty"`
+	ID        string                 `json:"id,omitempty"`
+}
+
+// qmpResponse is a message read from the QMP monitor. Exactly one of Greeting,
+// Return, Error or Event is set.
+type qmpResponse struct {
+	Greeting json.RawMessage `json:"QMP"`
+	Return   json.RawMessage `json:"return"`
+	Error    *qmpError       `json:"error"`
+	Event    string          `json:"event"`
+	ID       string          `json:"id"`
+}
+
+// qmpError is the error returned by the QMP monitor for a failed command
+type qmpError struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *qmpError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Class, e.Desc)
+}
+
+// getMonitorPath returns the path of the qemu monitor socket created in dir.
+func getMonitorPath(dir string) (string, error) {
+	return socketPath(dir, qemuMonitorSocketName)
+}
+
+// socketPath returns the path of the unix socket name created in dir. Unix
+// socket paths are limited to qemuLegacyMaxMonitorPathLen bytes, so an error
+// is returned when the resulting path would be too long for qemu to bind.
+func socketPath(dir, name string) (string, error) {
+	path := filepath.Join(dir, name)
+	if len(path) > qemuLegacyMaxMonitorPathLen {
+		return "", fmt.Errorf("socket path %q is %d bytes long, exceeding the %d byte limit for unix sockets",
+			path, len(path), qemuLegacyMaxMonitorPathLen)
+	}
+	return path, nil
+}
+
+// qmpExecute connects to the QMP monitor at monitorPath and executes cmd,
+// returning the command's result. It gives up once ctx is done.
+func qmpExecute(ctx context.Context, monitorPath string, cmd string, args map[string]interface{}) (json.RawMessage, error) {
+	c, err := newQMPClient(ctx, monitorPath, monitorTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.Execute(ctx, cmd, args)
+}
+
+// qmpClient is a connection to a QMP monitor. Commands are tagged with an id
+// so that their responses are told apart from the responses to commands of
+// a previous exchange that timed out.
+type qmpClient struct {
+	// lock serializes the commands sent on conn
+	lock    sync.Mutex
+	conn    net.Conn
+	dec     *json.Decoder
+	enc     *json.Encoder
+	timeout time.Duration
+	nextID  uint64
+}
+
+// newQMPClient connects to the QMP monitor at monitorPath and negotiates the
+// capabilities. Connecting and every command are bounded by timeout, and the
+// connection is abandoned if ctx is done first.
+func newQMPClient(ctx context.Context, monitorPath string, timeout time.Duration) (*qmpClient, error) {
+	conn, err := dialMonitor(ctx, monitorPath, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &qmpClient{
+		conn:    conn,
+		dec:     json.NewDecoder(conn),
+		enc:     json.NewEncoder(conn),
+		timeout: timeout,
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	stop := watchContext(ctx, conn)
+	var greeting qmpResponse
+	err = c.dec.Decode(&greeting)
+	stop()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read monitor greeting: %v", contextError(ctx, err))
+	}
+	if greeting.Greeting == nil {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected monitor greeting")
+	}
+
+	if _, err := c.Execute(ctx, "qmp_capabilities", nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Execute runs cmd with args and returns its result. It gives up once ctx is
+// done or the client's timeout has elapsed.
+func (c *qmpClient) Execute(ctx context.Context, cmd string, args map[string]interface{}) (json.RawMessage, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.nextID++
+	id := strconv.FormatUint(c.nextID, 10)
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	defer watchContext(ctx, c.conn)()
+
+	if err := c.enc.Encode(&qmpCommand{Execute: cmd, Arguments: args, ID: id}); err != nil {
+		return nil, fmt.Errorf("failed to send %q: %v", cmd, contextError(ctx, err))
+	}
+	for {
+		var resp qmpResponse
+		if err := c.dec.Decode(&resp); err != nil {
+			return nil, fmt.Errorf("failed to read %q response: %v", cmd, contextError(ctx, err))
+		}
+		// asynchronous events and stale responses may be interleaved with
+		// the response to cmd
+		if resp.Event != "" || resp.ID != id {
+			continue
+		}
+		if resp.Error != nil {
+			return nil, fmt.Errorf("command %q failed: %v", cmd, resp.Error)
+		}
+		return resp.Return, nil
+	}
+}
+
+// Close closes the connection to the monitor.
+func (c *qmpClient) Close() error {
+	return c.conn.Close()
+}
+
+// qmpExchange sends c and returns the result of the response to it. It speaks
+// to the guest agent, which shares the QMP wire protocol but synchronizes
+// with guest-sync rather than command ids.
+func qmpExchange(dec *json.Decoder, enc *json.Encoder, c qmpCommand) (json.RawMessage, error) {
+	if err := enc.Encode(&c); err != nil {
+		return nil, fmt.Errorf("failed to send %q: %v", c.Execute, err)
+	}
+	for {
+		var resp qmpResponse
+		if err := dec.Decode(&resp); err != nil {
+			return nil, fmt.Errorf("failed to read %q response: %v", c.Execute, err)
+		}
+		// asynchronous events may be interleaved with command responses
+		if resp.Event != "" {
+			continue
+		}
+		if resp.Error != nil {
+			return nil, fmt.Errorf("command %q failed: %v", c.Execute, resp.Error)
+		}
+		return resp.Return, nil
+	}
+}
+
+// qmpStatus is the result of the query-status command
+type qmpStatus struct {
+	Running bool   `json:"running"`
+	Status  string `json:"status"`
+}
+
+// waitRunning polls the monitor speaking protocol at monitorPath until the VM
+// reports it is running. It fails if qemu exits, which is signalled on
+// exited, if the VM is not running once timeout has elapsed or if ctx is
+// done.
+func waitRunning(ctx context.Context, protocol, monitorPath string, timeout time.Duration, exited <-chan int) error {
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+
+	var lastErr error
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case code := <-exited:
+			return fmt.Errorf("qemu exited with code %d before the VM was running", code)
+		case <-deadline:
+			if lastErr != nil {
+				return fmt.Errorf("VM was not running after %v: %v", timeout, lastErr)
+			}
+			return fmt.Errorf("VM was not running after %v", timeout)
+		case <-ticker.C:
+		}
+
+		status, err := monitorStatus(ctx, protocol, monitorPath)
+		if err != nil {
+			// the monitor socket is only created once qemu has initialized
+			lastErr = err
+			continue
+		}
+		if status.Running {
+			return nil
+		}
+		lastErr = fmt.Errorf("VM status is %q", status.Status)
+	}
+}
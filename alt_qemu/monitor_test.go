@@ -0,0 +1,292 @@
+package alt_qemu
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetMonitorPath(t *testing.T) {
+	dir := "/var/nomad/alloc/task"
+	path, err := getMonitorPath(dir)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, qemuMonitorSocketName), path)
+
+	// the longest directory whose socket path still fits
+	dir = "/" + strings.Repeat("a", qemuLegacyMaxMonitorPathLen-len(qemuMonitorSocketName)-2)
+	path, err = getMonitorPath(dir)
+	require.NoError(t, err)
+	require.Len(t, path, qemuLegacyMaxMonitorPathLen)
+
+	_, err = getMonitorPath(dir + "a")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "exceeding")
+}
+
+// fakeQMPServer listens on a unix socket in a temporary directory and answers
+// QMP commands through handle, recording every command it receives. It
+// returns the socket path and the channel the commands are sent on.
+func fakeQMPServer(t *testing.T, handle func(cmd qmpCommand) string) (string, <-chan qmpCommand) {
+	path := filepath.Join(t.TempDir(), qemuMonitorSocketName)
+	l, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	cmds := make(chan qmpCommand, 16)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte(`{"QMP": {"version": {}, "capabilities": []}}` + "\n"))
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					var cmd qmpCommand
+					if err := json.Unmarshal(scanner.Bytes(), &cmd); err != nil {
+						return
+					}
+					cmds <- cmd
+					conn.Write([]byte(tagResponses(handle(cmd), cmd.ID) + "\n"))
+				}
+			}()
+		}
+	}()
+	return path, cmds
+}
+
+// tagResponses sets the id of the responses among the messages in out that
+// carry none, like the monitor does for commands sent with an id. Events and
+// responses given an id explicitly are kept as is.
+func tagResponses(out, id string) string {
+	var msgs []string
+	dec := json.NewDecoder(strings.NewReader(out))
+	for {
+		var msg map[string]interface{}
+		if err := dec.Decode(&msg); err != nil {
+			break
+		}
+		_, hasID := msg["id"]
+		_, isEvent := msg["event"]
+		if !hasID && !isEvent && id != "" {
+			msg["id"] = id
+		}
+		b, _ := json.Marshal(msg)
+		msgs = append(msgs, string(b))
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func TestQmpExecute_Powerdown(t *testing.T) {
+	path, cmds := fakeQMPServer(t, func(cmd qmpCommand) string {
+		if cmd.Execute == "system_powerdown" {
+			// events may precede the command response
+			return `{"event": "POWERDOWN"}` + "\n" + `{"return": {}}`
+		}
+		return `{"return": {}}`
+	})
+
+	ret, err := qmpExecute(context.Background(), path, "system_powerdown", nil)
+	require.NoError(t, err)
+	require.JSONEq(t, `{}`, string(ret))
+
+	require.Equal(t, "qmp_capabilities", (<-cmds).Execute)
+	require.Equal(t, "system_powerdown", (<-cmds).Execute)
+}
+
+func TestQmpExecute_Error(t *testing.T) {
+	path, _ := fakeQMPServer(t, func(cmd qmpCommand) string {
+		if cmd.Execute == "qmp_capabilities" {
+			return `{"return": {}}`
+		}
+		return `{"error": {"class": "CommandNotFound", "desc": "The command foo has not been found"}}`
+	})
+
+	_, err := qmpExecute(context.Background(), path, "foo", nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "CommandNotFound")
+}
+
+func TestQmpClient_IgnoresStaleResponses(t *testing.T) {
+	path, cmds := fakeQMPServer(t, func(cmd qmpCommand) string {
+		if cmd.Execute == "query-status" {
+			// the response to a command of a previous exchange that timed
+			// out arrives before the one to query-status
+			return `{"id": "stale", "return": {"running": false, "status": "paused"}}` + "\n" +
+				`{"event": "RESUME"}` + "\n" +
+				`{"return": {"running": true, "status": "running"}}`
+		}
+		return `{"return": {}}`
+	})
+
+	c, err := newQMPClient(context.Background(), path, monitorTimeout)
+	require.NoError(t, err)
+	defer c.Close()
+
+	ret, err := c.Execute(context.Background(), "query-status", nil)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"running": true, "status": "running"}`, string(ret))
+
+	// successive commands on the same connection get distinct ids
+	_, err = c.Execute(context.Background(), "cont", nil)
+	require.NoError(t, err)
+
+	capabilities := <-cmds
+	require.Equal(t, "qmp_capabilities", capabilities.Execute)
+	query := <-cmds
+	require.Equal(t, "query-status", query.Execute)
+	cont := <-cmds
+	require.Equal(t, "cont", cont.Execute)
+	require.NotEmpty(t, query.ID)
+	require.NotEqual(t, capabilities.ID, query.ID)
+	require.NotEqual(t, query.ID, cont.ID)
+}
+
+func TestQmpClient_Timeout(t *testing.T) {
+	path, _ := fakeQMPServer(t, func(cmd qmpCommand) string {
+		if cmd.Execute == "qmp_capabilities" {
+			return `{"return": {}}`
+		}
+		// never answer the command itself
+		return `{"id": "other", "return": {}}`
+	})
+
+	c, err := newQMPClient(context.Background(), path, 200*time.Millisecond)
+	require.NoError(t, err)
+	defer c.Close()
+
+	_, err = c.Execute(context.Background(), "query-status", nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `failed to read "query-status" response`)
+}
+
+func TestQmpExecute_NoMonitor(t *testing.T) {
+	_, err := qmpExecute(context.Background(), filepath.Join(t.TempDir(), "missing.sock"), "system_powerdown", nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to connect to monitor")
+}
+
+func TestSocketPath(t *testing.T) {
+	path, err := socketPath("/alloc/task", qemuGuestAgentSocketName)
+	require.NoError(t, err)
+	require.Equal(t, "/alloc/task/qga.sock", path)
+
+	_, err = socketPath("/"+strings.Repeat("a", qemuLegacyMaxMonitorPathLen), qemuGuestAgentSocketName)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "socket path")
+}
+
+func TestWaitRunning(t *testing.T) {
+	var polls int
+	path, _ := fakeQMPServer(t, func(cmd qmpCommand) string {
+		if cmd.Execute != "query-status" {
+			return `{"return": {}}`
+		}
+		polls++
+		if polls < 2 {
+			return `{"return": {"running": false, "status": "prelaunch"}}`
+		}
+		return `{"return": {"running": true, "status": "running"}}`
+	})
+
+	require.NoError(t, waitRunning(context.Background(), "", path, 5*time.Second, nil))
+}
+
+func TestWaitRunning_Errors(t *testing.T) {
+	t.Run("qemu exited", func(t *testing.T) {
+		exited := make(chan int, 1)
+		exited <- 1
+		err := waitRunning(context.Background(), "", filepath.Join(t.TempDir(), qemuMonitorSocketName), 5*time.Second, exited)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "qemu exited with code 1")
+	})
+
+	t.Run("never running", func(t *testing.T) {
+		path, _ := fakeQMPServer(t, func(cmd qmpCommand) string {
+			return `{"return": {"running": false, "status": "paused"}}`
+		})
+		err := waitRunning(context.Background(), "", path, 600*time.Millisecond, nil)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), `VM status is "paused"`)
+	})
+
+	t.Run("no monitor", func(t *testing.T) {
+		err := waitRunning(context.Background(), "", filepath.Join(t.TempDir(), qemuMonitorSocketName), 300*time.Millisecond, nil)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "VM was not running after")
+	})
+}
+
+// silentMonitor listens on a unix socket in a temporary directory, accepting
+// connections but never writing to them, like a hung monitor.
+func silentMonitor(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), qemuMonitorSocketName)
+	l, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	return path
+}
+
+func TestMonitorExecute_ContextDone(t *testing.T) {
+	path := silentMonitor(t)
+
+	for name, execute := range map[string]func(ctx context.Context) error{
+		"qmp": func(ctx context.Context) error {
+			_, err := qmpExecute(ctx, path, "query-status", nil)
+			return err
+		},
+		"hmp": func(ctx context.Context) error {
+			_, err := hmpExecute(ctx, path, "info status")
+			return err
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			start := time.Now()
+			err := execute(ctx)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), context.DeadlineExceeded.Error())
+			// well before the socket timeout
+			require.True(t, time.Since(start) < monitorTimeout)
+		})
+	}
+}
+
+func TestWaitRunning_ContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := waitRunning(ctx, "", filepath.Join(t.TempDir(), qemuMonitorSocketName), 5*time.Second, nil)
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestContextError(t *testing.T) {
+	ioErr := fmt.Errorf("i/o timeout")
+	require.Equal(t, ioErr, contextError(context.Background(), ioErr))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(t, context.Canceled, contextError(ctx, ioErr))
+}
@@ -0,0 +1,89 @@
+package alt_qemu
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// cniInterfaceName is the interface CNI creates in the allocation's
+	// network namespace
+	cniInterfaceName = "eth0"
+
+	// cniTapName is the tap device created in the allocation's network
+	// namespace for the VM
+	cniTapName = "tap0"
+)
+
+// nsExec runs the command args inside the network namespace at nsPath and
+// returns its output.
+func nsExec(nsPath string, args ...string) (string, error) {
+	nsArgs := append([]string{"--net=" + nsPath, "--"}, args...)
+	out, err := exec.Command("nsenter", nsArgs...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%q failed in namespace %q: %v: %s", strings.Join(args, " "), nsPath, err, out)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// cniMacAddress returns the MAC address of the guest NIC of task cfg in the
+// cni network mode when mac_address is not set: a locally administered
+// address derived from the allocation and task name, so it is the same
+// across restarts of the task.
+func cniMacAddress(cfg *drivers.TaskConfig) string {
+	sum := sha256.Sum256([]byte(cfg.AllocID + "/" + cfg.Name))
+	return fmt.Sprintf("02:%02x:%02x:%02x:%02x:%02x", sum[0], sum[1], sum[2], sum[3], sum[4])
+}
+
+// setupNamespaceTap creates the VM's tap device in the network namespace at
+// nsPath and redirects all traffic between it and the CNI interface, so the
+// guest takes over the address CNI allocated. The CNI interface is given the
+// guest's MAC address mac, so the frames sent to it are accepted by the guest
+// NIC. The tap device and redirection left by a previous run of the task are
+// replaced, and those set up are removed again when a step fails.
+func setupNamespaceTap(nsPath, mac string) error {
+	// nothing is left behind by a clean stop, so errors only tell that
+	// there was nothing to remove
+	teardownNamespaceTap(nsPath)
+
+	cmds := [][]string{
+		{"ip", "link", "set", "dev", cniInterfaceName, "address", mac},
+		{"ip", "tuntap", "add", "dev", cniTapName, "mode", "tap"},
+		{"ip", "link", "set", cniTapName, "up"},
+		{"tc", "qdisc", "add", "dev", cniInterfaceName, "ingress"},
+		{"tc", "filter", "add", "dev", cniInterfaceName, "parent", "ffff:", "matchall",
+			"action", "mirred", "egress", "redirect", "dev", cniTapName},
+		{"tc", "qdisc", "add", "dev", cniTapName, "ingress"},
+		{"tc", "filter", "add", "dev", cniTapName, "parent", "ffff:", "matchall",
+			"action", "mirred", "egress", "redirect", "dev", cniInterfaceName},
+	}
+	for _, cmd := range cmds {
+		if _, err := nsExec(nsPath, cmd...); err != nil {
+			teardownNamespaceTap(nsPath)
+			return err
+		}
+	}
+	return nil
+}
+
+// teardownNamespaceTap removes the tap device created by setupNamespaceTap
+// in the network namespace at nsPath, along with its filters, and the
+// redirection of the CNI interface. Every step is attempted, the first error
+// is returned.
+func teardownNamespaceTap(nsPath string) error {
+	cmds := [][]string{
+		{"ip", "link", "delete", "dev", cniTapName},
+		{"tc", "qdisc", "del", "dev", cniInterfaceName, "ingress"},
+	}
+	var firstErr error
+	for _, cmd := range cmds {
+		if _, err := nsExec(nsPath, cmd...); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
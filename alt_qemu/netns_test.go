@@ -0,0 +1,163 @@
+package alt_qemu
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNsenter writes to dir an nsenter keeping the tap device and ingress
+// qdiscs of the namespace in state files, failing like ip and tc do when one
+// is added twice or removed while missing. The commands it runs are logged
+// to the returned file.
+func fakeNsenter(t *testing.T, dir string) string {
+	logPath := filepath.Join(dir, "nsenter.log")
+	state := filepath.Join(dir, "state")
+	require.NoError(t, os.Mkdir(state, 0755))
+	writeFakeBinary(t, dir, "nsenter", `shift 2
+echo "$@" >> `+logPath+`
+add() { [ -e `+state+`/$1 ] && { echo "File exists" >&2; exit 2; }; touch `+state+`/$1; }
+del() { [ -e `+state+`/$1 ] || { echo "Cannot find device" >&2; exit 1; }; rm -f `+state+`/$1 `+state+`/$2; }
+case "$*" in
+"ip tuntap add dev tap0 "*) add tap0 ;;
+"ip link delete dev tap0") del tap0 tap0-ingress ;;
+"tc qdisc add dev eth0 ingress") add eth0-ingress ;;
+"tc qdisc del dev eth0 ingress") del eth0-ingress ;;
+"tc qdisc add dev tap0 ingress") add tap0-ingress ;;
+esac
+exit 0`)
+	return logPath
+}
+
+// nsState returns the tap device and qdiscs the fake nsenter holds.
+func nsState(t *testing.T, dir string) []string {
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "state"))
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestCniMacAddress(t *testing.T) {
+	mac := cniMacAddress(&drivers.TaskConfig{AllocID: "alloc-1", Name: "web"})
+	require.Regexp(t, macAddressRegex, mac)
+	// locally administered unicast address
+	require.True(t, strings.HasPrefix(mac, "02:"))
+
+	// the address is the same across restarts of the task
+	require.Equal(t, mac, cniMacAddress(&drivers.TaskConfig{ID: "alloc-1/web/2", AllocID: "alloc-1", Name: "web"}))
+	require.NotEqual(t, mac, cniMacAddress(&drivers.TaskConfig{AllocID: "alloc-1", Name: "db"}))
+}
+
+func TestNetworkArgs_CNI(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake binaries are shell scripts")
+	}
+
+	// building the arguments does not enter the namespace
+	dir := t.TempDir()
+	logPath := fakeNsenter(t, dir)
+	setPath(t, dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	cfg := &drivers.TaskConfig{
+		AllocID:          "alloc-1",
+		Name:             "web",
+		NetworkIsolation: &drivers.NetworkIsolationSpec{Path: "/var/run/netns/alloc"},
+	}
+	tc := &TaskConfig{NetworkMode: "cni"}
+	args, err := networkArgs(cfg, tc)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"-netdev", "tap,id=nd0,ifname=tap0,script=no,downscript=no",
+		"-device", "virtio-net-pci,netdev=nd0,mac=" + cniMacAddress(cfg),
+	}, args)
+	require.Empty(t, tc.MacAddress)
+
+	tc.MacAddress = "52:54:00:12:34:56"
+	args, err = networkArgs(cfg, tc)
+	require.NoError(t, err)
+	require.Equal(t, "virtio-net-pci,netdev=nd0,mac=52:54:00:12:34:56", args[3])
+
+	_, err = os.Stat(logPath)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestSetupNamespaceTap(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake binaries are shell scripts")
+	}
+
+	dir := t.TempDir()
+	logPath := fakeNsenter(t, dir)
+	setPath(t, dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	require.NoError(t, setupNamespaceTap("/var/run/netns/alloc", "02:00:00:00:00:05"))
+	require.Equal(t, []string{"eth0-ingress", "tap0", "tap0-ingress"}, nsState(t, dir))
+
+	data, err := ioutil.ReadFile(logPath)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 9)
+	// the leftovers of a previous run are removed first
+	require.Equal(t, "ip link delete dev tap0", lines[0])
+	require.Equal(t, "tc qdisc del dev eth0 ingress", lines[1])
+	// the CNI interface takes over the guest NIC's MAC address
+	require.Equal(t, "ip link set dev eth0 address 02:00:00:00:00:05", lines[2])
+	require.Equal(t, "ip tuntap add dev tap0 mode tap", lines[3])
+
+	// a restart of the task in the same allocation replaces the tap device
+	require.NoError(t, setupNamespaceTap("/var/run/netns/alloc", "02:00:00:00:00:05"))
+	require.Equal(t, []string{"eth0-ingress", "tap0", "tap0-ingress"}, nsState(t, dir))
+
+	require.NoError(t, teardownNamespaceTap("/var/run/netns/alloc"))
+	require.Empty(t, nsState(t, dir))
+
+	err = teardownNamespaceTap("/var/run/netns/alloc")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Cannot find device")
+}
+
+func TestSetupNamespaceTap_Error(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake binaries are shell scripts")
+	}
+
+	// the tc filters cannot be added, the tap device is removed again
+	dir := t.TempDir()
+	fakeNsenter(t, dir)
+	nsenter := filepath.Join(dir, "nsenter")
+	data, err := ioutil.ReadFile(nsenter)
+	require.NoError(t, err)
+	script := strings.Replace(string(data), "case \"$*\" in", "case \"$*\" in\n\"tc filter \"*) echo \"no matchall support\" >&2; exit 2 ;;", 1)
+	require.NoError(t, ioutil.WriteFile(nsenter, []byte(script), 0755))
+	setPath(t, dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	err = setupNamespaceTap("/var/run/netns/alloc", "02:00:00:00:00:05")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no matchall support")
+	require.Empty(t, nsState(t, dir))
+}
+
+func TestTaskHandle_CleanupTap(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake binaries are shell scripts")
+	}
+
+	dir := t.TempDir()
+	fakeNsenter(t, dir)
+	setPath(t, dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	require.NoError(t, setupNamespaceTap("/var/run/netns/alloc", "02:00:00:00:00:05"))
+
+	h := &taskHandle{netnsPath: "/var/run/netns/alloc", logger: hclog.NewNullLogger()}
+	h.cleanup()
+	require.Empty(t, nsState(t, dir))
+}
@@ -0,0 +1,285 @@
+package alt_qemu
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// netdevID is the id of the VM's network backend
+	netdevID = "nd0"
+
+	// nicDeviceType is the device exposing the network backend to the guest
+	nicDeviceType = "virtio-net-pci"
+
+	// defaultBridgeName is the host bridge used by the bridge network mode
+	defaultBridgeName = "br0"
+
+	// hostfwdFamilyIPv4 forwards host ports listening on IPv4 addresses
+	hostfwdFamilyIPv4 = "ipv4"
+
+	// hostfwdFamilyIPv6 forwards host ports listening on IPv6 addresses
+	hostfwdFamilyIPv6 = "ipv6"
+
+	// hostfwdFamilyDual forwards host ports listening on both families
+	hostfwdFamilyDual = "dual"
+
+	// portProtocolBoth forwards a port over both TCP and UDP
+	portProtocolBoth = "both"
+)
+
+var (
+	// macAddressRegex matches a colon separated MAC address
+	macAddressRegex = regexp.MustCompile(`^([0-9a-fA-F]{2}:){5}[0-9a-fA-F]{2}$`)
+
+	// ifNameRegex matches a valid Linux network interface name
+	ifNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,15}$`)
+)
+
+// networkArgs returns the arguments creating the VM's network backend and NIC
+// for the given network_mode. User-mode networking is used when no mode is
+// set. The cni mode attaches to a tap device in the allocation's network
+// namespace, which is left to setupNamespaceTap.
+func networkArgs(cfg *drivers.TaskConfig, tc *TaskConfig) ([]string, error) {
+	if err := checkPortMap(cfg, tc.PortMap); err != nil {
+		return nil, err
+	}
+
+	var netdev string
+	switch tc.NetworkMode {
+	case "", "user":
+		// user-mode networking forwards the task's allocated ports to the
+		// guest
+		netdev = fmt.Sprintf("user,id=%s", netdevID)
+		forwards, err := hostForwards(cfg, tc)
+		if err != nil {
+			return nil, err
+		}
+		if len(forwards) > 0 {
+			netdev += "," + strings.Join(forwards, ",")
+		}
+	case "bridge":
+		bridge := tc.BridgeName
+		if bridge == "" {
+			bridge = defaultBridgeName
+		}
+		if !ifNameRegex.MatchString(bridge) {
+			return nil, fmt.Errorf("invalid bridge_name %q", bridge)
+		}
+		netdev = fmt.Sprintf("bridge,id=%s,br=%s", netdevID, bridge)
+	case "tap":
+		netdev = fmt.Sprintf("tap,id=%s", netdevID)
+	case "cni":
+		// the VM takes over the interface CNI set up in the network
+		// namespace Nomad created for the allocation
+		if cfg.NetworkIsolation == nil || cfg.NetworkIsolation.Path == "" {
+			return nil, fmt.Errorf("network_mode cni requires the task group to use bridge or cni networking")
+		}
+		netdev = fmt.Sprintf("tap,id=%s,ifname=%s,script=no,downscript=no", netdevID, cniTapName)
+	case "none":
+		return []string{"-nic", "none"}, nil
+	default:
+		return nil, fmt.Errorf("unknown network_mode %q, must be one of user, bridge, tap, cni or none", tc.NetworkMode)
+	}
+
+	nic := fmt.Sprintf("%s,netdev=%s", nicDeviceType, netdevID)
+	if tc.MacAddress != "" && !macAddressRegex.MatchString(tc.MacAddress) {
+		return nil, fmt.Errorf("invalid mac_address %q", tc.MacAddress)
+	}
+	if mac := guestMacAddress(cfg, tc); mac != "" {
+		nic += ",mac=" + mac
+	}
+
+	return []string{"-netdev", netdev, "-device", nic}, nil
+}
+
+// guestMacAddress returns the MAC address of the guest NIC: mac_address when
+// set, otherwise the one generated for the cni network mode. qemu picks the
+// address of other guests.
+func guestMacAddress(cfg *drivers.TaskConfig, tc *TaskConfig) string {
+	if tc.MacAddress == "" && tc.NetworkMode == "cni" {
+		return cniMacAddress(cfg)
+	}
+	return tc.MacAddress
+}
+
+// taskNetwork returns the driver network of a VM as known before it starts.
+// User-mode guests are reached through the host ports forwarded to them,
+// other guests at the host address until they report their own through
+// guestNetwork. consolePorts are the ports of the VM's consoles, which
+// listen on the host.
+func taskNetwork(cfg *drivers.TaskConfig, tc *TaskConfig, consolePorts map[string]int) *drivers.DriverNetwork {
+	network := &drivers.DriverNetwork{PortMap: map[string]int{}}
+	if cfg.Resources != nil && cfg.Resources.NomadResources != nil && len(cfg.Resources.NomadResources.Networks) > 0 {
+		network.IP = cfg.Resources.NomadResources.Networks[0].IP
+	}
+	for label, port := range consolePorts {
+		network.PortMap[label] = port
+	}
+
+	if tc.NetworkMode == "" || tc.NetworkMode == "user" {
+		taskPorts := taskPortLabels(cfg)
+		for label := range tc.PortMap {
+			if port, ok := taskPorts[label]; ok {
+				network.PortMap[label] = port
+			}
+		}
+	}
+
+	if network.IP == "" && len(network.PortMap) == 0 {
+		return nil
+	}
+	return network
+}
+
+// guestAddressWanted returns whether the guest of tc is bridged and reports
+// its address through the guest agent at agentPath.
+func guestAddressWanted(tc *TaskConfig, agentPath string) bool {
+	return (tc.NetworkMode == "bridge" || tc.NetworkMode == "tap") && agentPath != ""
+}
+
+// guestNetwork returns the driver network of a started bridged guest,
+// advertised at the address it reports through the guest agent at
+// agentPath. It returns nil for other guests or when the address is unknown,
+// including when ctx is done or qemu exits, as reported on exited, first.
+func (d *AltQemuDriverPlugin) guestNetwork(ctx context.Context, cfg *drivers.TaskConfig, tc *TaskConfig, agentPath string, exited <-chan int) *drivers.DriverNetwork {
+	if !guestAddressWanted(tc, agentPath) {
+		return nil
+	}
+
+	ip, err := guestAddress(ctx, agentPath, tc.MacAddress, guestAddressTimeout, exited)
+	if err != nil {
+		d.logger.Warn("failed to discover the guest address", "task_id", cfg.ID, "error", err)
+	}
+	if ip == "" {
+		return nil
+	}
+
+	network := &drivers.DriverNetwork{
+		IP:            ip,
+		AutoAdvertise: true,
+		PortMap:       map[string]int{},
+	}
+	for label, port := range tc.PortMap {
+		network.PortMap[label] = port
+	}
+	return network
+}
+
+// taskPortLabels returns the host ports allocated to the task by port label.
+func taskPortLabels(cfg *drivers.TaskConfig) map[string]int {
+	if cfg.Resources != nil && cfg.Resources.NomadResources != nil && len(cfg.Resources.NomadResources.Networks) > 0 {
+		return cfg.Resources.NomadResources.Networks[0].PortLabels()
+	}
+	return map[string]int{}
+}
+
+// checkPortMap returns an error listing the port labels of portMap that are
+// not among the ports allocated to the task, e.g. because of a typo.
+func checkPortMap(cfg *drivers.TaskConfig, portMap map[string]int) error {
+	taskPorts := taskPortLabels(cfg)
+	var unknown []string
+	for label := range portMap {
+		if _, ok := taskPorts[label]; !ok {
+			unknown = append(unknown, label)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	return fmt.Errorf("port_map refers to unknown port labels %s, the task's network must reserve them", strings.Join(unknown, ", "))
+}
+
+// hostfwdAddresses returns the host addresses hostfwd rules listen on for the
+// given hostfwd_family, in the form qemu expects them. Without a family, the
+// family of the address allocated to the task is used, IPv4 by default.
+func hostfwdAddresses(cfg *drivers.TaskConfig, family string) ([]string, error) {
+	if family == "" {
+		family = hostfwdFamilyIPv4
+		if cfg.Resources != nil && cfg.Resources.NomadResources != nil && len(cfg.Resources.NomadResources.Networks) > 0 {
+			if ip := net.ParseIP(cfg.Resources.NomadResources.Networks[0].IP); ip != nil && ip.To4() == nil {
+				family = hostfwdFamilyIPv6
+			}
+		}
+	}
+
+	switch family {
+	case hostfwdFamilyIPv4:
+		return []string{""}, nil
+	case hostfwdFamilyIPv6:
+		return []string{"[::]"}, nil
+	case hostfwdFamilyDual:
+		return []string{"", "[::]"}, nil
+	default:
+		return nil, fmt.Errorf("unknown hostfwd_family %q, must be ipv4, ipv6 or dual", family)
+	}
+}
+
+// portProtocols returns the protocols the port labelled label is forwarded
+// over, TCP unless protocols says otherwise.
+func portProtocols(protocols map[string]string, label string) ([]string, error) {
+	switch protocol := protocols[label]; protocol {
+	case "", "tcp":
+		return []string{"tcp"}, nil
+	case "udp":
+		return []string{"udp"}, nil
+	case portProtocolBoth:
+		return []string{"tcp", "udp"}, nil
+	default:
+		return nil, fmt.Errorf("unknown protocol %q for port %q, must be tcp, udp or both", protocol, label)
+	}
+}
+
+// hostForwards returns the user-mode networking hostfwd rules forwarding the
+// host ports allocated to the task to the guest ports given in the port_map
+// of tc, which maps port labels to guest ports. Rules are sorted by port
+// label, with a rule per protocol the port is forwarded over and address
+// family it listens on.
+func hostForwards(cfg *drivers.TaskConfig, tc *TaskConfig) ([]string, error) {
+	portMap := tc.PortMap
+	for label := range tc.PortProtocols {
+		if _, ok := portMap[label]; !ok {
+			return nil, fmt.Errorf("port_protocols refers to port %q which is not in port_map", label)
+		}
+	}
+	if len(portMap) == 0 {
+		return nil, nil
+	}
+
+	addrs, err := hostfwdAddresses(cfg, tc.HostfwdFamily)
+	if err != nil {
+		return nil, err
+	}
+
+	taskPorts := taskPortLabels(cfg)
+	labels := make([]string, 0, len(portMap))
+	for label := range portMap {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	var forwards []string
+	for _, label := range labels {
+		host, ok := taskPorts[label]
+		if !ok {
+			return nil, fmt.Errorf("unknown port label %q", label)
+		}
+		protocols, err := portProtocols(tc.PortProtocols, label)
+		if err != nil {
+			return nil, err
+		}
+		for _, protocol := range protocols {
+			for _, addr := range addrs {
+				forwards = append(forwards, fmt.Sprintf("hostfwd=%s:%s:%d-:%d", protocol, addr, host, portMap[label]))
+			}
+		}
+	}
+	return forwards, nil
+}
@@ -0,0 +1,287 @@
+package alt_qemu
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+// testTaskConfigWithPorts returns a task config whose first network has the
+// given labelled ports allocated.
+func testTaskConfigWithPorts(ports map[string]int) *drivers.TaskConfig {
+	network := &structs.NetworkResource{}
+	for label, port := range ports {
+		network.DynamicPorts = append(network.DynamicPorts, structs.Port{Label: label, Value: port})
+	}
+	return &drivers.TaskConfig{
+		ID: "task-1",
+		Resources: &drivers.Resources{
+			NomadResources: &structs.AllocatedTaskResources{
+				Networks: []*structs.NetworkResource{network},
+			},
+		},
+	}
+}
+
+func TestHostForwards(t *testing.T) {
+	cfg := testTaskConfigWithPorts(map[string]int{"ssh": 22000, "http": 28080})
+
+	forwards, err := hostForwards(cfg, &TaskConfig{PortMap: map[string]int{"ssh": 22, "http": 80}})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"hostfwd=tcp::28080-:80",
+		"hostfwd=tcp::22000-:22",
+	}, forwards)
+
+	forwards, err = hostForwards(cfg, &TaskConfig{})
+	require.NoError(t, err)
+	require.Empty(t, forwards)
+
+	_, err = hostForwards(cfg, &TaskConfig{PortMap: map[string]int{"db": 5432}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `unknown port label "db"`)
+
+	_, err = hostForwards(&drivers.TaskConfig{}, &TaskConfig{PortMap: map[string]int{"ssh": 22}})
+	require.Error(t, err)
+}
+
+func TestHostForwards_Family(t *testing.T) {
+	cfg := testTaskConfigWithPorts(map[string]int{"ssh": 22000})
+	portMap := map[string]int{"ssh": 22}
+
+	for family, expected := range map[string][]string{
+		"ipv4": {"hostfwd=tcp::22000-:22"},
+		"ipv6": {"hostfwd=tcp:[::]:22000-:22"},
+		"dual": {"hostfwd=tcp::22000-:22", "hostfwd=tcp:[::]:22000-:22"},
+	} {
+		forwards, err := hostForwards(cfg, &TaskConfig{PortMap: portMap, HostfwdFamily: family})
+		require.NoError(t, err, family)
+		require.Equal(t, expected, forwards, family)
+	}
+
+	_, err := hostForwards(cfg, &TaskConfig{PortMap: portMap, HostfwdFamily: "ipx"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `unknown hostfwd_family "ipx"`)
+
+	// the family defaults to the one of the allocated address
+	cfg.Resources.NomadResources.Networks[0].IP = "2001:db8::10"
+	forwards, err := hostForwards(cfg, &TaskConfig{PortMap: portMap})
+	require.NoError(t, err)
+	require.Equal(t, []string{"hostfwd=tcp:[::]:22000-:22"}, forwards)
+
+	cfg.Resources.NomadResources.Networks[0].IP = "192.168.0.10"
+	forwards, err = hostForwards(cfg, &TaskConfig{PortMap: portMap})
+	require.NoError(t, err)
+	require.Equal(t, []string{"hostfwd=tcp::22000-:22"}, forwards)
+}
+
+func TestHostForwards_Protocols(t *testing.T) {
+	cfg := testTaskConfigWithPorts(map[string]int{"ssh": 22000, "dns": 25353, "game": 27015})
+
+	forwards, err := hostForwards(cfg, &TaskConfig{
+		PortMap:       map[string]int{"ssh": 22, "dns": 53, "game": 27015},
+		PortProtocols: map[string]string{"dns": "udp", "game": "both", "ssh": "tcp"},
+		HostfwdFamily: "dual",
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"hostfwd=udp::25353-:53",
+		"hostfwd=udp:[::]:25353-:53",
+		"hostfwd=tcp::27015-:27015",
+		"hostfwd=tcp:[::]:27015-:27015",
+		"hostfwd=udp::27015-:27015",
+		"hostfwd=udp:[::]:27015-:27015",
+		"hostfwd=tcp::22000-:22",
+		"hostfwd=tcp:[::]:22000-:22",
+	}, forwards)
+
+	_, err = hostForwards(cfg, &TaskConfig{
+		PortMap:       map[string]int{"dns": 53},
+		PortProtocols: map[string]string{"dns": "sctp"},
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `unknown protocol "sctp" for port "dns"`)
+
+	_, err = hostForwards(cfg, &TaskConfig{
+		PortMap:       map[string]int{"ssh": 22},
+		PortProtocols: map[string]string{"dns": "udp"},
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `port_protocols refers to port "dns" which is not in port_map`)
+}
+
+func TestNetworkArgs(t *testing.T) {
+	cfg := testTaskConfigWithPorts(map[string]int{"ssh": 22000})
+	nic := []string{"-device", "virtio-net-pci,netdev=nd0"}
+
+	cases := []struct {
+		name string
+		tc   TaskConfig
+		args []string
+		err  string
+	}{
+		{
+			name: "default user",
+			tc:   TaskConfig{},
+			args: append([]string{"-netdev", "user,id=nd0"}, nic...),
+		},
+		{
+			name: "user with forwards",
+			tc:   TaskConfig{NetworkMode: "user", PortMap: map[string]int{"ssh": 22}},
+			args: append([]string{"-netdev", "user,id=nd0,hostfwd=tcp::22000-:22"}, nic...),
+		},
+		{
+			name: "bridge",
+			tc:   TaskConfig{NetworkMode: "bridge"},
+			args: append([]string{"-netdev", "bridge,id=nd0,br=br0"}, nic...),
+		},
+		{
+			name: "tap",
+			tc:   TaskConfig{NetworkMode: "tap"},
+			args: append([]string{"-netdev", "tap,id=nd0"}, nic...),
+		},
+		{
+			name: "none",
+			tc:   TaskConfig{NetworkMode: "none"},
+			args: []string{"-nic", "none"},
+		},
+		{
+			name: "bridge name",
+			tc:   TaskConfig{NetworkMode: "bridge", BridgeName: "virbr0"},
+			args: append([]string{"-netdev", "bridge,id=nd0,br=virbr0"}, nic...),
+		},
+		{
+			name: "mac address",
+			tc:   TaskConfig{MacAddress: "52:54:00:12:34:56"},
+			args: []string{"-netdev", "user,id=nd0", "-device", "virtio-net-pci,netdev=nd0,mac=52:54:00:12:34:56"},
+		},
+		{
+			name: "invalid bridge name",
+			tc:   TaskConfig{NetworkMode: "bridge", BridgeName: "br0,helper=/bin/sh"},
+			err:  `invalid bridge_name "br0,helper=/bin/sh"`,
+		},
+		{
+			name: "invalid mac address",
+			tc:   TaskConfig{MacAddress: "52:54:00:12:34"},
+			err:  `invalid mac_address "52:54:00:12:34"`,
+		},
+		{
+			name: "unknown mode",
+			tc:   TaskConfig{NetworkMode: "macvtap"},
+			err:  `unknown network_mode "macvtap"`,
+		},
+		{
+			name: "cni without network isolation",
+			tc:   TaskConfig{NetworkMode: "cni"},
+			err:  "network_mode cni requires the task group to use bridge or cni networking",
+		},
+		{
+			name: "unknown port label",
+			tc:   TaskConfig{PortMap: map[string]int{"http": 80}},
+			err:  "port_map refers to unknown port labels http",
+		},
+		{
+			name: "unknown port label with bridge",
+			tc:   TaskConfig{NetworkMode: "bridge", PortMap: map[string]int{"http": 80}},
+			err:  "port_map refers to unknown port labels http",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			args, err := networkArgs(cfg, &c.tc)
+			if c.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.args, args)
+		})
+	}
+}
+
+func TestCheckPortMap(t *testing.T) {
+	cfg := testTaskConfigWithPorts(map[string]int{"ssh": 22000, "http": 28080})
+
+	require.NoError(t, checkPortMap(cfg, nil))
+	require.NoError(t, checkPortMap(cfg, map[string]int{"ssh": 22, "http": 80}))
+
+	err := checkPortMap(cfg, map[string]int{"ssh": 22, "metrics": 9100, "db": 5432})
+	require.Error(t, err)
+	require.Equal(t, "port_map refers to unknown port labels db, metrics, the task's network must reserve them", err.Error())
+
+	// tasks without a network reserve no ports
+	err = checkPortMap(&drivers.TaskConfig{ID: "task-1"}, map[string]int{"ssh": 22})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unknown port labels ssh")
+}
+
+func TestTaskNetwork(t *testing.T) {
+	cfg := testTaskConfigWithPorts(map[string]int{"ssh": 22000})
+	cfg.Resources.NomadResources.Networks[0].IP = "192.168.0.10"
+
+	// user-mode guests are reached through the forwarded host ports
+	network := taskNetwork(cfg, &TaskConfig{PortMap: map[string]int{"ssh": 22}}, map[string]int{vncPortLabel: 5901})
+	require.Equal(t, &drivers.DriverNetwork{
+		IP:      "192.168.0.10",
+		PortMap: map[string]int{"ssh": 22000, vncPortLabel: 5901},
+	}, network)
+
+	// bridged guests are at the host address until they report their own
+	network = taskNetwork(cfg, &TaskConfig{NetworkMode: "bridge", PortMap: map[string]int{"ssh": 22}}, nil)
+	require.Equal(t, &drivers.DriverNetwork{IP: "192.168.0.10", PortMap: map[string]int{}}, network)
+
+	require.Nil(t, taskNetwork(&drivers.TaskConfig{ID: "task-1"}, &TaskConfig{NetworkMode: "none"}, nil))
+}
+
+func TestGuestNetwork(t *testing.T) {
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	path := fakeGuestAgent(t, func(cmd qmpCommand) string {
+		return `{"return": [{"name": "eth0", "hardware-address": "52:54:00:12:34:56", "ip-addresses": [
+  {"ip-address-type": "ipv4", "ip-address": "10.0.0.5"}]}]}`
+	})
+	cfg := &drivers.TaskConfig{ID: "task-1"}
+
+	network := d.guestNetwork(context.Background(), cfg, &TaskConfig{
+		NetworkMode: "bridge",
+		PortMap:     map[string]int{"ssh": 22},
+	}, path, nil)
+	require.Equal(t, &drivers.DriverNetwork{
+		IP:            "10.0.0.5",
+		AutoAdvertise: true,
+		PortMap:       map[string]int{"ssh": 22},
+	}, network)
+
+	// only bridged guests with a guest agent report their address
+	require.Nil(t, d.guestNetwork(context.Background(), cfg, &TaskConfig{NetworkMode: "user"}, path, nil))
+	require.Nil(t, d.guestNetwork(context.Background(), cfg, &TaskConfig{NetworkMode: "bridge"}, "", nil))
+
+	// the start of the task is not held up once the driver shuts down
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	missing := filepath.Join(t.TempDir(), qemuGuestAgentSocketName)
+	require.Nil(t, d.guestNetwork(ctx, cfg, &TaskConfig{NetworkMode: "bridge"}, missing, nil))
+}
+
+func TestTaskConfig_PortForwarding(t *testing.T) {
+	var tc *TaskConfig
+	hclutils.NewConfigParser(taskConfigSpec).ParseHCL(t, `
+config {
+  image_path     = "linux.img"
+  hostfwd_family = "dual"
+  port_map {
+    dns = 53
+  }
+  port_protocols {
+    dns = "udp"
+  }
+}`, &tc)
+	require.Equal(t, hostfwdFamilyDual, tc.HostfwdFamily)
+	require.Equal(t, map[string]string{"dns": "udp"}, map[string]string(tc.PortProtocols))
+}
@@ -0,0 +1,94 @@
+package alt_qemu
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// NUMANodeConfig describes a guest NUMA node, made of the vCPUs in CPUs and
+// MemoryMb of the guest memory.
+type NUMANodeConfig struct {
+	CPUs     string `codec:"cpus"` // vCPU indexes as a cpuset list, e.g. "0-3"
+	MemoryMb int64  `codec:"memory_mb"`
+}
+
+// numaArgs returns the arguments laying out the cpuCount vCPUs and memMb of
+// memory of the guest in the NUMA nodes, each backed by its own memory
+// object of the given memory_backend. Every vCPU must belong to exactly one
+// node and the node memory must add up to memMb.
+func numaArgs(nodes []NUMANodeConfig, cpuCount int, memMb int64, backend, hugepagesPath string, shared bool) ([]string, error) {
+	if backend == "file" {
+		if err := checkHugepagesMount(hugepagesPath); err != nil {
+			return nil, err
+		}
+	}
+
+	var args []string
+	var totalMb int64
+	owner := map[int]int{}
+	for i, node := range nodes {
+		ranges, err := parseCpusetRanges(node.CPUs)
+		if err != nil {
+			return nil, fmt.Errorf("numa node %d: %v", i, err)
+		}
+		// bound the ranges by the vCPUs before expanding them
+		for _, r := range ranges {
+			if r.last >= cpuCount {
+				return nil, fmt.Errorf("numa node %d: vCPU %d does not exist, %d vCPUs are allocated", i, r.last, cpuCount)
+			}
+		}
+		cpus := expandCpuRanges(ranges)
+		for _, cpu := range cpus {
+			if n, ok := owner[cpu]; ok {
+				return nil, fmt.Errorf("numa node %d: vCPU %d already belongs to node %d", i, cpu, n)
+			}
+			owner[cpu] = i
+		}
+		if node.MemoryMb <= 0 {
+			return nil, fmt.Errorf("numa node %d: memory_mb must be positive", i)
+		}
+		totalMb += node.MemoryMb
+
+		id := fmt.Sprintf("%s%d", memoryBackendID, i)
+		object, err := memoryBackendObject(backend, hugepagesPath, id, node.MemoryMb, shared)
+		if err != nil {
+			return nil, err
+		}
+		numa := fmt.Sprintf("node,nodeid=%d", i)
+		for _, r := range cpuRanges(cpus) {
+			numa += ",cpus=" + r
+		}
+		args = append(args, "-object", object, "-numa", numa+",memdev="+id)
+	}
+
+	if len(owner) != cpuCount {
+		return nil, fmt.Errorf("numa nodes hold %d vCPUs, but %d vCPUs are allocated", len(owner), cpuCount)
+	}
+	if totalMb != memMb {
+		return nil, fmt.Errorf("numa nodes hold %d MB of memory, but %d MB are allocated", totalMb, memMb)
+	}
+	return args, nil
+}
+
+// cpuRanges returns cpus as the sorted, contiguous "first-last" ranges qemu
+// accepts in the cpus property of a NUMA node.
+func cpuRanges(cpus []int) []string {
+	sorted := append([]int(nil), cpus...)
+	sort.Ints(sorted)
+
+	var ranges []string
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] == sorted[j]+1 {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, strconv.Itoa(sorted[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", sorted[i], sorted[j]))
+		}
+		i = j + 1
+	}
+	return ranges
+}
@@ -0,0 +1,128 @@
+package alt_qemu
+
+import (
+	"testing"
+
+	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskConfig_NUMA(t *testing.T) {
+	var tc *TaskConfig
+	hclutils.NewConfigParser(taskConfigSpec).ParseHCL(t, `
+config {
+  image_path = "linux.img"
+  numa {
+    cpus      = "0-1"
+    memory_mb = 1024
+  }
+  numa {
+    cpus      = "2,3"
+    memory_mb = 1024
+  }
+}`, &tc)
+
+	require.Equal(t, []NUMANodeConfig{
+		{CPUs: "0-1", MemoryMb: 1024},
+		{CPUs: "2,3", MemoryMb: 1024},
+	}, tc.NUMA)
+}
+
+func TestNumaArgs(t *testing.T) {
+	args, err := numaArgs([]NUMANodeConfig{
+		{CPUs: "0-1", MemoryMb: 1024},
+		{CPUs: "2,3", MemoryMb: 512},
+	}, 4, 1536, "", "", false)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"-object", "memory-backend-ram,id=mem0,size=1024M",
+		"-numa", "node,nodeid=0,cpus=0-1,memdev=mem0",
+		"-object", "memory-backend-ram,id=mem1,size=512M",
+		"-numa", "node,nodeid=1,cpus=2-3,memdev=mem1",
+	}, args)
+
+	// non contiguous vCPUs take a cpus property per range, memory shared
+	// with virtiofsd is backed by memfds
+	args, err = numaArgs([]NUMANodeConfig{
+		{CPUs: "0,2", MemoryMb: 512},
+		{CPUs: "1,3", MemoryMb: 512},
+	}, 4, 1024, "", "", true)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"-object", "memory-backend-memfd,id=mem0,size=512M,share=on",
+		"-numa", "node,nodeid=0,cpus=0,cpus=2,memdev=mem0",
+		"-object", "memory-backend-memfd,id=mem1,size=512M,share=on",
+		"-numa", "node,nodeid=1,cpus=1,cpus=3,memdev=mem1",
+	}, args)
+}
+
+func TestNumaArgs_Errors(t *testing.T) {
+	cases := []struct {
+		name  string
+		nodes []NUMANodeConfig
+		err   string
+	}{
+		{
+			name:  "invalid cpus",
+			nodes: []NUMANodeConfig{{CPUs: "0-a", MemoryMb: 1024}},
+			err:   "numa node 0",
+		},
+		{
+			name:  "vCPU out of range",
+			nodes: []NUMANodeConfig{{CPUs: "0-2", MemoryMb: 1024}},
+			err:   "vCPU 2 does not exist, 2 vCPUs are allocated",
+		},
+		{
+			name:  "range beyond the vCPUs",
+			nodes: []NUMANodeConfig{{CPUs: "1-8191", MemoryMb: 1024}},
+			err:   "numa node 0: vCPU 8191 does not exist, 2 vCPUs are allocated",
+		},
+		{
+			name:  "range beyond the maximum",
+			nodes: []NUMANodeConfig{{CPUs: "0-2147483647", MemoryMb: 1024}},
+			err:   "exceeds the maximum of 8192 CPUs",
+		},
+		{
+			name: "vCPU in two nodes",
+			nodes: []NUMANodeConfig{
+				{CPUs: "0-1", MemoryMb: 512},
+				{CPUs: "1", MemoryMb: 512},
+			},
+			err: "numa node 1: vCPU 1 already belongs to node 0",
+		},
+		{
+			name:  "missing vCPU",
+			nodes: []NUMANodeConfig{{CPUs: "0", MemoryMb: 1024}},
+			err:   "numa nodes hold 1 vCPUs, but 2 vCPUs are allocated",
+		},
+		{
+			name:  "no memory",
+			nodes: []NUMANodeConfig{{CPUs: "0-1"}},
+			err:   "memory_mb must be positive",
+		},
+		{
+			name:  "memory mismatch",
+			nodes: []NUMANodeConfig{{CPUs: "0-1", MemoryMb: 512}},
+			err:   "numa nodes hold 512 MB of memory, but 1024 MB are allocated",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := numaArgs(c.nodes, 2, 1024, "", "", false)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), c.err)
+		})
+	}
+
+	_, err := numaArgs([]NUMANodeConfig{{CPUs: "0-1", MemoryMb: 1024}}, 2, 1024, "file", "", false)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "hugepages_path must be set")
+}
+
+func TestCpuRanges(t *testing.T) {
+	require.Empty(t, cpuRanges(nil))
+	require.Equal(t, []string{"0"}, cpuRanges([]int{0}))
+	require.Equal(t, []string{"0-3"}, cpuRanges([]int{3, 1, 0, 2}))
+	require.Equal(t, []string{"0-1", "4", "6-7"}, cpuRanges([]int{0, 1, 4, 6, 7}))
+}
@@ -0,0 +1,47 @@
+package alt_qemu
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// vmstatPath is the kernel's virtual memory statistics file, which counts
+// the processes killed by the OOM killer since boot.
+const vmstatPath = "/proc/vmstat"
+
+// hostOOMKillCount returns the number of processes the kernel OOM killer has
+// killed since boot, or -1 if the count is not available.
+func hostOOMKillCount() int64 {
+	f, err := os.Open(vmstatPath)
+	if err != nil {
+		return -1
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || fields[0] != "oom_kill" {
+			continue
+		}
+		n, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return -1
+		}
+		return n
+	}
+	return -1
+}
+
+// probablyOOMKilled returns whether a qemu process that exited with signal
+// was likely killed by the OOM killer: it was sent SIGKILL without the
+// driver asking for it and the host OOM kill count went up since baseline.
+func probablyOOMKilled(signal int, stopRequested bool, baseline int64) bool {
+	if signal != int(syscall.SIGKILL) || stopRequested || baseline < 0 {
+		return false
+	}
+	return hostOOMKillCount() > baseline
+}
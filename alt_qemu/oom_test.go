@@ -0,0 +1,26 @@
+package alt_qemu
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbablyOOMKilled(t *testing.T) {
+	sigkill := int(syscall.SIGKILL)
+
+	require.False(t, probablyOOMKilled(0, false, 0))
+	require.False(t, probablyOOMKilled(int(syscall.SIGTERM), false, 0))
+	require.False(t, probablyOOMKilled(sigkill, true, 0))
+	require.False(t, probablyOOMKilled(sigkill, false, -1))
+
+	count := hostOOMKillCount()
+	if count < 0 {
+		t.Skip("the host OOM kill count is not available")
+	}
+	require.False(t, probablyOOMKilled(sigkill, false, count))
+	if count > 0 {
+		require.True(t, probablyOOMKilled(sigkill, false, count-1))
+	}
+}
@@ -0,0 +1,169 @@
+package alt_qemu
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	// pciDevicesPath lists the PCI devices of the host
+	pciDevicesPath = "/sys/bus/pci/devices"
+
+	// vfioDriverName is the host driver PCI devices must be bound to in
+	// order to be passed through
+	vfioDriverName = "vfio-pci"
+)
+
+// pciAddressRegex matches a PCI address as domain:bus:slot.function, the
+// domain being optional, e.g. "0000:65:00.0" or "65:00.0"
+var pciAddressRegex = regexp.MustCompile(`^(?:([0-9a-fA-F]{4}):)?([0-9a-fA-F]{2}):([0-1][0-9a-fA-F])\.([0-7])$`)
+
+// normalizePCIAddress returns addr in its full lowercase form, including the
+// domain, e.g. "0000:65:00.0".
+func normalizePCIAddress(addr string) (string, error) {
+	m := pciAddressRegex.FindStringSubmatch(addr)
+	if m == nil {
+		return "", fmt.Errorf("invalid PCI address %q, must be of the form 0000:65:00.0", addr)
+	}
+	domain := m[1]
+	if domain == "" {
+		domain = "0000"
+	}
+	return strings.ToLower(fmt.Sprintf("%s:%s:%s.%s", domain, m[2], m[3], m[4])), nil
+}
+
+// checkVFIODevice returns an error unless the host PCI device at addr is bound
+// to the vfio-pci driver.
+func checkVFIODevice(addr string) error {
+	link, err := os.Readlink(filepath.Join(pciDevicesPath, addr, "driver"))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("PCI device %s is not bound to any driver, it must be bound to %s", addr, vfioDriverName)
+	} else if err != nil {
+		return fmt.Errorf("failed to read driver of PCI device %s: %v", addr, err)
+	}
+	if driver := filepath.Base(link); driver != vfioDriverName {
+		return fmt.Errorf("PCI device %s is bound to %s, it must be bound to %s", addr, driver, vfioDriverName)
+	}
+	return nil
+}
+
+// isAllowedPCIDevice returns whether the PCI device at addr is one of
+// allowedDevices.
+func isAllowedPCIDevice(allowedDevices []string, addr string) bool {
+	for _, allowed := range allowedDevices {
+		if a, err := normalizePCIAddress(allowed); err == nil && a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// vfioDevice validates the host PCI device at addr for passthrough and returns
+// its normalized address. The device must be in allowedDevices and bound to
+// vfio-pci.
+func vfioDevice(allowedDevices []string, addr string) (string, error) {
+	addr, err := normalizePCIAddress(addr)
+	if err != nil {
+		return "", err
+	}
+	if !isAllowedPCIDevice(allowedDevices, addr) {
+		return "", fmt.Errorf("PCI device %s is not in allowed_pci_devices", addr)
+	}
+	if err := checkVFIODevice(addr); err != nil {
+		return "", err
+	}
+	return addr, nil
+}
+
+// pciArgs returns the arguments passing the host PCI devices at addrs through
+// to the guest with VFIO.
+func pciArgs(allowedDevices []string, addrs []string) ([]string, error) {
+	var args []string
+	for _, addr := range addrs {
+		addr, err := vfioDevice(allowedDevices, addr)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "-device", fmt.Sprintf("vfio-pci,host=%s", addr))
+	}
+	return args, nil
+}
+
+// gpuGuestSlot is the guest PCI slot of the first passed through GPU whose
+// functions are grouped, chosen above the slots qemu assigns to the other
+// devices. Further GPUs use the following slots.
+const gpuGuestSlot = 0x10
+
+// GPUConfig describes a host GPU passed through to the guest with VFIO, along
+// with its audio function. Both functions are grouped in a multifunction
+// guest device, as GPU drivers expect.
+type GPUConfig struct {
+	Address      string `codec:"address"`
+	AudioAddress string `codec:"audio_address"`
+	Romfile      string `codec:"romfile"` // image of the GPU's option ROM
+	VGA          bool   `codec:"vga"`     // expose the GPU as the guest's VGA device instead of the emulated one
+}
+
+// romfileOption returns the vfio-pci property loading the option ROM at path,
+// which must be a regular file.
+func romfileOption(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("romfile %q is not accessible: %v", path, err)
+	}
+	if !fi.Mode().IsRegular() {
+		return "", fmt.Errorf("romfile %q is not a regular file", path)
+	}
+	romfile, err := escapeOptionValue(path)
+	if err != nil {
+		return "", fmt.Errorf("invalid romfile: %v", err)
+	}
+	return ",romfile=" + romfile, nil
+}
+
+// gpuArgs returns the arguments passing the GPUs through to the guest with
+// VFIO. Every GPU and audio function must be in allowedDevices.
+func gpuArgs(allowedDevices []string, gpus []GPUConfig) ([]string, error) {
+	var args []string
+	var vga bool
+	for i, gpu := range gpus {
+		addr, err := vfioDevice(allowedDevices, gpu.Address)
+		if err != nil {
+			return nil, err
+		}
+
+		device := fmt.Sprintf("vfio-pci,host=%s", addr)
+		if gpu.Romfile != "" {
+			romfile, err := romfileOption(gpu.Romfile)
+			if err != nil {
+				return nil, err
+			}
+			device += romfile
+		}
+		if gpu.VGA {
+			if !vga {
+				args = append(args, "-vga", "none")
+				vga = true
+			}
+			device += ",x-vga=on"
+		}
+
+		if gpu.AudioAddress == "" {
+			args = append(args, "-device", device)
+			continue
+		}
+		audioAddr, err := vfioDevice(allowedDevices, gpu.AudioAddress)
+		if err != nil {
+			return nil, err
+		}
+		slot := gpuGuestSlot + i
+		args = append(args,
+			"-device", fmt.Sprintf("%s,multifunction=on,addr=0x%x.0", device, slot),
+			"-device", fmt.Sprintf("vfio-pci,host=%s,addr=0x%x.1", audioAddr, slot),
+		)
+	}
+	return args, nil
+}
@@ -0,0 +1,141 @@
+package alt_qemu
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizePCIAddress(t *testing.T) {
+	for addr, expected := range map[string]string{
+		"0000:65:00.0": "0000:65:00.0",
+		"65:00.0":      "0000:65:00.0",
+		"0001:AF:1F.7": "0001:af:1f.7",
+	} {
+		normalized, err := normalizePCIAddress(addr)
+		require.NoError(t, err, addr)
+		require.Equal(t, expected, normalized, addr)
+	}
+
+	for _, addr := range []string{"", "65:00", "65:20.0", "65:00.8", "0000:65:00.0,x-vga=on"} {
+		_, err := normalizePCIAddress(addr)
+		require.Error(t, err, addr)
+		require.Contains(t, err.Error(), "invalid PCI address")
+	}
+}
+
+func TestIsAllowedPCIDevice(t *testing.T) {
+	allowed := []string{"65:00.0", "invalid"}
+
+	require.True(t, isAllowedPCIDevice(allowed, "0000:65:00.0"))
+	require.False(t, isAllowedPCIDevice(allowed, "0000:65:00.1"))
+	require.False(t, isAllowedPCIDevice(nil, "0000:65:00.0"))
+}
+
+func TestPCIArgs(t *testing.T) {
+	args, err := pciArgs(nil, nil)
+	require.NoError(t, err)
+	require.Empty(t, args)
+
+	_, err = pciArgs([]string{"0000:65:00.0"}, []string{"65:00.0,x-vga=on"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid PCI address")
+
+	_, err = pciArgs([]string{"0000:65:00.0"}, []string{"0000:66:00.0"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "0000:66:00.0 is not in allowed_pci_devices")
+
+	// an allowed device that does not exist on the host is not bound to
+	// vfio-pci
+	_, err = pciArgs([]string{"ffff:ff:1f.7"}, []string{"ffff:ff:1f.7"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not bound to any driver")
+}
+
+func TestTaskConfig_GPUPassthrough(t *testing.T) {
+	var tc *TaskConfig
+	hclutils.NewConfigParser(taskConfigSpec).ParseHCL(t, `
+config {
+  image_path = "linux.img"
+  gpu_passthrough {
+    address       = "0000:65:00.0"
+    audio_address = "0000:65:00.1"
+    romfile       = "/opt/roms/gpu.rom"
+    vga           = true
+  }
+}`, &tc)
+
+	require.Equal(t, []GPUConfig{{
+		Address:      "0000:65:00.0",
+		AudioAddress: "0000:65:00.1",
+		Romfile:      "/opt/roms/gpu.rom",
+		VGA:          true,
+	}}, tc.GPUPassthrough)
+}
+
+func TestRomfileOption(t *testing.T) {
+	dir := t.TempDir()
+	rom := filepath.Join(dir, "gpu,x-vga=on.rom")
+	require.NoError(t, ioutil.WriteFile(rom, []byte("rom"), 0644))
+
+	// a comma in the path cannot add properties to the device
+	option, err := romfileOption(rom)
+	require.NoError(t, err)
+	require.Equal(t, ",romfile="+filepath.Join(dir, "gpu,,x-vga=on.rom"), option)
+
+	_, err = romfileOption(filepath.Join(dir, "missing.rom"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is not accessible")
+
+	_, err = romfileOption(dir)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is not a regular file")
+
+	invalid := filepath.Join(dir, "gpu\n.rom")
+	require.NoError(t, ioutil.WriteFile(invalid, []byte("rom"), 0644))
+	_, err = romfileOption(invalid)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid romfile")
+}
+
+func TestBuildQemuArgs_RomfileOutsideAllowedPaths(t *testing.T) {
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	d.config.AllowedPCIDevices = []string{"0000:65:00.0"}
+	cfg, tc := testBuildTask(t)
+	require.NoError(t, os.Symlink("/etc/passwd", filepath.Join(cfg.TaskDir().Dir, "gpu.rom")))
+
+	// links are followed before checking the romfile against the allowed
+	// paths
+	for _, romfile := range []string{"/etc/passwd", "gpu.rom"} {
+		tc.GPUPassthrough = []GPUConfig{{Address: "0000:65:00.0", Romfile: romfile}}
+		_, err := d.buildQemuArgs(cfg, tc)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "is not in the allowed paths")
+	}
+}
+
+func TestGPUArgs_Errors(t *testing.T) {
+	allowed := []string{"0000:65:00.0", "ffff:ff:1f.6"}
+
+	args, err := gpuArgs(allowed, nil)
+	require.NoError(t, err)
+	require.Empty(t, args)
+
+	_, err = gpuArgs(allowed, []GPUConfig{{Address: "65:00"}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid PCI address")
+
+	_, err = gpuArgs(allowed, []GPUConfig{{Address: "0000:66:00.0"}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is not in allowed_pci_devices")
+
+	// a GPU that does not exist on the host is not bound to vfio-pci
+	_, err = gpuArgs(allowed, []GPUConfig{{Address: "ffff:ff:1f.6", AudioAddress: "ffff:ff:1f.7"}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not bound to any driver")
+}
@@ -0,0 +1,52 @@
+package alt_qemu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// qemuPidFileName is the file in the task directory qemu writes its pid
+	// to
+	qemuPidFileName = "qemu.pid"
+
+	// pidFileTimeout bounds the wait for qemu to write its pidfile after it
+	// is launched
+	pidFileTimeout = 5 * time.Second
+)
+
+// readPidFile returns the pid written to the pidfile at path.
+func readPidFile(path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("invalid pidfile %q", path)
+	}
+	return pid, nil
+}
+
+// waitPidFile waits up to timeout for the qemu process launched as pid to
+// write its pidfile at path and returns the pid read from it. It gives up
+// early if the process exits.
+func waitPidFile(path string, pid int, timeout time.Duration) (int, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		filePid, err := readPidFile(path)
+		if err == nil {
+			return filePid, nil
+		}
+		if !processExists(pid) {
+			return 0, fmt.Errorf("qemu exited before writing its pidfile")
+		}
+		if time.Now().After(deadline) {
+			return 0, fmt.Errorf("qemu did not write its pidfile within %s: %v", timeout, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
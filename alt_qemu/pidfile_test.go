@@ -0,0 +1,93 @@
+package alt_qemu
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadPidFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, qemuPidFileName)
+
+	_, err := readPidFile(path)
+	require.True(t, os.IsNotExist(err))
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("4242\n"), 0644))
+	pid, err := readPidFile(path)
+	require.NoError(t, err)
+	require.Equal(t, 4242, pid)
+
+	for _, content := range []string{"", "qemu", "-1", "0"} {
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+		_, err := readPidFile(path)
+		require.Error(t, err, content)
+		require.Contains(t, err.Error(), "invalid pidfile")
+	}
+}
+
+func TestWaitPidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), qemuPidFileName)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		ioutil.WriteFile(path, []byte("4242\n"), 0644)
+	}()
+
+	pid, err := waitPidFile(path, os.Getpid(), 5*time.Second)
+	require.NoError(t, err)
+	require.Equal(t, 4242, pid)
+}
+
+func TestWaitPidFile_Errors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), qemuPidFileName)
+
+	_, err := waitPidFile(path, os.Getpid(), 200*time.Millisecond)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "qemu did not write its pidfile within 200ms")
+
+	// a process that exited never writes its pidfile
+	cmd := exec.Command("sh", "-c", "exit 0")
+	require.NoError(t, cmd.Run())
+	_, err = waitPidFile(path, cmd.Process.Pid, 5*time.Second)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "qemu exited before writing its pidfile")
+}
+
+func TestConfirmQemuProcess(t *testing.T) {
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	path := filepath.Join(t.TempDir(), qemuPidFileName)
+	taskState := &TaskState{
+		TaskConfig: &drivers.TaskConfig{ID: "task-1"},
+		Pid:        os.Getpid(),
+		PidPath:    path,
+	}
+
+	// the pidfile is gone once qemu exits
+	require.False(t, d.confirmQemuProcess(taskState))
+
+	// the pid of the task was reused by another process
+	require.NoError(t, ioutil.WriteFile(path, []byte("4242\n"), 0644))
+	require.False(t, d.confirmQemuProcess(taskState))
+
+	// the pidfile matches, but the process is not qemu
+	if runtime.GOOS != "windows" {
+		sleep := exec.Command("sleep", "30")
+		require.NoError(t, sleep.Start())
+		defer func() {
+			sleep.Process.Kill()
+			sleep.Wait()
+		}()
+		taskState.Pid = sleep.Process.Pid
+		require.NoError(t, ioutil.WriteFile(path, []byte(strconv.Itoa(sleep.Process.Pid)), 0644))
+		require.False(t, d.confirmQemuProcess(taskState))
+	}
+}
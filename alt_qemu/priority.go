@@ -0,0 +1,19 @@
+package alt_qemu
+
+import "fmt"
+
+const (
+	// minProcessPriority and maxProcessPriority bound the nice values
+	// accepted by process_priority
+	minProcessPriority = -20
+	maxProcessPriority = 19
+)
+
+// checkProcessPriority returns an error unless nice is a valid nice value.
+func checkProcessPriority(nice int) error {
+	if nice < minProcessPriority || nice > maxProcessPriority {
+		return fmt.Errorf("process_priority %d out of range, must be between %d and %d",
+			nice, minProcessPriority, maxProcessPriority)
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+package alt_qemu
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckProcessPriority(t *testing.T) {
+	for _, nice := range []int{-20, -5, 0, 10, 19} {
+		require.NoError(t, checkProcessPriority(nice))
+	}
+
+	for _, nice := range []int{-21, 20} {
+		err := checkProcessPriority(nice)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "must be between -20 and 19")
+	}
+}
@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package alt_qemu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"syscall"
+)
+
+// setProcessPriority sets the nice value of every thread of the process pid.
+// Threads qemu starts later, such as vCPU threads, inherit it.
+func setProcessPriority(pid, nice int) error {
+	tids := []int{pid}
+	if entries, err := ioutil.ReadDir(fmt.Sprintf("/proc/%d/task", pid)); err == nil {
+		tids = tids[:0]
+		for _, e := range entries {
+			if tid, err := strconv.Atoi(e.Name()); err == nil {
+				tids = append(tids, tid)
+			}
+		}
+	}
+
+	for _, tid := range tids {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, nice); err != nil {
+			return fmt.Errorf("failed to set priority of thread %d: %v", tid, err)
+		}
+	}
+	return nil
+}
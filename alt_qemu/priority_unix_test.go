@@ -0,0 +1,34 @@
+//go:build !windows
+// +build !windows
+
+package alt_qemu
+
+import (
+	"os/exec"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetProcessPriority(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("thread priorities are read from /proc")
+	}
+
+	cmd := exec.Command("sleep", "30")
+	require.NoError(t, cmd.Start())
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	// lowering the priority needs no privileges
+	require.NoError(t, setProcessPriority(cmd.Process.Pid, 10))
+
+	// the raw syscall returns 20 - nice
+	prio, err := syscall.Getpriority(syscall.PRIO_PROCESS, cmd.Process.Pid)
+	require.NoError(t, err)
+	require.Equal(t, 10, 20-prio)
+}
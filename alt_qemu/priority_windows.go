@@ -0,0 +1,8 @@
+package alt_qemu
+
+import "fmt"
+
+// setProcessPriority is unsupported on Windows.
+func setProcessPriority(pid, nice int) error {
+	return fmt.Errorf("process_priority is unsupported on the Windows platform")
+}
@@ -0,0 +1,63 @@
+package alt_qemu
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-plugin"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessExists(t *testing.T) {
+	require.True(t, processExists(os.Getpid()))
+	require.False(t, processExists(0))
+	require.False(t, processExists(-1))
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	cmd := exec.Command("true")
+	require.NoError(t, cmd.Run())
+	require.False(t, processExists(cmd.Process.Pid))
+}
+
+func TestReattachExecutor_ProcessGone(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("executors reattach over unix sockets")
+	}
+
+	d := NewAltQemuDriver(hclog.NewNullLogger()).(*AltQemuDriverPlugin)
+	rc := &plugin.ReattachConfig{
+		Protocol: plugin.ProtocolGRPC,
+		Addr:     &net.UnixAddr{Net: "unix", Name: "/nonexistent/executor.sock"},
+		Pid:      -1,
+	}
+
+	// retries stop right away once the VM is gone
+	start := time.Now()
+	_, _, err := d.reattachExecutor(rc, -1, &drivers.TaskConfig{ID: "task-1", Name: "vm"})
+	require.Error(t, err)
+	require.True(t, time.Since(start) < reattachBackoff, "reattach was retried")
+}
+
+func TestIsQemuProcess(t *testing.T) {
+	require.False(t, isQemuProcess(0))
+	if runtime.GOOS != "linux" {
+		return
+	}
+	// a running process the pid was reused by is not mistaken for qemu
+	cmd := exec.Command("sleep", "30")
+	require.NoError(t, cmd.Start())
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	require.True(t, processExists(cmd.Process.Pid))
+	require.False(t, isQemuProcess(cmd.Process.Pid))
+}
@@ -0,0 +1,37 @@
+//go:build !windows
+// +build !windows
+
+package alt_qemu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// processExists returns whether a process with the given pid is running.
+func processExists(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	// EPERM means the process exists but belongs to another user
+	return err == nil || err == syscall.EPERM
+}
+
+// isQemuProcess returns whether pid is a running qemu process, as opposed to
+// an unrelated process the pid was reused by. When the command line of the
+// process cannot be read, only its existence is checked.
+func isQemuProcess(pid int) bool {
+	if !processExists(pid) {
+		return false
+	}
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil || len(cmdline) == 0 {
+		return true
+	}
+	argv0 := strings.SplitN(string(cmdline), "\x00", 2)[0]
+	return strings.Contains(filepath.Base(argv0), "qemu")
+}
@@ -0,0 +1,23 @@
+package alt_qemu
+
+import "os"
+
+// processExists returns whether a process with the given pid is running. On
+// Windows, finding a process fails when it does not exist.
+func processExists(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
+
+// isQemuProcess returns whether pid is running. The command line of other
+// processes is not inspected on Windows.
+func isQemuProcess(pid int) bool {
+	return processExists(pid)
+}
@@ -0,0 +1,45 @@
+package alt_qemu
+
+import (
+	"fmt"
+	"os"
+)
+
+// defaultRNGSource is the host entropy source fed to the guest when the task
+// sets none
+const defaultRNGSource = "/dev/urandom"
+
+// rngSources are the host entropy sources a task may feed to its guest
+var rngSources = map[string]bool{
+	"/dev/random":  true,
+	"/dev/urandom": true,
+	"/dev/hwrng":   true,
+}
+
+// rngArgs returns the arguments exposing the host entropy source at source to
+// the guest through a virtio-rng device. The source must be one of
+// /dev/random, /dev/urandom or /dev/hwrng, and a character device.
+func rngArgs(source string) ([]string, error) {
+	if source == "" {
+		source = defaultRNGSource
+	}
+	if !rngSources[source] {
+		return nil, fmt.Errorf("unsupported rng_source %q, must be one of /dev/random, /dev/urandom or /dev/hwrng", source)
+	}
+	fi, err := os.Stat(source)
+	if err != nil {
+		return nil, fmt.Errorf("rng_source %q is not accessible: %v", source, err)
+	}
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		return nil, fmt.Errorf("rng_source %q is not a character device", source)
+	}
+	filename, err := escapeOptionValue(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rng_source: %v", err)
+	}
+
+	return []string{
+		"-object", fmt.Sprintf("rng-random,filename=%s,id=rng0", filename),
+		"-device", "virtio-rng-pci,rng=rng0",
+	}, nil
+}
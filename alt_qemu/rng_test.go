@@ -0,0 +1,54 @@
+package alt_qemu
+
+import (
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskConfig_RNG(t *testing.T) {
+	config := `
+config {
+  image_path = "linux.img"
+  enable_rng = true
+  rng_source = "/dev/hwrng"
+}`
+
+	var tc *TaskConfig
+	hclutils.NewConfigParser(taskConfigSpec).ParseHCL(t, config, &tc)
+
+	require.True(t, tc.EnableRNG)
+	require.Equal(t, "/dev/hwrng", tc.RNGSource)
+}
+
+func TestRngArgs(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no character device entropy source on Windows")
+	}
+
+	args, err := rngArgs("")
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"-object", "rng-random,filename=/dev/urandom,id=rng0",
+		"-device", "virtio-rng-pci,rng=rng0",
+	}, args)
+
+	args, err = rngArgs("/dev/random")
+	require.NoError(t, err)
+	require.Equal(t, "rng-random,filename=/dev/random,id=rng0", args[1])
+
+	for _, source := range []string{
+		"/dev/tty0",
+		"/dev/zero",
+		"/dev/urandom,id=rng1",
+		"/dev/../dev/urandom",
+		filepath.Join(t.TempDir(), "entropy"),
+	} {
+		_, err = rngArgs(source)
+		require.Error(t, err, source)
+		require.Contains(t, err.Error(), "must be one of /dev/random, /dev/urandom or /dev/hwrng", source)
+	}
+}
@@ -0,0 +1,41 @@
+package alt_qemu
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// lookupRunAsUser returns the uid and gid of the host user qemu drops its
+// privileges to with -runas.
+func lookupRunAsUser(name string) (int, int, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, 0, fmt.Errorf("run_as_user %q does not exist on this node: %v", name, err)
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("run_as_user %q has a non numeric uid %q", name, u.Uid)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("run_as_user %q has a non numeric gid %q", name, u.Gid)
+	}
+	return uid, gid, nil
+}
+
+// chownTaskFiles gives uid and gid ownership of the files the driver created
+// for qemu, so qemu can still use them once it has dropped its privileges.
+// Paths that are empty or do not exist are skipped.
+func chownTaskFiles(uid, gid int, paths ...string) error {
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if err := os.Chown(path, uid, gid); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to change the owner of %q: %v", path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package alt_qemu
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupRunAsUser(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("run_as_user is unsupported on Windows")
+	}
+
+	current, err := user.Current()
+	require.NoError(t, err)
+
+	uid, gid, err := lookupRunAsUser(current.Username)
+	require.NoError(t, err)
+	require.Equal(t, current.Uid, strconv.Itoa(uid))
+	require.Equal(t, current.Gid, strconv.Itoa(gid))
+
+	_, _, err = lookupRunAsUser("no-such-qemu-user")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `run_as_user "no-such-qemu-user" does not exist on this node`)
+}
+
+func TestChownTaskFiles(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("run_as_user is unsupported on Windows")
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "seed.iso")
+	require.NoError(t, ioutil.WriteFile(path, nil, 0600))
+
+	// chowning to the current owner needs no privileges, while empty and
+	// missing paths are skipped
+	require.NoError(t, chownTaskFiles(os.Getuid(), os.Getgid(), path, "", filepath.Join(dir, "missing")))
+}
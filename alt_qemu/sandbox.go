@@ -0,0 +1,59 @@
+package alt_qemu
+
+import (
+	"fmt"
+	"strings"
+)
+
+// defaultSandbox is the seccomp sandbox used when the task sets none
+const defaultSandbox = "on"
+
+// sandboxOptions maps the options of the -sandbox argument to the values
+// they accept
+var sandboxOptions = map[string][]string{
+	"obsolete":          {"allow", "deny"},
+	"elevateprivileges": {"allow", "deny", "children"},
+	"spawn":             {"allow", "deny"},
+	"resourcecontrol":   {"allow", "deny"},
+}
+
+// sandboxArg validates the sandbox spec, e.g. "on,obsolete=deny,spawn=deny",
+// and returns the value of the -sandbox argument. An empty spec enables the
+// sandbox with qemu's default options.
+func sandboxArg(spec string) (string, error) {
+	if spec == "" {
+		return defaultSandbox, nil
+	}
+
+	tokens := strings.Split(spec, ",")
+	switch tokens[0] {
+	case "off":
+		if len(tokens) > 1 {
+			return "", fmt.Errorf("invalid sandbox %q, options require the sandbox to be on", spec)
+		}
+		return spec, nil
+	case "on":
+	default:
+		return "", fmt.Errorf("invalid sandbox %q, must start with on or off", spec)
+	}
+
+	for _, token := range tokens[1:] {
+		kv := strings.SplitN(token, "=", 2)
+		values, ok := sandboxOptions[kv[0]]
+		if !ok || len(kv) != 2 {
+			return "", fmt.Errorf("invalid sandbox option %q", token)
+		}
+		valid := false
+		for _, v := range values {
+			if kv[1] == v {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return "", fmt.Errorf("invalid value %q for sandbox option %q, must be one of %s",
+				kv[1], kv[0], strings.Join(values, ", "))
+		}
+	}
+	return spec, nil
+}
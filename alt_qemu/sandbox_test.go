@@ -0,0 +1,38 @@
+package alt_qemu
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSandboxArg(t *testing.T) {
+	cases := []struct {
+		name string
+		spec string
+		arg  string
+		err  string
+	}{
+		{name: "default", spec: "", arg: "on"},
+		{name: "on", spec: "on", arg: "on"},
+		{name: "off", spec: "off", arg: "off"},
+		{name: "options", spec: "on,obsolete=deny,elevateprivileges=children,spawn=deny", arg: "on,obsolete=deny,elevateprivileges=children,spawn=deny"},
+		{name: "off with options", spec: "off,spawn=deny", err: "options require the sandbox to be on"},
+		{name: "no mode", spec: "spawn=deny", err: "must start with on or off"},
+		{name: "unknown option", spec: "on,network=deny", err: `invalid sandbox option "network=deny"`},
+		{name: "option without value", spec: "on,spawn", err: `invalid sandbox option "spawn"`},
+		{name: "invalid value", spec: "on,spawn=children", err: `invalid value "children" for sandbox option "spawn", must be one of allow, deny`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			arg, err := sandboxArg(c.spec)
+			if c.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.arg, arg)
+		})
+	}
+}
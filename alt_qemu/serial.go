@@ -0,0 +1,52 @@
+package alt_qemu
+
+import (
+	"fmt"
+	"strings"
+)
+
+// serialArgs returns the -serial arguments exposing a guest serial port for
+// each of serials, in order, along with the paths of the sockets created for
+// them. Each entry is one of:
+//
+//   - stdio: the port is written to the task's stdout
+//   - file:<path>: the port is written to path, relative to the task directory
+//   - socket: the port is served on a unix socket in the task directory
+//   - none: the port is disabled
+func serialArgs(taskDir string, serials []string) ([]string, []string, error) {
+	var args, sockets []string
+	for i, serial := range serials {
+		var chardev string
+		switch {
+		case serial == "stdio", serial == "none":
+			chardev = serial
+		case strings.HasPrefix(serial, "file:"):
+			path := strings.TrimPrefix(serial, "file:")
+			if path == "" {
+				return nil, nil, fmt.Errorf("serial %q must name a file", serial)
+			}
+			// qemu creates the file, so the symlinks of its directory
+			// are followed when it does not exist yet
+			path = resolveNewPath(resolveTaskPath(taskDir, path))
+			if !isSubpath(resolvePath(taskDir), path) {
+				return nil, nil, fmt.Errorf("serial file %q must be inside the task directory", path)
+			}
+			chardev = "file:" + path
+		case serial == "socket":
+			name := "serial.sock"
+			if i > 0 {
+				name = fmt.Sprintf("serial%d.sock", i)
+			}
+			sock, err := socketPath(taskDir, name)
+			if err != nil {
+				return nil, nil, err
+			}
+			sockets = append(sockets, sock)
+			chardev = fmt.Sprintf("unix:%s,server,nowait", sock)
+		default:
+			return nil, nil, fmt.Errorf("unknown serial %q, must be stdio, file:<path>, socket or none", serial)
+		}
+		args = append(args, "-serial", chardev)
+	}
+	return args, sockets, nil
+}
@@ -0,0 +1,102 @@
+package alt_qemu
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskConfig_Serial(t *testing.T) {
+	var tc *TaskConfig
+	hclutils.NewConfigParser(taskConfigSpec).ParseHCL(t, `
+config {
+  image_path = "linux.img"
+  serial     = ["stdio", "file:console.log", "socket", "none"]
+}`, &tc)
+	require.Equal(t, []string{"stdio", "file:console.log", "socket", "none"}, tc.Serial)
+}
+
+func TestSerialArgs(t *testing.T) {
+	args, sockets, err := serialArgs("/alloc/task", nil)
+	require.NoError(t, err)
+	require.Empty(t, args)
+	require.Empty(t, sockets)
+
+	args, sockets, err = serialArgs("/alloc/task", []string{"socket", "stdio", "file:logs/console.log", "socket", "none"})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"-serial", "unix:/alloc/task/serial.sock,server,nowait",
+		"-serial", "stdio",
+		"-serial", "file:/alloc/task/logs/console.log",
+		"-serial", "unix:/alloc/task/serial3.sock,server,nowait",
+		"-serial", "none",
+	}, args)
+	require.Equal(t, []string{"/alloc/task/serial.sock", "/alloc/task/serial3.sock"}, sockets)
+}
+
+func TestSerialArgs_Symlinks(t *testing.T) {
+	root := t.TempDir()
+	taskDir := filepath.Join(root, "task")
+	outsideDir := filepath.Join(root, "outside")
+	for _, dir := range []string{filepath.Join(taskDir, "logs"), outsideDir} {
+		require.NoError(t, os.MkdirAll(dir, 0755))
+	}
+	require.NoError(t, os.Symlink(outsideDir, filepath.Join(taskDir, "escape")))
+	require.NoError(t, os.Symlink(filepath.Join(outsideDir, "console.log"), filepath.Join(taskDir, "console.log")))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(outsideDir, "console.log"), nil, 0644))
+
+	resolvedTaskDir, err := filepath.EvalSymlinks(taskDir)
+	require.NoError(t, err)
+	args, _, err := serialArgs(taskDir, []string{"file:logs/console.log"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"-serial", "file:" + filepath.Join(resolvedTaskDir, "logs", "console.log")}, args)
+
+	// links cannot send the output of the port outside the task directory,
+	// whether the file exists or not
+	for _, serial := range []string{"file:escape/console.log", "file:escape/new.log", "file:console.log"} {
+		_, _, err := serialArgs(taskDir, []string{serial})
+		require.Error(t, err, serial)
+		require.Contains(t, err.Error(), "must be inside the task directory")
+	}
+}
+
+func TestSerialArgs_Errors(t *testing.T) {
+	cases := []struct {
+		name   string
+		serial string
+		err    string
+	}{
+		{
+			name:   "unknown",
+			serial: "pty",
+			err:    `unknown serial "pty"`,
+		},
+		{
+			name:   "file without path",
+			serial: "file:",
+			err:    "must name a file",
+		},
+		{
+			name:   "file outside the task directory",
+			serial: "file:../../etc/passwd",
+			err:    "must be inside the task directory",
+		},
+		{
+			name:   "absolute file outside the task directory",
+			serial: "file:/tmp/console.log",
+			err:    "must be inside the task directory",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, _, err := serialArgs("/alloc/task", []string{c.serial})
+			require.Error(t, err)
+			require.Contains(t, err.Error(), c.err)
+		})
+	}
+}
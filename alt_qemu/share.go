@@ -0,0 +1,77 @@
+package alt_qemu
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// mountTagRegex matches the mount tags accepted for shared folders, which
+// qemu limits to 31 bytes
+var mountTagRegex = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,31}$`)
+
+// ShareConfig describes a host directory shared with the guest, which mounts
+// it by its mount tag, e.g. `mount -t 9p -o trans=virtio <tag> /mnt` or
+// `mount -t virtiofs <tag> /mnt`.
+type ShareConfig struct {
+	Path     string `codec:"path"`
+	MountTag string `codec:"mount_tag"`
+	ReadOnly bool   `codec:"readonly"`
+	Driver   string `codec:"driver"` // 9p or virtiofs, defaults to 9p
+}
+
+// shareArgs returns the arguments exporting shares to the guest. 9p shares
+// are served by qemu, files created by the guest having their ownership and
+// mode stored in extended attributes. virtiofs shares are served by a
+// virtiofsd listening on a socket in taskDir, which must be started before
+// qemu; these daemons are returned along with the arguments.
+func shareArgs(taskDir string, shares []ShareConfig) ([]string, []virtiofsDaemon, error) {
+	var args []string
+	var daemons []virtiofsDaemon
+	tags := map[string]bool{}
+
+	for i, share := range shares {
+		if !mountTagRegex.MatchString(share.MountTag) {
+			return nil, nil, fmt.Errorf("invalid mount_tag %q for share %q", share.MountTag, share.Path)
+		}
+		if tags[share.MountTag] {
+			return nil, nil, fmt.Errorf("duplicate mount_tag %q", share.MountTag)
+		}
+		tags[share.MountTag] = true
+
+		switch share.Driver {
+		case "", "9p":
+		case "virtiofs":
+			socket, err := socketPath(taskDir, fmt.Sprintf("virtiofs%d.sock", i))
+			if err != nil {
+				return nil, nil, err
+			}
+			escapedSocket, err := escapeOptionValue(socket)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid virtiofs socket path: %v", err)
+			}
+			daemons = append(daemons, virtiofsDaemon{share: share, socket: socket})
+			args = append(args,
+				"-chardev", fmt.Sprintf("socket,id=vfs%d,path=%s", i, escapedSocket),
+				"-device", fmt.Sprintf("vhost-user-fs-pci,chardev=vfs%d,tag=%s", i, share.MountTag),
+			)
+			continue
+		default:
+			return nil, nil, fmt.Errorf("unknown driver %q for share %q, must be 9p or virtiofs", share.Driver, share.Path)
+		}
+
+		path, err := escapeOptionValue(share.Path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid share path: %v", err)
+		}
+		id := fmt.Sprintf("fsdev%d", i)
+		fsdev := fmt.Sprintf("local,id=%s,path=%s,security_model=mapped", id, path)
+		if share.ReadOnly {
+			fsdev += ",readonly=on"
+		}
+		args = append(args,
+			"-fsdev", fsdev,
+			"-device", fmt.Sprintf("virtio-9p-pci,fsdev=%s,mount_tag=%s", id, share.MountTag),
+		)
+	}
+	return args, daemons, nil
+}
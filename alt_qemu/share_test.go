@@ -0,0 +1,132 @@
+package alt_qemu
+
+import (
+	"testing"
+
+	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskConfig_Shares(t *testing.T) {
+	config := `
+config {
+  image_path = "linux.img"
+  share {
+    path      = "local/data"
+    mount_tag = "data"
+  }
+  share {
+    path      = "local/config"
+    mount_tag = "config"
+    readonly  = true
+  }
+}`
+
+	var tc *TaskConfig
+	hclutils.NewConfigParser(taskConfigSpec).ParseHCL(t, config, &tc)
+
+	require.Equal(t, []ShareConfig{
+		{Path: "local/data", MountTag: "data"},
+		{Path: "local/config", MountTag: "config", ReadOnly: true},
+	}, tc.Shares)
+}
+
+func TestShareArgs(t *testing.T) {
+	args, daemons, err := shareArgs("/alloc/task", []ShareConfig{
+		{Path: "/alloc/task/local/data", MountTag: "data"},
+		{Path: "/alloc/task/local/config", MountTag: "config", ReadOnly: true},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"-fsdev", "local,id=fsdev0,path=/alloc/task/local/data,security_model=mapped",
+		"-device", "virtio-9p-pci,fsdev=fsdev0,mount_tag=data",
+		"-fsdev", "local,id=fsdev1,path=/alloc/task/local/config,security_model=mapped,readonly=on",
+		"-device", "virtio-9p-pci,fsdev=fsdev1,mount_tag=config",
+	}, args)
+	require.Empty(t, daemons)
+
+	args, daemons, err = shareArgs("/alloc/task", nil)
+	require.NoError(t, err)
+	require.Empty(t, args)
+	require.Empty(t, daemons)
+}
+
+func TestShareArgs_Errors(t *testing.T) {
+	cases := []struct {
+		name   string
+		shares []ShareConfig
+		err    string
+	}{
+		{
+			name:   "empty mount tag",
+			shares: []ShareConfig{{Path: "/data"}},
+			err:    `invalid mount_tag "" for share "/data"`,
+		},
+		{
+			name:   "mount tag with comma",
+			shares: []ShareConfig{{Path: "/data", MountTag: "data,readonly=off"}},
+			err:    `invalid mount_tag "data,readonly=off"`,
+		},
+		{
+			name:   "mount tag too long",
+			shares: []ShareConfig{{Path: "/data", MountTag: "a-mount-tag-longer-than-31-bytes"}},
+			err:    `invalid mount_tag "a-mount-tag-longer-than-31-bytes"`,
+		},
+		{
+			name:   "unknown driver",
+			shares: []ShareConfig{{Path: "/data", MountTag: "data", Driver: "nfs"}},
+			err:    `unknown driver "nfs" for share "/data", must be 9p or virtiofs`,
+		},
+		{
+			name:   "duplicate mount tag",
+			shares: []ShareConfig{{Path: "/data", MountTag: "data"}, {Path: "/other", MountTag: "data"}},
+			err:    `duplicate mount_tag "data"`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, _, err := shareArgs("/alloc/task", c.shares)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), c.err)
+		})
+	}
+}
+
+func TestShareArgs_Escaping(t *testing.T) {
+	// a comma in a path does not add options to the fsdev or chardev
+	args, daemons, err := shareArgs("/alloc/a,b/task", []ShareConfig{
+		{Path: "/srv/data,security_model=passthrough", MountTag: "data"},
+		{Path: "/srv/cache", MountTag: "cache", Driver: "virtiofs"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"-fsdev", "local,id=fsdev0,path=/srv/data,,security_model=passthrough,security_model=mapped",
+		"-device", "virtio-9p-pci,fsdev=fsdev0,mount_tag=data",
+		"-chardev", "socket,id=vfs1,path=/alloc/a,,b/task/virtiofs1.sock",
+		"-device", "vhost-user-fs-pci,chardev=vfs1,tag=cache",
+	}, args)
+	// the daemon is given the socket path unescaped
+	require.Equal(t, "/alloc/a,b/task/virtiofs1.sock", daemons[0].socket)
+
+	_, _, err = shareArgs("/alloc/task", []ShareConfig{{Path: "/srv/data\n", MountTag: "data"}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid share path")
+}
+
+func TestShareArgs_Virtiofs(t *testing.T) {
+	args, daemons, err := shareArgs("/alloc/task", []ShareConfig{
+		{Path: "/alloc/task/local/data", MountTag: "data", Driver: "9p"},
+		{Path: "/alloc/task/local/cache", MountTag: "cache", Driver: "virtiofs", ReadOnly: true},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"-fsdev", "local,id=fsdev0,path=/alloc/task/local/data,security_model=mapped",
+		"-device", "virtio-9p-pci,fsdev=fsdev0,mount_tag=data",
+		"-chardev", "socket,id=vfs1,path=/alloc/task/virtiofs1.sock",
+		"-device", "vhost-user-fs-pci,chardev=vfs1,tag=cache",
+	}, args)
+	require.Equal(t, []virtiofsDaemon{{
+		share:  ShareConfig{Path: "/alloc/task/local/cache", MountTag: "cache", Driver: "virtiofs", ReadOnly: true},
+		socket: "/alloc/task/virtiofs1.sock",
+	}}, daemons)
+}
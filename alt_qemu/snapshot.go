@@ -0,0 +1,100 @@
+package alt_qemu
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// snapshotExecCommand is the command name intercepted by ExecTask to manage
+// VM snapshots on the monitor instead of running a command in the guest,
+// e.g. `nomad alloc exec <alloc> qemu-snapshot save before-upgrade`
+const snapshotExecCommand = "qemu-snapshot"
+
+// snapshotNameRegex matches the snapshot names accepted by the driver
+var snapshotNameRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// snapshotMonitorCommands maps the qemu-snapshot subcommands taking a
+// snapshot name to the human monitor command implementing them
+var snapshotMonitorCommands = map[string]string{
+	"save":   "savevm",
+	"load":   "loadvm",
+	"delete": "delvm",
+}
+
+// isSnapshotCommand returns whether an exec command is a snapshot command.
+func isSnapshotCommand(cmd []string) bool {
+	return len(cmd) > 0 && cmd[0] == snapshotExecCommand
+}
+
+// snapshotMonitorCommand translates the arguments of a qemu-snapshot command
+// to the human monitor command line to run.
+func snapshotMonitorCommand(args []string) (string, error) {
+	if len(args) == 1 && args[0] == "list" {
+		return "info snapshots", nil
+	}
+	if len(args) != 2 {
+		return "", fmt.Errorf("usage: %s save|load|delete <name> or %s list", snapshotExecCommand, snapshotExecCommand)
+	}
+
+	hmpCmd, ok := snapshotMonitorCommands[args[0]]
+	if !ok {
+		return "", fmt.Errorf("unknown %s subcommand %q", snapshotExecCommand, args[0])
+	}
+	if !snapshotNameRegex.MatchString(args[1]) {
+		return "", fmt.Errorf("invalid snapshot name %q", args[1])
+	}
+	return hmpCmd + " " + args[1], nil
+}
+
+// snapshotsSupported returns whether internal snapshots can be taken of the
+// VM, which requires every writable disk to be a qcow2 image.
+func snapshotsSupported(taskDir string, disks []DiskConfig, detectFormat func(string) (string, error)) (bool, error) {
+	for _, disk := range disks {
+		if disk.ReadOnly {
+			continue
+		}
+		format, err := diskFormat(taskDir, disk, detectFormat)
+		if err != nil {
+			return false, err
+		}
+		if format != "qcow2" {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// snapshot runs a qemu-snapshot command on the VM's monitor. Errors reported
+// by the monitor are returned as a failed exec result. The monitor is no
+// longer waited on once ctx is done.
+func (h *taskHandle) snapshot(ctx context.Context, args []string) (*drivers.ExecTaskResult, error) {
+	if !h.snapshots {
+		return nil, fmt.Errorf("task %q has disks that do not support snapshots, only qcow2 images do", h.taskConfig.ID)
+	}
+	hmpCmd, err := snapshotMonitorCommand(args)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := h.humanMonitorCommand(ctx, hmpCmd)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &drivers.ExecTaskResult{
+		ExitResult: &drivers.ExitResult{},
+	}
+	// the human monitor reports failures in its output rather than as a
+	// QMP error
+	if strings.HasPrefix(output, "Error") {
+		result.ExitResult.ExitCode = 1
+		result.Stderr = []byte(output)
+	} else {
+		result.Stdout = []byte(output)
+	}
+	return result, nil
+}
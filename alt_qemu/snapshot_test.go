@@ -0,0 +1,100 @@
+package alt_qemu
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotMonitorCommand(t *testing.T) {
+	cases := []struct {
+		args []string
+		cmd  string
+		err  string
+	}{
+		{args: []string{"list"}, cmd: "info snapshots"},
+		{args: []string{"save", "before-upgrade"}, cmd: "savevm before-upgrade"},
+		{args: []string{"load", "v1.2"}, cmd: "loadvm v1.2"},
+		{args: []string{"delete", "old_snap"}, cmd: "delvm old_snap"},
+		{args: nil, err: "usage"},
+		{args: []string{"save"}, err: "usage"},
+		{args: []string{"revert", "snap"}, err: `unknown qemu-snapshot subcommand "revert"`},
+		{args: []string{"save", "snap; quit"}, err: `invalid snapshot name "snap; quit"`},
+	}
+	for _, c := range cases {
+		t.Run(fmt.Sprint(c.args), func(t *testing.T) {
+			cmd, err := snapshotMonitorCommand(c.args)
+			if c.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.cmd, cmd)
+		})
+	}
+}
+
+func TestSnapshotsSupported(t *testing.T) {
+	formats := map[string]string{"/a.qcow2": "qcow2", "/b.img": "raw"}
+	detect := func(path string) (string, error) {
+		if f, ok := formats[path]; ok {
+			return f, nil
+		}
+		return "", fmt.Errorf("unknown image %q", path)
+	}
+
+	supported, err := snapshotsSupported("/task", []DiskConfig{{Path: "/a.qcow2"}, {Path: "/b.img", ReadOnly: true}}, detect)
+	require.NoError(t, err)
+	require.True(t, supported)
+
+	supported, err = snapshotsSupported("/task", []DiskConfig{{Path: "/a.qcow2"}, {Path: "/b.img"}}, detect)
+	require.NoError(t, err)
+	require.False(t, supported)
+
+	supported, err = snapshotsSupported("/task", []DiskConfig{{Path: "/dev/sdb", hostDevice: true}}, detect)
+	require.NoError(t, err)
+	require.False(t, supported)
+
+	_, err = snapshotsSupported("/task", []DiskConfig{{Path: "/c.img"}}, detect)
+	require.Error(t, err)
+}
+
+func TestTaskHandle_Snapshot(t *testing.T) {
+	var commandLines []string
+	path, _ := fakeQMPServer(t, func(cmd qmpCommand) string {
+		if cmd.Execute != "human-monitor-command" {
+			return `{"return": {}}`
+		}
+		line := cmd.Arguments["command-line"].(string)
+		commandLines = append(commandLines, line)
+		if line == "loadvm missing" {
+			return `{"return": "Error: Snapshot 'missing' does not exist\r\n"}`
+		}
+		return `{"return": ""}`
+	})
+	h := &taskHandle{
+		taskConfig:  &drivers.TaskConfig{ID: "task-1"},
+		monitorPath: path,
+		snapshots:   true,
+	}
+
+	result, err := h.snapshot(context.Background(), []string{"save", "snap1"})
+	require.NoError(t, err)
+	require.Equal(t, 0, result.ExitResult.ExitCode)
+
+	result, err = h.snapshot(context.Background(), []string{"load", "missing"})
+	require.NoError(t, err)
+	require.Equal(t, 1, result.ExitResult.ExitCode)
+	require.Contains(t, string(result.Stderr), "does not exist")
+
+	require.Equal(t, []string{"savevm snap1", "loadvm missing"}, commandLines)
+
+	h.snapshots = false
+	_, err = h.snapshot(context.Background(), []string{"list"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "only qcow2 images do")
+}
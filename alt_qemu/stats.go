@@ -0,0 +1,188 @@
+package alt_qemu
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/device"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	pstructs "github.com/hashicorp/nomad/plugins/shared/structs"
+)
+
+const (
+	// guestStatsVendor, guestStatsType and guestStatsName identify the
+	// device group the guest statistics are reported under
+	guestStatsVendor = "qemu"
+	guestStatsType   = "vm"
+	guestStatsName   = "guest"
+)
+
+// qmpBalloonInfo is the result of the query-balloon monitor command
+type qmpBalloonInfo struct {
+	Actual int64 `json:"actual"`
+}
+
+// qmpBlockStats is an entry of the result of the query-blockstats monitor
+// command
+type qmpBlockStats struct {
+	Device   string `json:"device"`
+	NodeName string `json:"node-name"`
+	Qdev     string `json:"qdev"`
+	Stats    struct {
+		RdBytes      int64 `json:"rd_bytes"`
+		WrBytes      int64 `json:"wr_bytes"`
+		RdOperations int64 `json:"rd_operations"`
+		WrOperations int64 `json:"wr_operations"`
+	} `json:"stats"`
+}
+
+// handleStats relays the qemu process stats received on execCh to ch, adding
+// the guest memory and disk stats queried from the monitor. When the monitor
+// cannot be queried the process stats are sent unchanged.
+func (d *AltQemuDriverPlugin) handleStats(ctx context.Context, handle *taskHandle, execCh <-chan *drivers.TaskResourceUsage, ch chan<- *drivers.TaskResourceUsage) {
+	defer close(ch)
+	for {
+		var usage *drivers.TaskResourceUsage
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.ctx.Done():
+			return
+		case u, ok := <-execCh:
+			if !ok {
+				return
+			}
+			usage = u
+		}
+
+		if usage.ResourceUsage != nil {
+			if stats := handle.guestStats(ctx); stats != nil {
+				usage.ResourceUsage.DeviceStats = append(usage.ResourceUsage.DeviceStats, stats)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.ctx.Done():
+			return
+		case ch <- usage:
+		}
+	}
+}
+
+// guestStats queries the monitor for the guest's memory and disk statistics.
+// It returns nil when none could be queried.
+func (h *taskHandle) guestStats(ctx context.Context) *device.DeviceGroupStats {
+	now := time.Now()
+	instances := map[string]*device.DeviceStats{}
+
+	if balloon, err := h.queryBalloon(ctx); err == nil {
+		stats := &device.DeviceStats{
+			Summary: &pstructs.StatValue{
+				IntNumeratorVal: int64Ptr(balloon.Actual),
+				Unit:            "bytes",
+				Desc:            "Memory assigned to the guest",
+			},
+			Timestamp: now,
+		}
+		if h.balloonEnabled {
+			h.stateLock.RLock()
+			target := h.balloonTarget
+			h.stateLock.RUnlock()
+			stats.Stats = &pstructs.StatObject{
+				Attributes: map[string]*pstructs.StatValue{
+					"balloon_target": {IntNumeratorVal: int64Ptr(target), Unit: "bytes"},
+					"balloon_actual": {IntNumeratorVal: int64Ptr(balloon.Actual), Unit: "bytes"},
+				},
+			}
+		}
+		instances["memory"] = stats
+	} else {
+		h.logger.Trace("failed to query guest memory", "error", err)
+	}
+
+	if blockStats, err := h.queryBlockStats(ctx); err == nil {
+		for _, b := range blockStats {
+			name := b.NodeName
+			if name == "" {
+				name = b.Device
+			}
+			if name == "" {
+				name = b.Qdev
+			}
+			instances["disk:"+name] = &device.DeviceStats{
+				Summary: &pstructs.StatValue{
+					IntNumeratorVal: int64Ptr(b.Stats.RdBytes + b.Stats.WrBytes),
+					Unit:            "bytes",
+					Desc:            "Bytes read and written by the guest",
+				},
+				Stats: &pstructs.StatObject{
+					Attributes: map[string]*pstructs.StatValue{
+						"read_bytes":       {IntNumeratorVal: int64Ptr(b.Stats.RdBytes), Unit: "bytes"},
+						"write_bytes":      {IntNumeratorVal: int64Ptr(b.Stats.WrBytes), Unit: "bytes"},
+						"read_operations":  {IntNumeratorVal: int64Ptr(b.Stats.RdOperations)},
+						"write_operations": {IntNumeratorVal: int64Ptr(b.Stats.WrOperations)},
+					},
+				},
+				Timestamp: now,
+			}
+		}
+	} else {
+		h.logger.Trace("failed to query guest block stats", "error", err)
+	}
+
+	if len(instances) == 0 {
+		return nil
+	}
+	return &device.DeviceGroupStats{
+		Vendor:        guestStatsVendor,
+		Type:          guestStatsType,
+		Name:          guestStatsName,
+		InstanceStats: instances,
+	}
+}
+
+// queryBalloon queries the monitor for the memory assigned to the guest.
+func (h *taskHandle) queryBalloon(ctx context.Context) (qmpBalloonInfo, error) {
+	var balloon qmpBalloonInfo
+	if h.monitorProtocol == monitorProtocolHMP {
+		out, err := h.humanMonitorCommand(ctx, "info balloon")
+		if err != nil {
+			return balloon, err
+		}
+		balloon.Actual, err = parseHMPBalloon(out)
+		return balloon, err
+	}
+
+	ret, err := h.monitorExecute(ctx, "query-balloon", nil)
+	if err != nil {
+		return balloon, err
+	}
+	err = json.Unmarshal(ret, &balloon)
+	return balloon, err
+}
+
+// queryBlockStats queries the monitor for the I/O statistics of the disks.
+func (h *taskHandle) queryBlockStats(ctx context.Context) ([]qmpBlockStats, error) {
+	if h.monitorProtocol == monitorProtocolHMP {
+		out, err := h.humanMonitorCommand(ctx, "info blockstats")
+		if err != nil {
+			return nil, err
+		}
+		return parseHMPBlockStats(out), nil
+	}
+
+	ret, err := h.monitorExecute(ctx, "query-blockstats", nil)
+	if err != nil {
+		return nil, err
+	}
+	var blockStats []qmpBlockStats
+	err = json.Unmarshal(ret, &blockStats)
+	return blockStats, err
+}
+
+func int64Ptr(i int64) *int64 {
+	return &i
+}
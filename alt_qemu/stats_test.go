@@ -0,0 +1,52 @@
+package alt_qemu
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskHandle_GuestStats(t *testing.T) {
+	path, _ := fakeQMPServer(t, func(cmd qmpCommand) string {
+		switch cmd.Execute {
+		case "query-balloon":
+			return `{"return": {"actual": 536870912}}`
+		case "query-blockstats":
+			return `{"return": [
+				{"node-name": "bootbd", "stats": {"rd_bytes": 100, "wr_bytes": 50, "rd_operations": 4, "wr_operations": 2}},
+				{"device": "ide1-cd0", "stats": {"rd_bytes": 10}}
+			]}`
+		}
+		return `{"return": {}}`
+	})
+	h := &taskHandle{
+		taskConfig:  &drivers.TaskConfig{ID: "task-1"},
+		monitorPath: path,
+		logger:      hclog.NewNullLogger(),
+	}
+
+	stats := h.guestStats(context.Background())
+	require.NotNil(t, stats)
+	require.Equal(t, guestStatsName, stats.Name)
+	require.Len(t, stats.InstanceStats, 3)
+
+	require.Equal(t, int64(536870912), *stats.InstanceStats["memory"].Summary.IntNumeratorVal)
+
+	boot := stats.InstanceStats["disk:bootbd"]
+	require.Equal(t, int64(150), *boot.Summary.IntNumeratorVal)
+	require.Equal(t, int64(4), *boot.Stats.Attributes["read_operations"].IntNumeratorVal)
+	require.Equal(t, int64(2), *boot.Stats.Attributes["write_operations"].IntNumeratorVal)
+
+	require.Equal(t, int64(10), *stats.InstanceStats["disk:ide1-cd0"].Summary.IntNumeratorVal)
+}
+
+func TestTaskHandle_GuestStats_NoMonitor(t *testing.T) {
+	h := &taskHandle{
+		taskConfig: &drivers.TaskConfig{ID: "task-1"},
+		logger:     hclog.NewNullLogger(),
+	}
+	require.Nil(t, h.guestStats(context.Background()))
+}
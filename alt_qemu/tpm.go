@@ -0,0 +1,102 @@
+package alt_qemu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// swtpmBin is the software TPM emulator connected to the VM
+	swtpmBin = "swtpm"
+
+	// driverSwtpmAttr reports whether swtpm is available on the node
+	driverSwtpmAttr = "driver.qemu.swtpm"
+
+	// tpmStateDirName is the directory in the task directory holding the
+	// emulated TPM's persistent state
+	tpmStateDirName = "tpm"
+
+	// tpmSocketName is the name of the swtpm control socket
+	tpmSocketName = "swtpm.sock"
+
+	// tpmPidName is the name of the file swtpm writes its pid to
+	tpmPidName = "swtpm.pid"
+)
+
+// TPMConfig configures the TPM 2.0 device emulated by swtpm
+type TPMConfig struct {
+	Enabled bool `codec:"enabled"`
+}
+
+// startSwtpm starts a swtpm daemon for the VM, keeping its state in taskDir,
+// and returns the paths of its control socket and pid file. swtpm exits by
+// itself once qemu closes the connection.
+func startSwtpm(taskDir string) (string, string, error) {
+	bin, err := GetAbsolutePath(swtpmBin)
+	if err != nil {
+		return "", "", fmt.Errorf("tpm requires %s, which was not found: %v", swtpmBin, err)
+	}
+
+	sockPath, err := socketPath(taskDir, tpmSocketName)
+	if err != nil {
+		return "", "", err
+	}
+	stateDir := filepath.Join(taskDir, tpmStateDirName)
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return "", "", fmt.Errorf("failed to create tpm state directory: %v", err)
+	}
+	pidPath := filepath.Join(taskDir, tpmPidName)
+
+	out, err := exec.Command(bin, "socket",
+		"--tpm2",
+		"--tpmstate", "dir="+stateDir,
+		"--ctrl", "type=unixio,path="+sockPath,
+		"--pid", "file="+pidPath,
+		"--terminate",
+		"--daemon",
+	).CombinedOutput()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to start %s: %v: %s", swtpmBin, err, out)
+	}
+	return sockPath, pidPath, nil
+}
+
+// tpmArgs returns the arguments attaching the swtpm listening on sockPath to
+// the VM as a TPM TIS device.
+func tpmArgs(sockPath string) []string {
+	return []string{
+		"-chardev", fmt.Sprintf("socket,id=chrtpm,path=%s", sockPath),
+		"-tpmdev", "emulator,id=tpm0,chardev=chrtpm",
+		"-device", "tpm-tis,tpmdev=tpm0",
+	}
+}
+
+// stopSwtpm terminates the swtpm whose pid is recorded in pidPath, if it is
+// still running.
+func stopSwtpm(pidPath string) error {
+	data, err := ioutil.ReadFile(pidPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("invalid swtpm pid file %q: %v", pidPath, err)
+	}
+
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return nil
+	}
+	if err := proc.Signal(syscall.SIGTERM); err != nil && err.Error() != "os: process already finished" {
+		return err
+	}
+	return os.Remove(pidPath)
+}
@@ -0,0 +1,49 @@
+package alt_qemu
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskConfig_TPM(t *testing.T) {
+	config := `
+config {
+  image_path = "windows.img"
+  tpm {
+    enabled = true
+  }
+}`
+
+	var tc *TaskConfig
+	hclutils.NewConfigParser(taskConfigSpec).ParseHCL(t, config, &tc)
+
+	require.True(t, tc.TPM.Enabled)
+}
+
+func TestTpmArgs(t *testing.T) {
+	require.Equal(t, []string{
+		"-chardev", "socket,id=chrtpm,path=/alloc/task/swtpm.sock",
+		"-tpmdev", "emulator,id=tpm0,chardev=chrtpm",
+		"-device", "tpm-tis,tpmdev=tpm0",
+	}, tpmArgs("/alloc/task/swtpm.sock"))
+}
+
+func TestStopSwtpm(t *testing.T) {
+	dir := t.TempDir()
+	pidPath := filepath.Join(dir, tpmPidName)
+
+	// a missing pid file means swtpm never started or already exited
+	require.NoError(t, stopSwtpm(pidPath))
+
+	require.NoError(t, ioutil.WriteFile(pidPath, []byte("not-a-pid\n"), 0644))
+	err := stopSwtpm(pidPath)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid swtpm pid file")
+	_, err = os.Stat(pidPath)
+	require.NoError(t, err)
+}
@@ -0,0 +1,139 @@
+package alt_qemu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// usbDevicesPath lists the USB devices of the host
+const usbDevicesPath = "/sys/bus/usb/devices"
+
+// usbIDRegex matches a USB vendor or product id, e.g. "046d" or "0x046d"
+var usbIDRegex = regexp.MustCompile(`^(0x)?[0-9a-fA-F]{1,4}$`)
+
+// USBConfig describes a host USB device passed through to the guest, either
+// by its vendor and product ids or by its bus and address on the host.
+type USBConfig struct {
+	VendorID  string `codec:"vendor_id"`
+	ProductID string `codec:"product_id"`
+	HostBus   int    `codec:"hostbus"`
+	HostAddr  int    `codec:"hostaddr"`
+}
+
+// normalizeUSBID returns id as four lowercase hex digits without prefix.
+func normalizeUSBID(id string) (string, error) {
+	if !usbIDRegex.MatchString(id) {
+		return "", fmt.Errorf("invalid USB id %q, must be up to 4 hex digits", id)
+	}
+	v, err := strconv.ParseUint(strings.TrimPrefix(id, "0x"), 16, 16)
+	if err != nil {
+		return "", fmt.Errorf("invalid USB id %q: %v", id, err)
+	}
+	return fmt.Sprintf("%04x", v), nil
+}
+
+// ids returns the vendor and product ids of the device, looking them up in
+// sysfs for devices given by bus and address.
+func (c *USBConfig) ids() (string, string, error) {
+	byID := c.VendorID != "" || c.ProductID != ""
+	byAddr := c.HostBus != 0 || c.HostAddr != 0
+	switch {
+	case byID && byAddr:
+		return "", "", fmt.Errorf("usb_passthrough must set either vendor_id and product_id or hostbus and hostaddr, not both")
+	case byID:
+		if c.VendorID == "" || c.ProductID == "" {
+			return "", "", fmt.Errorf("usb_passthrough must set both vendor_id and product_id")
+		}
+		vendor, err := normalizeUSBID(c.VendorID)
+		if err != nil {
+			return "", "", err
+		}
+		product, err := normalizeUSBID(c.ProductID)
+		if err != nil {
+			return "", "", err
+		}
+		return vendor, product, nil
+	case byAddr:
+		if c.HostBus <= 0 || c.HostAddr <= 0 {
+			return "", "", fmt.Errorf("usb_passthrough must set both hostbus and hostaddr")
+		}
+		return usbDeviceIDs(c.HostBus, c.HostAddr)
+	default:
+		return "", "", fmt.Errorf("usb_passthrough must set vendor_id and product_id or hostbus and hostaddr")
+	}
+}
+
+// usbDeviceIDs returns the vendor and product ids of the host USB device at
+// bus and addr.
+func usbDeviceIDs(bus, addr int) (string, string, error) {
+	dirs, err := ioutil.ReadDir(usbDevicesPath)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to list USB devices: %v", err)
+	}
+	read := func(dir, name string) string {
+		data, _ := ioutil.ReadFile(filepath.Join(usbDevicesPath, dir, name))
+		return strings.TrimSpace(string(data))
+	}
+	for _, d := range dirs {
+		if read(d.Name(), "busnum") != strconv.Itoa(bus) || read(d.Name(), "devnum") != strconv.Itoa(addr) {
+			continue
+		}
+		vendor, err := normalizeUSBID(read(d.Name(), "idVendor"))
+		if err != nil {
+			return "", "", err
+		}
+		product, err := normalizeUSBID(read(d.Name(), "idProduct"))
+		if err != nil {
+			return "", "", err
+		}
+		return vendor, product, nil
+	}
+	return "", "", fmt.Errorf("no USB device at hostbus %d hostaddr %d", bus, addr)
+}
+
+// isAllowedUSBDevice returns whether the device with the given ids is one of
+// allowedDevices, which are "vendor:product" pairs of hex ids.
+func isAllowedUSBDevice(allowedDevices []string, vendor, product string) bool {
+	for _, allowed := range allowedDevices {
+		parts := strings.SplitN(allowed, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		v, verr := normalizeUSBID(parts[0])
+		p, perr := normalizeUSBID(parts[1])
+		if verr == nil && perr == nil && v == vendor && p == product {
+			return true
+		}
+	}
+	return false
+}
+
+// usbArgs returns the arguments passing the host USB devices through to the
+// guest. Every device must be in allowedDevices.
+func usbArgs(allowedDevices []string, devices []USBConfig) ([]string, error) {
+	if len(devices) == 0 {
+		return nil, nil
+	}
+
+	args := []string{"-usb"}
+	for _, dev := range devices {
+		vendor, product, err := dev.ids()
+		if err != nil {
+			return nil, err
+		}
+		if !isAllowedUSBDevice(allowedDevices, vendor, product) {
+			return nil, fmt.Errorf("USB device %s:%s is not in allowed_usb_devices", vendor, product)
+		}
+
+		if dev.HostBus != 0 {
+			args = append(args, "-device", fmt.Sprintf("usb-host,hostbus=%d,hostaddr=%d", dev.HostBus, dev.HostAddr))
+		} else {
+			args = append(args, "-device", fmt.Sprintf("usb-host,vendorid=0x%s,productid=0x%s", vendor, product))
+		}
+	}
+	return args, nil
+}
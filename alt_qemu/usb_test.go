@@ -0,0 +1,123 @@
+package alt_qemu
+
+import (
+	"testing"
+
+	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskConfig_USBPassthrough(t *testing.T) {
+	var tc *TaskConfig
+	hclutils.NewConfigParser(taskConfigSpec).ParseHCL(t, `
+config {
+  image_path = "linux.img"
+  usb_passthrough {
+    vendor_id  = "046d"
+    product_id = "c52b"
+  }
+  usb_passthrough {
+    hostbus  = 1
+    hostaddr = 4
+  }
+}`, &tc)
+
+	require.Equal(t, []USBConfig{
+		{VendorID: "046d", ProductID: "c52b"},
+		{HostBus: 1, HostAddr: 4},
+	}, tc.USBPassthrough)
+}
+
+func TestNormalizeUSBID(t *testing.T) {
+	for id, expected := range map[string]string{
+		"046d":   "046d",
+		"0x046D": "046d",
+		"1":      "0001",
+		"ffff":   "ffff",
+	} {
+		normalized, err := normalizeUSBID(id)
+		require.NoError(t, err, id)
+		require.Equal(t, expected, normalized, id)
+	}
+
+	for _, id := range []string{"", "0x", "12345", "xyz", "04 6d"} {
+		_, err := normalizeUSBID(id)
+		require.Error(t, err, id)
+	}
+}
+
+func TestIsAllowedUSBDevice(t *testing.T) {
+	allowed := []string{"0x046D:0xC52B", "bad", "1d6b:zzzz"}
+
+	require.True(t, isAllowedUSBDevice(allowed, "046d", "c52b"))
+	require.False(t, isAllowedUSBDevice(allowed, "046d", "c52c"))
+	require.False(t, isAllowedUSBDevice(allowed, "1d6b", "0002"))
+	require.False(t, isAllowedUSBDevice(nil, "046d", "c52b"))
+}
+
+func TestUSBArgs(t *testing.T) {
+	allowed := []string{"046d:c52b", "0781:5567"}
+
+	args, err := usbArgs(allowed, nil)
+	require.NoError(t, err)
+	require.Empty(t, args)
+
+	args, err = usbArgs(allowed, []USBConfig{
+		{VendorID: "046D", ProductID: "c52b"},
+		{VendorID: "0x781", ProductID: "5567"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"-usb",
+		"-device", "usb-host,vendorid=0x046d,productid=0xc52b",
+		"-device", "usb-host,vendorid=0x0781,productid=0x5567",
+	}, args)
+}
+
+func TestUSBArgs_Errors(t *testing.T) {
+	allowed := []string{"046d:c52b"}
+
+	cases := []struct {
+		name   string
+		device USBConfig
+		err    string
+	}{
+		{
+			name:   "not allowed",
+			device: USBConfig{VendorID: "1d6b", ProductID: "0002"},
+			err:    "1d6b:0002 is not in allowed_usb_devices",
+		},
+		{
+			name:   "missing product",
+			device: USBConfig{VendorID: "046d"},
+			err:    "must set both vendor_id and product_id",
+		},
+		{
+			name:   "invalid id",
+			device: USBConfig{VendorID: "046d", ProductID: "mouse"},
+			err:    `invalid USB id "mouse"`,
+		},
+		{
+			name:   "missing hostaddr",
+			device: USBConfig{HostBus: 1},
+			err:    "must set both hostbus and hostaddr",
+		},
+		{
+			name:   "ids and address",
+			device: USBConfig{VendorID: "046d", ProductID: "c52b", HostBus: 1, HostAddr: 4},
+			err:    "not both",
+		},
+		{
+			name: "nothing",
+			err:  "must set vendor_id and product_id or hostbus and hostaddr",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := usbArgs(allowed, []USBConfig{c.device})
+			require.Error(t, err)
+			require.Contains(t, err.Error(), c.err)
+		})
+	}
+}
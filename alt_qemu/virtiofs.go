@@ -0,0 +1,115 @@
+package alt_qemu
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+const (
+	// driverVirtiofsdAttr reports whether virtiofsd is available on the node
+	driverVirtiofsdAttr = "driver.qemu.virtiofsd"
+
+	// virtiofsdStartTimeout bounds how long to wait for virtiofsd to create
+	// its socket
+	virtiofsdStartTimeout = 5 * time.Second
+)
+
+// virtiofsdPaths are the locations virtiofsd is looked up at, in order.
+// Distributions commonly install it outside of PATH.
+var virtiofsdPaths = []string{
+	"virtiofsd",
+	"/usr/libexec/virtiofsd",
+	"/usr/lib/qemu/virtiofsd",
+}
+
+// virtiofsDaemon is a virtiofsd serving a share to the VM on a socket
+type virtiofsDaemon struct {
+	share  ShareConfig
+	socket string
+}
+
+// hasVirtiofsShares returns whether any of shares uses virtiofs.
+func hasVirtiofsShares(shares []ShareConfig) bool {
+	for _, share := range shares {
+		if share.Driver == "virtiofs" {
+			return true
+		}
+	}
+	return false
+}
+
+// virtiofsd returns the absolute path of the virtiofsd binary.
+func virtiofsd() (string, error) {
+	for _, bin := range virtiofsdPaths {
+		if path, err := GetAbsolutePath(bin); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("virtiofs shares require virtiofsd, which was not found")
+}
+
+// startVirtiofsd starts a virtiofsd for every daemon and returns their pids.
+// The daemons exit by themselves once qemu disconnects from them. If any
+// daemon fails to start, those already started are stopped.
+func startVirtiofsd(daemons []virtiofsDaemon) ([]int, error) {
+	if len(daemons) == 0 {
+		return nil, nil
+	}
+	bin, err := virtiofsd()
+	if err != nil {
+		return nil, err
+	}
+
+	var pids []int
+	for _, daemon := range daemons {
+		args := []string{
+			"--socket-path=" + daemon.socket,
+			"--shared-dir=" + daemon.share.Path,
+			"--cache=auto",
+		}
+		if daemon.share.ReadOnly {
+			args = append(args, "--readonly")
+		}
+
+		cmd := exec.Command(bin, args...)
+		if err := cmd.Start(); err != nil {
+			stopVirtiofsd(pids)
+			return nil, fmt.Errorf("failed to start virtiofsd for %q: %v", daemon.share.Path, err)
+		}
+		go cmd.Wait()
+		pids = append(pids, cmd.Process.Pid)
+
+		if err := waitForSocket(daemon.socket, virtiofsdStartTimeout); err != nil {
+			stopVirtiofsd(pids)
+			return nil, fmt.Errorf("virtiofsd for %q did not start: %v", daemon.share.Path, err)
+		}
+	}
+	return pids, nil
+}
+
+// waitForSocket waits up to timeout for the socket at path to be created.
+func waitForSocket(path string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("socket %q not created within %v", path, timeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// stopVirtiofsd terminates the virtiofsd processes pids that are still
+// running.
+func stopVirtiofsd(pids []int) {
+	for _, pid := range pids {
+		if proc, err := os.FindProcess(pid); err == nil {
+			proc.Signal(syscall.SIGTERM)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package alt_qemu
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHasVirtiofsShares(t *testing.T) {
+	require.False(t, hasVirtiofsShares(nil))
+	require.False(t, hasVirtiofsShares([]ShareConfig{{MountTag: "data"}, {MountTag: "cache", Driver: "9p"}}))
+	require.True(t, hasVirtiofsShares([]ShareConfig{{MountTag: "data"}, {MountTag: "cache", Driver: "virtiofs"}}))
+}
+
+func TestStartVirtiofsd(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("virtiofs is only supported on Linux")
+	}
+
+	// the fake virtiofsd creates its socket, records its arguments and
+	// runs until it is stopped
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "args.log")
+	writeFakeBinary(t, dir, "virtiofsd", `echo "$@" > `+logPath+`
+for arg; do
+  case "$arg" in
+    --socket-path=*) touch "${arg#--socket-path=}" ;;
+  esac
+done
+exec sleep 30`)
+	orig := virtiofsdPaths
+	defer func() { virtiofsdPaths = orig }()
+	virtiofsdPaths = []string{filepath.Join(dir, "virtiofsd")}
+
+	socket := filepath.Join(dir, "virtiofs0.sock")
+	pids, err := startVirtiofsd([]virtiofsDaemon{{
+		share:  ShareConfig{Path: "/srv/data", MountTag: "data", Driver: "virtiofs", ReadOnly: true},
+		socket: socket,
+	}})
+	require.NoError(t, err)
+	require.Len(t, pids, 1)
+
+	data, err := ioutil.ReadFile(logPath)
+	require.NoError(t, err)
+	require.Equal(t, "--socket-path="+socket+" --shared-dir=/srv/data --cache=auto --readonly", strings.TrimSpace(string(data)))
+
+	// the process is reaped by startVirtiofsd once it exits
+	stopVirtiofsd(pids)
+	proc, err := os.FindProcess(pids[0])
+	require.NoError(t, err)
+	deadline := time.Now().Add(5 * time.Second)
+	for proc.Signal(syscall.Signal(0)) == nil {
+		require.True(t, time.Now().Before(deadline), "virtiofsd was not stopped")
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestStartVirtiofsd_NotFound(t *testing.T) {
+	orig := virtiofsdPaths
+	defer func() { virtiofsdPaths = orig }()
+	virtiofsdPaths = []string{filepath.Join(t.TempDir(), "virtiofsd")}
+
+	pids, err := startVirtiofsd(nil)
+	require.NoError(t, err)
+	require.Empty(t, pids)
+
+	_, err = startVirtiofsd([]virtiofsDaemon{{share: ShareConfig{Path: "/srv/data"}, socket: "virtiofs0.sock"}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "virtiofs shares require virtiofsd")
+}
+
+func TestWaitForSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "virtiofs0.sock")
+	err := waitForSocket(path, 100*time.Millisecond)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not created within")
+
+	require.NoError(t, ioutil.WriteFile(path, nil, 0600))
+	require.NoError(t, waitForSocket(path, 100*time.Millisecond))
+}
@@ -3,9 +3,7 @@ package main
 import (
 	log "github.com/hashicorp/go-hclog"
 
-	// TODO: update the path below to match your own repository
-	"github.com/hashicorp/nomad-skeleton-driver-plugin/hello"
-
+	"github.com/cyrex562/nomad_alt_qemu_driver/alt_qemu"
 	"github.com/hashicorp/nomad/plugins"
 )
 
@@ -16,5 +14,5 @@ func main() {
 
 // factory returns a new instance of a nomad driver plugin
 func factory(log log.Logger) interface{} {
-	return hello.NewPlugin(log)
+	return alt_qemu.NewAltQemuDriver(log)
 }